@@ -387,9 +387,13 @@ static inline int handle_ipv4(struct __sk_buff *skb, __u32 src_identity)
 				 *
 				 * For compatibility with older versions of
 				 * Cilium, we also ignore CLUSTER_ID.
+				 *
+				 * Other nodes carry REMOTE_NODE_ID if the
+				 * remote node identity is enabled, in which
+				 * case it is used like any other identity.
 				 */
 				if (sec_label != CLUSTER_ID &&
-				    sec_label != HOST_ID)
+				    !identity_is_host(sec_label))
 					src_identity = sec_label;
 			}
 		}
@@ -63,7 +63,9 @@ static inline int handle_ipv6(struct __sk_buff *skb)
 			return hdrlen;
 
 		l4_off = l3_off + hdrlen;
-		return ipv6_local_delivery(skb, l3_off, l4_off, key.tunnel_id, ip6, nexthdr, ep, METRIC_INGRESS);
+		return ipv6_local_delivery(skb, l3_off, l4_off,
+					   identity_from_tunnel(key.tunnel_id),
+					   ip6, nexthdr, ep, METRIC_INGRESS);
 	}
 
 to_host:
@@ -112,7 +114,9 @@ static inline int handle_ipv4(struct __sk_buff *skb)
 		if (ep->flags & ENDPOINT_F_HOST)
 			goto to_host;
 
-		return ipv4_local_delivery(skb, ETH_HLEN, l4_off, key.tunnel_id, ip4, ep, METRIC_INGRESS);
+		return ipv4_local_delivery(skb, ETH_HLEN, l4_off,
+					   identity_from_tunnel(key.tunnel_id),
+					   ip4, ep, METRIC_INGRESS);
 	}
 
 to_host:
@@ -175,6 +175,8 @@ struct endpoint_info {
 struct remote_endpoint_info {
 	__u32		sec_label;
 	__u32		tunnel_endpoint;
+	__u8		key;
+	__u8		pad[3];
 };
 
 struct policy_key {
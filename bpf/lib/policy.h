@@ -43,6 +43,37 @@ static inline bool identity_is_reserved(__u32 identity)
 	return identity < HEALTH_ID;
 }
 
+/**
+ * identity_is_host is used to determine whether an identity found in the
+ * ipcache refers to a host. Unless the remote node identity is enabled, other
+ * nodes are not distinguished from the local host, so REMOTE_NODE_ID, e.g. of
+ * ipcache entries left behind after the option has been disabled, is treated
+ * like HOST_ID.
+ */
+static inline bool identity_is_host(__u32 identity)
+{
+#ifndef ENABLE_REMOTE_NODE_IDENTITY
+	if (identity == REMOTE_NODE_ID)
+		return true;
+#endif
+	return identity == HOST_ID;
+}
+
+/**
+ * identity_from_tunnel returns the identity of a packet received from another
+ * node with the given identity in the tunnel key. The host of the other node
+ * sends its packets with HOST_ID, they are attributed to REMOTE_NODE_ID if
+ * the remote node identity is enabled.
+ */
+static inline __u32 identity_from_tunnel(__u32 identity)
+{
+#ifdef ENABLE_REMOTE_NODE_IDENTITY
+	if (identity == HOST_ID)
+		return REMOTE_NODE_ID;
+#endif
+	return identity;
+}
+
 static inline int __inline__
 __policy_can_access(void *map, struct __sk_buff *skb, __u32 identity,
 		    __u16 dport, __u8 proto, size_t cidr_addr_size,
@@ -36,6 +36,8 @@
 #define CLUSTER_ID 3
 #define HEALTH_ID 4
 #define INIT_ID 5
+#define REMOTE_NODE_ID 6
+#define ENABLE_REMOTE_NODE_IDENTITY
 #define HOST_IFINDEX_MAC { .addr = { 0xce, 0x72, 0xa7, 0x03, 0x88, 0x56 } }
 #define NAT46_PREFIX { .addr = { 0xbe, 0xef, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xa, 0x0, 0x0, 0x0, 0x0, 0x0 } }
 #define IPV4_MASK 0xffff
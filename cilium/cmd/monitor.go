@@ -117,6 +117,7 @@ func init() {
 	monitorCmd.Flags().Var(&related, "related-to", "Filter by either source or destination endpoint id")
 	monitorCmd.Flags().BoolVarP(&verboseMonitor, "verbose", "v", false, "Enable verbose output")
 	monitorCmd.Flags().BoolVarP(&jsonOutput, "json", "j", false, "Enable json output. Shadows -v flag")
+	monitorCmd.Flags().StringVar(&compression, "compression", string(listener.CompressionNone), "Request compression of the events sent by the node monitor (none, gzip, snappy)")
 }
 
 var (
@@ -128,6 +129,7 @@ var (
 	verboseMonitor = false
 	jsonOutput     = false
 	verbosity      = INFO
+	compression    = string(listener.CompressionNone)
 )
 
 func setVerbosity() {
@@ -141,6 +143,10 @@ func setVerbosity() {
 }
 
 func lostEvent(lost uint64, cpu int) {
+	if cpu == payload.ListenerCPU {
+		fmt.Printf("Monitor: Lost %d events\n", lost)
+		return
+	}
 	fmt.Printf("CPU %02d: Lost %d events\n", cpu, lost)
 }
 
@@ -314,34 +320,61 @@ func setupSigHandler() {
 }
 
 // openMonitorSock attempts to open a version specific monitor socket It
-// returns a connection, with a version, or an error.
-func openMonitorSock() (conn net.Conn, version listener.Version, err error) {
+// returns a connection, with the state of its listener, or an error. comp is
+// the compression requested from the node monitor, the events are sent
+// uncompressed if it is not supported.
+func openMonitorSock(comp listener.Compression) (conn net.Conn, state listener.State, err error) {
 	errors := make([]string, 0)
 
+	// try the handshake socket
+	conn, err = net.Dial("unix", defaults.MonitorSockPathHandshake)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(connTimeout))
+		offer := listener.OfferVersionsWithCompression(comp, 0,
+			listener.Version1_0, listener.Version1_2, listener.Version1_3)
+		state, err = listener.ClientHandshake(conn, func(caps listener.Capabilities) (listener.State, error) {
+			// Let the node monitor filter the event types so that
+			// unwanted events are not sent at all.
+			request, err := offer(caps)
+			request.MessageTypes = eventTypes
+			// Events unrelated to the endpoints are filtered out
+			// by the node monitor as well
+			request.Endpoints = related
+			request.Name = fmt.Sprintf("cilium-monitor[%d]", os.Getpid())
+			return request, err
+		})
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			return conn, state, nil
+		}
+		conn.Close()
+	}
+	errors = append(errors, defaults.MonitorSockPathHandshake+": "+err.Error())
+
 	// try the 1.2 socket
 	conn, err = net.Dial("unix", defaults.MonitorSockPath1_2)
 	if err == nil {
-		return conn, listener.Version1_2, nil
+		return conn, listener.State{Version: listener.Version1_2}, nil
 	}
 	errors = append(errors, defaults.MonitorSockPath1_2+": "+err.Error())
 
 	// try the 1.1 socket
 	conn, err = net.Dial("unix", defaults.MonitorSockPath1_0)
 	if err == nil {
-		return conn, listener.Version1_0, nil
+		return conn, listener.State{Version: listener.Version1_0}, nil
 	}
 	errors = append(errors, defaults.MonitorSockPath1_0+": "+err.Error())
 
-	return nil, listener.VersionUnsupported, fmt.Errorf("Cannot find or open a supported node-monitor socket. %s", strings.Join(errors, ","))
+	return nil, listener.State{Version: listener.VersionUnsupported}, fmt.Errorf("Cannot find or open a supported node-monitor socket. %s", strings.Join(errors, ","))
 }
 
 // consumeMonitorEvents handles and prints events on a monitor connection. It
 // calls getMonitorParsed to construct a monitor-version appropraite parser.
 // It closes conn on return, and returns on error, including io.EOF
-func consumeMonitorEvents(conn net.Conn, version listener.Version) error {
+func consumeMonitorEvents(conn net.Conn, state listener.State) error {
 	defer conn.Close()
 
-	getParsedPayload, err := getMonitorParser(conn, version)
+	getParsedPayload, err := getMonitorParser(conn, state)
 	if err != nil {
 		return err
 	}
@@ -359,6 +392,9 @@ func consumeMonitorEvents(conn net.Conn, version listener.Version) error {
 		case payload.RecordLost:
 			lostEvent(pl.Lost, pl.CPU)
 
+		case payload.Keepalive:
+			// The node monitor is alive but idle
+
 		default:
 			// earlier code used an else to handle this case, along with pl.Type ==
 			// payload.RecordLost above. It should be safe to call lostEvent to match
@@ -374,18 +410,22 @@ func consumeMonitorEvents(conn net.Conn, version listener.Version) error {
 type eventParserFunc func() (*payload.Payload, error)
 
 // getMonitorParser constructs and returns an eventParserFunc. It is
-// appropriate for the monitor API version passed in.
-func getMonitorParser(conn net.Conn, version listener.Version) (parser eventParserFunc, err error) {
-	switch version {
+// appropriate for the monitor API version and compression passed in.
+func getMonitorParser(conn net.Conn, state listener.State) (parser eventParserFunc, err error) {
+	switch state.Version {
 	case listener.Version1_0:
 		var (
 			meta payload.Meta
 			pl   payload.Payload
 		)
+		r, err := listener.NewDecompressedReader(conn, state.Compression)
+		if err != nil {
+			return nil, err
+		}
 		// This implements the older API. Always encode a Meta and Payload object,
 		// both with full gob type information
 		return func() (*payload.Payload, error) {
-			if err := payload.ReadMetaPayload(conn, &meta, &pl); err != nil {
+			if err := payload.ReadMetaPayload(r, &meta, &pl); err != nil {
 				return nil, err
 			}
 			return &pl, nil
@@ -405,8 +445,30 @@ func getMonitorParser(conn net.Conn, version listener.Version) (parser eventPars
 			return &pl, nil
 		}, nil
 
+	case listener.Version1_3:
+		var (
+			pl payload.Payload
+			fr = listener.NewFrameReader(conn)
+		)
+		// This implements the 1.3 API. Each payload is encoded on its own
+		// and sent in a frame, corrupt frames are skipped by the reader.
+		return func() (*payload.Payload, error) {
+			for {
+				data, err := fr.ReadFrame()
+				if err != nil {
+					return nil, err
+				}
+				pl = payload.Payload{}
+				if err := pl.Decode(data); err != nil {
+					log.WithError(err).Warn("Skipping undecodable monitor payload")
+					continue
+				}
+				return &pl, nil
+			}
+		}, nil
+
 	default:
-		return nil, fmt.Errorf("unsupported version %s", version)
+		return nil, fmt.Errorf("unsupported version %s", state.Version)
 	}
 }
 
@@ -424,19 +486,24 @@ func runMonitor(args []string) {
 				nm.Cpus, nm.Npages, nm.Pagesize)
 		}
 	}
+	comp, err := listener.ParseCompression(compression)
+	if err != nil {
+		Fatalf("Invalid compression: %s", err)
+	}
+
 	fmt.Printf("Press Ctrl-C to quit\n")
 
 	// On EOF, retry
 	// On other errors, exit
 	// always wait connTimeout when retrying
 	for ; ; time.Sleep(connTimeout) {
-		conn, version, err := openMonitorSock()
+		conn, state, err := openMonitorSock(comp)
 		if err != nil {
 			log.WithError(err).Error("Cannot open monitor socket")
 			return
 		}
 
-		err = consumeMonitorEvents(conn, version)
+		err = consumeMonitorEvents(conn, state)
 		switch {
 		case err == nil:
 		// no-op
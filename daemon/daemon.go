@@ -152,6 +152,16 @@ type Daemon struct {
 	// maps, etc. being performed without crucial information in securing said
 	// components. See GH-5038 and GH-4457.
 	k8sResourceSyncWaitGroup sync.WaitGroup
+
+	// ctx is cancelled once the daemon shuts down, see Shutdown()
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Shutdown stops background work which is tied to the lifetime of the
+// daemon, e.g. garbage collection of the BPF ipcache map
+func (d *Daemon) Shutdown() {
+	d.cancel()
 }
 
 // UpdateProxyRedirect updates the redirect rules in the proxy for a particular
@@ -166,7 +176,7 @@ func (d *Daemon) UpdateProxyRedirect(e *endpoint.Endpoint, l4 *policy.L4Filter,
 		return 0, err
 	}
 
-	return r.ProxyPort, nil
+	return r.GetProxyPort(), nil
 }
 
 // RemoveProxyRedirect removes a previously installed proxy redirect for an
@@ -798,11 +808,24 @@ func (d *Daemon) init() error {
 			return err
 		}
 
+		bpfListener, err := bpfIPCache.NewListener(d, option.Config.IPCacheGCInterval)
+		if err != nil {
+			return fmt.Errorf("unable to create ipcache listener: %s", err)
+		}
+		bpfListener.WithGCDryRun(option.Config.IPCacheGCDryRun)
+		gcSources, err := bpfIPCache.ParseGCSources(option.Config.IPCacheGCSources)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", option.IPCacheGCSourcesName, err)
+		}
+		bpfListener.WithGCSources(gcSources).WithGCContext(d.ctx).
+			WithGCDeleteBatchSize(option.Config.IPCacheGCDeleteBatchSize).
+			WithNotifier(d)
+
 		// Set up the list of IPCache listeners in the daemon, to be
 		// used by syncLXCMap().
 		ipcache.IPIdentityCache.SetListeners([]ipcache.IPIdentityMappingListener{
 			&envoy.NetworkPolicyHostsCache,
-			bpfIPCache.NewListener(d),
+			bpfListener,
 		})
 
 		// Insert local host entries to bpf maps
@@ -943,6 +966,10 @@ func createNodeConfigHeaderfile() error {
 	fmt.Fprintf(fw, "#define CLUSTER_ID %d\n", identity.GetReservedID(labels.IDNameCluster))
 	fmt.Fprintf(fw, "#define HEALTH_ID %d\n", identity.GetReservedID(labels.IDNameHealth))
 	fmt.Fprintf(fw, "#define INIT_ID %d\n", identity.GetReservedID(labels.IDNameInit))
+	fmt.Fprintf(fw, "#define REMOTE_NODE_ID %d\n", identity.GetReservedID(labels.IDNameRemoteNode))
+	if option.Config.EnableRemoteNodeIdentity {
+		fw.WriteString("#define ENABLE_REMOTE_NODE_IDENTITY\n")
+	}
 	fmt.Fprintf(fw, "#define LB_RR_MAX_SEQ %d\n", lbmap.MaxSeq)
 	fmt.Fprintf(fw, "#define CILIUM_LB_MAP_MAX_ENTRIES %d\n", lbmap.MaxEntries)
 	fmt.Fprintf(fw, "#define TUNNEL_ENDPOINT_MAP_SIZE %d\n", tunnel.MaxEntries)
@@ -962,6 +989,34 @@ func createNodeConfigHeaderfile() error {
 	return nil
 }
 
+// setEntityCIDRs provides the policy entities with the CIDRs of the cluster
+// and the addresses of the local node, which are used to classify IPs
+// without an identity into entities
+func setEntityCIDRs() {
+	policyApi.SetClusterCIDRs([]*net.IPNet{
+		node.GetIPv4ClusterRange(),
+		node.GetIPv6ClusterRange(),
+	})
+
+	var hostCIDRs []*net.IPNet
+	for _, ip := range []net.IP{
+		node.GetInternalIPv4(),
+		node.GetExternalIPv4(),
+		node.GetIPv6(),
+		node.GetIPv6Router(),
+	} {
+		if ip == nil {
+			continue
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			bits = net.IPv4len * 8
+		}
+		hostCIDRs = append(hostCIDRs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	policyApi.SetHostCIDRs(hostCIDRs)
+}
+
 // syncLXCMap adds local host enties to bpf lxcmap, as well as
 // ipcache, if needed, and also notifies the daemon and network policy
 // hosts cache if changes were made.
@@ -1109,6 +1164,7 @@ func NewDaemon() (*Daemon, *endpointRestoreState, error) {
 		buildEndpointChan: make(chan *endpoint.Request, lxcmap.MaxEntries),
 		compilationMutex:  new(lock.RWMutex),
 	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
 
 	workloads.Init(&d)
 
@@ -1245,6 +1301,8 @@ func NewDaemon() (*Daemon, *endpointRestoreState, error) {
 		log.WithError(err).Fatal("postinit failed")
 	}
 
+	setEntityCIDRs()
+
 	if k8s.IsEnabled() {
 		log.Info("Annotating k8s node with CIDR ranges")
 		err := k8s.AnnotateNode(k8s.Client(), node.GetName(),
@@ -1318,6 +1376,7 @@ func NewDaemon() (*Daemon, *endpointRestoreState, error) {
 	// FIXME: Make the port range configurable.
 	d.l7Proxy = proxy.StartProxySupport(10000, 20000, option.Config.RunDir,
 		option.Config.AccessLog, &d, option.Config.AgentLabels)
+	d.l7Proxy.SetRedirectDrainTimeout(option.Config.ProxyDrainTimeout)
 
 	d.startStatusCollector()
 
@@ -0,0 +1,121 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// kubeAPIServerName is the name of the service and endpoints of the
+	// kube-apiserver
+	kubeAPIServerName = "kubernetes"
+
+	// kubeAPIServerNamespace is the namespace of the service and endpoints
+	// of the kube-apiserver
+	kubeAPIServerNamespace = "default"
+)
+
+// kubeAPIServerIPCache are the IPs which have been associated with the
+// kube-apiserver identity in the ipcache by syncKubeAPIServerIPs
+var kubeAPIServerIPCache = struct {
+	lock.Mutex
+	ips map[string]struct{}
+}{
+	ips: map[string]struct{}{},
+}
+
+// isKubeAPIServerEndpoints returns true if ep are the endpoints of the
+// kube-apiserver
+func isKubeAPIServerEndpoints(ep *v1.Endpoints) bool {
+	return ep.ObjectMeta.Name == kubeAPIServerName && ep.ObjectMeta.Namespace == kubeAPIServerNamespace
+}
+
+// kubeAPIServerIPs returns the IPs of the kube-apiserver listed in ep, or
+// none if ep is nil
+func kubeAPIServerIPs(ep *v1.Endpoints) map[string]struct{} {
+	ips := map[string]struct{}{}
+	if ep == nil {
+		return ips
+	}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			if ip := net.ParseIP(addr.IP); ip != nil {
+				ips[ip.String()] = struct{}{}
+			}
+		}
+	}
+	return ips
+}
+
+// syncKubeAPIServerIPs associates the IPs of the kube-apiserver listed in ep
+// with the reserved kube-apiserver identity in the ipcache, so that they are
+// selected by the kube-apiserver entity, and removes the association of IPs
+// no longer listed. A nil ep removes all associations.
+//
+// The identity is only assigned to IPs which are not known to the ipcache
+// otherwise, i.e. to a kube-apiserver external to the cluster. A
+// kube-apiserver running in the cluster, on a node or in a pod, keeps the
+// identity of the node or pod and must be selected by it instead. The
+// kube-apiserver identity carries neither the world label nor CIDR labels,
+// so it must only be used if option.Config.EnableKubeAPIServerIdentity is
+// set.
+func syncKubeAPIServerIPs(ep *v1.Endpoints) {
+	desired := kubeAPIServerIPs(ep)
+
+	kubeAPIServerIPCache.Lock()
+	defer kubeAPIServerIPCache.Unlock()
+
+	for ip := range kubeAPIServerIPCache.ips {
+		if _, ok := desired[ip]; ok {
+			continue
+		}
+		delete(kubeAPIServerIPCache.ips, ip)
+		// Only remove the entry if it has not been taken over by a
+		// node or pod in the meantime
+		if id, ok := ipcache.IPIdentityCache.LookupByIP(ip); ok && id.ID == identity.ReservedIdentityKubeAPIServer {
+			log.WithField(logfields.IPAddr, ip).Debug("Removing kube-apiserver IP from ipcache")
+			ipcache.IPIdentityCache.Delete(ip)
+		}
+	}
+
+	for ip := range desired {
+		scopedLog := log.WithField(logfields.IPAddr, ip)
+		if id, ok := ipcache.IPIdentityCache.LookupByIP(ip); ok {
+			if id.ID != identity.ReservedIdentityKubeAPIServer {
+				scopedLog.WithFields(logrus.Fields{
+					logfields.Identity: id.ID,
+				}).Debug("kube-apiserver IP is part of the cluster, keeping its identity")
+			}
+			continue
+		}
+
+		scopedLog.Debug("Associating kube-apiserver IP with kube-apiserver identity")
+		if ipcache.IPIdentityCache.Upsert(ip, nil, ipcache.Identity{
+			ID:     identity.ReservedIdentityKubeAPIServer,
+			Source: ipcache.FromKubernetes,
+		}) {
+			kubeAPIServerIPCache.ips[ip] = struct{}{}
+		}
+	}
+}
@@ -878,6 +878,10 @@ func (d *Daemon) addK8sEndpointV1(ep *v1.Endpoints) {
 		Namespace:   ep.ObjectMeta.Namespace,
 	}
 
+	if option.Config.EnableKubeAPIServerIdentity && isKubeAPIServerEndpoints(ep) {
+		syncKubeAPIServerIPs(ep)
+	}
+
 	newSvcEP := parseK8sEPv1(ep)
 
 	d.loadBalancer.K8sMU.Lock()
@@ -966,6 +970,10 @@ func (d *Daemon) deleteK8sEndpointV1(ep *v1.Endpoints) {
 		Namespace:   ep.ObjectMeta.Namespace,
 	}
 
+	if option.Config.EnableKubeAPIServerIdentity && isKubeAPIServerEndpoints(ep) {
+		syncKubeAPIServerIPs(nil)
+	}
+
 	d.loadBalancer.K8sMU.Lock()
 	defer d.loadBalancer.K8sMU.Unlock()
 
@@ -2030,8 +2038,14 @@ func (d *Daemon) updateK8sNodeTunneling(k8sNodeOld, k8sNodeNew *v1.Node) error {
 		}
 	}
 
+	// The cilium_host IP of other nodes is associated with the remote-node
+	// identity if enabled, other nodes carry the host identity otherwise
+	nodeIdentity := identity.ReservedIdentityHost
+	if option.Config.EnableRemoteNodeIdentity {
+		nodeIdentity = identity.ReservedIdentityRemoteNode
+	}
 	selfOwned := ipcache.IPIdentityCache.Upsert(ciliumIPStrNew, hostIPNew, ipcache.Identity{
-		ID:     identity.ReservedIdentityHost,
+		ID:     nodeIdentity,
 		Source: ipcache.FromKubernetes,
 	})
 	if !selfOwned {
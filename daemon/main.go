@@ -35,6 +35,7 @@ import (
 	"github.com/cilium/cilium/pkg/bpf"
 	"github.com/cilium/cilium/pkg/components"
 	"github.com/cilium/cilium/pkg/controller"
+	bpfIPCache "github.com/cilium/cilium/pkg/datapath/ipcache"
 	"github.com/cilium/cilium/pkg/defaults"
 	"github.com/cilium/cilium/pkg/endpointmanager"
 	"github.com/cilium/cilium/pkg/envoy"
@@ -84,6 +85,7 @@ const (
 	argDebugVerboseFlow    = "flow"
 	argDebugVerboseKvstore = "kvstore"
 	argDebugVerboseEnvoy   = "envoy"
+	argDebugVerboseIPCache = "ipcache"
 
 	apiTimeout = 60 * time.Second
 )
@@ -383,6 +385,8 @@ func init() {
 	flags.StringVarP(&dockerEndpoint,
 		"docker", "e", workloads.GetRuntimeDefaultOpt(workloads.Docker, "endpoint"), "Path to docker runtime socket (DEPRECATED: use container-runtime-endpoint instead)")
 	flags.String("enable-policy", option.DefaultEnforcement, "Enable policy enforcement")
+	flags.Bool(option.EnableKubeAPIServerIdentityName, false, "Associate the IPs of a kube-apiserver external to the cluster with the kube-apiserver identity instead of the world identity")
+	flags.Bool(option.EnableRemoteNodeIdentityName, false, "Associate the IPs of the other nodes of the cluster with the remote-node identity instead of the host identity")
 	flags.BoolVar(&enableTracing,
 		"enable-tracing", false, "Enable tracing while determining policy (debugging)")
 	flags.String("envoy-log", "", "Path to a separate Envoy log file, if any")
@@ -495,6 +499,11 @@ func init() {
 	viper.BindEnv(option.CTMapEntriesGlobalTCPName, option.CTMapEntriesGlobalTCPNameEnv)
 	flags.Int(option.CTMapEntriesGlobalAnyName, option.CTMapEntriesGlobalAnyDefault, "Maximum number of entries in non-TCP CT table")
 	viper.BindEnv(option.CTMapEntriesGlobalAnyName, option.CTMapEntriesGlobalAnyNameEnv)
+	flags.Duration(option.IPCacheGCIntervalName, defaults.IPCacheGCInterval, "Interval in which the BPF ipcache map is garbage collected")
+	flags.Bool(option.IPCacheGCDryRunName, false, "Only log the entries garbage collection would remove from the BPF ipcache map instead of removing them")
+	flags.Int(option.IPCacheGCDeleteBatchSizeName, defaults.IPCacheGCDeleteBatchSize, "Maximum number of stale entries garbage collection deletes from the BPF ipcache map at once")
+	flags.Duration(option.ProxyDrainTimeoutName, 0, "Time the connections of a removed Kafka proxy redirect are given to finish before they are closed, 0 closes them immediately")
+	flags.StringSlice(option.IPCacheGCSourcesName, []string{"kvstore", "agent-local", "unknown"}, "Sources of the ipcache entries which garbage collection removes from the BPF ipcache map (k8s, kvstore, agent-local, unknown)")
 
 	flags.StringVar(&cmdRefDir,
 		"cmdref", "", "Path to cmdref output directory")
@@ -565,6 +574,9 @@ func initEnv(cmd *cobra.Command) {
 		case argDebugVerboseEnvoy:
 			log.Debugf("Enabling Envoy tracing")
 			envoy.EnableTracing()
+		case argDebugVerboseIPCache:
+			log.Debugf("Enabling ipcache overlap detection")
+			bpfIPCache.EnableOverlapDetection()
 		default:
 			log.Warningf("Unknown verbose debug group: %s", grp)
 		}
@@ -1046,6 +1058,7 @@ func runDaemon() {
 	server.ReadTimeout = apiTimeout
 	server.WriteTimeout = apiTimeout
 	defer server.Shutdown()
+	defer d.Shutdown()
 
 	server.ConfigureAPI()
 
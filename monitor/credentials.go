@@ -0,0 +1,74 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerUID returns the UID of the process connected to c, as reported by
+// SO_PEERCRED. ok is false if c is not a Unix socket connection.
+func peerUID(c net.Conn) (uid uint32, ok bool, err error) {
+	uc, isUnix := c.(*net.UnixConn)
+	if !isUnix {
+		return 0, false, nil
+	}
+
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0, true, err
+	}
+
+	var ucred *unix.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return 0, true, err
+	}
+	return ucred.Uid, true, nil
+}
+
+// authorizePeer returns an error if c is a Unix socket connection of a
+// process whose UID is not in allowedUIDs. All connections are authorized if
+// allowedUIDs is empty, and connections which are not Unix socket connections
+// bypass the check.
+func authorizePeer(c net.Conn, allowedUIDs []uint32) error {
+	if len(allowedUIDs) == 0 {
+		return nil
+	}
+
+	uid, ok, err := peerUID(c)
+	switch {
+	case !ok:
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to read peer credentials: %s", err)
+	}
+
+	for _, allowed := range allowedUIDs {
+		if uid == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("UID %d of peer is not allowed", uid)
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestAuthorizePeer(c *C) {
+	dir := c.MkDir()
+	server, err := net.Listen("unix", filepath.Join(dir, "monitor.sock"))
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	client, err := net.Dial("unix", server.Addr().String())
+	c.Assert(err, IsNil)
+	defer client.Close()
+	conn, err := server.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	uid := uint32(os.Getuid())
+	c.Assert(authorizePeer(conn, nil), IsNil)
+	c.Assert(authorizePeer(conn, []uint32{uid + 1, uid}), IsNil)
+	c.Assert(authorizePeer(conn, []uint32{uid + 1}), Not(IsNil))
+
+	// Connections which are not Unix socket connections bypass the check
+	pipeServer, pipeClient := net.Pipe()
+	defer pipeServer.Close()
+	defer pipeClient.Close()
+	c.Assert(authorizePeer(pipeServer, []uint32{uid + 1}), IsNil)
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/byteorder"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/monitor"
+)
+
+// payloadFilter is the allow-list of the message types of the event samples
+// sent to a listener. The message type is the first byte of the data of an
+// event sample. Payloads other than event samples, e.g. records of lost
+// events, are never filtered. A nil payloadFilter allows all payloads.
+type payloadFilter struct {
+	allowed [256]bool
+}
+
+// newPayloadFilter returns a filter allowing the given message types, or
+// nil to allow all payloads if types is empty
+func newPayloadFilter(types []int) *payloadFilter {
+	if len(types) == 0 {
+		return nil
+	}
+
+	f := &payloadFilter{}
+	for _, typ := range types {
+		if typ >= 0 && typ < len(f.allowed) {
+			f.allowed[typ] = true
+		}
+	}
+	return f
+}
+
+// allows returns true if pl is to be sent to the listener
+func (f *payloadFilter) allows(pl *payload.Payload) bool {
+	if f == nil || pl.Type != payload.EventSample || len(pl.Data) == 0 {
+		return true
+	}
+	return f.allowed[pl.Data[0]]
+}
+
+// Offsets of the fields identifying endpoints in the data of event samples
+// emitted by the datapath, see the notifications in pkg/monitor. All
+// datapath notifications start with the ID of the source endpoint, only drop
+// and trace notifications carry the identities and the destination endpoint.
+const (
+	offsetSource   = 2
+	offsetSrcLabel = 16
+	offsetDstLabel = 20
+	offsetDstID    = 24
+)
+
+// endpointFilter restricts the event samples sent to a listener to the
+// events of a set of endpoints or security identities. Event samples of the
+// datapath are allowed if their source or destination endpoint is in
+// endpoints, or if their source or destination identity is in identities.
+// Payloads which do not carry endpoints, e.g. agent notifications or records
+// of lost events, are never filtered. All payloads are allowed if both sets
+// are empty. The filter can be replaced while payloads are enqueued.
+type endpointFilter struct {
+	mutex      lock.RWMutex
+	endpoints  map[uint16]struct{}
+	identities map[uint32]struct{}
+}
+
+// newEndpointFilter returns a filter allowing the events of the given
+// endpoints and identities
+func newEndpointFilter(endpoints []uint16, identities []uint32) *endpointFilter {
+	f := &endpointFilter{}
+	f.set(endpoints, identities)
+	return f
+}
+
+// set replaces the endpoints and identities allowed by the filter
+func (f *endpointFilter) set(endpoints []uint16, identities []uint32) {
+	var endpointSet map[uint16]struct{}
+	if len(endpoints) > 0 {
+		endpointSet = make(map[uint16]struct{}, len(endpoints))
+		for _, id := range endpoints {
+			endpointSet[id] = struct{}{}
+		}
+	}
+	var identitySet map[uint32]struct{}
+	if len(identities) > 0 {
+		identitySet = make(map[uint32]struct{}, len(identities))
+		for _, id := range identities {
+			identitySet[id] = struct{}{}
+		}
+	}
+
+	f.mutex.Lock()
+	f.endpoints, f.identities = endpointSet, identitySet
+	f.mutex.Unlock()
+}
+
+// get returns the endpoints and identities allowed by the filter, e.g. to
+// hand off the state of the listener
+func (f *endpointFilter) get() (endpoints []uint16, identities []uint32) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	for id := range f.endpoints {
+		endpoints = append(endpoints, id)
+	}
+	for id := range f.identities {
+		identities = append(identities, id)
+	}
+	return endpoints, identities
+}
+
+// allows returns true if pl is to be sent to the listener
+func (f *endpointFilter) allows(pl *payload.Payload) bool {
+	if pl.Type != payload.EventSample || len(pl.Data) == 0 {
+		return true
+	}
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if f.endpoints == nil && f.identities == nil {
+		return true
+	}
+
+	data := pl.Data
+	switch data[0] {
+	case monitor.MessageTypeDebug, monitor.MessageTypeCapture:
+		return len(data) >= offsetSource+2 &&
+			f.hasEndpoint(byteorder.Native.Uint16(data[offsetSource:]))
+
+	case monitor.MessageTypeDrop, monitor.MessageTypeTrace:
+		// The destination endpoint is a 32 bit field in drop
+		// notifications, endpoint IDs fit into 16 bits
+		var dstID uint16
+		if data[0] == monitor.MessageTypeDrop {
+			if len(data) < offsetDstID+4 {
+				return false
+			}
+			dstID = uint16(byteorder.Native.Uint32(data[offsetDstID:]))
+		} else {
+			if len(data) < offsetDstID+2 {
+				return false
+			}
+			dstID = byteorder.Native.Uint16(data[offsetDstID:])
+		}
+		return f.hasEndpoint(byteorder.Native.Uint16(data[offsetSource:])) ||
+			f.hasEndpoint(dstID) ||
+			f.hasIdentity(byteorder.Native.Uint32(data[offsetSrcLabel:])) ||
+			f.hasIdentity(byteorder.Native.Uint32(data[offsetDstLabel:]))
+
+	default:
+		return true
+	}
+}
+
+// hasEndpoint returns true if the endpoint is allowed, f.mutex must be held
+func (f *endpointFilter) hasEndpoint(id uint16) bool {
+	_, ok := f.endpoints[id]
+	return ok
+}
+
+// hasIdentity returns true if the identity is allowed, f.mutex must be held
+func (f *endpointFilter) hasIdentity(id uint32) bool {
+	_, ok := f.identities[id]
+	return ok
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/byteorder"
+	"github.com/cilium/cilium/pkg/monitor"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestPayloadFilter(c *C) {
+	drop := &payload.Payload{Data: []byte{monitor.MessageTypeDrop}, Type: payload.EventSample}
+	trace := &payload.Payload{Data: []byte{monitor.MessageTypeTrace}, Type: payload.EventSample}
+	lost := &payload.Payload{Lost: 1, Type: payload.RecordLost}
+
+	// All payloads are allowed by default
+	var f *payloadFilter
+	c.Assert(f.allows(drop), Equals, true)
+	c.Assert(f.allows(trace), Equals, true)
+	c.Assert(newPayloadFilter(nil), IsNil)
+
+	f = newPayloadFilter([]int{monitor.MessageTypeDrop})
+	c.Assert(f.allows(drop), Equals, true)
+	c.Assert(f.allows(trace), Equals, false)
+	c.Assert(f.allows(lost), Equals, true)
+}
+
+// encodeEventSample returns an event sample carrying the notification
+func encodeEventSample(c *C, notification interface{}) *payload.Payload {
+	var buf bytes.Buffer
+	c.Assert(binary.Write(&buf, byteorder.Native, notification), IsNil)
+	return &payload.Payload{Data: buf.Bytes(), Type: payload.EventSample}
+}
+
+func (s *MonitorSuite) TestEndpointFilter(c *C) {
+	drop := encodeEventSample(c, monitor.DropNotify{
+		Type: monitor.MessageTypeDrop, Source: 1, SrcLabel: 100, DstLabel: 200, DstID: 2,
+	})
+	trace := encodeEventSample(c, monitor.TraceNotify{
+		Type: monitor.MessageTypeTrace, Source: 3, SrcLabel: 300, DstLabel: 100, DstID: 4,
+	})
+	debug := encodeEventSample(c, monitor.DebugMsg{Type: monitor.MessageTypeDebug, Source: 5})
+	agent := &payload.Payload{Data: []byte{monitor.MessageTypeAgent}, Type: payload.EventSample}
+	lost := &payload.Payload{Lost: 1, Type: payload.RecordLost}
+
+	// All payloads are allowed by default
+	f := newEndpointFilter(nil, nil)
+	for _, pl := range []*payload.Payload{drop, trace, debug, agent, lost} {
+		c.Assert(f.allows(pl), Equals, true)
+	}
+
+	// Source and destination endpoints are matched
+	f.set([]uint16{2, 5}, nil)
+	c.Assert(f.allows(drop), Equals, true)
+	c.Assert(f.allows(trace), Equals, false)
+	c.Assert(f.allows(debug), Equals, true)
+	c.Assert(f.allows(agent), Equals, true)
+	c.Assert(f.allows(lost), Equals, true)
+
+	// Source and destination identities are matched
+	f.set(nil, []uint32{100})
+	c.Assert(f.allows(drop), Equals, true)
+	c.Assert(f.allows(trace), Equals, true)
+	c.Assert(f.allows(debug), Equals, false)
+
+	f.set(nil, []uint32{300})
+	c.Assert(f.allows(drop), Equals, false)
+	c.Assert(f.allows(trace), Equals, true)
+	endpoints, identities := f.get()
+	c.Assert(endpoints, HasLen, 0)
+	c.Assert(identities, DeepEquals, []uint32{300})
+
+	// Truncated notifications are filtered out
+	c.Assert(f.allows(&payload.Payload{Data: drop.Data[:20], Type: payload.EventSample}), Equals, false)
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Compression is the compression algorithm applied to the stream of messages
+// sent to a listener.
+type Compression string
+
+const (
+	// CompressionNone sends messages uncompressed
+	CompressionNone = Compression("none")
+
+	// CompressionGzip compresses the stream of messages with gzip
+	CompressionGzip = Compression("gzip")
+
+	// CompressionSnappy compresses the stream of messages with snappy
+	CompressionSnappy = Compression("snappy")
+)
+
+// ParseCompression parses the name of a compression algorithm. An empty name
+// selects CompressionNone.
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	case CompressionSnappy:
+		return CompressionSnappy, nil
+	default:
+		return CompressionNone, fmt.Errorf("unsupported compression algorithm %q", name)
+	}
+}
+
+// ValidateCompressionLevel returns an error if level is not a valid level for
+// the compression algorithm. A level of 0 selects the default level of the
+// algorithm.
+func ValidateCompressionLevel(c Compression, level int) error {
+	switch c {
+	case CompressionGzip:
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("invalid gzip compression level %d", level)
+		}
+	default:
+		if level != 0 {
+			return fmt.Errorf("compression level is not supported by compression %q", c)
+		}
+	}
+	return nil
+}
+
+// CompressedWriter writes a compressed stream. Flush must be called to ensure
+// that all data written so far is sent to the underlying writer.
+type CompressedWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// nopFlusher is a CompressedWriter which passes all writes through
+type nopFlusher struct {
+	io.Writer
+}
+
+func (nopFlusher) Flush() error {
+	return nil
+}
+
+// NewCompressedWriter returns a writer which compresses the stream written to
+// w with the compression algorithm c at the given level.
+func NewCompressedWriter(w io.Writer, c Compression, level int) (CompressedWriter, error) {
+	switch c {
+	case "", CompressionNone:
+		return nopFlusher{w}, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", c)
+	}
+}
+
+// NewDecompressedReader returns a reader which decompresses the stream read
+// from r with the compression algorithm c.
+func NewDecompressedReader(r io.Reader, c Compression) (io.Reader, error) {
+	switch c {
+	case "", CompressionNone:
+		return r, nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionSnappy:
+		return snappy.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", c)
+	}
+}
+
+// compress returns data compressed on its own with the compression algorithm
+// c at the given level
+func compress(data []byte, c Compression, level int) ([]byte, error) {
+	switch c {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", c)
+	}
+}
+
+// decompress returns data compressed by compress() decompressed. An error is
+// returned if the decompressed data exceeds maxSize bytes.
+func decompress(data []byte, c Compression, maxSize int) ([]byte, error) {
+	switch c {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		if n, err := snappy.DecodedLen(data); err != nil {
+			return nil, err
+		} else if n > maxSize {
+			return nil, fmt.Errorf("decompressed data of %d bytes exceeds maximum size", n)
+		}
+		return snappy.Decode(nil, data)
+	}
+
+	r, err := NewDecompressedReader(bytes.NewReader(data), c)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxSize {
+		return nil, fmt.Errorf("decompressed data exceeds maximum size")
+	}
+	return buf, nil
+}
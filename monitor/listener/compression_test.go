@@ -0,0 +1,67 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ListenerSuite struct{}
+
+var _ = Suite(&ListenerSuite{})
+
+func (s *ListenerSuite) TestParseCompression(c *C) {
+	comp, err := ParseCompression("")
+	c.Assert(err, IsNil)
+	c.Assert(comp, Equals, CompressionNone)
+
+	comp, err = ParseCompression("gzip")
+	c.Assert(err, IsNil)
+	c.Assert(comp, Equals, CompressionGzip)
+
+	_, err = ParseCompression("zstd")
+	c.Assert(err, Not(IsNil))
+
+	c.Assert(ValidateCompressionLevel(CompressionGzip, 9), IsNil)
+	c.Assert(ValidateCompressionLevel(CompressionGzip, 10), Not(IsNil))
+	c.Assert(ValidateCompressionLevel(CompressionNone, 1), Not(IsNil))
+}
+
+func (s *ListenerSuite) TestCompressedRoundTrip(c *C) {
+	msg := bytes.Repeat([]byte("cilium"), 100)
+
+	for _, comp := range []Compression{CompressionNone, CompressionGzip} {
+		buf := &bytes.Buffer{}
+		w, err := NewCompressedWriter(buf, comp, 0)
+		c.Assert(err, IsNil)
+
+		_, err = w.Write(msg)
+		c.Assert(err, IsNil)
+		c.Assert(w.Flush(), IsNil)
+
+		r, err := NewDecompressedReader(buf, comp)
+		c.Assert(err, IsNil)
+		out := make([]byte, len(msg))
+		_, err = io.ReadFull(r, out)
+		c.Assert(err, IsNil)
+		c.Assert(out, DeepEquals, msg)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"io"
+)
+
+// After a successful handshake, clients may send control messages to the
+// node monitor on the same connection. They use the same length prefixed JSON
+// framing as the handshake messages. The server does not respond to control
+// messages; unknown or unsupported control messages are ignored, e.g.
+// ControlPause and ControlResume by Version1_2 listeners.
+
+// ControlType is the type of a control message
+type ControlType string
+
+const (
+	// ControlPause pauses the delivery of payloads to the listener. The
+	// connection and the state of the listener are kept. Payloads emitted
+	// while the listener is paused are queued until the queue of the
+	// listener is full, further payloads are dropped.
+	ControlPause = ControlType("pause")
+
+	// ControlResume resumes the delivery of payloads to a paused listener,
+	// starting with the payloads queued while it was paused.
+	ControlResume = ControlType("resume")
+
+	// ControlFilter replaces the endpoints and identities the listener
+	// receives events for with the Endpoints and Identities of the
+	// message, see State.Endpoints. Empty lists remove the filter.
+	ControlFilter = ControlType("filter")
+)
+
+// ControlMessage is a message sent by a client to control its listener
+type ControlMessage struct {
+	// Type is the type of the control message
+	Type ControlType `json:"type"`
+
+	// Endpoints and Identities are the new filter of a ControlFilter
+	// message
+	Endpoints  []uint16 `json:"endpoints,omitempty"`
+	Identities []uint32 `json:"identities,omitempty"`
+}
+
+// PausableListener is a MonitorListener whose delivery of payloads can be
+// paused and resumed by the client.
+type PausableListener interface {
+	MonitorListener
+
+	// Pause stops dequeuing payloads. Payloads are still enqueued until
+	// the queue is full, after which they are dropped.
+	Pause()
+
+	// Resume resumes dequeuing payloads after Pause.
+	Resume()
+
+	// Paused returns true if the listener is paused
+	Paused() bool
+}
+
+// FilterableListener is a MonitorListener whose endpoint filter can be
+// replaced by the client, see ControlFilter.
+type FilterableListener interface {
+	MonitorListener
+
+	// SetEndpointFilter restricts the event samples of the datapath sent
+	// to the client to the events of the given endpoints and identities,
+	// see State.Endpoints. Empty lists remove the filter.
+	SetEndpointFilter(endpoints []uint16, identities []uint32)
+}
+
+// WriteControlMessage sends a control message to the node monitor on w
+func WriteControlMessage(w io.Writer, msg ControlMessage) error {
+	return writeHandshakeMessage(w, msg)
+}
+
+// ReadControlMessage reads a control message sent by a client from r
+func ReadControlMessage(r io.Reader) (ControlMessage, error) {
+	var msg ControlMessage
+	err := readHandshakeMessage(r, &msg)
+	return msg, err
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ListenerSuite) TestControlMessage(c *C) {
+	var buf bytes.Buffer
+	for _, t := range []ControlType{ControlPause, ControlResume} {
+		c.Assert(WriteControlMessage(&buf, ControlMessage{Type: t}), IsNil)
+	}
+
+	msg, err := ReadControlMessage(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Type, Equals, ControlPause)
+
+	msg, err = ReadControlMessage(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(msg.Type, Equals, ControlResume)
+
+	_, err = ReadControlMessage(&buf)
+	c.Assert(err, NotNil)
+
+	filter := ControlMessage{Type: ControlFilter, Endpoints: []uint16{1, 2}, Identities: []uint32{100}}
+	c.Assert(WriteControlMessage(&buf, filter), IsNil)
+	msg, err = ReadControlMessage(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(msg, DeepEquals, filter)
+}
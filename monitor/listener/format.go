@@ -0,0 +1,29 @@
+// Copyright 2017 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+// Format is the encoding of the messages sent to a listener
+type Format string
+
+const (
+	// FormatBinary sends each payload as a binary payload.Meta followed by
+	// the gob encoded payload.Payload
+	FormatBinary = Format("binary")
+
+	// FormatJSON sends each payload as a payload.JSONPayload object on a
+	// line of its own (newline-delimited JSON). The version of the schema
+	// is included in every object.
+	FormatJSON = Format("json")
+)
@@ -0,0 +1,185 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Payloads of the 1.3 API are sent in frames. Each frame consists of a header
+// of FrameHeaderSize bytes followed by the data of the frame:
+//
+// - 2 bytes magic number, see frameMagic
+// - 1 byte frame format version, see FrameVersion
+// - 1 byte compression algorithm of the data, see frameCompression
+// - 4 bytes length of the data
+// - 4 bytes CRC-32 (IEEE) checksum of the data
+//
+// All fields are in network byte order. The data of each frame is compressed
+// on its own, so that frames can be decoded independently of each other. A
+// reader which encounters an invalid header or a checksum mismatch skips a
+// single byte and searches for the next valid frame, so a corrupt frame never
+// desynchronizes the stream.
+
+const (
+	// FrameHeaderSize is the size of the header of a frame in bytes
+	FrameHeaderSize = 12
+
+	// FrameVersion is the version of the frame format
+	FrameVersion = 1
+
+	// MaxFrameSize is the maximum size of the data of a frame in bytes,
+	// both before and after decompression
+	MaxFrameSize = 1024 * 1024
+
+	// frameMagic marks the start of a frame
+	frameMagic = 0xc1f7
+)
+
+// frameCompression maps compression algorithms to their identifier in the
+// frame header
+var frameCompression = map[Compression]byte{
+	CompressionNone:   0,
+	CompressionGzip:   1,
+	CompressionSnappy: 2,
+}
+
+// frameCompressionByID returns the compression algorithm identified by id in
+// a frame header
+func frameCompressionByID(id byte) (Compression, bool) {
+	for c, cid := range frameCompression {
+		if cid == id {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// WriteFrame writes data as a single frame to w. The data is compressed with
+// the compression algorithm c at the given level, unless compression does not
+// make the data any smaller.
+func WriteFrame(w io.Writer, data []byte, c Compression, level int) error {
+	if len(data) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds maximum size of %d bytes", len(data), MaxFrameSize)
+	}
+
+	if c == "" {
+		c = CompressionNone
+	}
+	id, ok := frameCompression[c]
+	if !ok {
+		return fmt.Errorf("unsupported compression algorithm %q", c)
+	}
+	if c != CompressionNone {
+		compressed, err := compress(data, c, level)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+		} else {
+			id = frameCompression[CompressionNone]
+		}
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf[0:2], frameMagic)
+	buf[2] = FrameVersion
+	buf[3] = id
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[8:12], crc32.ChecksumIEEE(data))
+	copy(buf[FrameHeaderSize:], data)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// FrameReader reads frames written by WriteFrame, skipping corrupt frames
+type FrameReader struct {
+	r *bufio.Reader
+
+	// skipped is the number of bytes skipped to resynchronize on a frame
+	skipped uint64
+}
+
+// NewFrameReader returns a FrameReader reading frames from r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReaderSize(r, FrameHeaderSize+MaxFrameSize)}
+}
+
+// Skipped returns the number of bytes skipped so far because they were not
+// part of a valid frame, e.g. to tell that corrupt frames have been dropped
+func (fr *FrameReader) Skipped() uint64 {
+	return fr.skipped
+}
+
+// peek returns the next n bytes without consuming them. io.EOF is only
+// returned if the stream ended on a frame boundary.
+func (fr *FrameReader) peek(n int) ([]byte, error) {
+	buf, err := fr.r.Peek(n)
+	if err == io.EOF && len(buf) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf, err
+}
+
+// ReadFrame returns the decompressed data of the next valid frame. The
+// returned slice is only valid until the next call of ReadFrame. Frames whose
+// data cannot be decompressed are skipped.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	for {
+		hdr, err := fr.peek(FrameHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+
+		size := int(binary.BigEndian.Uint32(hdr[4:8]))
+		compression, ok := frameCompressionByID(hdr[3])
+		if binary.BigEndian.Uint16(hdr[0:2]) != frameMagic || hdr[2] != FrameVersion ||
+			!ok || size > MaxFrameSize {
+			fr.r.Discard(1)
+			fr.skipped++
+			continue
+		}
+		sum := binary.BigEndian.Uint32(hdr[8:12])
+
+		frame, err := fr.peek(FrameHeaderSize + size)
+		if err != nil {
+			return nil, err
+		}
+
+		data := frame[FrameHeaderSize:]
+		if crc32.ChecksumIEEE(data) != sum {
+			fr.r.Discard(1)
+			fr.skipped++
+			continue
+		}
+
+		// Discarding the frame does not invalidate data, the buffer is
+		// only overwritten by subsequent reads.
+		fr.r.Discard(len(frame))
+
+		data, err = decompress(data, compression, MaxFrameSize)
+		if err != nil {
+			fr.skipped += uint64(len(frame))
+			continue
+		}
+		return data, nil
+	}
+}
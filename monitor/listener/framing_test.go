@@ -0,0 +1,93 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"bytes"
+	"io"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *ListenerSuite) TestFraming(c *C) {
+	var buf bytes.Buffer
+	c.Assert(WriteFrame(&buf, []byte("foo"), CompressionNone, 0), IsNil)
+	c.Assert(WriteFrame(&buf, []byte{}, CompressionNone, 0), IsNil)
+	c.Assert(WriteFrame(&buf, []byte("bar"), CompressionNone, 0), IsNil)
+	c.Assert(WriteFrame(&buf, make([]byte, MaxFrameSize+1), CompressionNone, 0), Not(IsNil))
+
+	fr := NewFrameReader(&buf)
+	for _, expected := range []string{"foo", "", "bar"} {
+		data, err := fr.ReadFrame()
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+	_, err := fr.ReadFrame()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(fr.Skipped(), Equals, uint64(0))
+}
+
+func (s *ListenerSuite) TestFramingResync(c *C) {
+	var buf bytes.Buffer
+	c.Assert(WriteFrame(&buf, []byte("foo"), CompressionNone, 0), IsNil)
+	frameSize := buf.Len()
+
+	// A reader connecting mid-frame sees the tail of a frame
+	var stream bytes.Buffer
+	stream.Write(buf.Bytes()[5:])
+
+	// A frame with corrupt data
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[FrameHeaderSize] ^= 0xff
+	stream.Write(corrupt)
+
+	c.Assert(WriteFrame(&stream, []byte("bar"), CompressionNone, 0), IsNil)
+
+	// A truncated frame at the end of the stream
+	stream.Write(buf.Bytes()[:FrameHeaderSize+1])
+
+	fr := NewFrameReader(&stream)
+	data, err := fr.ReadFrame()
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "bar")
+	c.Assert(fr.Skipped(), Equals, uint64(frameSize-5+frameSize))
+
+	_, err = fr.ReadFrame()
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func (s *ListenerSuite) TestFramingCompression(c *C) {
+	data := bytes.Repeat([]byte("cilium"), 1000)
+
+	for _, comp := range []Compression{CompressionGzip, CompressionSnappy} {
+		var buf bytes.Buffer
+		c.Assert(WriteFrame(&buf, data, comp, 0), IsNil)
+		c.Assert(buf.Len() < len(data), Equals, true)
+
+		// Data which does not compress is sent uncompressed
+		c.Assert(WriteFrame(&buf, []byte("x"), comp, 0), IsNil)
+
+		fr := NewFrameReader(&buf)
+		frame, err := fr.ReadFrame()
+		c.Assert(err, IsNil)
+		c.Assert(frame, DeepEquals, data)
+		frame, err = fr.ReadFrame()
+		c.Assert(err, IsNil)
+		c.Assert(string(frame), Equals, "x")
+	}
+
+	var buf bytes.Buffer
+	c.Assert(WriteFrame(&buf, data, "zstd", 0), Not(IsNil))
+}
@@ -0,0 +1,396 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The handshake is performed by clients connecting to the handshake socket of
+// the node monitor before any payload is sent. It consists of three messages:
+//
+// 1. The server sends its Capabilities.
+// 2. The client sends the State it requests, selected from the capabilities.
+// 3. The server sends a HandshakeResponse carrying the effective State of the
+//    listener, or an error after which the server closes the connection.
+//
+// Each message is a JSON object prefixed with its length in bytes as a 32 bit
+// unsigned integer in network byte order. Unknown fields must be ignored by
+// both sides so that fields can be added without breaking older peers. After
+// a successful handshake, payloads are sent as defined by the negotiated
+// Version. Clients may then send control messages, see ControlMessage.
+
+const (
+	// HandshakeVersion is the version of the handshake format. It is
+	// incremented on incompatible changes of the handshake.
+	HandshakeVersion = 1
+
+	// maxHandshakeMessageSize is the maximum size of a handshake message
+	maxHandshakeMessageSize = 64 * 1024
+)
+
+// Capabilities are the features supported by a node monitor server
+type Capabilities struct {
+	// HandshakeVersion is the version of the handshake format
+	HandshakeVersion int `json:"handshake-version"`
+
+	// Versions are the API versions supported by the server, ordered from
+	// the lowest to the highest version
+	Versions []Version `json:"versions"`
+
+	// Compression are the compression algorithms supported by the server
+	Compression []Compression `json:"compression,omitempty"`
+
+	// Formats are the message formats supported by the server in addition
+	// to FormatBinary
+	Formats []Format `json:"formats,omitempty"`
+
+	// Control are the control messages accepted by the server after the
+	// handshake, see ControlMessage
+	Control []ControlType `json:"control,omitempty"`
+
+	// MessageTypeFilter is true if the server only sends the message types
+	// requested in State.MessageTypes to the client. Older servers send
+	// all message types.
+	MessageTypeFilter bool `json:"message-type-filter,omitempty"`
+
+	// Resume is true if the server reports the number of events missed
+	// since the State.Seq requested by a reconnecting client. Version1_2
+	// listeners do not support resuming.
+	Resume bool `json:"resume,omitempty"`
+
+	// Keepalive is true if the server sends keepalive payloads to clients
+	// requesting a State.KeepaliveInterval
+	Keepalive bool `json:"keepalive,omitempty"`
+
+	// EndpointFilter is true if the server only sends the events of the
+	// endpoints and identities requested in State.Endpoints and
+	// State.Identities to the client
+	EndpointFilter bool `json:"endpoint-filter,omitempty"`
+}
+
+// HandshakeResponse is the final message of the handshake sent by the server
+type HandshakeResponse struct {
+	// State is the effective state of the listener
+	State State `json:"state"`
+
+	// Error is set if the server rejected the requested state
+	Error string `json:"error,omitempty"`
+}
+
+func (c Capabilities) supportsVersion(version Version) bool {
+	for _, v := range c.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) supportsCompression(compression Compression) bool {
+	if compression == CompressionNone {
+		return true
+	}
+	for _, comp := range c.Compression {
+		if comp == compression {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Capabilities) supportsFormat(format Format) bool {
+	if format == FormatBinary {
+		return true
+	}
+	for _, f := range c.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// highestCommonVersion returns the highest version supported by the server
+// which is contained in versions, or VersionUnsupported if there is none
+func (c Capabilities) highestCommonVersion(versions []Version) Version {
+	for i := len(c.Versions) - 1; i >= 0; i-- {
+		for _, v := range versions {
+			if v == c.Versions[i] {
+				return v
+			}
+		}
+	}
+	return VersionUnsupported
+}
+
+// versionSupportsCompression returns true if listeners of the given version
+// can compress the messages sent to the client
+func versionSupportsCompression(version Version) bool {
+	return version == Version1_0 || version == Version1_3
+}
+
+// versionSupportsResume returns true if listeners of the given version
+// report the events missed since the Seq requested by a reconnecting client
+func versionSupportsResume(version Version) bool {
+	return version == Version1_0 || version == Version1_3
+}
+
+// versionSupportsFormat returns true if listeners of the given version can
+// send messages in the given format
+func versionSupportsFormat(version Version, format Format) bool {
+	return format == FormatBinary || version == Version1_0
+}
+
+// MaxNameLength is the maximum length in bytes of the name of a client
+// requested in the handshake, see State.Name
+const MaxNameLength = 128
+
+// Select returns the effective state of a listener for the state requested by
+// a client. Settings not requested by the client are taken from defaults. A
+// client may lower, but not raise, the maximum message size configured in
+// defaults. If the client does not request a specific version, the highest
+// version supported by both the server and the client is selected.
+//
+// Payloads are only enqueued with an EnqueueTimeout if the client requests
+// it, the timeout is bounded by the EnqueueTimeout of defaults. Keepalives
+// are only sent if requested by the client.
+//
+// The Seq of defaults is the sequence number of the last event sample emitted
+// by the server. If the client requests to resume from an earlier Seq, the
+// number of event samples emitted since is returned in Missed. A request to
+// resume is rejected if the selected version does not support it, unless the
+// version has been selected by the server, in which case Missed is 0.
+//
+// Messages are only compressed if the client requests it, the compression of
+// defaults is ignored. If the selected version does not support compression,
+// a request for compression is rejected, unless the version has been selected
+// by the server, in which case messages are sent uncompressed.
+//
+// Messages are sent in FormatBinary unless the client requests another
+// format, which is rejected if it is not supported by the selected version.
+func (c Capabilities) Select(request, defaults State) (State, error) {
+	state := defaults
+	state.Version = request.Version
+	negotiated := false
+	if state.Version == "" && len(request.Versions) > 0 {
+		negotiated = true
+		state.Version = c.highestCommonVersion(request.Versions)
+		if state.Version == VersionUnsupported {
+			return State{}, fmt.Errorf("no common version, client supports %v", request.Versions)
+		}
+	}
+	if !c.supportsVersion(state.Version) {
+		return State{}, fmt.Errorf("unsupported version %q", state.Version)
+	}
+
+	for _, typ := range request.MessageTypes {
+		if typ < 0 || typ > 255 {
+			return State{}, fmt.Errorf("invalid message type %d", typ)
+		}
+	}
+	state.MessageTypes = request.MessageTypes
+	state.Endpoints, state.Identities = request.Endpoints, request.Identities
+
+	if len(request.Name) > MaxNameLength {
+		return State{}, fmt.Errorf("name exceeds %d bytes", MaxNameLength)
+	}
+	state.Name = request.Name
+
+	state.Missed = 0
+	if request.Seq > 0 && !versionSupportsResume(state.Version) {
+		if !negotiated {
+			return State{}, fmt.Errorf("resuming is not supported by version %q", state.Version)
+		}
+	} else if request.Seq > 0 && request.Seq <= defaults.Seq {
+		state.Missed = defaults.Seq - request.Seq
+	}
+
+	if request.MaxMessageSize > 0 &&
+		(defaults.MaxMessageSize == 0 || request.MaxMessageSize < defaults.MaxMessageSize) {
+		state.MaxMessageSize = request.MaxMessageSize
+	}
+
+	state.EnqueueTimeout = 0
+	if request.EnqueueTimeout > 0 {
+		state.EnqueueTimeout = request.EnqueueTimeout
+		if state.EnqueueTimeout > defaults.EnqueueTimeout {
+			state.EnqueueTimeout = defaults.EnqueueTimeout
+		}
+	}
+
+	state.KeepaliveInterval = 0
+	if request.KeepaliveInterval > 0 {
+		state.KeepaliveInterval = request.KeepaliveInterval
+		if state.KeepaliveInterval < MinKeepaliveInterval {
+			state.KeepaliveInterval = MinKeepaliveInterval
+		}
+	}
+
+	state.Compression, state.CompressionLevel = CompressionNone, 0
+	if request.Compression != "" {
+		state.Compression, state.CompressionLevel = request.Compression, request.CompressionLevel
+	}
+	if state.Compression != CompressionNone && !versionSupportsCompression(state.Version) {
+		if !negotiated {
+			return State{}, fmt.Errorf("compression is not supported by version %q", state.Version)
+		}
+		state.Compression, state.CompressionLevel = CompressionNone, 0
+	}
+	if !c.supportsCompression(state.Compression) {
+		return State{}, fmt.Errorf("unsupported compression algorithm %q", state.Compression)
+	}
+	if err := ValidateCompressionLevel(state.Compression, state.CompressionLevel); err != nil {
+		return State{}, err
+	}
+
+	state.Format = request.Format
+	if state.Format != "" && !c.supportsFormat(state.Format) {
+		return State{}, fmt.Errorf("unsupported message format %q", state.Format)
+	}
+	if state.Format != "" && !versionSupportsFormat(state.Version, state.Format) {
+		return State{}, fmt.Errorf("message format %q is not supported by version %q", state.Format, state.Version)
+	}
+
+	return state, nil
+}
+
+// writeHandshakeMessage writes msg as a length prefixed JSON object
+func writeHandshakeMessage(w io.Writer, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(buf)))
+	_, err = w.Write(append(hdr, buf...))
+	return err
+}
+
+// readHandshakeMessage reads a length prefixed JSON object into msg
+func readHandshakeMessage(r io.Reader, msg interface{}) error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(hdr)
+	if size > maxHandshakeMessageSize {
+		return fmt.Errorf("handshake message of %d bytes exceeds maximum size", size)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, msg)
+}
+
+// ServerHandshake performs the server side of the handshake on rw. It
+// advertises caps, and returns the state selected for the client with
+// defaults applied, see Capabilities.Select().
+func ServerHandshake(rw io.ReadWriter, caps Capabilities, defaults State) (State, error) {
+	if err := writeHandshakeMessage(rw, caps); err != nil {
+		return State{}, fmt.Errorf("unable to send capabilities: %s", err)
+	}
+
+	var request State
+	if err := readHandshakeMessage(rw, &request); err != nil {
+		return State{}, fmt.Errorf("unable to read requested state: %s", err)
+	}
+
+	state, selectErr := caps.Select(request, defaults)
+	resp := HandshakeResponse{State: state}
+	if selectErr != nil {
+		resp.Error = selectErr.Error()
+	}
+	if err := writeHandshakeMessage(rw, resp); err != nil {
+		return State{}, fmt.Errorf("unable to send handshake response: %s", err)
+	}
+
+	return state, selectErr
+}
+
+// ClientHandshake performs the client side of the handshake on rw. The
+// requested state is chosen by selectFn based on the capabilities advertised
+// by the server. It returns the effective state of the listener.
+func ClientHandshake(rw io.ReadWriter, selectFn func(Capabilities) (State, error)) (State, error) {
+	var caps Capabilities
+	if err := readHandshakeMessage(rw, &caps); err != nil {
+		return State{}, fmt.Errorf("unable to read capabilities: %s", err)
+	}
+	if caps.HandshakeVersion != HandshakeVersion {
+		return State{}, fmt.Errorf("unsupported handshake version %d", caps.HandshakeVersion)
+	}
+
+	request, err := selectFn(caps)
+	if err != nil {
+		return State{}, err
+	}
+	if err := writeHandshakeMessage(rw, request); err != nil {
+		return State{}, fmt.Errorf("unable to send requested state: %s", err)
+	}
+
+	var resp HandshakeResponse
+	if err := readHandshakeMessage(rw, &resp); err != nil {
+		return State{}, fmt.Errorf("unable to read handshake response: %s", err)
+	}
+	if resp.Error != "" {
+		return State{}, fmt.Errorf("handshake rejected by server: %s", resp.Error)
+	}
+
+	return resp.State, nil
+}
+
+// SelectHighestVersion returns a selectFn for ClientHandshake which requests
+// the first version in preferred which is supported by the server, with the
+// server's default settings.
+func SelectHighestVersion(preferred ...Version) func(Capabilities) (State, error) {
+	return func(caps Capabilities) (State, error) {
+		for _, v := range preferred {
+			if caps.supportsVersion(v) {
+				return State{Version: v}, nil
+			}
+		}
+		return State{}, fmt.Errorf("no common version, server supports %v", caps.Versions)
+	}
+}
+
+// OfferVersions returns a selectFn for ClientHandshake which lets the server
+// select the highest version supported by both sides out of versions, with
+// the server's default settings.
+func OfferVersions(versions ...Version) func(Capabilities) (State, error) {
+	return OfferVersionsWithCompression("", 0, versions...)
+}
+
+// OfferVersionsWithCompression is like OfferVersions, but additionally
+// requests messages to be compressed with the compression algorithm c at the
+// given level. Messages are sent uncompressed if the server does not support
+// c or the selected version does not support compression. An empty c selects
+// the server's default compression.
+func OfferVersionsWithCompression(c Compression, level int, versions ...Version) func(Capabilities) (State, error) {
+	return func(caps Capabilities) (State, error) {
+		request := State{Versions: versions}
+		if c != "" && caps.supportsCompression(c) {
+			request.Compression, request.CompressionLevel = c, level
+		}
+		return request, nil
+	}
+}
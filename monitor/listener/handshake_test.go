@@ -0,0 +1,282 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package listener
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var testCapabilities = Capabilities{
+	HandshakeVersion: HandshakeVersion,
+	Versions:         []Version{Version1_0, Version1_2, Version1_3},
+	Compression:      []Compression{CompressionGzip},
+	Formats:          []Format{FormatJSON},
+}
+
+// handshake runs the server and client side of the handshake over a pipe
+func handshake(defaults State, selectFn func(Capabilities) (State, error)) (server, client State, serverErr, clientErr error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server, serverErr = ServerHandshake(serverConn, testCapabilities, defaults)
+		close(done)
+	}()
+	client, clientErr = ClientHandshake(clientConn, selectFn)
+	<-done
+
+	return
+}
+
+func (s *ListenerSuite) TestHandshake(c *C) {
+	defaults := State{MaxMessageSize: 1024}
+
+	server, client, serverErr, clientErr := handshake(defaults, SelectHighestVersion("2.0", Version1_2))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client, DeepEquals, server)
+	c.Assert(client, DeepEquals, State{
+		Version:        Version1_2,
+		MaxMessageSize: 1024,
+		Compression:    CompressionNone,
+	})
+
+	server, client, serverErr, clientErr = handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: Version1_0, MaxMessageSize: 512, Compression: CompressionGzip, CompressionLevel: 9}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client, DeepEquals, server)
+	c.Assert(client, DeepEquals, State{
+		Version:          Version1_0,
+		MaxMessageSize:   512,
+		Compression:      CompressionGzip,
+		CompressionLevel: 9,
+	})
+
+	// Requests which are not supported by the server are rejected
+	_, _, serverErr, clientErr = handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: Version1_2, Compression: CompressionGzip}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+
+	_, _, serverErr, clientErr = handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: "2.0"}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+}
+
+func (s *ListenerSuite) TestHandshakeNegotiateVersion(c *C) {
+	defaults := State{MaxMessageSize: 1024}
+
+	// The server selects the highest version supported by both sides
+	server, client, serverErr, clientErr := handshake(defaults, OfferVersions(Version1_0, Version1_2, "2.0"))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client, DeepEquals, server)
+	c.Assert(client.Version, Equals, Version1_2)
+	c.Assert(client.Versions, IsNil)
+
+	server, client, serverErr, clientErr = handshake(defaults, OfferVersions(Version1_3, Version1_0, Version1_2))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Version, Equals, Version1_3)
+
+	_, _, serverErr, clientErr = handshake(defaults, OfferVersions("2.0"))
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+}
+
+func (s *ListenerSuite) TestHandshakeNegotiateCompression(c *C) {
+	defaults := State{Compression: CompressionGzip}
+
+	// Clients which do not request compression never get it, whatever
+	// the defaults of the server
+	_, client, serverErr, clientErr := handshake(defaults, OfferVersions(Version1_3))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Compression, Equals, CompressionNone)
+
+	_, client, serverErr, clientErr = handshake(defaults, OfferVersions(Version1_0))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Compression, Equals, CompressionNone)
+
+	_, client, serverErr, clientErr = handshake(defaults, OfferVersionsWithCompression(CompressionGzip, 9, Version1_3))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Compression, Equals, CompressionGzip)
+	c.Assert(client.CompressionLevel, Equals, 9)
+
+	// Compression degrades to none if not supported by the server or by
+	// the selected version
+	_, client, serverErr, clientErr = handshake(defaults, OfferVersionsWithCompression(CompressionSnappy, 0, Version1_3))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Compression, Equals, CompressionNone)
+
+	_, client, serverErr, clientErr = handshake(defaults, OfferVersionsWithCompression(CompressionGzip, 0, Version1_2))
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Version, Equals, Version1_2)
+	c.Assert(client.Compression, Equals, CompressionNone)
+}
+
+func (s *ListenerSuite) TestHandshakeMessageTypes(c *C) {
+	_, client, serverErr, clientErr := handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_2, MessageTypes: []int{1, 4}}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.MessageTypes, DeepEquals, []int{1, 4})
+
+	_, _, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_2, MessageTypes: []int{256}}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+}
+
+func (s *ListenerSuite) TestHandshakeName(c *C) {
+	_, client, serverErr, clientErr := handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, Name: "hubble"}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Name, Equals, "hubble")
+
+	_, _, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, Name: strings.Repeat("a", MaxNameLength+1)}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+}
+
+func (s *ListenerSuite) TestHandshakeEnqueueTimeout(c *C) {
+	defaults := State{EnqueueTimeout: time.Second}
+
+	// Clients have to opt in to waiting for their queue
+	_, client, serverErr, clientErr := handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: Version1_3}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.EnqueueTimeout, Equals, time.Duration(0))
+
+	_, client, serverErr, clientErr = handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, EnqueueTimeout: 100 * time.Millisecond}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.EnqueueTimeout, Equals, 100*time.Millisecond)
+
+	// The timeout is bounded by the server
+	_, client, serverErr, clientErr = handshake(defaults, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, EnqueueTimeout: time.Minute}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.EnqueueTimeout, Equals, time.Second)
+}
+
+func (s *ListenerSuite) TestHandshakeKeepalive(c *C) {
+	_, client, serverErr, clientErr := handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_0, KeepaliveInterval: 30 * time.Second}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.KeepaliveInterval, Equals, 30*time.Second)
+
+	// Short intervals are raised to the minimum
+	_, client, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_0, KeepaliveInterval: time.Millisecond}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.KeepaliveInterval, Equals, MinKeepaliveInterval)
+
+	// All API versions support keepalives
+	_, client, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, KeepaliveInterval: 30 * time.Second}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.KeepaliveInterval, Equals, 30*time.Second)
+}
+
+func (s *ListenerSuite) TestHandshakeResume(c *C) {
+	_, client, serverErr, clientErr := handshake(State{Seq: 100}, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, Seq: 90}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Seq, Equals, uint64(100))
+	c.Assert(client.Missed, Equals, uint64(10))
+
+	// The number of missed events is unknown if the cursor is ahead of
+	// the server
+	_, client, serverErr, clientErr = handshake(State{Seq: 5}, func(Capabilities) (State, error) {
+		return State{Version: Version1_3, Seq: 90}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Missed, Equals, uint64(0))
+
+	// Version1_2 listeners cannot resume, a request to resume is rejected
+	// unless the server selected the version
+	_, _, serverErr, clientErr = handshake(State{Seq: 100}, func(Capabilities) (State, error) {
+		return State{Version: Version1_2, Seq: 90}, nil
+	})
+	c.Assert(serverErr, ErrorMatches, "resuming is not supported by version .*")
+	c.Assert(clientErr, Not(IsNil))
+
+	_, client, serverErr, clientErr = handshake(State{Seq: 100}, func(Capabilities) (State, error) {
+		return State{Versions: []Version{Version1_2}, Seq: 90}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Version, Equals, Version1_2)
+	c.Assert(client.Missed, Equals, uint64(0))
+}
+
+func (s *ListenerSuite) TestHandshakeFormat(c *C) {
+	_, client, serverErr, clientErr := handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_0, Format: FormatJSON}, nil
+	})
+	c.Assert(serverErr, IsNil)
+	c.Assert(clientErr, IsNil)
+	c.Assert(client.Format, Equals, FormatJSON)
+
+	// Only the 1.0 API supports other formats
+	_, _, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_2, Format: FormatJSON}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+
+	_, _, serverErr, clientErr = handshake(State{}, func(Capabilities) (State, error) {
+		return State{Version: Version1_0, Format: "xml"}, nil
+	})
+	c.Assert(serverErr, Not(IsNil))
+	c.Assert(clientErr, Not(IsNil))
+}
@@ -18,17 +18,22 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/cilium/cilium/monitor/payload"
 )
 
 // Version is the version of a node-monitor listener client. There are
-// two API versions:
+// three API versions:
 // - 1.0 which encodes the gob type information with each payload sent, and
 //   adds a meta object before it.
 // - 1.2 which maintains a gob session per listener, thus only encoding the
 //   type information on the first payload sent. It does NOT prepend the a meta
 //   object.
+// - 1.3 which encodes each payload with its gob type information into a frame
+//   with a fixed-size header, see WriteFrame(). Clients can skip corrupt
+//   frames and resynchronize on the next header. Only available via the
+//   handshake.
 type Version string
 
 const (
@@ -40,8 +45,15 @@ const (
 
 	// Version1_2 is the API 1.0 version of the protocol (see above).
 	Version1_2 = Version("1.2")
+
+	// Version1_3 is the API 1.3 version of the protocol (see above).
+	Version1_3 = Version("1.3")
 )
 
+// MinKeepaliveInterval is the minimum State.KeepaliveInterval, shorter
+// intervals requested by clients are raised to it
+const MinKeepaliveInterval = time.Second
+
 // MonitorListener is a generic consumer of monitor events. Implementers are
 // expected to handle errors as needed, including exiting.
 type MonitorListener interface {
@@ -51,6 +63,117 @@ type MonitorListener interface {
 
 	// Version returns the API version of this listener
 	Version() Version
+
+	// State returns the effective configuration of this listener
+	State() State
+
+	// Dropped returns the number of payloads dropped because the queue of
+	// the listener was full
+	Dropped() uint64
+
+	// Close stops the listener. Payloads which have already been enqueued
+	// are still sent before the connection is closed. Enqueue must not be
+	// called after Close.
+	Close()
+}
+
+// State is the essential state of a listener, i.e. the configuration a
+// listener is created with.
+type State struct {
+	// Version is the API version negotiated with the client
+	Version Version `json:"version"`
+
+	// Name is a human-readable name of the client, e.g. the name of the
+	// consuming program, which identifies the listener in log messages.
+	// The remote address of the connection is used if it is empty.
+	Name string `json:"name,omitempty"`
+
+	// Versions are the API versions supported by the client. It is only
+	// set in handshake requests which leave Version empty to let the
+	// server select the highest version supported by both sides.
+	Versions []Version `json:"versions,omitempty"`
+
+	// MaxMessageSize is the maximum size of a message sent to the client,
+	// 0 if unlimited
+	MaxMessageSize int `json:"max-message-size,omitempty"`
+
+	// MaxQueueSize is the maximum number of payloads the queue of the
+	// listener grows to before payloads are dropped, the queue has a fixed
+	// size if it is not larger than the initial size of the queue. It is
+	// configured by the server and cannot be requested by clients.
+	MaxQueueSize int `json:"max-queue-size,omitempty"`
+
+	// RateLimit is the maximum number of payloads per second enqueued to
+	// the listener, payloads exceeding it are dropped. RateLimitBurst is
+	// the number of payloads which may be enqueued at once, 0 allows
+	// bursts of RateLimit payloads. The rate is unlimited if RateLimit is
+	// 0. Both are configured by the server and cannot be requested by
+	// clients.
+	RateLimit      int `json:"rate-limit,omitempty"`
+	RateLimitBurst int `json:"rate-limit-burst,omitempty"`
+
+	// EnqueueTimeout is the maximum duration a payload waits for the full
+	// queue of the listener to make room before a payload is dropped, 0
+	// drops payloads right away. Payloads waiting for room are held in a
+	// second queue of the listener so that other listeners are not
+	// delayed. The server configures the maximum EnqueueTimeout and
+	// clients opt in by requesting a timeout up to this maximum in the
+	// handshake.
+	EnqueueTimeout time.Duration `json:"enqueue-timeout,omitempty"`
+
+	// KeepaliveInterval, if not 0, is the interval after which a
+	// payload.Keepalive payload is sent to an idle client, so that the
+	// client can tell an idle node monitor from a hung connection and the
+	// node monitor detects dead clients. It is at least
+	// MinKeepaliveInterval.
+	KeepaliveInterval time.Duration `json:"keepalive-interval,omitempty"`
+
+	// Compression is the compression algorithm applied to the stream of
+	// messages sent to the client, or to each frame sent to the client for
+	// API version 1.3. Not supported by API version 1.2.
+	Compression Compression `json:"compression,omitempty"`
+
+	// CompressionLevel is the level of Compression, 0 selects the default
+	// level of the algorithm
+	CompressionLevel int `json:"compression-level,omitempty"`
+
+	// Format is the encoding of the messages sent to the client, empty
+	// selects FormatBinary. Only API version 1.0 supports other formats.
+	Format Format `json:"format,omitempty"`
+
+	// AllowedUIDs are the UIDs of the local processes allowed to connect
+	// to a listener of any version via a Unix socket, as reported by the
+	// peer credentials of the connection. All processes are allowed if empty.
+	// It is configured by the server and cannot be requested by clients.
+	AllowedUIDs []uint32 `json:"allowed-uids,omitempty"`
+
+	// MessageTypes is the allow-list of the message types of the event
+	// samples sent to the client, see pkg/monitor. Other payloads, e.g.
+	// records of lost events, are always sent. All message types are sent
+	// if empty.
+	MessageTypes []int `json:"message-types,omitempty"`
+
+	// Endpoints and Identities restrict the event samples of the datapath
+	// sent to the client to the events of the given endpoint IDs and
+	// security identities, in either direction. Event samples which do not
+	// carry an endpoint are always sent. All event samples are sent if both
+	// are empty. The filter can be replaced with ControlFilter.
+	Endpoints  []uint16 `json:"endpoints,omitempty"`
+	Identities []uint32 `json:"identities,omitempty"`
+
+	// Seq is the sequence number of the last event sample sent to the
+	// client, see payload.Payload. A reconnecting client sets it in its
+	// handshake request to the sequence number of the last event sample
+	// it received, to resume the event stream from this cursor.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Missed is the number of event samples emitted by the server since
+	// the Seq requested by a reconnecting client, i.e. the number of
+	// events the client missed while it was disconnected. Missed events
+	// are not replayed. It is 0 if unknown, e.g. because the node monitor
+	// has been restarted since. Events of the perf ring buffer are only
+	// counted while at least one listener is connected.
+	Missed uint64 `json:"missed,omitempty"`
 }
 
 // IsDisconnected is a convenience function that wraps the absurdly long set of
@@ -73,3 +196,10 @@ func IsDisconnected(err error) bool {
 	errn := syscerr.Err.(syscall.Errno)
 	return errn == syscall.EPIPE
 }
+
+// IsTimeout returns true if err is caused by a timeout, e.g. a write deadline
+// expiring because the client does not read its messages.
+func IsTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -15,26 +15,120 @@
 package main
 
 import (
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cilium/cilium/monitor/listener"
 	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
 )
 
 // listenerv1_0 implements the ciliim-node-monitor API protocol compatible with
 // cilium 1.0
 // cleanupFn is called on exit
 type listenerv1_0 struct {
-	conn      net.Conn
-	queue     chan *payload.Payload
+	*listenerConn
+	listenerPause
+
+	queue     *payloadQueue
 	cleanupFn func(listener.MonitorListener)
+	metrics   *listenerMetrics
+
+	// messageTypes are the message types requested by the client,
+	// payloads of other message types are filtered out by filter on
+	// Enqueue, see payloadFilter
+	messageTypes []int
+	filter       *payloadFilter
+
+	// endpointFilter filters out the events of other endpoints on Enqueue
+	endpointFilter *endpointFilter
+
+	// limiter drops payloads exceeding the rate limit of the listener
+	// state on Enqueue, see rateLimiter
+	limiter *rateLimiter
+
+	// maxMessageSize is the maximum size in bytes of a message sent to the
+	// listener, larger messages are dropped. A value of 0 disables the
+	// limit.
+	maxMessageSize int
+
+	// compression and compressionLevel select how the stream of messages
+	// is compressed before it is written to conn
+	compression      listener.Compression
+	compressionLevel int
+
+	// format is the encoding of the messages, see buildMessage()
+	format listener.Format
+
+	// allowedUIDs are the UIDs of the processes allowed to connect, see
+	// authorizePeer()
+	allowedUIDs []uint32
+
+	// enqueueTimeout is the maximum duration a payload waits for room in
+	// the full queue before it is dropped, see newWaitingQueue()
+	enqueueTimeout time.Duration
+
+	// input is the queue Enqueue adds payloads to. It is queue itself, or
+	// a waiting queue feeding queue if enqueueTimeout is not 0.
+	input *payloadQueue
+
+	// closeOnce guards closing input
+	closeOnce sync.Once
+
+	// oversizeDrops is the number of messages dropped because they
+	// exceeded maxMessageSize. It must be accessed atomically.
+	oversizeDrops uint64
+
+	// seq is the sequence number of the last event sample sent to the
+	// client, see payload.Payload. It is set by drainQueue just before
+	// the event sample is sent and must be accessed atomically.
+	seq uint64
+
+	// unreportedDrops is the number of payloads dropped because the queue
+	// was full or they exceeded the rate limit or maxMessageSize which
+	// have not been reported to the client yet, see reportDrops(). The events missed by
+	// a reconnecting client, see listener.State, are accounted here as
+	// well. It must be accessed atomically.
+	unreportedDrops uint64
 }
 
-func newListenerv1_0(c net.Conn, queueSize int, cleanupFn func(listener.MonitorListener)) *listenerv1_0 {
+// newListenerv1_0 returns a listener sending payloads on c
+func newListenerv1_0(c net.Conn, queueSize int, writeTimeout time.Duration, state listener.State, cleanupFn func(listener.MonitorListener)) *listenerv1_0 {
 	ml := &listenerv1_0{
-		conn:      c,
-		queue:     make(chan *payload.Payload, queueSize),
-		cleanupFn: cleanupFn,
+		listenerConn:     newListenerConn(c, writeTimeout, state),
+		queue:            newPayloadQueue(queueSize, state.MaxQueueSize),
+		cleanupFn:        cleanupFn,
+		messageTypes:     state.MessageTypes,
+		filter:           newPayloadFilter(state.MessageTypes),
+		endpointFilter:   newEndpointFilter(state.Endpoints, state.Identities),
+		limiter:          newRateLimiter(state.RateLimit, state.RateLimitBurst),
+		maxMessageSize:   state.MaxMessageSize,
+		compression:      state.Compression,
+		compressionLevel: state.CompressionLevel,
+		format:           state.Format,
+		allowedUIDs:      state.AllowedUIDs,
+		enqueueTimeout:   state.EnqueueTimeout,
+		seq:              state.Seq,
+		unreportedDrops:  state.Missed,
+	}
+	if ml.compression == "" {
+		ml.compression = listener.CompressionNone
+	}
+	ml.metrics = newListenerMetrics(ml.queue)
+	ml.input = ml.queue
+	if ml.enqueueTimeout > 0 {
+		// A paused listener does not make room in its queue
+		ml.input = newWaitingQueue(ml.queue, queueSize, func() time.Duration {
+			if ml.Paused() {
+				return 0
+			}
+			return ml.enqueueTimeout
+		}, ml.queueFull)
 	}
 
 	go ml.drainQueue()
@@ -42,43 +136,206 @@ func newListenerv1_0(c net.Conn, queueSize int, cleanupFn func(listener.MonitorL
 	return ml
 }
 
+// Enqueue adds pl to the queue of the listener. Payloads of message types not
+// requested by the client and payloads enqueued after the listener has been
+// closed are ignored. Event samples exceeding the rate limit are dropped.
 func (ml *listenerv1_0) Enqueue(pl *payload.Payload) {
-	select {
-	case ml.queue <- pl:
-	default:
-		log.Debug("Per listener queue is full, dropping message")
+	if !ml.filter.allows(pl) || !ml.endpointFilter.allows(pl) || ml.input.Closed() {
+		return
+	}
+
+	if isLowPriority(pl) && !ml.limiter.allow() {
+		atomic.AddUint64(&ml.unreportedDrops, 1)
+		metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonRateLimited).Inc()
+		return
+	}
+
+	if !ml.input.Push(pl) {
+		ml.queueFull()
 	}
 }
 
+// queueFull accounts a payload dropped because the queue was full
+func (ml *listenerv1_0) queueFull() {
+	ml.metrics.dropped()
+	atomic.AddUint64(&ml.unreportedDrops, 1)
+	reason := metrics.LabelValueDropReasonQueueFull
+	if ml.Paused() {
+		reason = metrics.LabelValueDropReasonPaused
+	}
+	metrics.NodeMonitorDroppedMessages.WithLabelValues(reason).Inc()
+	ml.scopedLog.WithField("reason", reason).Debug("Per listener queue is full, dropping message")
+}
+
+// Dropped returns the number of payloads dropped because the queue of the
+// listener was full
+func (ml *listenerv1_0) Dropped() uint64 {
+	n := ml.queue.Dropped()
+	if ml.input != ml.queue {
+		n += ml.input.Dropped()
+	}
+	return n
+}
+
 // drainQueue encodes and sends monitor payloads to the listener. It is
 // intended to be a goroutine.
 func (ml *listenerv1_0) drainQueue() {
+	compressionMetric := metrics.NodeMonitorListeners.WithLabelValues(string(ml.compression))
+	compressionMetric.Inc()
+
 	defer func() {
-		ml.conn.Close()
-		ml.cleanupFn(ml)
+		compressionMetric.Dec()
+		ml.teardown()
 	}()
 
-	for pl := range ml.queue {
-		buf, err := pl.BuildMessage()
+	w, err := listener.NewCompressedWriter(ml.conn, ml.compression, ml.compressionLevel)
+	if err != nil {
+		ml.scopedLog.WithError(err).Error("Removing listener due to invalid compression")
+		return
+	}
+
+	for {
+		if resumed := ml.resumedChan(); resumed != nil {
+			// Flush what has been sent so far so that the client
+			// can inspect it while the listener is paused.
+			ml.setWriteDeadline()
+			if err := w.Flush(); err != nil {
+				ml.scopedLog.WithError(err).Debug("Removing listener due to write failure")
+				return
+			}
+			<-resumed
+		}
+
+		pl, ok := ml.nextPayload(ml.queue)
+		if !ok {
+			return
+		}
+
+		buf, err := ml.buildMessage(pl)
 		if err != nil {
-			log.WithError(err).Error("Unable to send notification to listeners")
+			ml.scopedLog.WithError(err).Error("Unable to send notification to listeners")
 			continue
 		}
 
-		if _, err := ml.conn.Write(buf); err != nil {
-			switch {
-			case listener.IsDisconnected(err):
-				log.Debug("Listener disconnected")
-				return
+		if ml.maxMessageSize > 0 && len(buf) > ml.maxMessageSize {
+			atomic.AddUint64(&ml.unreportedDrops, 1)
+			metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonOversize).Inc()
+			ml.scopedLog.WithFields(logrus.Fields{
+				"size":           len(buf),
+				"count.dropped":  atomic.AddUint64(&ml.oversizeDrops, 1),
+				"maxMessageSize": ml.maxMessageSize,
+			}).Debug("Message exceeds maximum message size, dropping message")
+			continue
+		}
 
-			default:
-				log.WithError(err).Warn("Removing listener due to write failure")
-				return
-			}
+		if pl.Seq > 0 {
+			atomic.StoreUint64(&ml.seq, pl.Seq)
 		}
+		ml.setWriteDeadline()
+		_, err = w.Write(buf)
+		if err == nil {
+			err = ml.reportDrops(w)
+		}
+		// Flush the compressed stream once the queue is empty so that
+		// bursts of messages are compressed together.
+		if err == nil && ml.queue.Len() == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			ml.writeFailed(err)
+			return
+		}
+	}
+}
+
+// buildMessage encodes pl in the message format of the listener
+func (ml *listenerv1_0) buildMessage(pl *payload.Payload) ([]byte, error) {
+	if ml.format == listener.FormatJSON {
+		return pl.BuildJSONMessage()
+	}
+	return pl.BuildMessage()
+}
+
+// teardown closes the connection and calls cleanupFn, see
+// listenerConn.teardown()
+func (ml *listenerv1_0) teardown() {
+	ml.listenerConn.teardown(func() {
+		// Stop the goroutine waiting for room in the queue, if any
+		ml.input.Close()
+		ml.queue.Close()
+		ml.metrics.close()
+		ml.cleanupFn(ml)
+	})
+}
+
+// reportDrops sends a RecordLost payload with CPU payload.ListenerCPU to the
+// client if payloads have been dropped since the last report, so that the
+// client knows that it missed events. The count is reset once it has been
+// reported.
+func (ml *listenerv1_0) reportDrops(w io.Writer) error {
+	n := atomic.SwapUint64(&ml.unreportedDrops, 0)
+	if n == 0 {
+		return nil
 	}
+
+	pl := payload.Payload{Data: []byte{}, CPU: payload.ListenerCPU, Lost: n, Type: payload.RecordLost}
+	buf, err := ml.buildMessage(&pl)
+	if err == nil {
+		_, err = w.Write(buf)
+	}
+	if err != nil {
+		atomic.AddUint64(&ml.unreportedDrops, n)
+	}
+	return err
+}
+
+// SetEndpointFilter restricts the event samples of the datapath sent to the
+// listener to the events of the given endpoints and identities
+func (ml *listenerv1_0) SetEndpointFilter(endpoints []uint16, identities []uint32) {
+	ml.endpointFilter.set(endpoints, identities)
 }
 
 func (ml *listenerv1_0) Version() listener.Version {
 	return listener.Version1_0
 }
+
+func (ml *listenerv1_0) State() listener.State {
+	endpoints, identities := ml.endpointFilter.get()
+	return listener.State{
+		Version:           ml.Version(),
+		Name:              ml.name,
+		MaxMessageSize:    ml.maxMessageSize,
+		MaxQueueSize:      ml.queue.maxSize,
+		RateLimit:         ml.limiter.Limit(),
+		RateLimitBurst:    ml.limiter.Burst(),
+		EnqueueTimeout:    ml.enqueueTimeout,
+		KeepaliveInterval: ml.keepalive,
+		MessageTypes:      ml.messageTypes,
+		Endpoints:         endpoints,
+		Identities:        identities,
+		Seq:               atomic.LoadUint64(&ml.seq),
+		Compression:       ml.compression,
+		CompressionLevel:  ml.compressionLevel,
+		Format:            ml.format,
+		AllowedUIDs:       ml.allowedUIDs,
+	}
+}
+
+// Compression returns the compression algorithm and level applied to the
+// stream of messages sent to the listener.
+func (ml *listenerv1_0) Compression() (listener.Compression, int) {
+	return ml.compression, ml.compressionLevel
+}
+
+// Close closes the queue of the listener, further payloads are ignored.
+// drainQueue sends the remaining payloads before it closes the connection and
+// calls cleanupFn. A paused listener is resumed to do so. Sending the
+// remaining payloads is bounded by listenerCloseTimeout, a client which does
+// not read them in time is disconnected.
+func (ml *listenerv1_0) Close() {
+	ml.closeOnce.Do(func() {
+		ml.setCloseDeadline()
+		ml.Resume()
+		ml.input.Close()
+	})
+}
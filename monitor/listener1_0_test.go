@@ -0,0 +1,183 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/monitor/listener"
+	"github.com/cilium/cilium/monitor/payload"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MonitorSuite struct{}
+
+var _ = Suite(&MonitorSuite{})
+
+func (s *MonitorSuite) TestListenerWriteTimeout(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	removed := make(chan listener.MonitorListener, 1)
+	ml := newListenerv1_0(server, 16, 50*time.Millisecond, listener.State{Version: listener.Version1_0},
+		func(ml listener.MonitorListener) { removed <- ml })
+
+	// The client never reads, the write blocks until the deadline
+	ml.Enqueue(&payload.Payload{Data: []byte{1, 2, 3}, Type: payload.EventSample})
+
+	select {
+	case removedListener := <-removed:
+		c.Assert(removedListener, Equals, listener.MonitorListener(ml))
+	case <-time.After(5 * time.Second):
+		c.Fatal("listener not removed after write deadline expired")
+	}
+
+	// The connection has been closed
+	_, err := client.Read(make([]byte, 1))
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *MonitorSuite) TestListenerResume(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_0(server, 16, 0, listener.State{Version: listener.Version1_0, Seq: 10, Missed: 3},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+	c.Assert(ml.State().Seq, Equals, uint64(10))
+
+	ml.Enqueue(&payload.Payload{Data: []byte{1}, Type: payload.EventSample, Seq: 14})
+
+	var meta payload.Meta
+	var pl payload.Payload
+	c.Assert(payload.ReadMetaPayload(client, &meta, &pl), IsNil)
+	c.Assert(pl.Seq, Equals, uint64(14))
+
+	// The events missed while the client was disconnected are reported
+	// after the first event
+	pl = payload.Payload{}
+	c.Assert(payload.ReadMetaPayload(client, &meta, &pl), IsNil)
+	c.Assert(pl.Type, Equals, payload.RecordLost)
+	c.Assert(pl.CPU, Equals, payload.ListenerCPU)
+	c.Assert(pl.Lost, Equals, uint64(3))
+	c.Assert(ml.State().Seq, Equals, uint64(14))
+}
+
+func (s *MonitorSuite) TestListenerName(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_0(server, 16, 0, listener.State{Version: listener.Version1_0, Name: "hubble"},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+	c.Assert(ml.State().Name, Equals, "hubble")
+	c.Assert(ml.scopedLog.Data["listener"], Equals, "hubble")
+
+	// The remote address identifies clients which did not send a name
+	c.Assert(listenerName(server, ""), Equals, server.RemoteAddr().String())
+}
+
+func (s *MonitorSuite) TestListenerKeepalive(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// The handshake, which enforces the minimum interval, is bypassed here
+	state := listener.State{Version: listener.Version1_0, KeepaliveInterval: 10 * time.Millisecond}
+	ml := newListenerv1_0(server, 16, 0, state, func(listener.MonitorListener) {})
+	defer ml.Close()
+	ml.Enqueue(&payload.Payload{Data: []byte{1}, Type: payload.EventSample, Seq: 1})
+
+	var meta payload.Meta
+	var pl payload.Payload
+	c.Assert(payload.ReadMetaPayload(client, &meta, &pl), IsNil)
+	c.Assert(pl.Type, Equals, payload.EventSample)
+
+	// An idle listener receives keepalives
+	pl = payload.Payload{}
+	c.Assert(payload.ReadMetaPayload(client, &meta, &pl), IsNil)
+	c.Assert(pl.Type, Equals, payload.Keepalive)
+	c.Assert(pl.CPU, Equals, payload.ListenerCPU)
+}
+
+func (s *MonitorSuite) TestListenerTeardownOnce(c *C) {
+	server, client := net.Pipe()
+
+	var cleanups uint64
+	removed := make(chan struct{})
+	ml := newListenerv1_0(server, 16, 0, listener.State{Version: listener.Version1_0},
+		func(listener.MonitorListener) {
+			if atomic.AddUint64(&cleanups, 1) == 1 {
+				close(removed)
+			}
+		})
+
+	// Trigger a write failure by closing the client end while the
+	// listener is explicitly closed and torn down concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			ml.Enqueue(&payload.Payload{Data: []byte{1, 2, 3}, Type: payload.EventSample})
+		}()
+		go func() {
+			defer wg.Done()
+			ml.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			ml.teardown()
+		}()
+	}
+	client.Close()
+	wg.Wait()
+
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("listener not removed")
+	}
+
+	// Wait for drainQueue to exit, it must not clean up again
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadUint64(&cleanups), Equals, uint64(1))
+}
+
+func (s *MonitorSuite) TestListenerFormatJSON(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_0(server, 16, 0, listener.State{Version: listener.Version1_0, Format: listener.FormatJSON},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+
+	sent := payload.Payload{Data: []byte{1, 2, 3}, CPU: 2, Type: payload.EventSample, Seq: 1}
+	ml.Enqueue(&sent)
+
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	c.Assert(err, IsNil)
+
+	var pl payload.Payload
+	c.Assert(pl.DecodeJSON(line), IsNil)
+	c.Assert(pl, DeepEquals, sent)
+}
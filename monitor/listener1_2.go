@@ -17,25 +17,81 @@ package main
 import (
 	"encoding/gob"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cilium/cilium/monitor/listener"
 	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
 )
 
 // listenerv1_2 implements the ciliim-node-monitor API protocol compatible with
 // cilium 1.2
 // cleanupFn is called on exit
 type listenerv1_2 struct {
-	conn      net.Conn
-	queue     chan *payload.Payload
+	*listenerConn
+
+	queue     *payloadQueue
 	cleanupFn func(listener.MonitorListener)
+	metrics   *listenerMetrics
+
+	// messageTypes are the message types requested by the client,
+	// payloads of other message types are filtered out by filter on
+	// Enqueue, see payloadFilter
+	messageTypes []int
+	filter       *payloadFilter
+
+	// endpointFilter filters out the events of other endpoints on Enqueue
+	endpointFilter *endpointFilter
+
+	// limiter drops payloads exceeding the rate limit of the listener
+	// state on Enqueue, see rateLimiter
+	limiter *rateLimiter
+
+	// maxMessageSize is the maximum size in bytes of the data of a payload
+	// sent to the listener, payloads with more data are dropped. As the
+	// payload is encoded directly into the gob session, the size of the
+	// encoded message is not known beforehand. A value of 0 disables the
+	// limit.
+	maxMessageSize int
+
+	// enqueueTimeout is the maximum duration a payload waits for room in
+	// the full queue before it is dropped, see newWaitingQueue()
+	enqueueTimeout time.Duration
+
+	// input is the queue Enqueue adds payloads to. It is queue itself, or
+	// a waiting queue feeding queue if enqueueTimeout is not 0.
+	input *payloadQueue
+
+	// closeOnce guards closing input
+	closeOnce sync.Once
+
+	// oversizeDrops is the number of payloads dropped because they
+	// exceeded maxMessageSize. It must be accessed atomically.
+	oversizeDrops uint64
 }
 
-func newListenerv1_2(c net.Conn, queueSize int, cleanupFn func(listener.MonitorListener)) *listenerv1_2 {
+func newListenerv1_2(c net.Conn, queueSize int, writeTimeout time.Duration, state listener.State, cleanupFn func(listener.MonitorListener)) *listenerv1_2 {
 	ml := &listenerv1_2{
-		conn:      c,
-		queue:     make(chan *payload.Payload, queueSize),
-		cleanupFn: cleanupFn,
+		listenerConn:   newListenerConn(c, writeTimeout, state),
+		queue:          newPayloadQueue(queueSize, state.MaxQueueSize),
+		cleanupFn:      cleanupFn,
+		messageTypes:   state.MessageTypes,
+		filter:         newPayloadFilter(state.MessageTypes),
+		endpointFilter: newEndpointFilter(state.Endpoints, state.Identities),
+		limiter:        newRateLimiter(state.RateLimit, state.RateLimitBurst),
+		maxMessageSize: state.MaxMessageSize,
+		enqueueTimeout: state.EnqueueTimeout,
+	}
+	ml.metrics = newListenerMetrics(ml.queue)
+	ml.input = ml.queue
+	if ml.enqueueTimeout > 0 {
+		ml.input = newWaitingQueue(ml.queue, queueSize, func() time.Duration {
+			return ml.enqueueTimeout
+		}, ml.queueFull)
 	}
 
 	go ml.drainQueue()
@@ -43,38 +99,117 @@ func newListenerv1_2(c net.Conn, queueSize int, cleanupFn func(listener.MonitorL
 	return ml
 }
 
+// Enqueue adds pl to the queue of the listener. Payloads of message types not
+// requested by the client and payloads enqueued after the listener has been
+// closed are ignored. Event samples exceeding the rate limit are dropped.
 func (ml *listenerv1_2) Enqueue(pl *payload.Payload) {
-	select {
-	case ml.queue <- pl:
-	default:
-		log.Debug("Per listener queue is full, dropping message")
+	if !ml.filter.allows(pl) || !ml.endpointFilter.allows(pl) || ml.input.Closed() {
+		return
 	}
+
+	if isLowPriority(pl) && !ml.limiter.allow() {
+		metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonRateLimited).Inc()
+		return
+	}
+
+	if !ml.input.Push(pl) {
+		ml.queueFull()
+	}
+}
+
+// queueFull accounts a payload dropped because the queue was full
+func (ml *listenerv1_2) queueFull() {
+	ml.metrics.dropped()
+	metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonQueueFull).Inc()
+	ml.scopedLog.Debug("Per listener queue is full, dropping message")
+}
+
+// Dropped returns the number of payloads dropped because the queue of the
+// listener was full
+func (ml *listenerv1_2) Dropped() uint64 {
+	n := ml.queue.Dropped()
+	if ml.input != ml.queue {
+		n += ml.input.Dropped()
+	}
+	return n
 }
 
 // drainQueue encodes and sends monitor payloads to the listener. It is
 // intended to be a goroutine.
 func (ml *listenerv1_2) drainQueue() {
-	defer func() {
-		ml.conn.Close()
-		ml.cleanupFn(ml)
-	}()
+	defer ml.teardown()
 
 	enc := gob.NewEncoder(ml.conn)
-	for pl := range ml.queue {
+	for {
+		pl, ok := ml.nextPayload(ml.queue)
+		if !ok {
+			return
+		}
+
+		if ml.maxMessageSize > 0 && len(pl.Data) > ml.maxMessageSize {
+			metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonOversize).Inc()
+			ml.scopedLog.WithFields(logrus.Fields{
+				"size":           len(pl.Data),
+				"count.dropped":  atomic.AddUint64(&ml.oversizeDrops, 1),
+				"maxMessageSize": ml.maxMessageSize,
+			}).Debug("Payload exceeds maximum message size, dropping message")
+			continue
+		}
+
+		ml.setWriteDeadline()
 		if err := pl.EncodeBinary(enc); err != nil {
-			switch {
-			case listener.IsDisconnected(err):
-				log.Debug("Listener disconnected")
-				return
-
-			default:
-				log.WithError(err).Warn("Removing listener due to write failure")
-				return
-			}
+			ml.writeFailed(err)
+			return
 		}
 	}
 }
 
+// SetEndpointFilter restricts the event samples of the datapath sent to the
+// listener to the events of the given endpoints and identities
+func (ml *listenerv1_2) SetEndpointFilter(endpoints []uint16, identities []uint32) {
+	ml.endpointFilter.set(endpoints, identities)
+}
+
 func (ml *listenerv1_2) Version() listener.Version {
 	return listener.Version1_2
 }
+
+func (ml *listenerv1_2) State() listener.State {
+	endpoints, identities := ml.endpointFilter.get()
+	return listener.State{
+		Version:           ml.Version(),
+		Name:              ml.name,
+		MaxMessageSize:    ml.maxMessageSize,
+		MaxQueueSize:      ml.queue.maxSize,
+		RateLimit:         ml.limiter.Limit(),
+		RateLimitBurst:    ml.limiter.Burst(),
+		MessageTypes:      ml.messageTypes,
+		Endpoints:         endpoints,
+		Identities:        identities,
+		EnqueueTimeout:    ml.enqueueTimeout,
+		KeepaliveInterval: ml.keepalive,
+	}
+}
+
+// teardown closes the connection and calls cleanupFn, see
+// listenerConn.teardown()
+func (ml *listenerv1_2) teardown() {
+	ml.listenerConn.teardown(func() {
+		// Stop the goroutine waiting for room in the queue, if any
+		ml.input.Close()
+		ml.queue.Close()
+		ml.metrics.close()
+		ml.cleanupFn(ml)
+	})
+}
+
+// Close closes the queue of the listener. drainQueue sends the remaining
+// payloads before it closes the connection and calls cleanupFn. Sending the
+// remaining payloads is bounded by listenerCloseTimeout, a client which does
+// not read them in time is disconnected.
+func (ml *listenerv1_2) Close() {
+	ml.closeOnce.Do(func() {
+		ml.setCloseDeadline()
+		ml.input.Close()
+	})
+}
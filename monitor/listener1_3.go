@@ -0,0 +1,295 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/cilium/monitor/listener"
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listenerv1_3 implements the ciliim-node-monitor API protocol compatible with
+// cilium 1.3
+// cleanupFn is called on exit
+type listenerv1_3 struct {
+	*listenerConn
+	listenerPause
+
+	queue     *payloadQueue
+	cleanupFn func(listener.MonitorListener)
+	metrics   *listenerMetrics
+
+	// messageTypes are the message types requested by the client,
+	// payloads of other message types are filtered out by filter on
+	// Enqueue, see payloadFilter
+	messageTypes []int
+	filter       *payloadFilter
+
+	// endpointFilter filters out the events of other endpoints on Enqueue
+	endpointFilter *endpointFilter
+
+	// limiter drops payloads exceeding the rate limit of the listener
+	// state on Enqueue, see rateLimiter
+	limiter *rateLimiter
+
+	// maxMessageSize is the maximum size in bytes of an encoded payload
+	// sent to the listener, larger payloads are dropped. A value of 0
+	// limits the size to listener.MaxFrameSize.
+	maxMessageSize int
+
+	// compression and compressionLevel select how the data of each frame
+	// is compressed
+	compression      listener.Compression
+	compressionLevel int
+
+	// enqueueTimeout is the maximum duration a payload waits for room in
+	// the full queue before it is dropped, see newWaitingQueue()
+	enqueueTimeout time.Duration
+
+	// input is the queue Enqueue adds payloads to. It is queue itself, or
+	// a waiting queue feeding queue if enqueueTimeout is not 0.
+	input *payloadQueue
+
+	// closeOnce guards closing input
+	closeOnce sync.Once
+
+	// oversizeDrops is the number of payloads dropped because they
+	// exceeded maxMessageSize. It must be accessed atomically.
+	oversizeDrops uint64
+
+	// seq is the sequence number of the last event sample sent to the
+	// client, see payload.Payload. It is set by drainQueue just before
+	// the event sample is sent and must be accessed atomically.
+	seq uint64
+
+	// unreportedDrops is the number of payloads dropped because the queue
+	// was full or they exceeded the rate limit or maxMessageSize which
+	// have not been reported to the client yet, see reportDrops(). The events missed by
+	// a reconnecting client, see listener.State, are accounted here as
+	// well. It must be accessed atomically.
+	unreportedDrops uint64
+}
+
+func newListenerv1_3(c net.Conn, queueSize int, writeTimeout time.Duration, state listener.State, cleanupFn func(listener.MonitorListener)) *listenerv1_3 {
+	ml := &listenerv1_3{
+		listenerConn:     newListenerConn(c, writeTimeout, state),
+		queue:            newPayloadQueue(queueSize, state.MaxQueueSize),
+		cleanupFn:        cleanupFn,
+		messageTypes:     state.MessageTypes,
+		filter:           newPayloadFilter(state.MessageTypes),
+		endpointFilter:   newEndpointFilter(state.Endpoints, state.Identities),
+		limiter:          newRateLimiter(state.RateLimit, state.RateLimitBurst),
+		maxMessageSize:   state.MaxMessageSize,
+		compression:      state.Compression,
+		compressionLevel: state.CompressionLevel,
+		enqueueTimeout:   state.EnqueueTimeout,
+		seq:              state.Seq,
+		unreportedDrops:  state.Missed,
+	}
+	ml.metrics = newListenerMetrics(ml.queue)
+	ml.input = ml.queue
+	if ml.enqueueTimeout > 0 {
+		// A paused listener does not make room in its queue
+		ml.input = newWaitingQueue(ml.queue, queueSize, func() time.Duration {
+			if ml.Paused() {
+				return 0
+			}
+			return ml.enqueueTimeout
+		}, ml.queueFull)
+	}
+
+	go ml.drainQueue()
+
+	return ml
+}
+
+// Enqueue adds pl to the queue of the listener. Payloads of message types not
+// requested by the client and payloads enqueued after the listener has been
+// closed are ignored. Event samples exceeding the rate limit are dropped.
+func (ml *listenerv1_3) Enqueue(pl *payload.Payload) {
+	if !ml.filter.allows(pl) || !ml.endpointFilter.allows(pl) || ml.input.Closed() {
+		return
+	}
+
+	if isLowPriority(pl) && !ml.limiter.allow() {
+		atomic.AddUint64(&ml.unreportedDrops, 1)
+		metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonRateLimited).Inc()
+		return
+	}
+
+	if !ml.input.Push(pl) {
+		ml.queueFull()
+	}
+}
+
+// queueFull accounts a payload dropped because the queue was full
+func (ml *listenerv1_3) queueFull() {
+	ml.metrics.dropped()
+	atomic.AddUint64(&ml.unreportedDrops, 1)
+	reason := metrics.LabelValueDropReasonQueueFull
+	if ml.Paused() {
+		reason = metrics.LabelValueDropReasonPaused
+	}
+	metrics.NodeMonitorDroppedMessages.WithLabelValues(reason).Inc()
+	ml.scopedLog.WithField("reason", reason).Debug("Per listener queue is full, dropping message")
+}
+
+// Dropped returns the number of payloads dropped because the queue of the
+// listener was full
+func (ml *listenerv1_3) Dropped() uint64 {
+	n := ml.queue.Dropped()
+	if ml.input != ml.queue {
+		n += ml.input.Dropped()
+	}
+	return n
+}
+
+// drainQueue encodes and sends monitor payloads to the listener. Each payload
+// is encoded on its own and sent in a frame, see listener.WriteFrame(). It is
+// intended to be a goroutine.
+func (ml *listenerv1_3) drainQueue() {
+	defer ml.teardown()
+
+	maxSize := listener.MaxFrameSize
+	if ml.maxMessageSize > 0 && ml.maxMessageSize < maxSize {
+		maxSize = ml.maxMessageSize
+	}
+
+	for {
+		pl, ok := ml.nextPayload(ml.queue)
+		if !ok {
+			return
+		}
+
+		// The payload is held until the listener is resumed, so that a
+		// listener paused while waiting for a payload sends nothing
+		if resumed := ml.resumedChan(); resumed != nil {
+			<-resumed
+		}
+
+		buf, err := pl.Encode()
+		if err != nil {
+			ml.scopedLog.WithError(err).Error("Unable to send notification to listeners")
+			continue
+		}
+
+		if len(buf) > maxSize {
+			atomic.AddUint64(&ml.unreportedDrops, 1)
+			metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonOversize).Inc()
+			ml.scopedLog.WithFields(logrus.Fields{
+				"size":           len(buf),
+				"count.dropped":  atomic.AddUint64(&ml.oversizeDrops, 1),
+				"maxMessageSize": maxSize,
+			}).Debug("Message exceeds maximum message size, dropping message")
+			continue
+		}
+
+		if pl.Seq > 0 {
+			atomic.StoreUint64(&ml.seq, pl.Seq)
+		}
+		ml.setWriteDeadline()
+		err = listener.WriteFrame(ml.conn, buf, ml.compression, ml.compressionLevel)
+		if err == nil {
+			err = ml.reportDrops()
+		}
+		if err != nil {
+			ml.writeFailed(err)
+			return
+		}
+	}
+}
+
+// reportDrops sends a RecordLost payload with CPU payload.ListenerCPU to the
+// client if payloads have been dropped since the last report, so that the
+// client knows that it missed events. The count is reset once it has been
+// reported.
+func (ml *listenerv1_3) reportDrops() error {
+	n := atomic.SwapUint64(&ml.unreportedDrops, 0)
+	if n == 0 {
+		return nil
+	}
+
+	pl := payload.Payload{Data: []byte{}, CPU: payload.ListenerCPU, Lost: n, Type: payload.RecordLost}
+	buf, err := pl.Encode()
+	if err == nil {
+		err = listener.WriteFrame(ml.conn, buf, ml.compression, ml.compressionLevel)
+	}
+	if err != nil {
+		atomic.AddUint64(&ml.unreportedDrops, n)
+	}
+	return err
+}
+
+// SetEndpointFilter restricts the event samples of the datapath sent to the
+// listener to the events of the given endpoints and identities
+func (ml *listenerv1_3) SetEndpointFilter(endpoints []uint16, identities []uint32) {
+	ml.endpointFilter.set(endpoints, identities)
+}
+
+func (ml *listenerv1_3) Version() listener.Version {
+	return listener.Version1_3
+}
+
+func (ml *listenerv1_3) State() listener.State {
+	endpoints, identities := ml.endpointFilter.get()
+	return listener.State{
+		Version:           ml.Version(),
+		Name:              ml.name,
+		MaxMessageSize:    ml.maxMessageSize,
+		MaxQueueSize:      ml.queue.maxSize,
+		RateLimit:         ml.limiter.Limit(),
+		RateLimitBurst:    ml.limiter.Burst(),
+		MessageTypes:      ml.messageTypes,
+		Endpoints:         endpoints,
+		Identities:        identities,
+		Seq:               atomic.LoadUint64(&ml.seq),
+		Compression:       ml.compression,
+		CompressionLevel:  ml.compressionLevel,
+		EnqueueTimeout:    ml.enqueueTimeout,
+		KeepaliveInterval: ml.keepalive,
+	}
+}
+
+// teardown closes the connection and calls cleanupFn, see
+// listenerConn.teardown()
+func (ml *listenerv1_3) teardown() {
+	ml.listenerConn.teardown(func() {
+		// Stop the goroutine waiting for room in the queue, if any
+		ml.input.Close()
+		ml.queue.Close()
+		ml.metrics.close()
+		ml.cleanupFn(ml)
+	})
+}
+
+// Close closes the queue of the listener. drainQueue sends the remaining
+// payloads before it closes the connection and calls cleanupFn. A paused
+// listener is resumed to do so. Sending the remaining payloads is bounded by
+// listenerCloseTimeout, a client which does not read them in time is
+// disconnected.
+func (ml *listenerv1_3) Close() {
+	ml.closeOnce.Do(func() {
+		ml.setCloseDeadline()
+		ml.Resume()
+		ml.input.Close()
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/monitor/listener"
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestListenerv1_3WriteTimeout(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	removed := make(chan listener.MonitorListener, 1)
+	ml := newListenerv1_3(server, 16, 50*time.Millisecond, listener.State{Version: listener.Version1_3},
+		func(ml listener.MonitorListener) { removed <- ml })
+
+	// The client never reads, the write blocks until the deadline
+	ml.Enqueue(&payload.Payload{Data: []byte{1, 2, 3}, Type: payload.EventSample})
+
+	select {
+	case removedListener := <-removed:
+		c.Assert(removedListener, Equals, listener.MonitorListener(ml))
+	case <-time.After(5 * time.Second):
+		c.Fatal("listener not removed after write deadline expired")
+	}
+}
+
+func (s *MonitorSuite) TestListenerv1_3Resume(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_3(server, 16, 0, listener.State{Version: listener.Version1_3, Seq: 10, Missed: 3},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+	c.Assert(ml.State().Seq, Equals, uint64(10))
+
+	ml.Enqueue(&payload.Payload{Data: []byte{1}, Type: payload.EventSample, Seq: 14})
+
+	frames := listener.NewFrameReader(client)
+	data, err := frames.ReadFrame()
+	c.Assert(err, IsNil)
+	var pl payload.Payload
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Seq, Equals, uint64(14))
+
+	// The events missed while the client was disconnected are reported
+	// after the first event
+	data, err = frames.ReadFrame()
+	c.Assert(err, IsNil)
+	pl = payload.Payload{}
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Type, Equals, payload.RecordLost)
+	c.Assert(pl.CPU, Equals, payload.ListenerCPU)
+	c.Assert(pl.Lost, Equals, uint64(3))
+	c.Assert(ml.State().Seq, Equals, uint64(14))
+}
+
+func (s *MonitorSuite) TestListenerv1_3Oversize(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_3(server, 16, 0, listener.State{Version: listener.Version1_3, MaxMessageSize: 256},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+
+	oversize := metrics.NodeMonitorDroppedMessages.WithLabelValues(metrics.LabelValueDropReasonOversize)
+	dropped := metrics.GetCounterValue(oversize)
+	ml.Enqueue(&payload.Payload{Data: make([]byte, 512), Type: payload.EventSample, Seq: 1})
+	ml.Enqueue(&payload.Payload{Data: []byte{1}, Type: payload.EventSample, Seq: 2})
+
+	// The oversized payload is dropped and reported after the next one
+	frames := listener.NewFrameReader(client)
+	data, err := frames.ReadFrame()
+	c.Assert(err, IsNil)
+	var pl payload.Payload
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Seq, Equals, uint64(2))
+
+	data, err = frames.ReadFrame()
+	c.Assert(err, IsNil)
+	pl = payload.Payload{}
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Type, Equals, payload.RecordLost)
+	c.Assert(pl.Lost, Equals, uint64(1))
+	c.Assert(metrics.GetCounterValue(oversize), Equals, dropped+1)
+}
+
+func (s *MonitorSuite) TestListenerv1_3Pause(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	ml := newListenerv1_3(server, 16, 0, listener.State{Version: listener.Version1_3},
+		func(listener.MonitorListener) {})
+	defer ml.Close()
+	c.Assert(listener.MonitorListener(ml), Implements, new(listener.PausableListener))
+
+	// Payloads are queued, not sent, while the listener is paused
+	ml.Pause()
+	c.Assert(ml.Paused(), Equals, true)
+	ml.Enqueue(&payload.Payload{Data: []byte{1}, Type: payload.EventSample, Seq: 1})
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.Read(make([]byte, 1))
+	c.Assert(listener.IsTimeout(err), Equals, true)
+
+	client.SetReadDeadline(time.Time{})
+	ml.Resume()
+	data, err := listener.NewFrameReader(client).ReadFrame()
+	c.Assert(err, IsNil)
+	var pl payload.Payload
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Seq, Equals, uint64(1))
+}
+
+func (s *MonitorSuite) TestListenerv1_3Keepalive(c *C) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	// The handshake, which enforces the minimum interval, is bypassed here
+	state := listener.State{Version: listener.Version1_3, Name: "hubble", KeepaliveInterval: 10 * time.Millisecond}
+	ml := newListenerv1_3(server, 16, 0, state, func(listener.MonitorListener) {})
+	defer ml.Close()
+	c.Assert(ml.State().Name, Equals, "hubble")
+	c.Assert(ml.scopedLog.Data["listener"], Equals, "hubble")
+
+	// An idle listener receives keepalives
+	data, err := listener.NewFrameReader(client).ReadFrame()
+	c.Assert(err, IsNil)
+	var pl payload.Payload
+	c.Assert(pl.Decode(data), IsNil)
+	c.Assert(pl.Type, Equals, payload.Keepalive)
+	c.Assert(pl.CPU, Equals, payload.ListenerCPU)
+}
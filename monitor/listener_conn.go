@@ -0,0 +1,143 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/cilium/monitor/listener"
+	"github.com/cilium/cilium/monitor/payload"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listenerConn is the connection of a listener to its client. It implements
+// the write deadlines, keepalives, logging and teardown shared by all
+// listener versions.
+type listenerConn struct {
+	// closeDeadline is the deadline for sending the remaining payloads
+	// once the listener has been closed, in nanoseconds since the epoch,
+	// or 0 if the listener has not been closed. It must be accessed
+	// atomically. It is the first field to guarantee 64-bit alignment.
+	closeDeadline int64
+
+	conn net.Conn
+
+	// name is the name requested by the client
+	name string
+
+	// scopedLog identifies the listener by name, or by the remote address
+	// of conn if name is empty, in all log messages of the listener
+	scopedLog *logrus.Entry
+
+	// writeTimeout is the maximum duration of a write to conn, a client
+	// which does not read its messages in time is disconnected. A value
+	// of 0 disables the timeout.
+	writeTimeout time.Duration
+
+	// keepalive, if not 0, is the interval after which a keepalive
+	// payload is sent to an idle client, see nextPayload(). A client which
+	// disconnected is detected by the failing write.
+	keepalive time.Duration
+
+	// teardownOnce guards closing conn and calling the cleanup function,
+	// see teardown()
+	teardownOnce sync.Once
+}
+
+// newListenerConn returns the connection of a listener to the client on c
+func newListenerConn(c net.Conn, writeTimeout time.Duration, state listener.State) *listenerConn {
+	return &listenerConn{
+		conn:         c,
+		name:         state.Name,
+		scopedLog:    log.WithField("listener", listenerName(c, state.Name)),
+		writeTimeout: writeTimeout,
+		keepalive:    state.KeepaliveInterval,
+	}
+}
+
+// listenerName returns the name identifying the listener of a client in log
+// messages, which is the name requested by the client or, if it is empty, the
+// remote address of the connection
+func listenerName(c net.Conn, name string) string {
+	if name != "" {
+		return name
+	}
+	if addr := c.RemoteAddr(); addr != nil && addr.String() != "" {
+		return addr.String()
+	}
+	return "unknown"
+}
+
+// setWriteDeadline sets the deadline for the next write to the connection,
+// which is writeTimeout from now, or the close deadline if it is earlier
+func (lc *listenerConn) setWriteDeadline() {
+	var deadline time.Time
+	if lc.writeTimeout > 0 {
+		deadline = time.Now().Add(lc.writeTimeout)
+	}
+	if d := atomic.LoadInt64(&lc.closeDeadline); d != 0 {
+		if closeDeadline := time.Unix(0, d); deadline.IsZero() || closeDeadline.Before(deadline) {
+			deadline = closeDeadline
+		}
+	}
+	lc.conn.SetWriteDeadline(deadline)
+}
+
+// setCloseDeadline bounds sending the payloads remaining once the listener
+// has been closed by listenerCloseTimeout
+func (lc *listenerConn) setCloseDeadline() {
+	deadline := time.Now().Add(listenerCloseTimeout)
+	atomic.StoreInt64(&lc.closeDeadline, deadline.UnixNano())
+	lc.conn.SetWriteDeadline(deadline)
+}
+
+// nextPayload pops the next payload from q, or returns a keepalive payload if
+// no payload has been enqueued within the keepalive interval. Returns false
+// once q has been closed and all payloads have been popped.
+func (lc *listenerConn) nextPayload(q *payloadQueue) (*payload.Payload, bool) {
+	pl, ok := q.PopTimeout(lc.keepalive)
+	if ok && pl == nil {
+		pl = &payload.Payload{Data: []byte{}, CPU: payload.ListenerCPU, Type: payload.Keepalive}
+	}
+	return pl, ok
+}
+
+// writeFailed logs why the listener is removed after a failed write to conn
+func (lc *listenerConn) writeFailed(err error) {
+	switch {
+	case listener.IsDisconnected(err):
+		lc.scopedLog.Debug("Listener disconnected")
+
+	case listener.IsTimeout(err):
+		lc.scopedLog.Debug("Listener did not read messages in time, disconnecting")
+
+	default:
+		lc.scopedLog.WithError(err).Warn("Removing listener due to write failure")
+	}
+}
+
+// teardown closes conn and calls cleanup. It is safe to call from every path
+// tearing down the listener, e.g. concurrently on a write failure and an
+// explicit close, only the first call has an effect.
+func (lc *listenerConn) teardown(cleanup func()) {
+	lc.teardownOnce.Do(func() {
+		lc.conn.Close()
+		cleanup()
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// listenerIDs are the identifiers assigned to the listeners which have not
+// been closed yet, see newListenerMetrics(). Identifiers are reused once
+// their listener is closed, so that the number of label values of the
+// listener metrics is bounded by the number of concurrent listeners.
+var listenerIDs = struct {
+	lock.Mutex
+	used map[uint64]struct{}
+}{
+	used: map[uint64]struct{}{},
+}
+
+// allocateListenerID returns the lowest identifier not assigned to any
+// listener
+func allocateListenerID() uint64 {
+	listenerIDs.Lock()
+	defer listenerIDs.Unlock()
+
+	id := uint64(1)
+	for ; ; id++ {
+		if _, ok := listenerIDs.used[id]; !ok {
+			break
+		}
+	}
+	listenerIDs.used[id] = struct{}{}
+	return id
+}
+
+// releaseListenerID makes the identifier available to new listeners
+func releaseListenerID(id uint64) {
+	listenerIDs.Lock()
+	delete(listenerIDs.used, id)
+	listenerIDs.Unlock()
+}
+
+// listenerMetrics exposes the length of the queue of a listener and the
+// number of payloads dropped because it was full, labeled by an identifier
+// unique to the listener. The length of the queue is sampled every
+// listenerQueueSampleInterval until close() is called.
+type listenerMetrics struct {
+	numericID uint64
+	id        string
+	drops     prometheus.Counter
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newListenerMetrics assigns an identifier to a listener and starts sampling
+// the length of its queue q
+func newListenerMetrics(q *payloadQueue) *listenerMetrics {
+	numericID := allocateListenerID()
+	id := strconv.FormatUint(numericID, 10)
+	lm := &listenerMetrics{
+		numericID: numericID,
+		id:        id,
+		drops:     metrics.NodeMonitorListenerDroppedMessages.WithLabelValues(id),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go lm.sampleQueueLength(q)
+
+	return lm
+}
+
+func (lm *listenerMetrics) sampleQueueLength(q *payloadQueue) {
+	defer close(lm.done)
+
+	gauge := metrics.NodeMonitorListenerQueueLength.WithLabelValues(lm.id)
+	ticker := time.NewTicker(listenerQueueSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		gauge.Set(float64(q.Len()))
+
+		select {
+		case <-lm.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dropped accounts a payload dropped because the queue was full
+func (lm *listenerMetrics) dropped() {
+	lm.drops.Inc()
+}
+
+// close stops sampling the length of the queue, removes the metrics of the
+// listener and releases its identifier. It must be called when the listener
+// is cleaned up.
+func (lm *listenerMetrics) close() {
+	lm.closeOnce.Do(func() {
+		close(lm.stop)
+		<-lm.done
+		metrics.NodeMonitorListenerQueueLength.DeleteLabelValues(lm.id)
+		metrics.NodeMonitorListenerDroppedMessages.DeleteLabelValues(lm.id)
+		releaseListenerID(lm.numericID)
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestListenerMetrics(c *C) {
+	q := newPayloadQueue(1, 1)
+	lm := newListenerMetrics(q)
+
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample}), Equals, true)
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample}), Equals, false)
+	lm.dropped()
+
+	var m dto.Metric
+	c.Assert(lm.drops.Write(&m), IsNil)
+	c.Assert(m.GetCounter().GetValue(), Equals, float64(1))
+
+	// The metrics of the listener are removed once it is closed, removing
+	// them again fails. The sampling goroutine does not recreate the
+	// queue length metric after it has been stopped.
+	lm.close()
+	lm.close()
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(metrics.NodeMonitorListenerDroppedMessages.DeleteLabelValues(lm.id), Equals, false)
+	c.Assert(metrics.NodeMonitorListenerQueueLength.DeleteLabelValues(lm.id), Equals, false)
+}
+
+func (s *MonitorSuite) TestListenerMetricsReuseID(c *C) {
+	lm1 := newListenerMetrics(newPayloadQueue(1, 1))
+	lm2 := newListenerMetrics(newPayloadQueue(1, 1))
+	defer lm2.close()
+	c.Assert(lm1.id, Not(Equals), lm2.id)
+
+	// The identifier of a closed listener is assigned to the next listener
+	id := lm1.id
+	lm1.close()
+	lm3 := newListenerMetrics(newPayloadQueue(1, 1))
+	defer lm3.close()
+	c.Assert(lm3.id, Equals, id)
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// listenerPause implements pausing and resuming the delivery of payloads to
+// the client of a listener, see listener.PausableListener. While the
+// listener is paused, drainQueue does not dequeue payloads. The queue fills
+// up to its size, or grows up to the MaxQueueSize of the listener state,
+// after which payloads are dropped and counted in the
+// node_monitor_dropped_messages_total metric with reason "paused".
+type listenerPause struct {
+	// pauseMutex protects resumed
+	pauseMutex lock.Mutex
+
+	// resumed is non-nil while the listener is paused, and closed when it
+	// is resumed
+	resumed chan struct{}
+}
+
+// Pause stops sending payloads to the listener until Resume is called.
+// Payloads are queued while the listener is paused; once the queue is full,
+// payloads are dropped, see payloadQueue.
+func (lp *listenerPause) Pause() {
+	lp.pauseMutex.Lock()
+	if lp.resumed == nil {
+		lp.resumed = make(chan struct{})
+	}
+	lp.pauseMutex.Unlock()
+}
+
+// Resume resumes sending payloads to a paused listener
+func (lp *listenerPause) Resume() {
+	lp.pauseMutex.Lock()
+	if lp.resumed != nil {
+		close(lp.resumed)
+		lp.resumed = nil
+	}
+	lp.pauseMutex.Unlock()
+}
+
+// Paused returns true if the listener is paused
+func (lp *listenerPause) Paused() bool {
+	lp.pauseMutex.Lock()
+	defer lp.pauseMutex.Unlock()
+	return lp.resumed != nil
+}
+
+// resumedChan returns a channel which is closed once the listener is
+// resumed, or nil if the listener is not paused.
+func (lp *listenerPause) resumedChan() chan struct{} {
+	lp.pauseMutex.Lock()
+	defer lp.pauseMutex.Unlock()
+	return lp.resumed
+}
@@ -16,18 +16,22 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/cilium/cilium/common"
+	"github.com/cilium/cilium/monitor/listener"
 	"github.com/cilium/cilium/pkg/api"
 	"github.com/cilium/cilium/pkg/bpf"
 	"github.com/cilium/cilium/pkg/defaults"
 	"github.com/cilium/cilium/pkg/logging"
 	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
 
 	gops "github.com/google/gops/agent"
 	"github.com/spf13/cobra"
@@ -51,6 +55,37 @@ var (
 	}
 	npages int
 
+	// maxMessageSize is the maximum size of a message sent to a listener,
+	// larger messages are dropped. 0 disables the limit.
+	maxMessageSize int
+
+	// maxQueueSize is the maximum number of payloads the queue of a
+	// listener grows to before payloads are dropped. The queue has a fixed
+	// size if it is not larger than queueSize.
+	maxQueueSize int
+
+	// rateLimit is the maximum number of payloads per second enqueued to a
+	// listener, rateLimitBurst the size of bursts. 0 disables the limit.
+	rateLimit      int
+	rateLimitBurst int
+
+	// maxEnqueueTimeout is the maximum duration a listener may request to
+	// wait for its full queue before payloads are dropped. 0 disables
+	// waiting.
+	maxEnqueueTimeout time.Duration
+
+	// allowedUIDs are the UIDs of the processes allowed to connect to the
+	// node monitor sockets. All processes are allowed if empty.
+	allowedUIDs []uint
+
+	// compression are the compression algorithms clients of the handshake
+	// socket may request, see listener.Capabilities
+	compression []string
+
+	// prometheusServeAddr is the address the metrics of the node monitor
+	// are served on, metrics are not served if empty
+	prometheusServeAddr string
+
 	// bpfRoot is the path to the BPF mount. This can be non-default if
 	// cilium-agent mounts bpf at an alternate location.
 	bpfRoot string
@@ -58,6 +93,14 @@ var (
 
 func init() {
 	rootCmd.Flags().IntVar(&npages, "num-pages", 64, "Number of pages for ring buffer")
+	rootCmd.Flags().IntVar(&maxMessageSize, "max-message-size", 0, "Maximum size in bytes of a message sent to a listener, larger messages are dropped (0 = unlimited)")
+	rootCmd.Flags().IntVar(&maxQueueSize, "max-queue-size", 0, fmt.Sprintf("Maximum number of messages queued per listener before messages are dropped, the queue grows from %d messages up to this size (0 = fixed size)", queueSize))
+	rootCmd.Flags().IntVar(&rateLimit, "rate-limit", 0, "Maximum number of messages per second sent to a listener, excess messages are dropped (0 = unlimited)")
+	rootCmd.Flags().IntVar(&rateLimitBurst, "rate-limit-burst", 0, "Maximum number of messages sent to a listener in a burst above the rate limit (0 = rate limit)")
+	rootCmd.Flags().DurationVar(&maxEnqueueTimeout, "max-enqueue-timeout", 0, "Maximum duration a listener may request to wait for its full queue before messages are dropped (0 = never wait)")
+	rootCmd.Flags().UintSliceVar(&allowedUIDs, "allowed-uids", nil, "UIDs of the local processes allowed to connect to the node monitor sockets (empty = all)")
+	rootCmd.Flags().StringSliceVar(&compression, "compression", []string{string(listener.CompressionGzip), string(listener.CompressionSnappy)}, "Compression algorithms clients of the handshake API may request (gzip, snappy, none = no compression)")
+	rootCmd.Flags().StringVar(&prometheusServeAddr, "prometheus-serve-addr", "", "IP:Port on which to serve the node monitor prometheus metrics (pass \":Port\" to bind on all interfaces, \"\" is off)")
 	rootCmd.Flags().StringVar(&bpfRoot, "bpf-root", "/sys/fs/bpf", "Path to the root of the bpf mount")
 }
 
@@ -118,13 +161,46 @@ func runNodeMonitor() {
 	defer server1_2.Close() // Stop accepting new v1.2 connections
 	log.Infof("Serving cilium node monitor v1.2 API at unix://%s", defaults.MonitorSockPath1_2)
 
+	listenerDefaults := listener.State{
+		MaxMessageSize: maxMessageSize,
+		MaxQueueSize:   maxQueueSize,
+		RateLimit:      rateLimit,
+		RateLimitBurst: rateLimitBurst,
+		EnqueueTimeout: maxEnqueueTimeout,
+	}
+	for _, uid := range allowedUIDs {
+		listenerDefaults.AllowedUIDs = append(listenerDefaults.AllowedUIDs, uint32(uid))
+	}
+
+	var offeredCompression []listener.Compression
+	for _, name := range compression {
+		comp, err := listener.ParseCompression(name)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid compression")
+		}
+		if comp != listener.CompressionNone {
+			offeredCompression = append(offeredCompression, comp)
+		}
+	}
+
+	serverHandshake := buildServerOrExit(defaults.MonitorSockPathHandshake)
+	defer serverHandshake.Close() // Stop accepting new handshake connections
+	log.Infof("Serving cilium node monitor handshake API at unix://%s", defaults.MonitorSockPathHandshake)
+
 	mainCtx, mainCtxCancel := context.WithCancel(context.Background())
 
-	monitorSingleton, err = NewMonitor(mainCtx, npages, pipe, server1_0, server1_2)
+	monitorSingleton, err = NewMonitor(mainCtx, npages, listenerDefaults, offeredCompression, pipe, server1_0, server1_2, serverHandshake)
 	if err != nil {
 		log.WithError(err).Fatal("Error initialising monitor handlers")
 	}
 
+	if prometheusServeAddr != "" {
+		log.Infof("Serving node monitor prometheus metrics on %s", prometheusServeAddr)
+		if err := metrics.EnableNodeMonitor(prometheusServeAddr); err != nil {
+			log.WithError(err).Fatal("Error while starting metrics")
+		}
+	}
+
 	shutdownChan := make(chan os.Signal)
 	signal.Notify(shutdownChan, syscall.SIGQUIT, syscall.SIGINT, syscall.SIGTERM, syscall.SIGINT)
 	sig := <-shutdownChan
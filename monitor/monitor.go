@@ -37,6 +37,23 @@ const (
 
 	// queueSize is the size of the message queue
 	queueSize = 65536
+
+	// handshakeTimeout is the maximum duration of the handshake with a
+	// newly connected client
+	handshakeTimeout = 5 * time.Second
+
+	// listenerCloseTimeout is the maximum duration to send the payloads
+	// remaining in the queue of a listener when it is closed
+	listenerCloseTimeout = 5 * time.Second
+
+	// listenerWriteTimeout is the maximum duration of a write to the
+	// connection of a listener before the client is disconnected
+	listenerWriteTimeout = 10 * time.Second
+
+	// listenerQueueSampleInterval is the interval in which the length of
+	// the queue of each listener is sampled into the
+	// node_monitor_listener_queue_length metric
+	listenerQueueSampleInterval = 5 * time.Second
 )
 
 // isCtxDone is a utility function that returns true when the context's Done()
@@ -68,7 +85,22 @@ type Monitor struct {
 	perfReaderCancel context.CancelFunc
 	listeners        map[listener.MonitorListener]struct{}
 	nPages           int
+	listenerDefaults listener.State
 	monitorEvents    *bpf.PerCpuEvents
+
+	// compression are the compression algorithms clients of the
+	// handshake socket may request
+	compression []listener.Compression
+
+	// sendMutex serializes send() so that payloads are enqueued in the
+	// order of their sequence numbers, it protects seq. It is separate
+	// from the lock of the monitor so that listeners can be added and
+	// removed while payloads are sent.
+	sendMutex lock.Mutex
+
+	// seq is the sequence number of the last event sample sent to the
+	// listeners, see payload.Payload
+	seq uint64
 }
 
 // agentPipeReader reads agent events from the agentPipe and distributes to all listeners
@@ -100,17 +132,27 @@ func (m *Monitor) agentPipeReader(ctx context.Context, agentPipe io.Reader) {
 // handling.
 // Note that the perf buffer reader is started only when listeners are
 // connected.
-func NewMonitor(ctx context.Context, nPages int, agentPipe io.Reader, server1_0, server1_2 net.Listener) (m *Monitor, err error) {
+// listenerDefaults is the configuration applied to newly connected listeners,
+// e.g. the maximum message size. Its Version and compression are ignored.
+// Clients connecting to serverHandshake negotiate the version and features of
+// their listener, see listener.ServerHandshake(). They may request one of
+// the compression algorithms in compression.
+func NewMonitor(ctx context.Context, nPages int, listenerDefaults listener.State, compression []listener.Compression, agentPipe io.Reader, server1_0, server1_2, serverHandshake net.Listener) (m *Monitor, err error) {
+	listenerDefaults.Compression, listenerDefaults.CompressionLevel = listener.CompressionNone, 0
+
 	m = &Monitor{
 		ctx:              ctx,
 		listeners:        make(map[listener.MonitorListener]struct{}),
 		nPages:           nPages,
+		listenerDefaults: listenerDefaults,
+		compression:      compression,
 		perfReaderCancel: func() {}, // no-op to avoid doing null checks everywhere
 	}
 
 	// start new MonitorListener handler
 	go m.connectionHandler1_0(ctx, server1_0)
 	go m.connectionHandler1_2(ctx, server1_2)
+	go m.connectionHandlerHandshake(ctx, serverHandshake)
 
 	// start agent event pipe reader
 	go m.agentPipeReader(ctx, agentPipe)
@@ -122,8 +164,16 @@ func NewMonitor(ctx context.Context, nPages int, agentPipe io.Reader, server1_0,
 // a singleton goroutine to read and distribute the events. It passes a
 // cancelable context to this goroutine and the cancelFunc is assigned to
 // perfReaderCancel. Note that cancelling parentCtx (e.g. on program shutdown)
-// will also cancel the derived context.
-func (m *Monitor) registerNewListener(parentCtx context.Context, conn net.Conn, version listener.Version) {
+// will also cancel the derived context. It returns the new listener, or nil if
+// state is not supported or if conn is a Unix socket connection of a process
+// whose UID is not in the AllowedUIDs of state, see authorizePeer().
+func (m *Monitor) registerNewListener(parentCtx context.Context, conn net.Conn, state listener.State) listener.MonitorListener {
+	if err := authorizePeer(conn, state.AllowedUIDs); err != nil {
+		conn.Close()
+		log.WithError(err).Warn("Closing new connection from unauthorized monitor client")
+		return nil
+	}
+
 	m.Lock()
 	defer m.Unlock()
 
@@ -135,24 +185,54 @@ func (m *Monitor) registerNewListener(parentCtx context.Context, conn net.Conn,
 		go m.perfEventReader(perfEventReaderCtx, m.nPages)
 	}
 
-	switch version {
+	var newListener listener.MonitorListener
+	switch state.Version {
 	case listener.Version1_0:
-		newListener := newListenerv1_0(conn, queueSize, m.removeListener)
+		newListener = newListenerv1_0(conn, queueSize, listenerWriteTimeout, state, m.removeListener)
 		m.listeners[newListener] = struct{}{}
 
 	case listener.Version1_2:
-		newListener := newListenerv1_2(conn, queueSize, m.removeListener)
+		newListener = newListenerv1_2(conn, queueSize, listenerWriteTimeout, state, m.removeListener)
+		m.listeners[newListener] = struct{}{}
+
+	case listener.Version1_3:
+		newListener = newListenerv1_3(conn, queueSize, listenerWriteTimeout, state, m.removeListener)
 		m.listeners[newListener] = struct{}{}
 
 	default:
 		conn.Close()
-		log.WithField("version", version).Error("Closing new connection from unsupported monitor client version")
+		log.WithField("version", state.Version).Error("Closing new connection from unsupported monitor client version")
+	}
+
+	if newListener == nil {
+		// Don't keep the perf reader running without any listener
+		if len(m.listeners) == 0 {
+			m.perfReaderCancel()
+		}
+		return nil
 	}
 
 	log.WithFields(logrus.Fields{
 		"count.listener": len(m.listeners),
-		"version":        version,
+		"version":        state.Version,
+		"listener":       listenerName(conn, state.Name),
 	}).Debug("New listener connected")
+
+	return newListener
+}
+
+// newListenerState returns the initial state of a listener for a newly
+// connected client using the given API version.
+func (m *Monitor) newListenerState(version listener.Version) listener.State {
+	state := m.listenerDefaults
+	state.Version = version
+
+	// Clients of these sockets can neither detect a compressed stream nor
+	// opt in to waiting for their queue
+	state.Compression, state.CompressionLevel = listener.CompressionNone, 0
+	state.EnqueueTimeout = 0
+
+	return state
 }
 
 // removeListener deletes the MonitorListener from the list, closes its queue, and
@@ -164,6 +244,7 @@ func (m *Monitor) removeListener(ml listener.MonitorListener) {
 	delete(m.listeners, ml)
 	log.WithFields(logrus.Fields{
 		"count.listener": len(m.listeners),
+		"count.dropped":  ml.Dropped(),
 		"version":        ml.Version(),
 	}).Debug("Removed listener")
 
@@ -270,7 +351,7 @@ func (m *Monitor) connectionHandler1_0(parentCtx context.Context, server net.Lis
 			continue
 		}
 
-		m.registerNewListener(parentCtx, conn, listener.Version1_0)
+		m.registerNewListener(parentCtx, conn, m.newListenerState(listener.Version1_0))
 	}
 }
 
@@ -293,15 +374,137 @@ func (m *Monitor) connectionHandler1_2(parentCtx context.Context, server net.Lis
 			continue
 		}
 
-		m.registerNewListener(parentCtx, conn, listener.Version1_2)
+		m.registerNewListener(parentCtx, conn, m.newListenerState(listener.Version1_2))
 	}
 }
 
-// send enqueues the payload to all listeners.
+// capabilities returns the capabilities advertised to clients in the
+// handshake
+func (m *Monitor) capabilities() listener.Capabilities {
+	return listener.Capabilities{
+		HandshakeVersion:  listener.HandshakeVersion,
+		Versions:          []listener.Version{listener.Version1_0, listener.Version1_2, listener.Version1_3},
+		Compression:       m.compression,
+		Formats:           []listener.Format{listener.FormatJSON},
+		Control:           []listener.ControlType{listener.ControlPause, listener.ControlResume, listener.ControlFilter},
+		MessageTypeFilter: true,
+		Resume:            true,
+		Keepalive:         true,
+		EndpointFilter:    true,
+	}
+}
+
+// handshake negotiates the state of the listener with the client on conn and
+// registers the listener. conn is closed if the handshake fails.
+func (m *Monitor) handshake(parentCtx context.Context, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defaults := m.listenerDefaults
+	m.sendMutex.Lock()
+	defaults.Seq = m.seq
+	m.sendMutex.Unlock()
+
+	state, err := listener.ServerHandshake(conn, m.capabilities(), defaults)
+	if err != nil {
+		log.WithError(err).Warn("Closing new connection due to failed handshake")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if ml := m.registerNewListener(parentCtx, conn, state); ml != nil {
+		m.controlReader(conn, ml)
+	}
+}
+
+// controlReader reads the control messages sent by the client of ml on conn
+// until the connection is closed.
+func (m *Monitor) controlReader(conn net.Conn, ml listener.MonitorListener) {
+	scopedLog := log.WithField("version", ml.Version())
+	pausable, _ := ml.(listener.PausableListener)
+	filterable, _ := ml.(listener.FilterableListener)
+	for {
+		msg, err := listener.ReadControlMessage(conn)
+		if err != nil {
+			// Resume a paused listener so that it notices the
+			// closed connection on its next write and is removed.
+			if pausable != nil {
+				pausable.Resume()
+			}
+			scopedLog.WithError(err).Debug("Stopped reading control messages")
+			return
+		}
+
+		switch msg.Type {
+		case listener.ControlPause, listener.ControlResume:
+			if pausable == nil {
+				scopedLog.WithField("control", msg.Type).Warn("Ignoring control message unsupported by listener")
+			} else if msg.Type == listener.ControlPause {
+				pausable.Pause()
+				scopedLog.Debug("Listener paused")
+			} else {
+				pausable.Resume()
+				scopedLog.Debug("Listener resumed")
+			}
+		case listener.ControlFilter:
+			if filterable == nil {
+				scopedLog.WithField("control", msg.Type).Warn("Ignoring control message unsupported by listener")
+				break
+			}
+			filterable.SetEndpointFilter(msg.Endpoints, msg.Identities)
+			scopedLog.WithFields(logrus.Fields{
+				"endpoints":  msg.Endpoints,
+				"identities": msg.Identities,
+			}).Debug("Listener endpoint filter updated")
+		default:
+			scopedLog.WithField("control", msg.Type).Warn("Ignoring unknown control message")
+		}
+	}
+}
+
+// connectionHandlerHandshake handles all the incoming connections which
+// negotiate their listener in a handshake. It will block on Accept, but
+// expects the caller to close server, inducing a return.
+func (m *Monitor) connectionHandlerHandshake(parentCtx context.Context, server net.Listener) {
+	for !isCtxDone(parentCtx) {
+		conn, err := server.Accept()
+		switch {
+		case isCtxDone(parentCtx) && conn != nil:
+			conn.Close()
+			fallthrough
+
+		case isCtxDone(parentCtx) && conn == nil:
+			return
+
+		case err != nil:
+			log.WithError(err).Warn("Error accepting connection")
+			continue
+		}
+
+		// Perform the handshake asynchronously so that a slow client
+		// cannot block the acceptance of other connections.
+		go m.handshake(parentCtx, conn)
+	}
+}
+
+// send assigns the next sequence number to event samples and enqueues the
+// payload to all listeners. The lock of the monitor is not held while the
+// payload is enqueued.
 func (m *Monitor) send(pl *payload.Payload) {
+	m.sendMutex.Lock()
+	defer m.sendMutex.Unlock()
+	if pl.Type == payload.EventSample {
+		m.seq++
+		pl.Seq = m.seq
+	}
+
 	m.Lock()
-	defer m.Unlock()
+	listeners := make([]listener.MonitorListener, 0, len(m.listeners))
 	for ml := range m.listeners {
+		listeners = append(listeners, ml)
+	}
+	m.Unlock()
+
+	for _, ml := range listeners {
 		ml.Enqueue(pl)
 	}
 }
@@ -0,0 +1,43 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/monitor/listener"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestNewListenerState(c *C) {
+	m := &Monitor{listenerDefaults: listener.State{
+		MaxMessageSize:   1024,
+		Compression:      listener.CompressionGzip,
+		CompressionLevel: 9,
+		EnqueueTimeout:   time.Second,
+	}}
+
+	// Clients of the version specific sockets never get a compressed
+	// stream as they cannot detect it
+	for _, version := range []listener.Version{listener.Version1_0, listener.Version1_2} {
+		state := m.newListenerState(version)
+		c.Assert(state, DeepEquals, listener.State{
+			Version:        version,
+			MaxMessageSize: 1024,
+			Compression:    listener.CompressionNone,
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSONSchemaVersion is the version of the JSON representation of payloads,
+// see JSONPayload. It is incremented on incompatible changes of the schema;
+// fields may be added without incrementing it, so parsers must ignore
+// unknown fields.
+const JSONSchemaVersion = 1
+
+// JSONPayload is the JSON representation of a Payload. Data is encoded in
+// base64.
+type JSONPayload struct {
+	Schema int    `json:"schema"`
+	Type   int    `json:"type"`
+	CPU    int    `json:"cpu"`
+	Lost   uint64 `json:"lost,omitempty"`
+	Seq    uint64 `json:"seq,omitempty"`
+	Data   []byte `json:"data"`
+}
+
+// BuildJSONMessage builds the newline-delimited JSON message to be sent and
+// returns it
+func (pl *Payload) BuildJSONMessage() ([]byte, error) {
+	buf, err := json.Marshal(JSONPayload{
+		Schema: JSONSchemaVersion,
+		Type:   pl.Type,
+		CPU:    pl.CPU,
+		Lost:   pl.Lost,
+		Seq:    pl.Seq,
+		Data:   pl.Data,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode payload: %s", err)
+	}
+	return append(buf, '\n'), nil
+}
+
+// DecodeJSON decodes the payload from a single line of JSON written by
+// BuildJSONMessage. Payloads of an unsupported schema version are rejected.
+func (pl *Payload) DecodeJSON(data []byte) error {
+	var jpl JSONPayload
+	if err := json.Unmarshal(data, &jpl); err != nil {
+		return err
+	}
+	if jpl.Schema != JSONSchemaVersion {
+		return fmt.Errorf("unsupported JSON schema version %d", jpl.Schema)
+	}
+
+	*pl = Payload{Data: jpl.Data, CPU: jpl.CPU, Lost: jpl.Lost, Type: jpl.Type, Seq: jpl.Seq}
+	return nil
+}
@@ -30,8 +30,17 @@ const (
 	EventSample = 9
 	// RecordLost is equivalent to PERF_RECORD_LOST
 	RecordLost = 2
+	// Keepalive is the type of the empty payloads sent by the node
+	// monitor to a listener which has been idle for its keepalive
+	// interval. It is outside of the range of perf record types.
+	Keepalive = 1 << 16
 )
 
+// ListenerCPU is the CPU of RecordLost payloads which report payloads dropped
+// by the node monitor because the queue of the listener was full, as opposed
+// to samples lost in the perf ring buffer of a CPU.
+const ListenerCPU = -1
+
 // Meta is used by readers to get information about the payload.
 type Meta struct {
 	Size uint32
@@ -63,11 +72,17 @@ func (meta *Meta) WriteBinary(w io.Writer) error {
 }
 
 // Payload is the structure used when copying events from the main monitor.
+// Seq is the sequence number assigned to event samples by the node monitor,
+// incremented by one for each event sample. A client which observes a jump
+// in the sequence numbers has missed events. It is 0 if not set, e.g. for
+// records of lost events or if the node monitor does not assign sequence
+// numbers.
 type Payload struct {
 	Data []byte
 	CPU  int
 	Lost uint64
 	Type int
+	Seq  uint64
 }
 
 // Decode decodes the payload from its binary representation.
@@ -166,3 +166,24 @@ func (s *PayloadSuite) BenchmarkReadPayloadRuseEncoder(c *C) {
 		c.Assert(err, Equals, nil)
 	}
 }
+
+func (s *PayloadSuite) TestPayload_JSON(c *C) {
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+		Seq:  42,
+	}
+	buf, err := payload1.BuildJSONMessage()
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buf), Equals, `{"schema":1,"type":9,"cpu":12,"lost":5243,"seq":42,"data":"AQIDBA=="}`+"\n")
+
+	var payload2 Payload
+	err = payload2.DecodeJSON(buf)
+	c.Assert(err, Equals, nil)
+	c.Assert(payload1, checker.DeepEquals, payload2)
+
+	err = payload2.DecodeJSON([]byte(`{"schema":2,"type":9}`))
+	c.Assert(err, Not(Equals), nil)
+}
@@ -0,0 +1,288 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/cilium/monitor/payload"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// payloadQueue is the queue of payloads waiting to be sent to a listener.
+// The queue holds up to size payloads. If maxSize is larger than size, the
+// queue grows adaptively by doubling its size up to maxSize before payloads
+// are dropped, and shrinks back to its initial size once it has been emptied.
+//
+// When the queue is full, the oldest low priority payload is dropped in
+// favour of the new payload. If the queue only holds high priority payloads,
+// the new payload is dropped.
+type payloadQueue struct {
+	mutex       lock.Mutex
+	items       []*payload.Payload
+	initialSize int
+	size        int
+	maxSize     int
+	closed      bool
+
+	// notify is signalled when a payload is pushed or the queue is
+	// closed
+	notify chan struct{}
+
+	// space is signalled when a payload is popped, done is closed when
+	// the queue is closed. Both wake up PushWait().
+	space chan struct{}
+	done  chan struct{}
+
+	// dropped is the number of payloads dropped because the queue was
+	// full. It must be accessed atomically.
+	dropped uint64
+}
+
+// newPayloadQueue returns a queue holding size payloads which grows up to
+// maxSize payloads. The queue has a fixed size if maxSize is not larger than
+// size.
+func newPayloadQueue(size, maxSize int) *payloadQueue {
+	return &payloadQueue{
+		initialSize: size,
+		size:        size,
+		maxSize:     maxSize,
+		notify:      make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// isLowPriority returns true if pl may be dropped in favour of other
+// payloads. Records of lost events tell the client that it missed events and
+// are kept in favour of event samples.
+func isLowPriority(pl *payload.Payload) bool {
+	return pl.Type != payload.RecordLost
+}
+
+func (q *payloadQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Push adds pl to the end of the queue. Returns false if the queue was full
+// and a payload, either pl or an older low priority payload, was dropped.
+func (q *payloadQueue) Push(pl *payload.Payload) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return false
+	}
+	return q.pushLocked(pl)
+}
+
+// PushWait adds pl to the end of the queue like Push, but if the queue is full
+// it first waits for up to timeout for a payload to be popped before a
+// payload is dropped. It returns as soon as the queue is closed so that a
+// producer waiting for a listener being torn down is released. A timeout of 0
+// does not wait.
+func (q *payloadQueue) PushWait(pl *payload.Payload, timeout time.Duration) bool {
+	if timeout <= 0 {
+		return q.Push(pl)
+	}
+
+	var expired <-chan time.Time
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return false
+		}
+		if !q.fullLocked() {
+			queued := q.pushLocked(pl)
+			q.mutex.Unlock()
+			return queued
+		}
+		q.mutex.Unlock()
+
+		if expired == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-q.space:
+		case <-q.done:
+		case <-expired:
+			return q.Push(pl)
+		}
+	}
+}
+
+// newWaitingQueue returns a queue of size payloads feeding dst. A goroutine
+// moves the payloads to dst and waits for up to the duration returned by
+// timeout for room in dst when it is full, see PushWait. This lets a listener
+// wait for room in its queue without blocking the producer sending payloads
+// to all listeners, which only pushes to the returned queue. dropped is called
+// for every payload dropped by dst.
+//
+// Once the returned queue has been closed and emptied, dst is closed. If dst
+// is closed first, the returned queue is closed and its payloads are
+// discarded.
+func newWaitingQueue(dst *payloadQueue, size int, timeout func() time.Duration, dropped func()) *payloadQueue {
+	q := newPayloadQueue(size, size)
+
+	go func() {
+		for {
+			pl, ok := q.Pop()
+			if !ok {
+				dst.Close()
+				return
+			}
+			if !dst.PushWait(pl, timeout()) {
+				if dst.Closed() {
+					q.Close()
+					return
+				}
+				dropped()
+			}
+		}
+	}()
+
+	return q
+}
+
+// fullLocked returns true if the queue can neither hold nor grow to hold
+// another payload, q.mutex must be held
+func (q *payloadQueue) fullLocked() bool {
+	return len(q.items) >= q.size && q.size >= q.maxSize
+}
+
+// pushLocked implements Push, q.mutex must be held and the queue must not be
+// closed
+func (q *payloadQueue) pushLocked(pl *payload.Payload) bool {
+	if len(q.items) >= q.size && q.size < q.maxSize {
+		q.size *= 2
+		if q.size > q.maxSize {
+			q.size = q.maxSize
+		}
+	}
+
+	queued := true
+	if len(q.items) >= q.size {
+		queued = false
+		atomic.AddUint64(&q.dropped, 1)
+
+		oldest := -1
+		for i, item := range q.items {
+			if isLowPriority(item) {
+				oldest = i
+				break
+			}
+		}
+		if oldest < 0 {
+			return false
+		}
+		copy(q.items[oldest:], q.items[oldest+1:])
+		q.items = q.items[:len(q.items)-1]
+	}
+
+	q.items = append(q.items, pl)
+	q.signal()
+
+	return queued
+}
+
+// Pop removes and returns the payload at the front of the queue, blocking
+// until a payload is available. Returns false once the queue has been closed
+// and all payloads have been removed.
+func (q *payloadQueue) Pop() (*payload.Payload, bool) {
+	return q.PopTimeout(0)
+}
+
+// PopTimeout is Pop, but returns a nil payload and true if no payload has
+// become available within timeout. A timeout of 0 waits indefinitely.
+func (q *payloadQueue) PopTimeout(timeout time.Duration) (*payload.Payload, bool) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		q.mutex.Lock()
+		if len(q.items) > 0 {
+			pl := q.items[0]
+			q.items[0] = nil
+			q.items = q.items[1:]
+			if len(q.items) == 0 && q.size > q.initialSize {
+				// Release the memory of the grown queue
+				q.items = nil
+				q.size = q.initialSize
+			}
+			q.mutex.Unlock()
+
+			select {
+			case q.space <- struct{}{}:
+			default:
+			}
+			return pl, true
+		}
+		closed := q.closed
+		q.mutex.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-q.notify:
+		case <-expired:
+			return nil, true
+		}
+	}
+}
+
+// Len returns the number of payloads in the queue
+func (q *payloadQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// Dropped returns the number of payloads dropped because the queue was full
+func (q *payloadQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Closed returns true if the queue has been closed
+func (q *payloadQueue) Closed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// Close closes the queue. Payloads already in the queue can still be
+// removed with Pop, further payloads are dropped and PushWait no longer
+// waits.
+func (q *payloadQueue) Close() {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+	q.mutex.Unlock()
+	q.signal()
+}
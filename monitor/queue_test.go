@@ -0,0 +1,188 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/cilium/cilium/monitor/payload"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestPayloadQueueGrowth(c *C) {
+	q := newPayloadQueue(2, 5)
+	for seq := uint64(1); seq <= 5; seq++ {
+		c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: seq}), Equals, true)
+	}
+
+	// The queue doubled its size twice, bounded by maxSize
+	c.Assert(q.size, Equals, 5)
+	c.Assert(q.Len(), Equals, 5)
+	c.Assert(q.Dropped(), Equals, uint64(0))
+
+	// Once grown to maxSize, the oldest payload is dropped
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 6}), Equals, false)
+	c.Assert(q.size, Equals, 5)
+	c.Assert(q.Dropped(), Equals, uint64(1))
+	pl, ok := q.Pop()
+	c.Assert(ok, Equals, true)
+	c.Assert(pl.Seq, Equals, uint64(2))
+
+	// The queue shrinks back to its initial size once it has been emptied
+	for i := 0; i < 4; i++ {
+		_, ok = q.Pop()
+		c.Assert(ok, Equals, true)
+	}
+	c.Assert(q.size, Equals, 2)
+	c.Assert(q.Len(), Equals, 0)
+}
+
+func (s *MonitorSuite) TestPayloadQueuePriority(c *C) {
+	q := newPayloadQueue(3, 3)
+	c.Assert(q.Push(&payload.Payload{Type: payload.RecordLost, Lost: 1}), Equals, true)
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 1}), Equals, true)
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 2}), Equals, true)
+
+	// The oldest event samples are dropped in favour of records of lost
+	// events
+	c.Assert(q.Push(&payload.Payload{Type: payload.RecordLost, Lost: 2}), Equals, false)
+	c.Assert(q.Push(&payload.Payload{Type: payload.RecordLost, Lost: 3}), Equals, false)
+	c.Assert(q.Dropped(), Equals, uint64(2))
+
+	// Once the queue only holds records of lost events, the new payload
+	// is dropped
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 3}), Equals, false)
+	c.Assert(q.Dropped(), Equals, uint64(3))
+
+	var popped []*payload.Payload
+	for q.Len() > 0 {
+		pl, ok := q.Pop()
+		c.Assert(ok, Equals, true)
+		popped = append(popped, pl)
+	}
+	c.Assert(popped, DeepEquals, []*payload.Payload{
+		{Type: payload.RecordLost, Lost: 1},
+		{Type: payload.RecordLost, Lost: 2},
+		{Type: payload.RecordLost, Lost: 3},
+	})
+}
+
+func (s *MonitorSuite) TestPayloadQueuePushWait(c *C) {
+	q := newPayloadQueue(1, 1)
+	c.Assert(q.PushWait(&payload.Payload{Type: payload.EventSample, Seq: 1}, time.Minute), Equals, true)
+
+	// A full queue waits for a payload to be popped
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.PushWait(&payload.Payload{Type: payload.EventSample, Seq: 2}, time.Minute)
+	}()
+	select {
+	case <-pushed:
+		c.Fatal("PushWait() returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pl, ok := q.Pop()
+	c.Assert(ok, Equals, true)
+	c.Assert(pl.Seq, Equals, uint64(1))
+	c.Assert(<-pushed, Equals, true)
+	c.Assert(q.Dropped(), Equals, uint64(0))
+
+	// The oldest payload is dropped once the timeout expires
+	c.Assert(q.PushWait(&payload.Payload{Type: payload.EventSample, Seq: 3}, 10*time.Millisecond), Equals, false)
+	c.Assert(q.Dropped(), Equals, uint64(1))
+	pl, ok = q.Pop()
+	c.Assert(ok, Equals, true)
+	c.Assert(pl.Seq, Equals, uint64(3))
+
+	// Closing the queue releases a waiting producer
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 4}), Equals, true)
+	go func() {
+		pushed <- q.PushWait(&payload.Payload{Type: payload.EventSample, Seq: 5}, time.Minute)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	select {
+	case ok = <-pushed:
+		c.Assert(ok, Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatal("PushWait() not released by Close()")
+	}
+}
+
+func (s *MonitorSuite) TestWaitingQueue(c *C) {
+	dst := newPayloadQueue(1, 1)
+	dropped := make(chan struct{}, 10)
+	q := newWaitingQueue(dst, 3, func() time.Duration { return time.Minute }, func() {
+		dropped <- struct{}{}
+	})
+
+	// Pushing never waits, even though dst is full
+	start := time.Now()
+	for i := uint64(1); i <= 3; i++ {
+		c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: i}), Equals, true)
+	}
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	// The payloads waiting for room in dst are not dropped
+	for i := uint64(1); i <= 3; i++ {
+		pl, ok := dst.PopTimeout(5 * time.Second)
+		c.Assert(ok, Equals, true)
+		c.Assert(pl, Not(IsNil))
+		c.Assert(pl.Seq, Equals, i)
+	}
+	c.Assert(dropped, HasLen, 0)
+
+	// Closing the waiting queue closes dst once it has been emptied
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 4}), Equals, true)
+	q.Close()
+	pl, ok := dst.PopTimeout(5 * time.Second)
+	c.Assert(ok, Equals, true)
+	c.Assert(pl.Seq, Equals, uint64(4))
+	_, ok = dst.PopTimeout(5 * time.Second)
+	c.Assert(ok, Equals, false)
+
+	// Closing dst releases the goroutine waiting for room
+	dst = newPayloadQueue(1, 1)
+	q = newWaitingQueue(dst, 2, func() time.Duration { return time.Minute }, func() {
+		dropped <- struct{}{}
+	})
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 1}), Equals, true)
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 2}), Equals, true)
+	time.Sleep(10 * time.Millisecond)
+	dst.Close()
+	for i := 0; !q.Closed() && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(q.Closed(), Equals, true)
+	c.Assert(dropped, HasLen, 0)
+}
+
+func (s *MonitorSuite) TestPayloadQueuePopTimeout(c *C) {
+	q := newPayloadQueue(1, 1)
+
+	pl, ok := q.PopTimeout(10 * time.Millisecond)
+	c.Assert(ok, Equals, true)
+	c.Assert(pl, IsNil)
+
+	c.Assert(q.Push(&payload.Payload{Type: payload.EventSample, Seq: 1}), Equals, true)
+	pl, ok = q.PopTimeout(time.Minute)
+	c.Assert(ok, Equals, true)
+	c.Assert(pl.Seq, Equals, uint64(1))
+
+	q.Close()
+	_, ok = q.PopTimeout(time.Minute)
+	c.Assert(ok, Equals, false)
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting the rate of event samples enqueued
+// to a listener. The bucket holds up to burst tokens and is refilled with limit
+// tokens per second. It is implemented as a generic cell rate algorithm,
+// which only keeps the theoretical arrival time of the next payload, so that
+// the bucket can be updated with a single atomic compare-and-swap on the hot
+// path of Enqueue.
+type rateLimiter struct {
+	limit int
+	burst int
+
+	// interval is the time in nanoseconds it takes to refill a single
+	// token
+	interval int64
+
+	// tat is the theoretical arrival time of the next payload in
+	// nanoseconds since the epoch. The bucket is empty if tat is burst
+	// intervals ahead of now. It must be accessed atomically.
+	tat int64
+}
+
+// newRateLimiter returns a rate limiter allowing limit payloads per second
+// with bursts of up to burst payloads. A burst of 0 allows bursts of limit
+// payloads. Returns nil, which allows all payloads, if limit is 0.
+func newRateLimiter(limit, burst int) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = limit
+	}
+	return &rateLimiter{
+		limit:    limit,
+		burst:    burst,
+		interval: int64(time.Second) / int64(limit),
+	}
+}
+
+// allow takes a token from the bucket. Returns false if the bucket is empty,
+// in which case the payload exceeds the limit and must be dropped.
+func (l *rateLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	for {
+		tat := atomic.LoadInt64(&l.tat)
+		next := tat
+		if next < now {
+			next = now
+		}
+		next += l.interval
+		if next-now > int64(l.burst)*l.interval {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.tat, tat, next) {
+			return true
+		}
+	}
+}
+
+// Limit returns the number of payloads allowed per second, 0 if unlimited
+func (l *rateLimiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return l.limit
+}
+
+// Burst returns the maximum number of payloads allowed in a burst, 0 if
+// unlimited
+func (l *rateLimiter) Burst() int {
+	if l == nil {
+		return 0
+	}
+	return l.burst
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MonitorSuite) TestRateLimiter(c *C) {
+	// Payloads are not limited by default
+	var l *rateLimiter
+	c.Assert(newRateLimiter(0, 10), IsNil)
+	c.Assert(l.allow(), Equals, true)
+	c.Assert(l.Limit(), Equals, 0)
+
+	// The burst defaults to the limit
+	c.Assert(newRateLimiter(10, 0).Burst(), Equals, 10)
+
+	l = newRateLimiter(100, 5)
+	for i := 0; i < 5; i++ {
+		c.Assert(l.allow(), Equals, true)
+	}
+	c.Assert(l.allow(), Equals, false)
+
+	// A token is refilled every 10ms
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(l.allow(), Equals, true)
+}
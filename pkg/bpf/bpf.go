@@ -80,6 +80,7 @@ const (
 	BPF_BTF_LOAD            = 18
 	BPF_BTF_GET_FD_BY_ID    = 19
 	BPF_TASK_FD_QUERY       = 20
+	BPF_MAP_DELETE_BATCH    = 27
 
 	// Flags for BPF_MAP_UPDATE_ELEM. Must match values from linux/bpf.h
 	BPF_ANY     = 0
@@ -221,6 +222,51 @@ func DeleteElement(fd int, key unsafe.Pointer) error {
 	return nil
 }
 
+// This struct must be in sync with union bpf_attr's anonymous struct used by
+// BPF_MAP_*_BATCH commands
+type bpfAttrMapBatch struct {
+	inBatch   uint64
+	outBatch  uint64
+	keys      uint64
+	values    uint64
+	count     uint32
+	mapFd     uint32
+	elemFlags uint64
+	flags     uint64
+}
+
+func deleteBatch(fd int, keys unsafe.Pointer, count uint32) (uint32, syscall.Errno) {
+	uba := bpfAttrMapBatch{
+		mapFd: uint32(fd),
+		keys:  uint64(uintptr(keys)),
+		count: count,
+	}
+	_, _, err := unix.Syscall(
+		unix.SYS_BPF,
+		BPF_MAP_DELETE_BATCH,
+		uintptr(unsafe.Pointer(&uba)),
+		unsafe.Sizeof(uba),
+	)
+
+	// On error, count holds the number of keys deleted before the key
+	// which failed.
+	return uba.count, err
+}
+
+// DeleteBatch deletes the 'count' map elements with the keys stored
+// contiguously at 'keys' with a single syscall. The keys are deleted in
+// order, the number of deleted keys is returned. On error, the key following
+// the deleted keys is the one which could not be deleted.
+func DeleteBatch(fd int, keys unsafe.Pointer, count uint32) (uint32, error) {
+	deleted, err := deleteBatch(fd, keys, count)
+
+	if err != 0 {
+		return deleted, fmt.Errorf("Unable to delete batch of elements from map with file descriptor %d: %s", fd, err)
+	}
+
+	return deleted, nil
+}
+
 // GetNextKey stores, in nextKey, the next key after the key of the map in fd.
 func GetNextKey(fd int, key, nextKey unsafe.Pointer) error {
 	uba := bpfAttrMapOpElem{
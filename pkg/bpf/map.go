@@ -273,6 +273,11 @@ func (m *Map) GetFd() int {
 	return m.fd
 }
 
+// Name returns the name of the map
+func (m *Map) Name() string {
+	return m.name
+}
+
 // Path returns the path to this map on the filesystem.
 func (m *Map) Path() (string, error) {
 	if err := m.setPathIfUnset(); err != nil {
@@ -760,6 +765,64 @@ func (m *Map) Delete(key MapKey) error {
 	return err
 }
 
+// SupportsDeleteBatch returns true if the kernel supports deleting multiple
+// elements of the map with a single syscall, see DeleteBatch(). The map is
+// probed with an empty batch, so the result depends on the type of the map as
+// well as on the kernel version.
+func (m *Map) SupportsDeleteBatch() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.Open(); err != nil {
+		return false
+	}
+
+	_, errno := deleteBatch(m.fd, nil, 0)
+	return errno == 0
+}
+
+// DeleteBatch deletes the elements with the given keys from the map with a
+// single syscall, see SupportsDeleteBatch(). The keys are deleted in order,
+// the number of deleted keys is returned. On error, keys[n] with n being the
+// number of deleted keys is the key which could not be deleted; the keys
+// following it have not been attempted.
+func (m *Map) DeleteBatch(keys []MapKey) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.Open(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, len(keys)*int(m.KeySize))
+	for i, key := range keys {
+		k := (*[1 << 30]byte)(key.GetKeyPtr())[:m.KeySize:m.KeySize]
+		copy(buf[i*int(m.KeySize):], k)
+	}
+
+	count, errno := deleteBatch(m.fd, unsafe.Pointer(&buf[0]), uint32(len(keys)))
+	deleted := int(count)
+	if deleted > len(keys) {
+		deleted = len(keys)
+	}
+	for _, key := range keys[:deleted] {
+		m.deleteCacheEntry(key, nil)
+	}
+
+	if errno != 0 {
+		if deleted == len(keys) {
+			return deleted, fmt.Errorf("Unable to delete batch of elements from map %s: %s", m.name, errno.Error())
+		}
+		return deleted, fmt.Errorf("Unable to delete key %s from map %s: %s", keys[deleted], m.name, errno.Error())
+	}
+
+	return deleted, nil
+}
+
 // scopedLogger returns a logger scoped for the map. m.lock must be held.
 func (m *Map) scopedLogger() *logrus.Entry {
 	return log.WithFields(logrus.Fields{logfields.Path: m.path, "name": m.name})
@@ -808,7 +871,7 @@ func (m *Map) DeleteAll() error {
 		if err2 == nil {
 			m.deleteCacheEntry(k, err)
 		} else {
-			log.WithError(err2).Warning("Unable to correlate iteration key %v with cache entry. Inconsistent cache.", nextKey)
+			log.WithError(err2).Warningf("Unable to correlate iteration key %v with cache entry. Inconsistent cache.", nextKey)
 		}
 
 		if err != nil {
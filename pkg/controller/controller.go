@@ -15,6 +15,7 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -45,6 +46,12 @@ type ExitReason struct {
 	error
 }
 
+// NewExitReason returns a new ExitReason with the given reason, e.g. for use
+// outside of this package
+func NewExitReason(reason string) ExitReason {
+	return ExitReason{errors.New(reason)}
+}
+
 // ControllerParams contains all parameters of a controller
 type ControllerParams struct {
 	// DoFunc is the function that will be run until it succeeds and/or
@@ -0,0 +1,173 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxChurnPrefixes is the maximum number of prefixes tracked by the
+	// churn detection
+	maxChurnPrefixes = 16384
+
+	// churnForgetRate is the decayed rate below which a prefix is no
+	// longer tracked
+	churnForgetRate = 0.1
+)
+
+// prefixChurn is the identity churn of a single prefix
+type prefixChurn struct {
+	// rate is the number of identity changes of the prefix, decayed
+	// exponentially with the churn window as time constant
+	rate float64
+
+	// lastChange is the time of the last identity change
+	lastChange time.Time
+
+	// alerted is true while the rate exceeds the threshold and the
+	// prefix has been reported
+	alerted bool
+}
+
+// decayedRate returns the rate of the prefix at time 'now'
+func (p *prefixChurn) decayedRate(now time.Time, window time.Duration) float64 {
+	elapsed := now.Sub(p.lastChange)
+	if elapsed <= 0 {
+		return p.rate
+	}
+	return p.rate * math.Exp(-float64(elapsed)/float64(window))
+}
+
+// churnTracker detects prefixes whose identity changes more than threshold
+// times within window. The number of tracked prefixes is bounded by
+// maxPrefixes; changes of new prefixes are not tracked while the tracker is
+// full and no tracked prefix has decayed enough to be forgotten.
+type churnTracker struct {
+	mutex       lock.Mutex
+	threshold   int
+	window      time.Duration
+	maxPrefixes int
+	prefixes    map[string]*prefixChurn
+}
+
+func newChurnTracker(threshold int, window time.Duration) *churnTracker {
+	return &churnTracker{
+		threshold:   threshold,
+		window:      window,
+		maxPrefixes: maxChurnPrefixes,
+		prefixes:    map[string]*prefixChurn{},
+	}
+}
+
+// WithChurnDetection enables the detection of prefixes whose identity changes
+// more than 'threshold' times within 'window', which typically indicates the
+// reuse of IPs or a misconfiguration. Such prefixes are logged and counted in
+// the ipcache_identity_churn_alerts_total metric. It must be called before
+// the listener is registered with the IPCache.
+func (l *BPFListener) WithChurnDetection(threshold int, window time.Duration) *BPFListener {
+	l.churn = newChurnTracker(threshold, window)
+	return l
+}
+
+// isIdentityChange returns true if the IPCache modification changes the
+// identity associated with the prefix
+func isIdentityChange(modType ipcache.CacheModification, oldID *identity.NumericIdentity, newID identity.NumericIdentity) bool {
+	switch modType {
+	case ipcache.Upsert:
+		return oldID == nil || *oldID != newID
+	case ipcache.Delete:
+		return true
+	}
+	return false
+}
+
+// forgetDecayed removes all prefixes whose rate has decayed below
+// churnForgetRate. Must be called with t.mutex held.
+func (t *churnTracker) forgetDecayed(now time.Time) {
+	for prefix, p := range t.prefixes {
+		if p.decayedRate(now, t.window) < churnForgetRate {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// record accounts an identity change of 'cidr' at time 'now' and returns the
+// decayed rate of changes of the prefix, and whether the rate has exceeded
+// the threshold with this change.
+func (t *churnTracker) record(cidr net.IPNet, now time.Time) (float64, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	prefix := cidr.String()
+	p, ok := t.prefixes[prefix]
+	if !ok {
+		if len(t.prefixes) >= t.maxPrefixes {
+			t.forgetDecayed(now)
+			if len(t.prefixes) >= t.maxPrefixes {
+				return 0, false
+			}
+		}
+		p = &prefixChurn{}
+		t.prefixes[prefix] = p
+	}
+
+	p.rate = p.decayedRate(now, t.window) + 1
+	p.lastChange = now
+
+	threshold := float64(t.threshold)
+	switch {
+	case p.rate > threshold && !p.alerted:
+		p.alerted = true
+		return p.rate, true
+	case p.rate <= threshold/2:
+		// Report the prefix again once it has calmed down and
+		// starts flapping again.
+		p.alerted = false
+	}
+
+	return p.rate, false
+}
+
+// recordChurn accounts the modification of the IPCache for the churn
+// detection, if enabled.
+func (l *BPFListener) recordChurn(modType ipcache.CacheModification, cidr net.IPNet,
+	oldID *identity.NumericIdentity, newID identity.NumericIdentity) {
+	if l.churn == nil || !isIdentityChange(modType, oldID, newID) {
+		return
+	}
+
+	rate, exceeded := l.churn.record(cidr, time.Now())
+	if exceeded {
+		metrics.IPCacheIdentityChurnAlerts.Inc()
+		log.WithFields(logrus.Fields{
+			logfields.IPAddr:   cidr,
+			logfields.Identity: newID,
+			"rate":             int(rate),
+			"threshold":        l.churn.threshold,
+			"window":           l.churn.window,
+		}).Warning("Identity of prefix is changing rapidly, this may indicate IP reuse or a misconfiguration")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+
+	"github.com/sirupsen/logrus"
+)
+
+// coalescedChange is the latest change of a prefix within the coalescing
+// window
+type coalescedChange struct {
+	modType    ipcache.CacheModification
+	cidr       net.IPNet
+	hostIP     net.IP
+	id         identity.NumericIdentity
+	encryptKey uint8
+
+	// existed is true if the prefix was known to the listener before the
+	// first change within the window, and may thus be present in the BPF
+	// map
+	existed bool
+}
+
+// changeCoalescer accumulates the changes of the IPCache for a window, so
+// that only the final state of each prefix is written into the BPF map.
+type changeCoalescer struct {
+	mutex   lock.Mutex
+	window  time.Duration
+	pending map[ipcacheMap.Key]*coalescedChange
+
+	// startOnce guards starting the controller flushing the changes
+	startOnce sync.Once
+}
+
+// WithCoalescing enables the coalescing of changes of the IPCache: changes
+// are accumulated for 'window' and the final state of each prefix is then
+// written into the BPF map in one flush. This reduces the number of map
+// operations when the IPCache changes in bursts, e.g. while the agent
+// restarts. It must be called before the listener is registered with the
+// IPCache.
+func (l *BPFListener) WithCoalescing(window time.Duration) *BPFListener {
+	l.coalescer = &changeCoalescer{
+		window:  window,
+		pending: map[ipcacheMap.Key]*coalescedChange{},
+	}
+	return l
+}
+
+// add records the change of the prefix 'key', superseding any earlier change
+// within the window. An upsert of a prefix unknown before the window which
+// is followed by a delete cancels out; should a stale entry from a previous
+// run of the agent exist in the BPF map, it is removed by the garbage
+// collection.
+func (c *changeCoalescer) add(key ipcacheMap.Key, change coalescedChange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if prev, ok := c.pending[key]; ok {
+		change.existed = prev.existed
+	}
+	if change.modType == ipcache.Delete && !change.existed {
+		delete(c.pending, key)
+		return
+	}
+	c.pending[key] = &change
+}
+
+// len returns the number of prefixes with pending changes
+func (c *changeCoalescer) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.pending)
+}
+
+// coalesce records the change to be written into the BPF map with the next
+// flush.
+func (l *BPFListener) coalesce(key ipcacheMap.Key, modType ipcache.CacheModification, cidr net.IPNet,
+	newHostIP net.IP, oldID *identity.NumericIdentity, newID identity.NumericIdentity, encryptKey uint8) {
+	l.coalescer.add(key, coalescedChange{
+		modType:    modType,
+		cidr:       cidr,
+		hostIP:     newHostIP,
+		id:         newID,
+		encryptKey: encryptKey,
+		existed:    modType == ipcache.Delete || oldID != nil,
+	})
+
+	l.coalescer.startOnce.Do(func() {
+		controller.NewManager().UpdateController(l.controllerName("ipcache-bpf-coalescing"),
+			controller.ControllerParams{
+				DoFunc: func() error {
+					l.flushCoalescedChanges()
+					return nil
+				},
+				RunInterval: l.coalescer.window,
+			},
+		)
+	})
+}
+
+// flushCoalescedChanges writes the final state of all prefixes changed
+// within the window into the BPF map.
+func (l *BPFListener) flushCoalescedChanges() {
+	l.flushPendingChanges()
+	l.checkSynced()
+}
+
+// flushPendingChanges applies the pending changes. The ipcache is locked for
+// reading so that no change is applied after it has been superseded by a
+// concurrent change of the ipcache.
+func (l *BPFListener) flushPendingChanges() {
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	c := l.coalescer
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = map[ipcacheMap.Key]*coalescedChange{}
+	c.mutex.Unlock()
+
+	for key, change := range pending {
+		scopedLog := log.WithFields(logrus.Fields{
+			logfields.IPAddr:       change.cidr,
+			logfields.Identity:     change.id,
+			logfields.Modification: change.modType,
+		})
+		l.applyChange(key, change.modType, change.cidr, change.hostIP, change.id, change.encryptKey, scopedLog)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+)
+
+// consistencyCheckInterval is the minimum interval between two comparisons
+// of the BPF map with the in-memory ipcache, see CheckConsistency()
+const consistencyCheckInterval = 30 * time.Second
+
+// ConsistencyStatus is the result of a comparison of the BPF map with the
+// in-memory ipcache. Only the prefixes are compared, not their values.
+type ConsistencyStatus struct {
+	// OnlyInBPF is the number of entries of the BPF map whose prefix does
+	// not exist in the in-memory ipcache
+	OnlyInBPF int
+
+	// OnlyInMemory is the number of prefixes of the in-memory ipcache
+	// without an entry in the BPF map
+	OnlyInMemory int
+
+	// Timestamp is the time of the comparison
+	Timestamp time.Time
+}
+
+// InSync returns true if the BPF map and the in-memory ipcache contain the
+// same prefixes
+func (s ConsistencyStatus) InSync() bool {
+	return s.OnlyInBPF == 0 && s.OnlyInMemory == 0
+}
+
+// consistencyCache holds the result of the last comparison
+type consistencyCache struct {
+	mutex  lock.Mutex
+	status *ConsistencyStatus
+}
+
+// memoryPrefixCollector collects the keys of the prefixes of the in-memory
+// ipcache dumped by CheckConsistency()
+type memoryPrefixCollector struct {
+	keys map[ipcacheMap.Key]struct{}
+}
+
+func (m *memoryPrefixCollector) OnIPIdentityCacheChange(modType ipcache.CacheModification, cidr net.IPNet,
+	oldHostIP, newHostIP net.IP, oldID *identity.NumericIdentity, newID identity.NumericIdentity,
+	encryptKey uint8) {
+	m.keys[ipcacheMap.NewKey(cidr.IP, cidr.Mask)] = struct{}{}
+}
+
+func (m *memoryPrefixCollector) OnIPIdentityCacheGC() {}
+
+// CheckConsistency compares the prefixes of the BPF map with those of the
+// in-memory ipcache without modifying the BPF map, e.g. to report whether
+// the BPF map is in sync in the status of the agent. The BPF map is dumped at
+// most once per consistencyCheckInterval, the result of the last comparison
+// is returned in between.
+func (l *BPFListener) CheckConsistency() (ConsistencyStatus, error) {
+	c := &l.consistency
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.status != nil && time.Since(c.status.Timestamp) < consistencyCheckInterval {
+		return *c.status, nil
+	}
+
+	status, err := l.compareWithMemory()
+	if err != nil {
+		return ConsistencyStatus{}, err
+	}
+	c.status = &status
+	return status, nil
+}
+
+// compareWithMemory compares the prefixes of the BPF map with those of the
+// in-memory ipcache, like garbage collection does to find stale entries.
+func (l *BPFListener) compareWithMemory() (ConsistencyStatus, error) {
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	inBPF, err := l.dumpKeys()
+	if err != nil {
+		return ConsistencyStatus{}, err
+	}
+
+	inMemory := &memoryPrefixCollector{keys: map[ipcacheMap.Key]struct{}{}}
+	ipcache.IPIdentityCache.DumpToListenerLocked(inMemory)
+
+	status := ConsistencyStatus{Timestamp: time.Now()}
+	for key := range inBPF {
+		if _, ok := inMemory.keys[key]; !ok {
+			status.OnlyInBPF++
+		}
+	}
+	for key := range inMemory.keys {
+		if _, ok := inBPF[key]; !ok {
+			status.OnlyInMemory++
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	"github.com/cilium/cilium/pkg/identity"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+)
+
+// PrefixesForIdentity returns all prefixes which map to the given security
+// identity in the BPF ipcache map. The map is dumped on every call, so this
+// is intended for debugging and for analyzing the impact of identity
+// changes rather than for use on hot paths.
+func (l *BPFListener) PrefixesForIdentity(id identity.NumericIdentity) ([]net.IPNet, error) {
+	prefixes := []net.IPNet{}
+	err := l.bpfMap.DumpWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		if identity.NumericIdentity(value.(*ipcacheMap.RemoteEndpointInfo).SecurityIdentity) == id {
+			prefixes = append(prefixes, key.(*ipcacheMap.Key).IPNet())
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error dumping ipcache BPF map: %s", err)
+	}
+
+	return prefixes, nil
+}
+
+// Dump returns all entries of the BPF ipcache map, sorted by address family,
+// address and prefix length. Only the BPF map is read, so the ipcache lock
+// does not need to be held.
+func (l *BPFListener) Dump() ([]ipcacheMap.Entry, error) {
+	entries := []ipcacheMap.Entry{}
+	err := l.bpfMap.DumpWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		entries = append(entries, ipcacheMap.Entry{
+			Key:   *key.(*ipcacheMap.Key),
+			Value: *value.(*ipcacheMap.RemoteEndpointInfo),
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error dumping ipcache BPF map: %s", err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Less(&entries[j])
+	})
+
+	return entries, nil
+}
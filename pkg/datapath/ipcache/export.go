@@ -0,0 +1,138 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+)
+
+// exportChunkSize is the number of entries the export buffer grows by while
+// the BPF map is dumped
+const exportChunkSize = 1024
+
+// exportEntry is the representation of a single BPF ipcache entry used when
+// exporting the contents of the map for offline analysis.
+type exportEntry struct {
+	Prefix         string `json:"prefix"`
+	Identity       uint32 `json:"identity"`
+	TunnelEndpoint string `json:"tunnel-endpoint,omitempty"`
+	EncryptKey     uint8  `json:"encrypt-key,omitempty"`
+}
+
+var csvHeader = []string{"prefix", "identity", "tunnel-endpoint", "encrypt-key"}
+
+func newExportEntry(key *ipcacheMap.Key, value *ipcacheMap.RemoteEndpointInfo) exportEntry {
+	entry := exportEntry{
+		Prefix:     key.String(),
+		Identity:   value.SecurityIdentity,
+		EncryptKey: value.Key,
+	}
+
+	if tunnelEndpoint := net.IP(value.TunnelEndpoint[:]); !tunnelEndpoint.IsUnspecified() {
+		entry.TunnelEndpoint = tunnelEndpoint.String()
+	}
+
+	return entry
+}
+
+// exportWithCallback dumps the BPF map and passes each entry to 'fn'. The
+// entries are copied into a buffer while the map is dumped and are only
+// passed to 'fn' once the dump has completed, so that the lock of the map is
+// not held while 'fn' writes them out, e.g. to a slow client. The buffer
+// grows in chunks of exportChunkSize entries and is bounded by the maximum
+// size of the map. The export is aborted at the first error returned by
+// 'fn'.
+func (l *BPFListener) exportWithCallback(fn func(exportEntry) error) error {
+	var (
+		chunks  [][]ipcacheMap.Entry
+		count   int
+		tooMany bool
+	)
+	err := l.bpfMap.DumpWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		if count >= ipcacheMap.MaxEntries {
+			tooMany = true
+			return
+		}
+		if count%exportChunkSize == 0 {
+			chunks = append(chunks, make([]ipcacheMap.Entry, 0, exportChunkSize))
+		}
+		chunk := &chunks[len(chunks)-1]
+		*chunk = append(*chunk, ipcacheMap.Entry{
+			Key:   *key.(*ipcacheMap.Key),
+			Value: *value.(*ipcacheMap.RemoteEndpointInfo),
+		})
+		count++
+	})
+	if err != nil {
+		return err
+	}
+	if tooMany {
+		return fmt.Errorf("ipcache BPF map holds more than %d entries", ipcacheMap.MaxEntries)
+	}
+
+	for _, chunk := range chunks {
+		for i := range chunk {
+			if err := fn(newExportEntry(&chunk[i].Key, &chunk[i].Value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ExportJSON writes all entries of the BPF ipcache map into 'w' as a stream
+// of newline-delimited JSON objects, each carrying the "prefix", "identity"
+// and optional "tunnel-endpoint" and "encrypt-key" of an entry. The entries
+// are written after the map has been dumped, see exportWithCallback().
+func (l *BPFListener) ExportJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return l.exportWithCallback(func(entry exportEntry) error {
+		return enc.Encode(entry)
+	})
+}
+
+// ExportCSV writes all entries of the BPF ipcache map into 'w' in CSV format
+// with the columns "prefix", "identity", "tunnel-endpoint" and "encrypt-key",
+// preceded by a header line. The entries are written after the map has been
+// dumped, see exportWithCallback().
+func (l *BPFListener) ExportCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	if err := csvWriter.Write(csvHeader); err != nil {
+		return err
+	}
+
+	err := l.exportWithCallback(func(entry exportEntry) error {
+		return csvWriter.Write([]string{
+			entry.Prefix,
+			strconv.FormatUint(uint64(entry.Identity), 10),
+			entry.TunnelEndpoint,
+			strconv.FormatUint(uint64(entry.EncryptKey), 10),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"sync"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+)
+
+// batchDeleter is implemented by BPF maps which can delete multiple entries
+// with a single syscall, see bpf.Map.DeleteBatch()
+type batchDeleter interface {
+	SupportsDeleteBatch() bool
+	DeleteBatch(keys []bpf.MapKey) (int, error)
+}
+
+var _ batchDeleter = &ipcacheMap.Map{}
+
+// batchDeleteSupport caches whether the BPF map supports batched deletion
+type batchDeleteSupport struct {
+	once      sync.Once
+	supported bool
+}
+
+// WithGCDeleteBatchSize sets the maximum number of stale entries which garbage
+// collection deletes from the BPF map at once, and returns the listener. The
+// ipcache lock is held for the duration of each batch. If the BPF map
+// supports it, each batch is deleted with a single syscall. Values below 1
+// are ignored. It must be called before OnIPIdentityCacheGC().
+func (l *BPFListener) WithGCDeleteBatchSize(size int) *BPFListener {
+	if size > 0 {
+		l.gcDeleteBatchSize = size
+	}
+	return l
+}
+
+// batchDeleter returns the BPF map as batchDeleter if the BPF map supports
+// batched deletion. Support is probed on the first call only.
+func (l *BPFListener) batchDeleter() (batchDeleter, bool) {
+	bd, ok := l.bpfMap.(batchDeleter)
+	if !ok {
+		return nil, false
+	}
+
+	l.batchDelete.once.Do(func() {
+		l.batchDelete.supported = bd.SupportsDeleteBatch()
+		log.WithField("supported", l.batchDelete.supported).
+			Debug("Probed support for batched deletion from ipcache BPF map")
+	})
+	return bd, l.batchDelete.supported
+}
+
+// deleteStaleKeysBatched deletes the entries with the prefixes 'stale' from
+// the BPF map with a single syscall. It returns the prefixes of the entries
+// which were not deleted because the deletion of one of them failed, to be
+// deleted individually.
+//
+// Must be called while holding ipcache.IPIdentityCache.Lock for reading.
+func (l *BPFListener) deleteStaleKeysBatched(bd batchDeleter, stale []string, keysToRemove map[string]*ipcacheMap.Key) []string {
+	keys := make([]bpf.MapKey, 0, len(stale))
+	for _, keyToIP := range stale {
+		k := keysToRemove[keyToIP]
+		l.shadow.forget(*k)
+		keys = append(keys, k)
+	}
+
+	deleted, err := bd.DeleteBatch(keys)
+	for _, keyToIP := range stale[:deleted] {
+		countMapOperation(metricOpGC, nil)
+		l.gcSources.forget(keyToIP)
+	}
+	if err != nil {
+		scopedLog := log.WithError(err).WithField("deleted", deleted)
+		if deleted < len(keys) {
+			scopedLog = scopedLog.WithField(logfields.BPFMapKey, keys[deleted])
+		}
+		scopedLog.Warning("Batched deletion from ipcache BPF map failed, deleting remaining entries individually")
+	}
+
+	return stale[deleted:]
+}
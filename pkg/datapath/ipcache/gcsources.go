@@ -0,0 +1,202 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GCSourceUnknown is the pseudo-source of the entries of the BPF map whose
+// prefix has never been observed in the in-memory ipcache, e.g. entries left
+// over from a previous run of the agent
+const GCSourceUnknown ipcache.Source = "unknown"
+
+// gcSourcesMaxEntries bounds the number of prefixes whose source is recorded
+// to the capacity of the BPF ipcache map
+const gcSourcesMaxEntries = ipcacheMap.MaxEntries
+
+// DefaultGCSources are the sources whose entries are removed from the BPF map
+// by garbage collection by default, see WithGCSources()
+var DefaultGCSources = []ipcache.Source{ipcache.FromKVStore, ipcache.FromAgentLocal, GCSourceUnknown}
+
+// ParseGCSources parses the names of the sources whose entries are eligible
+// for garbage collection, see WithGCSources()
+func ParseGCSources(names []string) ([]ipcache.Source, error) {
+	sources := make([]ipcache.Source, 0, len(names))
+	for _, name := range names {
+		switch source := ipcache.Source(name); source {
+		case ipcache.FromKubernetes, ipcache.FromKVStore, ipcache.FromAgentLocal, GCSourceUnknown:
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("unknown ipcache source %q", name)
+		}
+	}
+	return sources, nil
+}
+
+// gcSources decides which entries of the BPF map are removed by garbage
+// collection once their prefix no longer exists in the in-memory ipcache.
+// The BPF map does not carry the source of its entries, so the source of each
+// prefix is recorded with every change of the prefix in the in-memory ipcache,
+// see track(), and whenever garbage collection observes the prefix in the
+// in-memory ipcache. The latest observation wins, so an entry whose source
+// changes between two observations is judged by its latest source. At most
+// maxEntries prefixes are recorded, any further prefix has an unknown source.
+type gcSources struct {
+	mutex lock.Mutex
+
+	// eligible are the sources whose entries are removed
+	eligible map[ipcache.Source]struct{}
+
+	// observed is the source of each prefix of the BPF map as last
+	// observed in the in-memory ipcache
+	observed map[string]ipcache.Source
+
+	// maxEntries is the maximum number of prefixes in observed
+	maxEntries int
+}
+
+func newGCSources(eligible []ipcache.Source) *gcSources {
+	s := &gcSources{
+		observed:   map[string]ipcache.Source{},
+		maxEntries: gcSourcesMaxEntries,
+	}
+	s.setEligible(eligible)
+	return s
+}
+
+// setEligible sets the sources whose entries are removed
+func (s *gcSources) setEligible(eligible []ipcache.Source) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.eligible = make(map[ipcache.Source]struct{}, len(eligible))
+	for _, source := range eligible {
+		s.eligible[source] = struct{}{}
+	}
+}
+
+// WithGCSources sets the sources whose entries are removed from the BPF map by
+// garbage collection once their prefix no longer exists in the in-memory
+// ipcache, and returns the listener. Entries whose prefix has never been
+// observed in the in-memory ipcache have the source GCSourceUnknown. It must
+// be called before OnIPIdentityCacheGC(), DefaultGCSources apply otherwise.
+func (l *BPFListener) WithGCSources(sources []ipcache.Source) *BPFListener {
+	l.gcSources.setEligible(sources)
+	return l
+}
+
+// source returns the source of the prefix as last observed in the in-memory
+// ipcache, or GCSourceUnknown
+func (s *gcSources) source(keyToIP string) ipcache.Source {
+	if source, ok := s.observed[keyToIP]; ok {
+		return source
+	}
+	return GCSourceUnknown
+}
+
+// observe records the source of a prefix which exists in the in-memory
+// ipcache. Entries without a source are recorded as GCSourceUnknown. Nothing
+// is recorded for a new prefix once maxEntries prefixes are recorded.
+// gcSources.mutex must be held.
+func (s *gcSources) observe(keyToIP string, source ipcache.Source) {
+	if source == "" {
+		source = GCSourceUnknown
+	}
+	if _, ok := s.observed[keyToIP]; !ok && len(s.observed) >= s.maxEntries {
+		return
+	}
+	s.observed[keyToIP] = source
+}
+
+// track records the source of a prefix which has been upserted into the
+// in-memory ipcache, and drops the recorded source of a prefix which has been
+// deleted from it, so that the table follows the in-memory ipcache between
+// garbage collection runs.
+//
+// Must be called while holding ipcache.IPIdentityCache.Lock.
+func (s *gcSources) track(modType ipcache.CacheModification, keyToIP string) {
+	switch modType {
+	case ipcache.Upsert:
+		id, exists := ipcache.IPIdentityCache.LookupByPrefixRLocked(keyToIP)
+		if !exists {
+			return
+		}
+		s.mutex.Lock()
+		s.observe(keyToIP, id.Source)
+		s.mutex.Unlock()
+	case ipcache.Delete:
+		s.forget(keyToIP)
+	}
+}
+
+// isStale returns true if the entry of the BPF map for the prefix 'keyToIP'
+// is to be removed. If the prefix exists in the in-memory ipcache, its source
+// is recorded if 'observe' is true.
+//
+// Must be called while holding ipcache.IPIdentityCache.Lock for reading.
+func (s *gcSources) isStale(keyToIP string, observe bool) bool {
+	id, exists := ipcache.IPIdentityCache.LookupByPrefixRLocked(keyToIP)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if exists {
+		if observe {
+			s.observe(keyToIP, id.Source)
+		}
+		return false
+	}
+
+	// The prefix does not exist in memory, so the zero value returned by
+	// the lookup carries no source. Only the recorded source decides.
+	source := s.source(keyToIP)
+	_, eligible := s.eligible[source]
+	if observe {
+		log.WithFields(logrus.Fields{
+			logfields.IPAddr: keyToIP,
+			"source":         source,
+			"gcEligible":     eligible,
+		}).Info("Prefix of ipcache BPF map entry does not exist in memory")
+	}
+	return eligible
+}
+
+// forget drops the recorded source of the prefix, e.g. once its entry has
+// been removed from the BPF map
+func (s *gcSources) forget(keyToIP string) {
+	s.mutex.Lock()
+	delete(s.observed, keyToIP)
+	s.mutex.Unlock()
+}
+
+// retain drops the recorded sources of all prefixes which are not in 'seen',
+// e.g. after a sweep of the entire BPF map
+func (s *gcSources) retain(seen map[string]struct{}) {
+	s.mutex.Lock()
+	for keyToIP := range s.observed {
+		if _, ok := seen[keyToIP]; !ok {
+			delete(s.observed, keyToIP)
+		}
+	}
+	s.mutex.Unlock()
+}
@@ -15,19 +15,23 @@
 package ipcache
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/cilium/cilium/pkg/bpf"
 	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/defaults"
 	"github.com/cilium/cilium/pkg/identity"
 	"github.com/cilium/cilium/pkg/ipcache"
 	"github.com/cilium/cilium/pkg/logging"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+	"github.com/cilium/cilium/pkg/metrics"
 	"github.com/cilium/cilium/pkg/node"
 
 	"github.com/sirupsen/logrus"
@@ -41,6 +45,42 @@ type datapath interface {
 	TriggerReloadWithoutCompile(reason string) (*sync.WaitGroup, error)
 }
 
+const (
+	// gcControllerName is the name of the controller garbage collecting
+	// the BPF map, see GCControllerName()
+	gcControllerName = "ipcache-bpf-garbage-collection"
+
+	// metricOpUpsert labels upserts of entries into the BPF map
+	metricOpUpsert = "upsert"
+
+	// metricOpDelete labels deletions of entries from the BPF map
+	metricOpDelete = "delete"
+
+	// metricOpGC labels deletions of stale entries by the garbage
+	// collection of the BPF map
+	metricOpGC = "gc"
+)
+
+// countMapOperation accounts an operation on the BPF map in the
+// IPCacheMapOperations metric. It does not block, so it is safe to call with
+// the ipcache lock held.
+func countMapOperation(op string, err error) {
+	status := metrics.LabelValueOutcomeSuccess
+	if err != nil {
+		status = metrics.LabelValueOutcomeFail
+	}
+	metrics.IPCacheMapOperations.WithLabelValues(op, status).Inc()
+}
+
+// ValueMutator is a function which may modify the value of a BPF ipcache
+// entry before it is written to the map. It is passed the prefix and the
+// security identity that the entry is being written for.
+//
+// A ValueMutator may only modify the value; the prefix is passed for
+// informational purposes and the key of the entry is derived from it before
+// the mutator is invoked.
+type ValueMutator func(value *ipcacheMap.RemoteEndpointInfo, cidr net.IPNet, id identity.NumericIdentity)
+
 // BPFListener implements the ipcache.IPIdentityMappingBPFListener
 // interface with an IPCache store that is backed by BPF maps.
 //
@@ -50,22 +90,212 @@ type datapath interface {
 type BPFListener struct {
 	// bpfMap is the BPF map that this listener will update when events are
 	// received from the IPCache.
-	bpfMap *ipcacheMap.Map
+	bpfMap ipcacheBPFMap
 
 	// datapath allows this listener to trigger BPF program regeneration.
 	datapath datapath
+
+	// valueMutator, if not nil, is invoked on every value before it is
+	// written to bpfMap.
+	valueMutator ValueMutator
+
+	// identityVerifier, if not nil, defers upserts of entries until their
+	// identity is known to the identity allocator.
+	identityVerifier *identityVerifier
+
+	// externalIPv4 returns the external IPv4 address of the local node,
+	// or nil if it is not known yet
+	externalIPv4 func() net.IP
+
+	// externalIPv6 returns the IPv6 address of the local node, or nil if
+	// it is not known yet
+	externalIPv6 func() net.IP
+
+	// unknownNodeIPMode defines how entries with a host IP are programmed
+	// while the IPv4 address of the local node is not known
+	unknownNodeIPMode UnknownNodeIPMode
+
+	// unresolved tracks the entries programmed while the IPv4 address of
+	// the local node was not known
+	unresolved unresolvedTunnelEndpoints
+
+	// sync tracks whether the BPF map has converged with the IPCache
+	sync syncState
+
+	// churn, if not nil, detects prefixes whose identity changes rapidly
+	churn *churnTracker
+
+	// overlaps, if not nil, detects overlapping prefixes with conflicting
+	// identities, see EnableOverlapDetection()
+	overlaps *overlapDetector
+
+	// notifier, if not nil, is notified about changes of the tunnel
+	// endpoint of prefixes, see WithNotifier()
+	notifier Notifier
+
+	// readOnly, if true, makes the listener only validate the changes of
+	// the IPCache against the BPF map instead of writing them, see
+	// WithReadOnly()
+	readOnly bool
+
+	// gcInterval is the interval in which the BPF map is garbage
+	// collected, see OnIPIdentityCacheGC()
+	gcInterval time.Duration
+
+	// gcDryRun, if true, makes garbage collection only report the stale
+	// entries of the BPF map instead of removing them, see WithGCDryRun()
+	gcDryRun bool
+
+	// gcSources decides which entries are removed by garbage collection,
+	// see WithGCSources()
+	gcSources *gcSources
+
+	// gcCtx cancels garbage collection once it is done, see
+	// WithGCContext()
+	gcCtx context.Context
+
+	// gcDeleteBatchSize is the maximum number of stale entries deleted
+	// from the BPF map while holding the ipcache lock, and with a single
+	// syscall if supported, see WithGCDeleteBatchSize()
+	gcDeleteBatchSize int
+
+	// batchDelete probes once whether the BPF map supports deleting
+	// multiple entries with a single syscall
+	batchDelete batchDeleteSupport
+
+	// retries holds the failed operations on the BPF map which are
+	// retried with exponential backoff
+	retries retryQueue
+
+	// shadow holds the values last written into the BPF map, so that
+	// no-op upserts are skipped
+	shadow shadowMap
+
+	// consistency caches the result of CheckConsistency()
+	consistency consistencyCache
+	// coalescer, if not nil, accumulates changes of the IPCache which are
+	// written into the BPF map in one flush
+	coalescer *changeCoalescer
 }
 
-func newListener(m *ipcacheMap.Map, d datapath) *BPFListener {
+// ipcacheBPFMap is the subset of the operations on the BPF ipcache map used
+// by the listener. It allows to test the listener with an in-memory map
+// instead of a BPF map.
+type ipcacheBPFMap interface {
+	Name() string
+	SupportsDelete() bool
+	Update(key bpf.MapKey, value bpf.MapValue) error
+	Delete(key bpf.MapKey) error
+	Lookup(key bpf.MapKey) (bpf.MapValue, error)
+	DumpWithCallback(cb bpf.DumpCallback) error
+	Reopen() error
+}
+
+func newListener(m ipcacheBPFMap, d datapath, gcInterval time.Duration) *BPFListener {
+	if gcInterval == 0 {
+		gcInterval = defaults.IPCacheGCInterval
+	}
+
+	var overlaps *overlapDetector
+	if overlapDetection {
+		overlaps = newOverlapDetector()
+	}
+
 	return &BPFListener{
-		bpfMap:   m,
-		datapath: d,
+		bpfMap:       m,
+		datapath:     d,
+		gcInterval:   gcInterval,
+		externalIPv4: node.GetExternalIPv4,
+		externalIPv6: node.GetIPv6,
+		unresolved: unresolvedTunnelEndpoints{
+			entries: map[ipcacheMap.Key]ipcacheEntry{},
+		},
+		sync:      newSyncState(),
+		overlaps:  overlaps,
+		gcSources: newGCSources(DefaultGCSources),
+		gcCtx:     context.Background(),
+
+		gcDeleteBatchSize: defaults.IPCacheGCDeleteBatchSize,
+		retries: retryQueue{
+			pending: map[ipcacheMap.Key]*failedOperation{},
+		},
+		shadow: shadowMap{
+			entries: map[ipcacheMap.Key]ipcacheMap.RemoteEndpointInfo{},
+		},
+	}
+}
+
+// checkMapOpen returns an error if the BPF map 'm' has not been opened or
+// its pin on the filesystem does not exist.
+func checkMapOpen(m *ipcacheMap.Map) error {
+	if m.GetFd() == 0 {
+		return fmt.Errorf("bpf map %s is not open", m.Name())
 	}
+
+	path, err := m.Path()
+	if err != nil {
+		return fmt.Errorf("unable to determine path of bpf map %s: %s", m.Name(), err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("unable to find bpf map %s: %s", m.Name(), err)
+	}
+
+	return nil
 }
 
 // NewListener returns a new listener to push IPCache entries into BPF maps.
-func NewListener(d datapath) *BPFListener {
-	return newListener(ipcacheMap.IPCache, d)
+// The BPF map is garbage collected every gcInterval, a value of 0 selects
+// defaults.IPCacheGCInterval. An error is returned if the BPF ipcache map has
+// not been opened.
+func NewListener(d datapath, gcInterval time.Duration) (*BPFListener, error) {
+	return NewListenerForMap(ipcacheMap.IPCache, d, gcInterval)
+}
+
+// NewListenerForMap returns a new listener like NewListener, but which
+// mirrors the IPCache entries into 'm' instead of the BPF ipcache map, e.g.
+// for use by the encryption subsystem. Multiple listeners can be registered
+// with the IPCache, as long as each is backed by a map of a different name.
+func NewListenerForMap(m *ipcacheMap.Map, d datapath, gcInterval time.Duration) (*BPFListener, error) {
+	if err := checkMapOpen(m); err != nil {
+		return nil, err
+	}
+	return newListener(m, d, gcInterval), nil
+}
+
+// controllerName returns the name of the controller 'name' of the listener.
+// Controllers of listeners for maps other than the BPF ipcache map carry the
+// name of the map, so that the controllers of multiple listeners don't
+// replace each other.
+func (l *BPFListener) controllerName(name string) string {
+	if mapName := l.bpfMap.Name(); mapName != ipcacheMap.Name {
+		return name + "-" + mapName
+	}
+	return name
+}
+
+// GCControllerName returns the name of the controller which garbage collects
+// the BPF map of the listener, see OnIPIdentityCacheGC(). The name is unique
+// per BPF map, e.g. to look up the status of the controller of a specific
+// listener.
+func (l *BPFListener) GCControllerName() string {
+	return l.controllerName(gcControllerName)
+}
+
+// WithValueMutator sets the function which is invoked on every value right
+// before it is written into the BPF map, and returns the listener. It must be
+// called before the listener is registered with the IPCache.
+func (l *BPFListener) WithValueMutator(fn ValueMutator) *BPFListener {
+	l.valueMutator = fn
+	return l
+}
+
+// WithGCDryRun enables the dry-run mode of garbage collection if dryRun is
+// true, and returns the listener. In dry-run mode, the garbage collection
+// controller only logs the entries it would remove from the BPF map, see
+// garbageCollectReport(). It must be called before OnIPIdentityCacheGC().
+func (l *BPFListener) WithGCDryRun(dryRun bool) *BPFListener {
+	l.gcDryRun = dryRun
+	return l
 }
 
 // OnIPIdentityCacheChange is called whenever there is a change of state in the
@@ -75,8 +305,12 @@ func NewListener(d datapath) *BPFListener {
 // 'oldIPIDPair' is ignored here, because in the BPF maps an update for the
 // IP->ID mapping will replace any existing contents; knowledge of the old pair
 // is not required to upsert the new pair.
+//
+// The source of the prefix is recorded for garbage collection, see
+// gcSources.track(). The IPCache invokes listeners with its lock held.
 func (l *BPFListener) OnIPIdentityCacheChange(modType ipcache.CacheModification, cidr net.IPNet,
-	oldHostIP, newHostIP net.IP, oldID *identity.NumericIdentity, newID identity.NumericIdentity) {
+	oldHostIP, newHostIP net.IP, oldID *identity.NumericIdentity, newID identity.NumericIdentity,
+	encryptKey uint8) {
 	scopedLog := log.WithFields(logrus.Fields{
 		logfields.IPAddr:       cidr,
 		logfields.Identity:     newID,
@@ -85,6 +319,11 @@ func (l *BPFListener) OnIPIdentityCacheChange(modType ipcache.CacheModification,
 
 	scopedLog.Debug("Daemon notified of IP-Identity cache state change")
 
+	l.recordChurn(modType, cidr, oldID, newID)
+	if l.overlaps != nil {
+		l.overlaps.track(modType, cidr, newID)
+	}
+
 	// TODO - see if we can factor this into an interface under something like
 	// pkg/datapath instead of in the daemon directly so that the code is more
 	// logically located.
@@ -92,60 +331,261 @@ func (l *BPFListener) OnIPIdentityCacheChange(modType ipcache.CacheModification,
 	// Update BPF Maps.
 
 	key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+	l.supersede(key)
+	l.gcSources.track(modType, key.String())
+
+	if l.coalescer != nil {
+		l.coalesce(key, modType, cidr, newHostIP, oldID, newID, encryptKey)
+		return
+	}
+
+	l.applyChange(key, modType, cidr, newHostIP, newID, encryptKey, scopedLog)
+}
 
+// supersede drops all operations for 'key' which are still waiting to be
+// applied to the BPF map, as any update for the prefix supersedes them, e.g.
+// an update which is still waiting for its identity to be allocated.
+func (l *BPFListener) supersede(key ipcacheMap.Key) {
+	if l.identityVerifier != nil {
+		l.identityVerifier.cancel(key)
+	}
+	l.unresolved.forget(key)
+	l.retries.forget(key)
+}
+
+// applyChange applies the modification of the IPCache to the BPF map.
+func (l *BPFListener) applyChange(key ipcacheMap.Key, modType ipcache.CacheModification, cidr net.IPNet,
+	newHostIP net.IP, newID identity.NumericIdentity, encryptKey uint8, scopedLog *logrus.Entry) {
 	switch modType {
 	case ipcache.Upsert:
-		value := ipcacheMap.RemoteEndpointInfo{
-			SecurityIdentity: uint32(newID),
-		}
-
-		if newHostIP != nil {
-			// If the hostIP is specified and it doesn't point to
-			// the local host, then the ipcache should be populated
-			// with the hostIP so that this traffic can be guided
-			// to a tunnel endpoint destination.
-			externalIP := node.GetExternalIPv4()
-			if ip4 := newHostIP.To4(); ip4 != nil && !ip4.Equal(externalIP) {
-				copy(value.TunnelEndpoint[:], ip4)
-			}
-		}
-		err := l.bpfMap.Update(&key, &value)
-		if err != nil {
-			scopedLog.WithError(err).WithFields(logrus.Fields{"key": key.String(),
-				"value": value.String()}).
-				Warning("unable to update bpf map")
+		if l.identityVerifier != nil && !l.identityVerifier.isKnown(newID) {
+			scopedLog.Debug("Identity is not allocated yet, deferring update of bpf map")
+			l.identityVerifier.deferUpsert(key, cidr, newHostIP, newID, encryptKey)
+			return
 		}
+		l.upsert(key, cidr, newHostIP, newID, encryptKey, scopedLog)
 	case ipcache.Delete:
+		if l.readOnly {
+			l.observeDelete(key, scopedLog)
+			return
+		}
+		l.shadow.forget(key)
 		err := l.bpfMap.Delete(&key)
+		countMapOperation(metricOpDelete, err)
 		if err != nil {
 			scopedLog.WithError(err).WithFields(logrus.Fields{"key": key.String()}).
-				Warning("unable to delete from bpf map")
+				Warning("unable to delete from bpf map, retrying later")
+			l.retryLater(key, nil)
 		}
 	default:
 		scopedLog.Warning("cache modification type not supported")
 	}
 }
 
+// upsert writes the entry for 'cidr' into the BPF map.
+func (l *BPFListener) upsert(key ipcacheMap.Key, cidr net.IPNet, newHostIP net.IP,
+	newID identity.NumericIdentity, encryptKey uint8, scopedLog *logrus.Entry) {
+	externalIP := l.externalIPv4()
+	if externalIP == nil && newHostIP != nil && newHostIP.To4() != nil {
+		// Whether the host IP refers to the local node cannot be
+		// decided yet, re-evaluate the entry once the IP is known.
+		l.trackUnresolvedTunnelEndpoint(key, cidr, newHostIP, newID, encryptKey)
+		if l.unknownNodeIPMode == UnknownNodeIPDefer {
+			scopedLog.Debug("Node IP is unknown, deferring update of bpf map")
+			return
+		}
+	}
+
+	l.write(key, cidr, newHostIP, newID, encryptKey, externalIP, scopedLog)
+}
+
+// write writes the entry for 'cidr' into the BPF map, with 'externalIP' being
+// the IPv4 address of the local node, or nil if unknown.
+func (l *BPFListener) write(key ipcacheMap.Key, cidr net.IPNet, newHostIP net.IP,
+	newID identity.NumericIdentity, encryptKey uint8, externalIP net.IP, scopedLog *logrus.Entry) {
+	value := ipcacheMap.RemoteEndpointInfo{
+		SecurityIdentity: uint32(newID),
+		Key:              encryptKey,
+	}
+
+	if newHostIP != nil {
+		// If the hostIP is specified and it doesn't point to
+		// the local host, then the ipcache should be populated
+		// with the hostIP so that this traffic can be guided
+		// to a tunnel endpoint destination. IPv4-mapped IPv6
+		// addresses are treated as IPv4 addresses.
+		if ip4 := newHostIP.To4(); ip4 != nil {
+			if externalIP == nil && l.unknownNodeIPMode == UnknownNodeIPTunnel ||
+				externalIP != nil && !ip4.Equal(externalIP) {
+				value.SetTunnelEndpoint(ip4)
+			}
+		} else if !newHostIP.Equal(l.externalIPv6()) {
+			// The datapath only encapsulates to IPv4 tunnel
+			// endpoints, see struct remote_endpoint_info.
+			scopedLog.WithField("hostIP", newHostIP).
+				Debug("IPv6 tunnel endpoints are not supported by the datapath, not populating tunnel endpoint")
+		}
+	}
+	if l.valueMutator != nil {
+		l.valueMutator(&value, cidr, newID)
+	}
+	if l.readOnly {
+		l.observeUpsert(key, value, scopedLog)
+		return
+	}
+	previous, programmed := l.shadow.get(key)
+	if programmed && previous == value {
+		scopedLog.Debug("Entry is already programmed, skipping update of bpf map")
+		metrics.IPCacheSkippedUpdates.Inc()
+		return
+	}
+	err := l.bpfMap.Update(&key, &value)
+	countMapOperation(metricOpUpsert, err)
+	if err != nil {
+		l.shadow.forget(key)
+		scopedLog.WithError(err).WithFields(logrus.Fields{"key": key.String(),
+			"value": value.String()}).
+			Warning("unable to update bpf map, retrying later")
+		l.retryLater(key, &value)
+		return
+	}
+	l.shadow.set(key, value)
+
+	if programmed && previous.TunnelEndpoint != value.TunnelEndpoint {
+		l.tunnelEndpointChanged(cidr, previous, value, scopedLog)
+	}
+}
+
+// WithGCContext ties garbage collection of the BPF map to ctx and returns the
+// listener. Once ctx is done, a running garbage collection stops before
+// deleting the next batch of entries and the garbage collection controller
+// stops running. It must be called before OnIPIdentityCacheGC().
+func (l *BPFListener) WithGCContext(ctx context.Context) *BPFListener {
+	l.gcCtx = ctx
+	return l
+}
+
+// isStaleEntry returns true if the BPF map entry for the prefix 'keyToIP'
+// does not exist in the in-memory ipcache and its source is eligible for
+// garbage collection, see gcSources. Entries are matched by prefix only, an
+// entry whose encryption key differs from the one in the ipcache is not
+// stale; it is overwritten by the next upsert of the prefix.
+//
+// Must be called while holding ipcache.IPIdentityCache.Lock for reading.
+func (l *BPFListener) isStaleEntry(keyToIP string) bool {
+	return l.gcSources.isStale(keyToIP, false)
+}
+
 // updateStaleEntriesFunction returns a DumpCallback that will update the
 // specified "keysToRemove" map with entries that exist in the BPF map which
-// do not exist in the in-memory ipcache.
+// do not exist in the in-memory ipcache and are eligible for garbage
+// collection. The source of every entry which exists in the in-memory ipcache
+// is recorded, and the prefix of every entry is added to "seen".
 //
 // Must be called while holding ipcache.IPIdentityCache.Lock for reading.
-func updateStaleEntriesFunction(keysToRemove map[string]*ipcacheMap.Key) bpf.DumpCallback {
+func (l *BPFListener) updateStaleEntriesFunction(keysToRemove map[string]*ipcacheMap.Key, seen map[string]struct{}) bpf.DumpCallback {
 	return func(key bpf.MapKey, value bpf.MapValue) {
 		k := key.(*ipcacheMap.Key)
 		keyToIP := k.String()
+		seen[keyToIP] = struct{}{}
 
-		// Don't RLock as part of the same goroutine.
-		if i, exists := ipcache.IPIdentityCache.LookupByPrefixRLocked(keyToIP); !exists {
-			switch i.Source {
-			case ipcache.FromKVStore, ipcache.FromAgentLocal:
-				// Cannot delete from map during callback because DumpWithCallback
-				// RLocks the map.
-				keysToRemove[keyToIP] = k
-			}
+		if l.gcSources.isStale(keyToIP, true) {
+			// Cannot delete from map during callback because DumpWithCallback
+			// RLocks the map.
+			keysToRemove[keyToIP] = k
+		}
+	}
+}
+
+// collectStaleEntries returns the entries of the BPF map within 'scope' which
+// do not exist in the in-memory ipcache, keyed by their prefix.
+func (l *BPFListener) collectStaleEntries(scope net.IPNet) (map[string]*ipcacheMap.Key, error) {
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	keysToRemove := map[string]*ipcacheMap.Key{}
+	seen := map[string]struct{}{}
+	updateStaleEntries := l.updateStaleEntriesFunction(keysToRemove, seen)
+	err := l.bpfMap.DumpWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		if prefixWithinScope(key.(*ipcacheMap.Key).IPNet(), scope) {
+			updateStaleEntries(key, value)
 		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error dumping ipcache BPF map: %s", err)
+	}
+
+	// Only a sweep of the entire map tells which prefixes are gone
+	if scope.IP == nil {
+		l.gcSources.retain(seen)
 	}
+
+	return keysToRemove, nil
+}
+
+// deleteStaleEntries removes the entries in 'keysToRemove' from the BPF map
+// in batches of at most l.gcDeleteBatchSize entries. The ipcache lock is only
+// held for the duration of a batch so that the in-memory cache is not
+// blocked for the entire deletion. As the ipcache may have changed since
+// the entries were collected, each entry is verified to still be stale
+// right before it is deleted.
+func (l *BPFListener) deleteStaleEntries(ctx context.Context, keysToRemove map[string]*ipcacheMap.Key) error {
+	keys := make([]string, 0, len(keysToRemove))
+	for keyToIP := range keysToRemove {
+		keys = append(keys, keyToIP)
+	}
+
+	for len(keys) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch := keys
+		if len(batch) > l.gcDeleteBatchSize {
+			batch = batch[:l.gcDeleteBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		if err := l.deleteStaleBatch(batch, keysToRemove); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteStaleBatch removes the entries of 'batch' which are still stale from
+// the BPF map, with a single syscall if the BPF map supports it. Entries which
+// could not be deleted by the batched syscall are deleted individually.
+func (l *BPFListener) deleteStaleBatch(batch []string, keysToRemove map[string]*ipcacheMap.Key) error {
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	stale := make([]string, 0, len(batch))
+	for _, keyToIP := range batch {
+		if l.isStaleEntry(keyToIP) {
+			stale = append(stale, keyToIP)
+		}
+	}
+
+	if bd, ok := l.batchDeleter(); ok {
+		stale = l.deleteStaleKeysBatched(bd, stale, keysToRemove)
+	}
+
+	for _, keyToIP := range stale {
+		k := keysToRemove[keyToIP]
+		log.WithFields(logrus.Fields{logfields.BPFMapKey: k}).
+			Debug("deleting from ipcache BPF map")
+		l.shadow.forget(*k)
+		err := l.bpfMap.Delete(k)
+		countMapOperation(metricOpGC, err)
+		if err != nil {
+			return fmt.Errorf("error deleting key %s from ipcache BPF map: %s", k, err)
+		}
+		l.gcSources.forget(keyToIP)
+	}
+
+	return nil
 }
 
 // handleMapShuffleFailure attempts to move the map with name 'backup' back to
@@ -192,70 +632,155 @@ func shuffleMaps(realized, backup, pending string) error {
 //   the in-memory cache, delete the old map, and trigger regeneration of all
 //   BPF programs so that they pick up the new map.
 //
-// Returns an error if garbage collection failed to occur.
-func (l *BPFListener) garbageCollect() error {
-	log.Debug("Running garbage collection for BPF IPCache")
+// Garbage collection stops early and returns the error of ctx once ctx is
+// done. Returns an error if garbage collection failed to occur.
+func (l *BPFListener) garbageCollect(ctx context.Context) error {
+	return l.garbageCollectScope(ctx, net.IPNet{})
+}
 
-	// Since controllers run asynchronously, need to make sure
-	// IPIdentityCache is not being updated concurrently while we do
-	// GC;
-	ipcache.IPIdentityCache.RLock()
-	defer ipcache.IPIdentityCache.RUnlock()
+// garbageCollectReport returns the keys of the entries of the BPF map which
+// garbage collection would remove, sorted by prefix, without removing them.
+// On kernels which do not support deletion from the map, these are the
+// entries which would not be carried over into the rebuilt map.
+func (l *BPFListener) garbageCollectReport() ([]*ipcacheMap.Key, error) {
+	keysToRemove, err := l.collectStaleEntries(net.IPNet{})
+	if err != nil {
+		return nil, err
+	}
 
-	if ipcacheMap.SupportsDelete() {
-		keysToRemove := map[string]*ipcacheMap.Key{}
-		if err := l.bpfMap.DumpWithCallback(updateStaleEntriesFunction(keysToRemove)); err != nil {
-			return fmt.Errorf("error dumping ipcache BPF map: %s", err)
-		}
+	prefixes := make([]string, 0, len(keysToRemove))
+	for keyToIP := range keysToRemove {
+		prefixes = append(prefixes, keyToIP)
+	}
+	sort.Strings(prefixes)
 
-		// Remove all keys which are not in in-memory cache from BPF map
-		// for consistency.
-		for _, k := range keysToRemove {
-			log.WithFields(logrus.Fields{logfields.BPFMapKey: k}).
-				Debug("deleting from ipcache BPF map")
-			if err := l.bpfMap.Delete(k); err != nil {
-				return fmt.Errorf("error deleting key %s from ipcache BPF map: %s", k, err)
-			}
-		}
-	} else {
-		// Populate the map at the new path
-		pendingMapName := fmt.Sprintf("%s_pending", ipcacheMap.Name)
-		pendingMap := ipcacheMap.NewMap(pendingMapName)
-		if _, err := pendingMap.OpenOrCreate(); err != nil {
-			return fmt.Errorf("Unable to create %s map: %s", pendingMapName, err)
-		}
-		pendingListener := newListener(pendingMap, l.datapath)
-		ipcache.IPIdentityCache.DumpToListenerLocked(pendingListener)
+	keys := make([]*ipcacheMap.Key, 0, len(prefixes))
+	for _, keyToIP := range prefixes {
+		keys = append(keys, keysToRemove[keyToIP])
+	}
+	return keys, nil
+}
 
-		// Move the maps around on the filesystem so that BPF reload
-		// will pick up the new paths without requiring recompilation.
-		backupMapName := fmt.Sprintf("%s_old", ipcacheMap.Name)
-		if err := shuffleMaps(ipcacheMap.Name, backupMapName, pendingMapName); err != nil {
-			return err
-		}
+// logGarbageCollectReport logs the entries of the BPF map which garbage
+// collection would remove, see garbageCollectReport()
+func (l *BPFListener) logGarbageCollectReport() error {
+	keys, err := l.garbageCollectReport()
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		log.WithFields(logrus.Fields{
+			logfields.BPFMapKey:  k,
+			logfields.BPFMapName: l.bpfMap.Name(),
+		}).Info("Garbage collection dry-run: would delete entry from ipcache BPF map")
+	}
+	log.WithFields(logrus.Fields{
+		"count":              len(keys),
+		logfields.BPFMapName: l.bpfMap.Name(),
+	}).Info("Garbage collection dry-run of ipcache BPF map completed")
+
+	return nil
+}
+
+// prefixWithinScope returns true if 'prefix' is contained within 'scope'. The
+// zero value of net.IPNet is the scope containing all prefixes.
+func prefixWithinScope(prefix, scope net.IPNet) bool {
+	if scope.IP == nil {
+		return true
+	}
+
+	prefixOnes, prefixBits := prefix.Mask.Size()
+	scopeOnes, scopeBits := scope.Mask.Size()
+	return prefixBits == scopeBits && prefixOnes >= scopeOnes && scope.Contains(prefix.IP)
+}
 
-		wg, err := l.datapath.TriggerReloadWithoutCompile("datapath ipcache")
+// garbageCollectScope implements GC of the ipcache map like garbageCollect,
+// but only considers entries whose prefix is contained within 'scope'. This
+// limits the cost of the sweep when only part of the ipcache needs to be
+// reconciled. The zero value of net.IPNet selects all entries.
+//
+// On kernels which do not support deletion from the map, the map is always
+// rebuilt in its entirety, regardless of the scope.
+func (l *BPFListener) garbageCollectScope(ctx context.Context, scope net.IPNet) error {
+	log.WithField("scope", scope.String()).Debug("Running garbage collection for BPF IPCache")
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The BPF map is never modified in read-only mode, the stale entries
+	// of the entire map are reported instead.
+	if l.readOnly {
+		return l.logGarbageCollectReport()
+	}
+
+	if l.bpfMap.SupportsDelete() {
+		keysToRemove, err := l.collectStaleEntries(scope)
 		if err != nil {
-			handleMapShuffleFailure(backupMapName, ipcacheMap.Name)
 			return err
 		}
-
-		// If the base programs successfully compiled, then the maps
-		// should be OK so let's update all references to the IPCache
-		// so that they point to the new version.
-		_ = os.RemoveAll(bpf.MapPath(backupMapName))
-		if err := ipcacheMap.Reopen(); err != nil {
-			// Very unlikely; base program compilation succeeded.
-			log.WithError(err).Warning("Failed to reopen BPF ipcache map")
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		wg.Wait()
+
+		// Remove all keys which are not in in-memory cache from BPF map
+		// for consistency.
+		return l.deleteStaleEntries(ctx, keysToRemove)
 	}
+
+	// Since controllers run asynchronously, need to make sure
+	// IPIdentityCache is not being updated concurrently while we
+	// rebuild the map.
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	// The values written into the replaced map no longer tell what the
+	// map holds, whether or not the rebuild succeeds.
+	defer l.shadow.reset()
+
+	// Populate the map at the new path
+	mapName := l.bpfMap.Name()
+	pendingMapName := fmt.Sprintf("%s_pending", mapName)
+	pendingMap := ipcacheMap.NewMap(pendingMapName)
+	if _, err := pendingMap.OpenOrCreate(); err != nil {
+		return fmt.Errorf("Unable to create %s map: %s", pendingMapName, err)
+	}
+	pendingListener := newListener(pendingMap, l.datapath, l.gcInterval).WithValueMutator(l.valueMutator)
+	ipcache.IPIdentityCache.DumpToListenerLocked(pendingListener)
+
+	// Move the maps around on the filesystem so that BPF reload
+	// will pick up the new paths without requiring recompilation.
+	backupMapName := fmt.Sprintf("%s_old", mapName)
+	if err := shuffleMaps(mapName, backupMapName, pendingMapName); err != nil {
+		return err
+	}
+
+	wg, err := l.datapath.TriggerReloadWithoutCompile("datapath ipcache")
+	if err != nil {
+		handleMapShuffleFailure(backupMapName, mapName)
+		return err
+	}
+
+	// If the base programs successfully compiled, then the maps
+	// should be OK so let's update all references to the map so
+	// that they point to the new version.
+	_ = os.RemoveAll(bpf.MapPath(backupMapName))
+	if err := l.bpfMap.Reopen(); err != nil {
+		// Very unlikely; base program compilation succeeded.
+		log.WithError(err).Warning("Failed to reopen BPF ipcache map")
+		return err
+	}
+	wg.Wait()
 	return nil
 }
 
 // OnIPIdentityCacheGC spawns a controller which synchronizes the BPF IPCache Map
-// with the in-memory IP-Identity cache.
+// with the in-memory IP-Identity cache. In dry-run mode, see WithGCDryRun(),
+// the controller only logs the entries it would remove. Synced() is signalled
+// after the first report nonetheless, so that the dry-run mode does not block
+// callers waiting for the map to be synced. The controller stops running once
+// the context of WithGCContext() is done.
 func (l *BPFListener) OnIPIdentityCacheGC() {
 	// This controller ensures that the in-memory IP-identity cache is in-sync
 	// with the BPF map on disk. These can get out of sync if the cilium-agent
@@ -265,10 +790,31 @@ func (l *BPFListener) OnIPIdentityCacheGC() {
 	// fully to give us the history of all events. As such, periodically check
 	// for inconsistencies in the data-path with that in the agent to ensure
 	// consistent state.
-	controller.NewManager().UpdateController("ipcache-bpf-garbage-collection",
+	gcInterval := l.gcInterval
+	if gcInterval <= 0 {
+		log.WithField("interval", gcInterval).
+			Warningf("Invalid ipcache garbage collection interval, using default of %s", defaults.IPCacheGCInterval)
+		gcInterval = defaults.IPCacheGCInterval
+	}
+	controller.NewManager().UpdateController(l.GCControllerName(),
 		controller.ControllerParams{
-			DoFunc:      l.garbageCollect,
-			RunInterval: 5 * time.Minute,
+			DoFunc: func() error {
+				var err error
+				if l.gcReportOnly() {
+					err = l.logGarbageCollectReport()
+				} else {
+					err = l.garbageCollect(l.gcCtx)
+				}
+				if ctxErr := l.gcCtx.Err(); ctxErr != nil {
+					return controller.NewExitReason(fmt.Sprintf("garbage collection cancelled: %s", ctxErr))
+				}
+				if err != nil {
+					return err
+				}
+				l.garbageCollectCompleted()
+				return nil
+			},
+			RunInterval: gcInterval,
 		},
 	)
 }
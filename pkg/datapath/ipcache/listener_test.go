@@ -0,0 +1,1260 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	"github.com/cilium/cilium/pkg/checker"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+	"github.com/cilium/cilium/pkg/metrics"
+	"github.com/cilium/cilium/pkg/monitor"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type IPCacheTestSuite struct{}
+
+var _ = Suite(&IPCacheTestSuite{})
+
+func (s *IPCacheTestSuite) TestNewExportEntry(c *C) {
+	_, cidr, err := net.ParseCIDR("10.1.0.0/16")
+	c.Assert(err, IsNil)
+	key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+
+	value := &ipcacheMap.RemoteEndpointInfo{SecurityIdentity: 1234}
+	c.Assert(newExportEntry(&key, value), Equals, exportEntry{
+		Prefix:   "10.1.0.0/16",
+		Identity: 1234,
+	})
+
+	copy(value.TunnelEndpoint[:], net.ParseIP("192.168.1.1").To4())
+	c.Assert(newExportEntry(&key, value), Equals, exportEntry{
+		Prefix:         "10.1.0.0/16",
+		Identity:       1234,
+		TunnelEndpoint: "192.168.1.1",
+	})
+
+	value.Key = 3
+	c.Assert(newExportEntry(&key, value), Equals, exportEntry{
+		Prefix:         "10.1.0.0/16",
+		Identity:       1234,
+		TunnelEndpoint: "192.168.1.1",
+		EncryptKey:     3,
+	})
+}
+
+// dumpCheckingWriter fails the test if it is written to while the map is
+// being dumped, i.e. while the lock of the map is held
+type dumpCheckingWriter struct {
+	c       *C
+	m       *lockingFakeMap
+	written bytes.Buffer
+}
+
+func (w *dumpCheckingWriter) Write(p []byte) (int, error) {
+	w.c.Assert(w.m.dumping, Equals, false)
+	return w.written.Write(p)
+}
+
+// lockingFakeMap is a fakeMap which records whether it is being dumped
+type lockingFakeMap struct {
+	*fakeMap
+	dumping bool
+}
+
+func (m *lockingFakeMap) DumpWithCallback(cb bpf.DumpCallback) error {
+	m.dumping = true
+	defer func() { m.dumping = false }()
+	return m.fakeMap.DumpWithCallback(cb)
+}
+
+func (s *IPCacheTestSuite) TestExport(c *C) {
+	m := &lockingFakeMap{fakeMap: newFakeMap()}
+	for i := 0; i < exportChunkSize+1; i++ {
+		key := ipcacheMap.NewKey(net.IPv4(10, 0, byte(i>>8), byte(i)), net.CIDRMask(32, 32))
+		m.entries[key] = ipcacheMap.RemoteEndpointInfo{SecurityIdentity: 100, Key: 2}
+	}
+	l := newListener(m, nil, 0)
+
+	w := &dumpCheckingWriter{c: c, m: m}
+	c.Assert(l.ExportCSV(w), IsNil)
+	lines := strings.Split(strings.TrimSpace(w.written.String()), "\n")
+	c.Assert(lines, HasLen, exportChunkSize+2)
+	c.Assert(lines[0], Equals, "prefix,identity,tunnel-endpoint,encrypt-key")
+	c.Assert(lines[1], Matches, `10\.0\.\d+\.\d+/32,100,,2`)
+
+	w = &dumpCheckingWriter{c: c, m: m}
+	c.Assert(l.ExportJSON(w), IsNil)
+	lines = strings.Split(strings.TrimSpace(w.written.String()), "\n")
+	c.Assert(lines, HasLen, exportChunkSize+1)
+	c.Assert(lines[0], Matches, `\{"prefix":"10\.0\.\d+\.\d+/32","identity":100,"encrypt-key":2\}`)
+}
+
+func (s *IPCacheTestSuite) TestKeyIPNet(c *C) {
+	for _, prefix := range []string{"10.1.0.0/16", "192.168.1.1/32", "f00d::/64", "f00d::1/128"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+		ipNet := key.IPNet()
+		c.Assert(ipNet.String(), Equals, prefix)
+	}
+}
+
+func (s *IPCacheTestSuite) TestPrefixWithinScope(c *C) {
+	mustParseCIDR := func(s string) net.IPNet {
+		_, cidr, err := net.ParseCIDR(s)
+		c.Assert(err, IsNil)
+		return *cidr
+	}
+
+	scope := mustParseCIDR("10.0.0.0/8")
+	c.Assert(prefixWithinScope(mustParseCIDR("10.1.0.0/16"), scope), Equals, true)
+	c.Assert(prefixWithinScope(mustParseCIDR("10.1.2.3/32"), scope), Equals, true)
+	c.Assert(prefixWithinScope(mustParseCIDR("10.0.0.0/8"), scope), Equals, true)
+	c.Assert(prefixWithinScope(mustParseCIDR("10.0.0.0/7"), scope), Equals, false)
+	c.Assert(prefixWithinScope(mustParseCIDR("11.0.0.0/16"), scope), Equals, false)
+	c.Assert(prefixWithinScope(mustParseCIDR("::a00:0/120"), scope), Equals, false)
+
+	// The zero scope contains everything
+	c.Assert(prefixWithinScope(mustParseCIDR("11.0.0.0/16"), net.IPNet{}), Equals, true)
+	c.Assert(prefixWithinScope(mustParseCIDR("f00d::/64"), net.IPNet{}), Equals, true)
+}
+
+// fakeMap is an in-memory implementation of ipcacheBPFMap
+type fakeMap struct {
+	name    string
+	entries map[ipcacheMap.Key]ipcacheMap.RemoteEndpointInfo
+
+	// err, if not nil, is returned by Update and Delete
+	err error
+}
+
+func newFakeMap() *fakeMap {
+	return &fakeMap{
+		name:    ipcacheMap.Name,
+		entries: map[ipcacheMap.Key]ipcacheMap.RemoteEndpointInfo{},
+	}
+}
+
+func (m *fakeMap) Name() string {
+	return m.name
+}
+
+func (m *fakeMap) SupportsDelete() bool {
+	return true
+}
+
+func (m *fakeMap) Reopen() error {
+	return nil
+}
+
+func (m *fakeMap) Update(key bpf.MapKey, value bpf.MapValue) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.entries[*key.(*ipcacheMap.Key)] = *value.(*ipcacheMap.RemoteEndpointInfo)
+	return nil
+}
+
+func (m *fakeMap) Delete(key bpf.MapKey) error {
+	if m.err != nil {
+		return m.err
+	}
+	delete(m.entries, *key.(*ipcacheMap.Key))
+	return nil
+}
+
+func (m *fakeMap) Lookup(key bpf.MapKey) (bpf.MapValue, error) {
+	value, ok := m.entries[*key.(*ipcacheMap.Key)]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found", key)
+	}
+	return &value, nil
+}
+
+func (m *fakeMap) DumpWithCallback(cb bpf.DumpCallback) error {
+	for k, v := range m.entries {
+		key, value := k, v
+		cb(&key, &value)
+	}
+	return nil
+}
+
+// lookup returns the entry for the CIDR
+func (m *fakeMap) lookup(c *C, cidr string) (ipcacheMap.RemoteEndpointInfo, bool) {
+	_, prefix, err := net.ParseCIDR(cidr)
+	c.Assert(err, IsNil)
+	value, ok := m.entries[ipcacheMap.NewKey(prefix.IP, prefix.Mask)]
+	return value, ok
+}
+
+func (s *IPCacheTestSuite) TestUnknownNodeIP(c *C) {
+	var nodeIP net.IP
+	localHostIP, remoteHostIP := net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2")
+	noTunnel := [4]byte{}
+	remoteTunnel := [4]byte{192, 168, 0, 2}
+	localTunnel := [4]byte{192, 168, 0, 1}
+
+	for _, tt := range []struct {
+		mode         UnknownNodeIPMode
+		programmed   bool
+		localTunnel  [4]byte
+		remoteTunnel [4]byte
+	}{
+		{UnknownNodeIPTunnel, true, localTunnel, remoteTunnel},
+		{UnknownNodeIPNoTunnel, true, noTunnel, noTunnel},
+		{UnknownNodeIPDefer, false, noTunnel, noTunnel},
+	} {
+		nodeIP = nil
+		m := newFakeMap()
+		l := newListener(m, nil, 0).WithUnknownNodeIPMode(tt.mode)
+		l.externalIPv4 = func() net.IP { return nodeIP }
+		// Prevent the resolution controller from interfering
+		l.unresolved.startOnce.Do(func() {})
+
+		_, local, _ := net.ParseCIDR("10.0.1.1/32")
+		_, remote, _ := net.ParseCIDR("10.0.2.1/32")
+		_, noHost, _ := net.ParseCIDR("10.0.3.1/32")
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *local, nil, localHostIP, nil, identity.NumericIdentity(100), 0)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *remote, nil, remoteHostIP, nil, identity.NumericIdentity(101), 0)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *noHost, nil, nil, nil, identity.NumericIdentity(102), 0)
+
+		value, ok := m.lookup(c, "10.0.1.1/32")
+		c.Assert(ok, Equals, tt.programmed)
+		c.Assert(value.TunnelEndpoint, Equals, tt.localTunnel)
+		value, ok = m.lookup(c, "10.0.2.1/32")
+		c.Assert(ok, Equals, tt.programmed)
+		c.Assert(value.TunnelEndpoint, Equals, tt.remoteTunnel)
+		_, ok = m.lookup(c, "10.0.3.1/32")
+		c.Assert(ok, Equals, true)
+
+		// Nothing is resolved while the node IP is unknown
+		l.resolveTunnelEndpoints()
+		c.Assert(l.unresolved.entries, HasLen, 2)
+
+		// Entries are corrected once the node IP is known
+		nodeIP = localHostIP
+		l.resolveTunnelEndpoints()
+		c.Assert(l.unresolved.entries, HasLen, 0)
+
+		value, ok = m.lookup(c, "10.0.1.1/32")
+		c.Assert(ok, Equals, true)
+		c.Assert(value.TunnelEndpoint, Equals, noTunnel)
+		c.Assert(value.SecurityIdentity, Equals, uint32(100))
+		value, ok = m.lookup(c, "10.0.2.1/32")
+		c.Assert(ok, Equals, true)
+		c.Assert(value.TunnelEndpoint, Equals, remoteTunnel)
+		c.Assert(value.SecurityIdentity, Equals, uint32(101))
+	}
+}
+
+// cacheEvent is an event delivered to OnIPIdentityCacheChange
+type cacheEvent struct {
+	modType ipcache.CacheModification
+	cidr    string
+	hostIP  string
+	id      identity.NumericIdentity
+}
+
+// mapEntry is the expected content of the BPF map for a prefix
+type mapEntry struct {
+	id             uint32
+	tunnelEndpoint string
+}
+
+func (s *IPCacheTestSuite) TestOnIPIdentityCacheChangeSequences(c *C) {
+	const (
+		nodeIP   = "192.168.0.1"
+		nodeIPv6 = "f00d::b"
+	)
+
+	for _, tt := range []struct {
+		name     string
+		events   []cacheEvent
+		expected map[string]mapEntry
+	}{
+		{
+			name: "upsert",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "", 100},
+				{ipcache.Upsert, "10.0.0.2/32", "192.168.0.2", 101},
+				{ipcache.Upsert, "10.1.0.0/16", nodeIP, 102},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.1/32": {100, ""},
+				"10.0.0.2/32": {101, "192.168.0.2"},
+				"10.1.0.0/16": {102, ""},
+			},
+		},
+		{
+			name: "delete",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.2", 100},
+				{ipcache.Upsert, "10.0.0.2/32", "", 101},
+				{ipcache.Delete, "10.0.0.1/32", "", 100},
+				// Deleting an unknown prefix is a no-op
+				{ipcache.Delete, "10.0.0.3/32", "", 102},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.2/32": {101, ""},
+			},
+		},
+		{
+			name: "identity change",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.2", 100},
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.2", 200},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.1/32": {200, "192.168.0.2"},
+			},
+		},
+		{
+			name: "host IP change",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.2", 100},
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.3", 100},
+				// Moved to the local node
+				{ipcache.Upsert, "10.0.0.2/32", "192.168.0.2", 101},
+				{ipcache.Upsert, "10.0.0.2/32", nodeIP, 101},
+				// Host IP removed
+				{ipcache.Upsert, "10.0.0.3/32", "192.168.0.2", 102},
+				{ipcache.Upsert, "10.0.0.3/32", "", 102},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.1/32": {100, "192.168.0.3"},
+				"10.0.0.2/32": {101, ""},
+				"10.0.0.3/32": {102, ""},
+			},
+		},
+		{
+			name: "interleaved host IP and identity changes",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.2", 100},
+				{ipcache.Upsert, "10.0.0.1/32", "192.168.0.3", 200},
+				{ipcache.Delete, "10.0.0.1/32", "", 200},
+				{ipcache.Upsert, "10.0.0.1/32", nodeIP, 300},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.1/32": {300, ""},
+			},
+		},
+		{
+			name: "IPv6 host IPs are not used as tunnel endpoint",
+			events: []cacheEvent{
+				{ipcache.Upsert, "f00d::1/128", "192.168.0.2", 100},
+				{ipcache.Upsert, "f00d::2/128", "f00d::a", 101},
+				{ipcache.Upsert, "f00d::3/128", nodeIPv6, 102},
+				{ipcache.Upsert, "10.0.0.1/32", "f00d::a", 103},
+			},
+			expected: map[string]mapEntry{
+				"f00d::1/128": {100, "192.168.0.2"},
+				"f00d::2/128": {101, ""},
+				"f00d::3/128": {102, ""},
+				"10.0.0.1/32": {103, ""},
+			},
+		},
+		{
+			name: "IPv4-mapped IPv6 host IPs are used as IPv4",
+			events: []cacheEvent{
+				{ipcache.Upsert, "10.0.0.1/32", "::ffff:192.168.0.2", 100},
+				{ipcache.Upsert, "10.0.0.2/32", "::ffff:" + nodeIP, 101},
+				{ipcache.Upsert, "f00d::1/128", "::ffff:192.168.0.3", 102},
+			},
+			expected: map[string]mapEntry{
+				"10.0.0.1/32": {100, "192.168.0.2"},
+				"10.0.0.2/32": {101, ""},
+				"f00d::1/128": {102, "192.168.0.3"},
+			},
+		},
+	} {
+		c.Logf("Test case: %s", tt.name)
+
+		m := newFakeMap()
+		l := newListener(m, nil, 0)
+		l.externalIPv4 = func() net.IP { return net.ParseIP(nodeIP).To4() }
+		l.externalIPv6 = func() net.IP { return net.ParseIP(nodeIPv6) }
+
+		for _, ev := range tt.events {
+			_, cidr, err := net.ParseCIDR(ev.cidr)
+			c.Assert(err, IsNil)
+			var hostIP net.IP
+			if ev.hostIP != "" {
+				hostIP = net.ParseIP(ev.hostIP)
+			}
+			l.OnIPIdentityCacheChange(ev.modType, *cidr, nil, hostIP, nil, ev.id, 0)
+		}
+
+		c.Assert(m.entries, HasLen, len(tt.expected))
+		for cidr, expected := range tt.expected {
+			value, ok := m.lookup(c, cidr)
+			c.Assert(ok, Equals, true, Commentf("prefix %s not found", cidr))
+			c.Assert(value.SecurityIdentity, Equals, expected.id, Commentf("prefix %s", cidr))
+
+			var tunnelEndpoint [4]byte
+			if expected.tunnelEndpoint != "" {
+				copy(tunnelEndpoint[:], net.ParseIP(expected.tunnelEndpoint).To4())
+			}
+			c.Assert(value.TunnelEndpoint, Equals, tunnelEndpoint, Commentf("prefix %s", cidr))
+		}
+	}
+}
+
+func (s *IPCacheTestSuite) TestSynced(c *C) {
+	var nodeIP net.IP
+	l := newListener(newFakeMap(), nil, 0).WithUnknownNodeIPMode(UnknownNodeIPDefer)
+	l.externalIPv4 = func() net.IP { return nodeIP }
+	l.unresolved.startOnce.Do(func() {})
+	c.Assert(l.IsSynced(), Equals, false)
+
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.2"), nil, identity.NumericIdentity(100), 0)
+
+	// The update is still pending until the node IP is known
+	l.garbageCollectCompleted()
+	c.Assert(l.IsSynced(), Equals, false)
+
+	nodeIP = net.ParseIP("192.168.0.1")
+	l.resolveTunnelEndpoints()
+	c.Assert(l.IsSynced(), Equals, true)
+	<-l.Synced()
+}
+
+func (s *IPCacheTestSuite) TestChurnTracker(c *C) {
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+	_, other, err := net.ParseCIDR("10.0.0.2/32")
+	c.Assert(err, IsNil)
+
+	t := newChurnTracker(3, time.Minute)
+	now := time.Now()
+
+	// The threshold is reported once when it is exceeded
+	for i := 1; i <= 3; i++ {
+		rate, exceeded := t.record(*cidr, now)
+		c.Assert(rate, Equals, float64(i))
+		c.Assert(exceeded, Equals, false)
+	}
+	_, exceeded := t.record(*cidr, now)
+	c.Assert(exceeded, Equals, true)
+	_, exceeded = t.record(*cidr, now)
+	c.Assert(exceeded, Equals, false)
+
+	// Changes spread out over several windows do not exceed the threshold
+	for i := 0; i < 10; i++ {
+		now = now.Add(10 * time.Minute)
+		_, exceeded = t.record(*other, now)
+		c.Assert(exceeded, Equals, false)
+	}
+
+	// Once calmed down, the prefix is reported again
+	_, exceeded = t.record(*cidr, now)
+	c.Assert(exceeded, Equals, false)
+	for i := 0; i < 3; i++ {
+		_, exceeded = t.record(*cidr, now)
+	}
+	c.Assert(exceeded, Equals, true)
+
+	// The number of tracked prefixes is bounded, decayed prefixes are
+	// forgotten to make room for new ones
+	t.maxPrefixes = 2
+	_, third, err := net.ParseCIDR("10.0.0.3/32")
+	c.Assert(err, IsNil)
+	rate, _ := t.record(*third, now)
+	c.Assert(rate, Equals, float64(0))
+	c.Assert(t.prefixes, HasLen, 2)
+
+	rate, _ = t.record(*third, now.Add(time.Hour))
+	c.Assert(rate, Equals, float64(1))
+	c.Assert(t.prefixes, HasLen, 1)
+
+	c.Assert(isIdentityChange(ipcache.Upsert, nil, 1), Equals, true)
+	id := identity.NumericIdentity(1)
+	c.Assert(isIdentityChange(ipcache.Upsert, &id, 1), Equals, false)
+	c.Assert(isIdentityChange(ipcache.Upsert, &id, 2), Equals, true)
+	c.Assert(isIdentityChange(ipcache.Delete, &id, 0), Equals, true)
+}
+
+func (s *IPCacheTestSuite) TestMapOperationMetrics(c *C) {
+	count := func(op, status string) float64 {
+		return metrics.GetCounterValue(metrics.IPCacheMapOperations.WithLabelValues(op, status))
+	}
+	upserts, deletes := count(metricOpUpsert, metrics.LabelValueOutcomeSuccess), count(metricOpDelete, metrics.LabelValueOutcomeSuccess)
+	upsertErrors, deleteErrors := count(metricOpUpsert, metrics.LabelValueOutcomeFail), count(metricOpDelete, metrics.LabelValueOutcomeFail)
+
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 100, 0)
+	c.Assert(count(metricOpUpsert, metrics.LabelValueOutcomeSuccess), Equals, upserts+1)
+	c.Assert(count(metricOpDelete, metrics.LabelValueOutcomeSuccess), Equals, deletes+1)
+
+	m.err = fmt.Errorf("map operation failed")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 100, 0)
+	c.Assert(count(metricOpUpsert, metrics.LabelValueOutcomeFail), Equals, upsertErrors+1)
+	c.Assert(count(metricOpDelete, metrics.LabelValueOutcomeFail), Equals, deleteErrors+1)
+}
+
+func (s *IPCacheTestSuite) TestSkipUnchangedUpserts(c *C) {
+	upserts := func() float64 {
+		return metrics.GetCounterValue(metrics.IPCacheMapOperations.WithLabelValues(metricOpUpsert, metrics.LabelValueOutcomeSuccess))
+	}
+	skipped := func() float64 {
+		return metrics.GetCounterValue(metrics.IPCacheSkippedUpdates)
+	}
+
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+	hostIP := net.ParseIP("192.168.0.2")
+
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1") }
+
+	u, sk := upserts(), skipped()
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, hostIP, nil, 100, 0)
+	c.Assert(upserts(), Equals, u+1)
+
+	// Identical upserts are skipped
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, hostIP, nil, 100, 0)
+	c.Assert(upserts(), Equals, u+1)
+	c.Assert(skipped(), Equals, sk+1)
+
+	// Any difference in the value is written
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, hostIP, nil, 100, 1)
+	c.Assert(upserts(), Equals, u+2)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 1)
+	c.Assert(upserts(), Equals, u+3)
+
+	// Once deleted, the entry is written again
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 1)
+	c.Assert(upserts(), Equals, u+4)
+	_, ok := m.lookup(c, "10.0.0.1/32")
+	c.Assert(ok, Equals, true)
+
+	// A failed upsert leaves the value of the entry unknown
+	m.err = fmt.Errorf("map operation failed")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 200, 1)
+	m.err = nil
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 1)
+	c.Assert(upserts(), Equals, u+5)
+	c.Assert(skipped(), Equals, sk+1)
+}
+
+func (s *IPCacheTestSuite) TestRetryFailedOperations(c *C) {
+	c.Assert(retryBackoff(1), Equals, retryBackoffMin)
+	c.Assert(retryBackoff(2), Equals, 2*retryBackoffMin)
+	c.Assert(retryBackoff(100), Equals, retryBackoffMax)
+
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+	key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+	// Retries are triggered manually
+	l.retries.startOnce.Do(func() {})
+
+	// Repeated failures of the same prefix are coalesced
+	m.err = fmt.Errorf("map operation failed")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 200, 0)
+	c.Assert(l.retries.pending, HasLen, 1)
+	c.Assert(metrics.GetGaugeValue(metrics.IPCacheRetryQueueDepth), Equals, float64(1))
+
+	// Failed retries back off
+	now := time.Now()
+	l.retryFailedOperations(now.Add(retryBackoffMin))
+	c.Assert(l.retries.pending[key].attempts, Equals, 2)
+	l.retryFailedOperations(now.Add(2 * retryBackoffMin))
+	c.Assert(l.retries.pending[key].attempts, Equals, 2)
+
+	m.err = nil
+	l.retryFailedOperations(now.Add(time.Hour))
+	c.Assert(l.retries.pending, HasLen, 0)
+	c.Assert(metrics.GetGaugeValue(metrics.IPCacheRetryQueueDepth), Equals, float64(0))
+	value, ok := m.lookup(c, "10.0.0.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(200))
+
+	// A failed delete is retried, unless superseded by a later upsert
+	m.err = fmt.Errorf("map operation failed")
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 200, 0)
+	c.Assert(l.retries.pending[key].value, IsNil)
+	m.err = nil
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 300, 0)
+	c.Assert(l.retries.pending, HasLen, 0)
+	value, ok = m.lookup(c, "10.0.0.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(300))
+}
+
+func (s *IPCacheTestSuite) TestDump(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1").To4() }
+
+	for _, prefix := range []string{"f00d::1/128", "10.0.0.2/32", "10.0.0.0/8", "10.0.0.1/32", "10.0.0.0/16"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.2"), nil, 100, 0)
+	}
+
+	entries, err := l.Dump()
+	c.Assert(err, IsNil)
+	prefixes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		prefix := entry.Prefix()
+		prefixes = append(prefixes, prefix.String())
+		c.Assert(entry.Value.SecurityIdentity, Equals, uint32(100))
+		c.Assert(entry.Value.GetTunnelEndpoint().String(), Equals, "192.168.0.2")
+	}
+	c.Assert(prefixes, DeepEquals, []string{"10.0.0.0/8", "10.0.0.0/16", "10.0.0.1/32", "10.0.0.2/32", "f00d::1/128"})
+}
+
+func (s *IPCacheTestSuite) TestControllerName(c *C) {
+	l := newListener(newFakeMap(), nil, 0)
+	c.Assert(l.controllerName("ipcache-bpf-garbage-collection"), Equals, "ipcache-bpf-garbage-collection")
+	c.Assert(l.GCControllerName(), Equals, "ipcache-bpf-garbage-collection")
+
+	m := newFakeMap()
+	m.name = "cilium_encrypt_ipcache"
+	l = newListener(m, nil, 0)
+	c.Assert(l.controllerName("ipcache-bpf-garbage-collection"), Equals, "ipcache-bpf-garbage-collection-cilium_encrypt_ipcache")
+	c.Assert(l.GCControllerName(), Equals, "ipcache-bpf-garbage-collection-cilium_encrypt_ipcache")
+}
+
+func (s *IPCacheTestSuite) TestEncryptKey(c *C) {
+	var nodeIP net.IP
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithUnknownNodeIPMode(UnknownNodeIPDefer)
+	l.externalIPv4 = func() net.IP { return nodeIP }
+	l.unresolved.startOnce.Do(func() {})
+
+	_, encrypted, _ := net.ParseCIDR("10.0.1.1/32")
+	_, plain, _ := net.ParseCIDR("10.0.2.1/32")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *encrypted, nil, net.ParseIP("192.168.0.2"), nil, 100, 3)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *plain, nil, nil, nil, 101, 0)
+
+	_, ok := m.lookup(c, "10.0.1.1/32")
+	c.Assert(ok, Equals, false)
+	value, ok := m.lookup(c, "10.0.2.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.Key, Equals, uint8(0))
+
+	// The key is retained while the update is deferred
+	nodeIP = net.ParseIP("192.168.0.1").To4()
+	l.resolveTunnelEndpoints()
+	value, ok = m.lookup(c, "10.0.1.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.Key, Equals, uint8(3))
+	c.Assert(value.SecurityIdentity, Equals, uint32(100))
+}
+
+func (s *IPCacheTestSuite) TestIdentityVerification(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1").To4() }
+	known := map[identity.NumericIdentity]bool{}
+	l.identityVerifier = &identityVerifier{
+		pending: map[ipcacheMap.Key]deferredUpsert{},
+		maxWait: time.Minute,
+		isKnown: func(id identity.NumericIdentity) bool { return known[id] },
+	}
+
+	_, allocated, _ := net.ParseCIDR("10.0.1.1/32")
+	_, expired, _ := net.ParseCIDR("10.0.2.1/32")
+	_, superseded, _ := net.ParseCIDR("10.0.3.1/32")
+	_, deleted, _ := net.ParseCIDR("10.0.4.1/32")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *allocated, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *expired, nil, nil, nil, 200, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *superseded, nil, nil, nil, 300, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *deleted, nil, nil, nil, 400, 0)
+
+	// Upserts are deferred until their identity is allocated
+	c.Assert(m.entries, HasLen, 0)
+	c.Assert(l.identityVerifier.pending, HasLen, 4)
+	l.applyDeferredUpserts(time.Now())
+	c.Assert(m.entries, HasLen, 0)
+
+	// A later update of the prefix cancels the deferred upsert
+	known[301] = true
+	oldID := identity.NumericIdentity(300)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *superseded, nil, nil, &oldID, 301, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *deleted, nil, nil, nil, 400, 0)
+	c.Assert(l.identityVerifier.pending, HasLen, 2)
+	value, ok := m.lookup(c, "10.0.3.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(301))
+
+	// The upsert is applied once the identity has been allocated
+	known[100], known[300], known[400] = true, true, true
+	l.applyDeferredUpserts(time.Now())
+	value, ok = m.lookup(c, "10.0.1.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(100))
+	_, ok = m.lookup(c, "10.0.2.1/32")
+	c.Assert(ok, Equals, false)
+	value, ok = m.lookup(c, "10.0.3.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(301))
+	_, ok = m.lookup(c, "10.0.4.1/32")
+	c.Assert(ok, Equals, false)
+
+	// The upsert is applied regardless once the deadline has passed
+	l.applyDeferredUpserts(time.Now().Add(2 * time.Minute))
+	value, ok = m.lookup(c, "10.0.2.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(200))
+	c.Assert(l.identityVerifier.pending, HasLen, 0)
+}
+
+func (s *IPCacheTestSuite) TestValueMutator(c *C) {
+	m := newFakeMap()
+	var mutated []string
+	l := newListener(m, nil, 0).WithValueMutator(
+		func(value *ipcacheMap.RemoteEndpointInfo, cidr net.IPNet, id identity.NumericIdentity) {
+			mutated = append(mutated, cidr.String())
+			value.Key = uint8(id % 16)
+			// The prefix is informational, modifying it does not
+			// affect the key of the entry
+			cidr.IP[0] = 192
+		})
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1").To4() }
+
+	_, prefix, _ := net.ParseCIDR("10.0.1.1/32")
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *prefix, nil, nil, nil, 103, 0)
+
+	c.Assert(mutated, DeepEquals, []string{"10.0.1.1/32"})
+	c.Assert(m.entries, HasLen, 1)
+	value, ok := m.lookup(c, "10.0.1.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.Key, Equals, uint8(7))
+	c.Assert(value.SecurityIdentity, Equals, uint32(103))
+}
+
+func (s *IPCacheTestSuite) TestCoalescing(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithCoalescing(50 * time.Millisecond)
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1").To4() }
+	// Prevent the flush controller from interfering
+	l.coalescer.startOnce.Do(func() {})
+
+	_, updated, _ := net.ParseCIDR("10.0.1.1/32")
+	_, transient, _ := net.ParseCIDR("10.0.2.1/32")
+	_, deleted, _ := net.ParseCIDR("10.0.3.1/32")
+	oldID := identity.NumericIdentity(100)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *updated, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *updated, nil, nil, &oldID, 200, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *transient, nil, nil, nil, 300, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *transient, nil, nil, nil, 300, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *deleted, nil, nil, nil, 400, 0)
+
+	// Nothing is written before the flush, and the upsert and delete of
+	// the transient prefix have cancelled out
+	c.Assert(m.entries, HasLen, 0)
+	c.Assert(l.coalescer.pending, HasLen, 2)
+	c.Assert(l.hasPendingUpdates(), Equals, true)
+
+	m.entries[ipcacheMap.NewKey(deleted.IP, deleted.Mask)] = ipcacheMap.RemoteEndpointInfo{SecurityIdentity: 400}
+	l.flushCoalescedChanges()
+	c.Assert(l.coalescer.pending, HasLen, 0)
+
+	value, ok := m.lookup(c, "10.0.1.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(200))
+	_, ok = m.lookup(c, "10.0.2.1/32")
+	c.Assert(ok, Equals, false)
+	_, ok = m.lookup(c, "10.0.3.1/32")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *IPCacheTestSuite) TestNewListenerForUnopenedMap(c *C) {
+	l, err := NewListenerForMap(ipcacheMap.NewMap("cilium_test_ipcache"), nil, 0)
+	c.Assert(err, Not(IsNil))
+	c.Assert(l, IsNil)
+}
+
+func (s *IPCacheTestSuite) TestGarbageCollectReport(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithGCDryRun(true)
+	c.Assert(l.gcDryRun, Equals, true)
+
+	_, cidr, err := net.ParseCIDR("10.1.0.1/32")
+	c.Assert(err, IsNil)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+
+	ipcache.IPIdentityCache.Upsert("10.1.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.1.0.1")
+
+	// Entries which exist in the in-memory ipcache are not reported
+	keys, err := l.garbageCollectReport()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+	c.Assert(l.logGarbageCollectReport(), IsNil)
+
+	// The report leaves the BPF map untouched
+	_, ok := m.lookup(c, "10.1.0.1/32")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *IPCacheTestSuite) TestGarbageCollectSources(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithGCDryRun(true)
+
+	for _, prefix := range []string{"10.2.0.1/32", "10.2.0.2/32"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+
+	reported := func() []string {
+		keys, err := l.garbageCollectReport()
+		c.Assert(err, IsNil)
+		prefixes := []string{}
+		for _, k := range keys {
+			prefixes = append(prefixes, k.String())
+		}
+		return prefixes
+	}
+
+	// Entries which have never been observed in the in-memory ipcache
+	// have an unknown source and are removed by default
+	ipcache.IPIdentityCache.Upsert("10.2.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKubernetes})
+	c.Assert(reported(), checker.DeepEquals, []string{"10.2.0.2/32"})
+
+	// Entries last observed from Kubernetes are kept by default
+	ipcache.IPIdentityCache.Delete("10.2.0.1")
+	c.Assert(reported(), checker.DeepEquals, []string{"10.2.0.2/32"})
+
+	// The latest observed source decides
+	ipcache.IPIdentityCache.Upsert("10.2.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	c.Assert(reported(), checker.DeepEquals, []string{"10.2.0.2/32"})
+	ipcache.IPIdentityCache.Delete("10.2.0.1")
+	c.Assert(reported(), checker.DeepEquals, []string{"10.2.0.1/32", "10.2.0.2/32"})
+
+	// Entries of unknown source can be kept as well
+	sources, err := ParseGCSources([]string{"kvstore"})
+	c.Assert(err, IsNil)
+	l.WithGCSources(sources)
+	c.Assert(reported(), checker.DeepEquals, []string{"10.2.0.1/32"})
+
+	_, err = ParseGCSources([]string{"kvstore", "foo"})
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *IPCacheTestSuite) TestIsStaleEntry(c *C) {
+	l := newListener(newFakeMap(), nil, 0)
+
+	isStale := func(keyToIP string, observe bool) bool {
+		ipcache.IPIdentityCache.RLock()
+		defer ipcache.IPIdentityCache.RUnlock()
+		return l.gcSources.isStale(keyToIP, observe)
+	}
+
+	// Found in memory, then removed: the recorded source decides
+	ipcache.IPIdentityCache.Upsert("10.3.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	c.Assert(isStale("10.3.0.1/32", true), Equals, false)
+	ipcache.IPIdentityCache.Delete("10.3.0.1")
+	c.Assert(isStale("10.3.0.1/32", false), Equals, true)
+
+	ipcache.IPIdentityCache.Upsert("10.3.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKubernetes})
+	c.Assert(isStale("10.3.0.1/32", true), Equals, false)
+	ipcache.IPIdentityCache.Delete("10.3.0.1")
+	c.Assert(isStale("10.3.0.1/32", false), Equals, false)
+
+	// Found in memory without a source: recorded as unknown
+	ipcache.IPIdentityCache.Upsert("10.3.0.2", nil, ipcache.Identity{ID: 100})
+	c.Assert(isStale("10.3.0.2/32", true), Equals, false)
+	c.Assert(l.gcSources.source("10.3.0.2/32"), Equals, GCSourceUnknown)
+	ipcache.IPIdentityCache.Delete("10.3.0.2")
+	c.Assert(isStale("10.3.0.2/32", false), Equals, true)
+
+	// Genuinely absent: never observed, so the source is unknown
+	c.Assert(isStale("10.3.0.3/32", true), Equals, true)
+	c.Assert(l.gcSources.source("10.3.0.3/32"), Equals, GCSourceUnknown)
+
+	l.WithGCSources([]ipcache.Source{ipcache.FromKVStore})
+	c.Assert(isStale("10.3.0.3/32", true), Equals, false)
+}
+
+func (s *IPCacheTestSuite) TestGarbageCollectCancelled(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+
+	_, cidr, err := net.ParseCIDR("10.4.0.1/32")
+	c.Assert(err, IsNil)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Cancellation is checked before anything is removed
+	c.Assert(l.garbageCollect(ctx), Equals, context.Canceled)
+	_, ok := m.lookup(c, "10.4.0.1/32")
+	c.Assert(ok, Equals, true)
+
+	keysToRemove, err := l.collectStaleEntries(net.IPNet{})
+	c.Assert(err, IsNil)
+	c.Assert(keysToRemove, HasLen, 1)
+	c.Assert(l.deleteStaleEntries(ctx, keysToRemove), Equals, context.Canceled)
+	_, ok = m.lookup(c, "10.4.0.1/32")
+	c.Assert(ok, Equals, true)
+
+	c.Assert(l.deleteStaleEntries(context.Background(), keysToRemove), IsNil)
+	_, ok = m.lookup(c, "10.4.0.1/32")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *IPCacheTestSuite) TestForceResync(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+
+	ipcache.IPIdentityCache.Upsert("10.5.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.5.0.1")
+	ipcache.IPIdentityCache.Upsert("10.5.0.2", nil, ipcache.Identity{ID: 200, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.5.0.2")
+
+	for _, prefix := range []string{"10.5.0.1/32", "10.5.0.3/32"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+
+	// The BPF map drifts from what was written into it
+	_, cidr, err := net.ParseCIDR("10.5.0.1/32")
+	c.Assert(err, IsNil)
+	m.entries[ipcacheMap.NewKey(cidr.IP, cidr.Mask)] = ipcacheMap.RemoteEndpointInfo{SecurityIdentity: 300}
+
+	c.Assert(l.ForceResync(), IsNil)
+
+	value, ok := m.lookup(c, "10.5.0.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(100))
+	value, ok = m.lookup(c, "10.5.0.2/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(200))
+
+	_, ok = m.lookup(c, "10.5.0.3/32")
+	c.Assert(ok, Equals, false)
+
+	// Stale entries are only reported in dry-run mode
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	_, cidr, err = net.ParseCIDR("10.5.0.3/32")
+	c.Assert(err, IsNil)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	c.Assert(l.WithGCDryRun(true).ForceResync(), IsNil)
+	_, ok = m.lookup(c, "10.5.0.3/32")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *IPCacheTestSuite) TestGarbageCollect(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+
+	ipcache.IPIdentityCache.Upsert("10.9.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.9.0.1")
+
+	for _, prefix := range []string{"10.9.0.1/32", "10.9.0.2/32", "10.9.0.0/24"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+
+	// Only entries within the scope are removed
+	_, scope, err := net.ParseCIDR("10.9.0.2/32")
+	c.Assert(err, IsNil)
+	c.Assert(l.garbageCollectScope(context.Background(), *scope), IsNil)
+	_, ok := m.lookup(c, "10.9.0.2/32")
+	c.Assert(ok, Equals, false)
+	_, ok = m.lookup(c, "10.9.0.0/24")
+	c.Assert(ok, Equals, true)
+
+	c.Assert(l.garbageCollect(context.Background()), IsNil)
+	_, ok = m.lookup(c, "10.9.0.0/24")
+	c.Assert(ok, Equals, false)
+	_, ok = m.lookup(c, "10.9.0.1/32")
+	c.Assert(ok, Equals, true)
+}
+
+// fakeBatchMap is a fakeMap which supports batched deletion. DeleteBatch
+// fails on the key 'failKey'.
+type fakeBatchMap struct {
+	*fakeMap
+
+	failKey string
+	batches int
+}
+
+func (m *fakeBatchMap) SupportsDeleteBatch() bool {
+	return true
+}
+
+func (m *fakeBatchMap) DeleteBatch(keys []bpf.MapKey) (int, error) {
+	m.batches++
+	for i, key := range keys {
+		if key.String() == m.failKey {
+			return i, fmt.Errorf("unable to delete %s", key)
+		}
+		delete(m.entries, *key.(*ipcacheMap.Key))
+	}
+	return len(keys), nil
+}
+
+func (s *IPCacheTestSuite) TestDeleteStaleEntriesBatched(c *C) {
+	m := &fakeBatchMap{fakeMap: newFakeMap(), failKey: "10.6.0.3/32"}
+	l := newListener(m, nil, 0).WithGCDeleteBatchSize(2)
+	c.Assert(l.gcDeleteBatchSize, Equals, 2)
+	c.Assert(l.WithGCDeleteBatchSize(0).gcDeleteBatchSize, Equals, 2)
+
+	for _, prefix := range []string{"10.6.0.1/32", "10.6.0.2/32", "10.6.0.3/32", "10.6.0.4/32", "10.6.0.5/32"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+
+	keysToRemove, err := l.collectStaleEntries(net.IPNet{})
+	c.Assert(err, IsNil)
+	c.Assert(keysToRemove, HasLen, 5)
+
+	// The key failing the batched deletion is retried individually
+	c.Assert(l.deleteStaleEntries(context.Background(), keysToRemove), IsNil)
+	c.Assert(m.entries, HasLen, 0)
+	c.Assert(m.batches, Equals, 3)
+
+	// Maps which do not support batched deletion delete every key
+	// individually
+	_, ok := l.batchDeleter()
+	c.Assert(ok, Equals, true)
+	_, ok = newListener(newFakeMap(), nil, 0).batchDeleter()
+	c.Assert(ok, Equals, false)
+}
+
+func (s *IPCacheTestSuite) TestReadOnly(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithReadOnly(true)
+	c.Assert(l.gcReportOnly(), Equals, true)
+
+	_, cidr, err := net.ParseCIDR("10.7.0.1/32")
+	c.Assert(err, IsNil)
+	key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+
+	// Upserts are not written
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	_, ok := m.lookup(c, "10.7.0.1/32")
+	c.Assert(ok, Equals, false)
+
+	// Neither changes nor deletions of existing entries are written
+	m.entries[key] = ipcacheMap.RemoteEndpointInfo{SecurityIdentity: 200}
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 100, 0)
+	value, ok := m.lookup(c, "10.7.0.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(value.SecurityIdentity, Equals, uint32(200))
+	c.Assert(l.retries.pending, HasLen, 0)
+
+	// Garbage collection only reports the stale entry
+	c.Assert(l.garbageCollect(context.Background()), IsNil)
+	_, ok = m.lookup(c, "10.7.0.1/32")
+	c.Assert(ok, Equals, true)
+	c.Assert(l.ForceResync(), IsNil)
+	_, ok = m.lookup(c, "10.7.0.1/32")
+	c.Assert(ok, Equals, true)
+}
+
+func (s *IPCacheTestSuite) TestTrackGCSources(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0).WithGCDryRun(true)
+
+	_, cidr, err := net.ParseCIDR("10.8.0.1/32")
+	c.Assert(err, IsNil)
+
+	// The source is recorded with the change of the ipcache, without
+	// garbage collection observing the prefix
+	ipcache.IPIdentityCache.Upsert("10.8.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKubernetes})
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	c.Assert(l.gcSources.source("10.8.0.1/32"), Equals, ipcache.FromKubernetes)
+
+	// Entries from Kubernetes are kept by default once they disappear
+	ipcache.IPIdentityCache.Delete("10.8.0.1")
+	keys, err := l.garbageCollectReport()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	// Deletions drop the recorded source
+	l.OnIPIdentityCacheChange(ipcache.Delete, *cidr, nil, nil, nil, 100, 0)
+	c.Assert(l.gcSources.source("10.8.0.1/32"), Equals, GCSourceUnknown)
+	c.Assert(l.gcSources.observed, HasLen, 0)
+
+	// The number of recorded prefixes is bounded
+	l.gcSources.maxEntries = 1
+	for _, ip := range []string{"10.8.0.2", "10.8.0.3"} {
+		ipcache.IPIdentityCache.Upsert(ip, nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+		defer ipcache.IPIdentityCache.Delete(ip)
+		_, cidr, err := net.ParseCIDR(ip + "/32")
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+	c.Assert(l.gcSources.observed, HasLen, 1)
+	c.Assert(l.gcSources.source("10.8.0.2/32"), Equals, ipcache.FromKVStore)
+	c.Assert(l.gcSources.source("10.8.0.3/32"), Equals, GCSourceUnknown)
+}
+
+// fakeNotifier records the notifications sent to the node monitor
+type fakeNotifier struct {
+	notifications []monitor.AgentNotify
+}
+
+func (n *fakeNotifier) SendNotification(typ monitor.AgentNotification, text string) error {
+	n.notifications = append(n.notifications, monitor.AgentNotify{Type: typ, Text: text})
+	return nil
+}
+
+func (s *IPCacheTestSuite) TestTunnelEndpointChanged(c *C) {
+	n := &fakeNotifier{}
+	l := newListener(newFakeMap(), nil, 0).WithNotifier(n)
+	l.externalIPv4 = func() net.IP { return net.ParseIP("192.168.0.1") }
+
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+
+	// The first upsert of a prefix is no change
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.2"), nil, 100, 0)
+	c.Assert(n.notifications, HasLen, 0)
+
+	// Neither is a change of the identity only
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.2"), nil, 200, 0)
+	c.Assert(n.notifications, HasLen, 0)
+
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.3"), nil, 200, 0)
+	c.Assert(n.notifications, HasLen, 1)
+	c.Assert(n.notifications[0].Type, Equals, monitor.AgentNotifyTunnelEndpointChanged)
+	c.Assert(n.notifications[0].Text, Equals,
+		`{"cidr":"10.0.0.1/32","old_identity":200,"new_identity":200,"old_tunnel_endpoint":"192.168.0.2","new_tunnel_endpoint":"192.168.0.3"}`)
+
+	// Moving to the local node removes the tunnel endpoint
+	l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, net.ParseIP("192.168.0.1"), nil, 200, 0)
+	c.Assert(n.notifications, HasLen, 2)
+	c.Assert(n.notifications[1].Text, Equals,
+		`{"cidr":"10.0.0.1/32","old_identity":200,"new_identity":200,"old_tunnel_endpoint":"192.168.0.3"}`)
+}
+
+func (s *IPCacheTestSuite) TestOverlapDetection(c *C) {
+	c.Assert(newListener(newFakeMap(), nil, 0).overlaps, IsNil)
+
+	EnableOverlapDetection()
+	defer func() { overlapDetection = false }()
+	l := newListener(newFakeMap(), nil, 0)
+	c.Assert(l.overlaps, Not(IsNil))
+
+	cidrs := map[string]net.IPNet{}
+	for _, prefix := range []string{"10.10.0.0/16", "10.10.1.0/24", "10.10.1.1/32", "10.10.2.1/32", "f00d::/64"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		cidrs[prefix] = *cidr
+	}
+	overlaps := func(prefix string, id identity.NumericIdentity) []string {
+		cidr := cidrs[prefix]
+		ones, bits := cidr.Mask.Size()
+		l.overlaps.mutex.Lock()
+		defer l.overlaps.mutex.Unlock()
+		prefixes := []string{}
+		for _, e := range l.overlaps.overlaps(cidr, prefixLength{ones: ones, bits: bits}, id) {
+			prefixes = append(prefixes, e.cidr.String())
+		}
+		sort.Strings(prefixes)
+		return prefixes
+	}
+
+	l.OnIPIdentityCacheChange(ipcache.Upsert, cidrs["10.10.1.0/24"], nil, nil, nil, 100, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, cidrs["10.10.1.1/32"], nil, nil, nil, 200, 0)
+	l.OnIPIdentityCacheChange(ipcache.Upsert, cidrs["10.10.2.1/32"], nil, nil, nil, 100, 0)
+
+	// Contained within a prefix of a different identity
+	c.Assert(overlaps("10.10.1.1/32", 200), checker.DeepEquals, []string{"10.10.1.0/24"})
+	c.Assert(overlaps("10.10.1.1/32", 100), checker.DeepEquals, []string{})
+
+	// Containing prefixes of a different identity
+	c.Assert(overlaps("10.10.0.0/16", 100), checker.DeepEquals, []string{"10.10.1.1/32"})
+	c.Assert(overlaps("10.10.0.0/16", 300), checker.DeepEquals, []string{"10.10.1.0/24", "10.10.1.1/32", "10.10.2.1/32"})
+
+	// Other address families never overlap
+	c.Assert(overlaps("f00d::/64", 300), checker.DeepEquals, []string{})
+
+	// Deleted prefixes no longer overlap
+	l.OnIPIdentityCacheChange(ipcache.Delete, cidrs["10.10.1.1/32"], nil, nil, nil, 200, 0)
+	c.Assert(overlaps("10.10.0.0/16", 100), checker.DeepEquals, []string{})
+}
+
+func (s *IPCacheTestSuite) TestCheckConsistency(c *C) {
+	m := newFakeMap()
+	l := newListener(m, nil, 0)
+
+	ipcache.IPIdentityCache.Upsert("10.11.0.1", nil, ipcache.Identity{ID: 100, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.11.0.1")
+	ipcache.IPIdentityCache.Upsert("10.11.0.2", nil, ipcache.Identity{ID: 200, Source: ipcache.FromKVStore})
+	defer ipcache.IPIdentityCache.Delete("10.11.0.2")
+
+	for _, prefix := range []string{"10.11.0.1/32", "10.11.0.3/32", "10.11.0.4/32"} {
+		_, cidr, err := net.ParseCIDR(prefix)
+		c.Assert(err, IsNil)
+		l.OnIPIdentityCacheChange(ipcache.Upsert, *cidr, nil, nil, nil, 100, 0)
+	}
+
+	status, err := l.CheckConsistency()
+	c.Assert(err, IsNil)
+	c.Assert(status.OnlyInBPF, Equals, 2)
+	c.Assert(status.OnlyInMemory, Equals, 1)
+	c.Assert(status.InSync(), Equals, false)
+
+	// Nothing is removed from the BPF map
+	_, ok := m.lookup(c, "10.11.0.3/32")
+	c.Assert(ok, Equals, true)
+
+	// The last result is returned until it expires
+	_, cidr, err := net.ParseCIDR("10.11.0.3/32")
+	c.Assert(err, IsNil)
+	delete(m.entries, ipcacheMap.NewKey(cidr.IP, cidr.Mask))
+	cached, err := l.CheckConsistency()
+	c.Assert(err, IsNil)
+	c.Assert(cached, checker.DeepEquals, status)
+
+	l.consistency.status.Timestamp = status.Timestamp.Add(-consistencyCheckInterval)
+	status, err = l.CheckConsistency()
+	c.Assert(err, IsNil)
+	c.Assert(status.OnlyInBPF, Equals, 1)
+}
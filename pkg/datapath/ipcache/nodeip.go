@@ -0,0 +1,139 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tunnelEndpointResolutionInterval is the interval in which entries
+	// programmed while the node IP was unknown are re-evaluated
+	tunnelEndpointResolutionInterval = time.Second
+)
+
+// UnknownNodeIPMode defines how entries with a host IP are programmed into
+// the BPF map while the IPv4 address of the local node is not known yet, e.g.
+// early during startup. In this case, it cannot be decided whether the host
+// IP refers to the local node or a remote node, and thus whether it must be
+// used as tunnel endpoint. Regardless of the mode, all such entries are
+// corrected once the node IP is known.
+type UnknownNodeIPMode int
+
+const (
+	// UnknownNodeIPTunnel assumes that the host IP refers to a remote node
+	// and programs it as tunnel endpoint
+	UnknownNodeIPTunnel UnknownNodeIPMode = iota
+
+	// UnknownNodeIPNoTunnel assumes that the host IP refers to the local
+	// node and programs the entry without tunnel endpoint
+	UnknownNodeIPNoTunnel
+
+	// UnknownNodeIPDefer does not program the entry until the node IP is
+	// known
+	UnknownNodeIPDefer
+)
+
+// ipcacheEntry is an entry of the ipcache as received from the IPCache
+type ipcacheEntry struct {
+	cidr       net.IPNet
+	hostIP     net.IP
+	id         identity.NumericIdentity
+	encryptKey uint8
+}
+
+// unresolvedTunnelEndpoints are the entries of the BPF map whose tunnel
+// endpoint could not be decided because the node IP was unknown
+type unresolvedTunnelEndpoints struct {
+	mutex   lock.Mutex
+	entries map[ipcacheMap.Key]ipcacheEntry
+
+	// startOnce guards starting the controller resolving the entries
+	startOnce sync.Once
+}
+
+// forget stops tracking the entry for key
+func (u *unresolvedTunnelEndpoints) forget(key ipcacheMap.Key) {
+	u.mutex.Lock()
+	delete(u.entries, key)
+	u.mutex.Unlock()
+}
+
+// WithUnknownNodeIPMode sets how entries with a host IP are programmed while
+// the IPv4 address of the local node is not known, and returns the listener.
+// It must be called before the listener is registered with the IPCache.
+func (l *BPFListener) WithUnknownNodeIPMode(mode UnknownNodeIPMode) *BPFListener {
+	l.unknownNodeIPMode = mode
+	return l
+}
+
+// trackUnresolvedTunnelEndpoint remembers the entry so that it is
+// re-evaluated once the node IP is known.
+func (l *BPFListener) trackUnresolvedTunnelEndpoint(key ipcacheMap.Key, cidr net.IPNet,
+	hostIP net.IP, id identity.NumericIdentity, encryptKey uint8) {
+	l.unresolved.mutex.Lock()
+	l.unresolved.entries[key] = ipcacheEntry{cidr: cidr, hostIP: hostIP, id: id, encryptKey: encryptKey}
+	l.unresolved.mutex.Unlock()
+
+	l.unresolved.startOnce.Do(func() {
+		controller.NewManager().UpdateController(l.controllerName("ipcache-bpf-tunnel-endpoint-resolution"),
+			controller.ControllerParams{
+				DoFunc: func() error {
+					l.resolveTunnelEndpoints()
+					return nil
+				},
+				RunInterval: tunnelEndpointResolutionInterval,
+			},
+		)
+	})
+}
+
+// resolveTunnelEndpoints re-programs all entries which were programmed while
+// the node IP was unknown, if the node IP is known by now.
+func (l *BPFListener) resolveTunnelEndpoints() {
+	externalIP := l.externalIPv4()
+	if externalIP == nil {
+		return
+	}
+
+	l.rewriteUnresolvedEntries(externalIP)
+	l.checkSynced()
+}
+
+func (l *BPFListener) rewriteUnresolvedEntries(externalIP net.IP) {
+	l.unresolved.mutex.Lock()
+	defer l.unresolved.mutex.Unlock()
+
+	for key, entry := range l.unresolved.entries {
+		scopedLog := log.WithFields(logrus.Fields{
+			logfields.IPAddr:   entry.cidr,
+			logfields.Identity: entry.id,
+		})
+		scopedLog.Debug("Node IP is known, re-evaluating tunnel endpoint of bpf map entry")
+
+		delete(l.unresolved.entries, key)
+		l.write(key, entry.cidr, entry.hostIP, entry.id, entry.encryptKey, externalIP, scopedLog)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+)
+
+var overlapDetection = false
+
+// EnableOverlapDetection enables the detection of overlapping prefixes with
+// conflicting identities for all listeners created afterwards. This is a
+// debugging aid: as the BPF map resolves an address to its most specific
+// prefix, a prefix covered by a less specific prefix of a different identity
+// may be surprising to policy authors.
+func EnableOverlapDetection() {
+	overlapDetection = true
+}
+
+// prefixLength is the length of the mask of a prefix of a given address
+// family, as returned by net.IPMask.Size()
+type prefixLength struct {
+	ones, bits int
+}
+
+type overlapEntry struct {
+	cidr net.IPNet
+	id   identity.NumericIdentity
+}
+
+// overlapDetector tracks the prefixes of the ipcache to detect overlapping
+// prefixes with conflicting identities. Checking whether a prefix contains
+// other prefixes walks all more specific prefixes, which is why the detection
+// is only enabled for debugging.
+type overlapDetector struct {
+	mutex lock.Mutex
+
+	// prefixes holds the identity of each prefix, indexed by the length of
+	// the prefix and the prefix itself
+	prefixes map[prefixLength]map[string]overlapEntry
+}
+
+func newOverlapDetector() *overlapDetector {
+	return &overlapDetector{
+		prefixes: map[prefixLength]map[string]overlapEntry{},
+	}
+}
+
+// track records the change of 'cidr' and logs the existing prefixes which
+// contain or are contained within an upserted prefix and map to a different
+// identity.
+func (d *overlapDetector) track(modType ipcache.CacheModification, cidr net.IPNet, id identity.NumericIdentity) {
+	ones, bits := cidr.Mask.Size()
+	length := prefixLength{ones: ones, bits: bits}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if modType == ipcache.Delete {
+		delete(d.prefixes[length], cidr.String())
+		if len(d.prefixes[length]) == 0 {
+			delete(d.prefixes, length)
+		}
+		return
+	}
+
+	for _, overlap := range d.overlaps(cidr, length, id) {
+		scopedLog := log.WithFields(logrus.Fields{
+			logfields.IPAddr:      cidr.String(),
+			logfields.Identity:    id,
+			"overlappingPrefix":   overlap.cidr.String(),
+			"overlappingIdentity": overlap.id,
+		})
+		if overlap.cidr.Contains(cidr.IP) {
+			scopedLog.Info("Prefix is contained within a prefix with a different identity")
+		} else {
+			scopedLog.Info("Prefix contains a prefix with a different identity")
+		}
+	}
+
+	entries, ok := d.prefixes[length]
+	if !ok {
+		entries = map[string]overlapEntry{}
+		d.prefixes[length] = entries
+	}
+	entries[cidr.String()] = overlapEntry{cidr: cidr, id: id}
+}
+
+// overlaps returns the tracked prefixes of the same address family which
+// contain or are contained within 'cidr' and map to an identity other than
+// 'id'. d.mutex must be held.
+func (d *overlapDetector) overlaps(cidr net.IPNet, length prefixLength, id identity.NumericIdentity) []overlapEntry {
+	var overlaps []overlapEntry
+	for l, entries := range d.prefixes {
+		if l.bits != length.bits || l.ones == length.ones {
+			continue
+		}
+
+		if l.ones < length.ones {
+			mask := net.CIDRMask(l.ones, l.bits)
+			covering := net.IPNet{IP: cidr.IP.Mask(mask), Mask: mask}
+			if e, ok := entries[covering.String()]; ok && e.id != id {
+				overlaps = append(overlaps, e)
+			}
+			continue
+		}
+
+		for _, e := range entries {
+			if e.id != id && cidr.Contains(e.cidr.IP) {
+				overlaps = append(overlaps, e)
+			}
+		}
+	}
+	return overlaps
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithReadOnly enables the read-only mode of the listener if readOnly is true,
+// and returns the listener. In read-only mode, the listener never writes into
+// the BPF map. Instead, each change of the ipcache is validated against the
+// BPF map and the listener logs what it would have written, and garbage
+// collection only reports the stale entries as in dry-run mode, see
+// WithGCDryRun(). This allows to compare the ipcache against a BPF map
+// which is programmed by someone else without modifying it. It must be
+// called before the listener is registered with the IPCache.
+func (l *BPFListener) WithReadOnly(readOnly bool) *BPFListener {
+	l.readOnly = readOnly
+	return l
+}
+
+// gcReportOnly returns true if garbage collection only reports the stale
+// entries of the BPF map instead of removing them
+func (l *BPFListener) gcReportOnly() bool {
+	return l.gcDryRun || l.readOnly
+}
+
+// observeUpsert logs the upsert of 'value' for 'key' which the listener
+// would have written into the BPF map in read-only mode, and whether the BPF
+// map already holds that value.
+func (l *BPFListener) observeUpsert(key ipcacheMap.Key, value ipcacheMap.RemoteEndpointInfo, scopedLog *logrus.Entry) {
+	scopedLog = scopedLog.WithFields(logrus.Fields{
+		logfields.BPFMapKey:   key.String(),
+		logfields.BPFMapValue: value.String(),
+	})
+
+	current, err := l.bpfMap.Lookup(&key)
+	switch {
+	case err != nil:
+		scopedLog.WithError(err).Info("Read-only mode: entry is missing from bpf map, not upserting")
+	case *current.(*ipcacheMap.RemoteEndpointInfo) != value:
+		scopedLog.WithField("current", current.String()).
+			Info("Read-only mode: entry in bpf map differs, not upserting")
+	default:
+		scopedLog.Debug("Read-only mode: entry in bpf map is up to date")
+	}
+}
+
+// observeDelete logs the deletion of 'key' which the listener would have
+// performed on the BPF map in read-only mode, and whether the BPF map still
+// holds the entry.
+func (l *BPFListener) observeDelete(key ipcacheMap.Key, scopedLog *logrus.Entry) {
+	scopedLog = scopedLog.WithField(logfields.BPFMapKey, key.String())
+
+	if current, err := l.bpfMap.Lookup(&key); err == nil {
+		scopedLog.WithField("current", current.String()).
+			Info("Read-only mode: entry still exists in bpf map, not deleting")
+		return
+	}
+	scopedLog.Debug("Read-only mode: entry is absent from bpf map")
+}
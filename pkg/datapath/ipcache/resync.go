@@ -0,0 +1,119 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cilium/cilium/pkg/bpf"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+
+	"github.com/sirupsen/logrus"
+)
+
+// resyncListener writes the entries of the ipcache dumped by ForceResync()
+// straight into the BPF map of the listener. Churn detection and coalescing
+// are bypassed, as the entries have not actually changed.
+type resyncListener struct {
+	l *BPFListener
+}
+
+func (r resyncListener) OnIPIdentityCacheChange(modType ipcache.CacheModification, cidr net.IPNet,
+	oldHostIP, newHostIP net.IP, oldID *identity.NumericIdentity, newID identity.NumericIdentity,
+	encryptKey uint8) {
+	scopedLog := log.WithFields(logrus.Fields{
+		logfields.IPAddr:       cidr,
+		logfields.Identity:     newID,
+		logfields.Modification: modType,
+	})
+
+	key := ipcacheMap.NewKey(cidr.IP, cidr.Mask)
+	r.l.supersede(key)
+	r.l.gcSources.track(modType, key.String())
+	r.l.applyChange(key, modType, cidr, newHostIP, newID, encryptKey, scopedLog)
+}
+
+func (r resyncListener) OnIPIdentityCacheGC() {}
+
+// dumpKeys returns the keys of all entries of the BPF map
+func (l *BPFListener) dumpKeys() (map[ipcacheMap.Key]struct{}, error) {
+	keys := map[ipcacheMap.Key]struct{}{}
+	err := l.bpfMap.DumpWithCallback(func(key bpf.MapKey, value bpf.MapValue) {
+		keys[*key.(*ipcacheMap.Key)] = struct{}{}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error dumping ipcache BPF map: %s", err)
+	}
+	return keys, nil
+}
+
+// ForceResync rebuilds the BPF map from the in-memory ipcache, e.g. when the
+// BPF map is suspected to have drifted from the in-memory ipcache. Every entry
+// of the in-memory ipcache is written into the BPF map, and the BPF map is
+// then garbage collected to remove the entries which do not exist in memory.
+// In dry-run mode, see WithGCDryRun(), these entries are only logged. In
+// read-only mode, see WithReadOnly(), nothing is written at all. The
+// number of entries added to and removed from the BPF map is logged; entries
+// which are overwritten in place are not counted.
+func (l *BPFListener) ForceResync() error {
+	before, err := l.dumpKeys()
+	if err != nil {
+		return err
+	}
+
+	// The BPF map may no longer hold the values last written into it, so
+	// nothing may be skipped as unchanged.
+	l.shadow.reset()
+
+	ipcache.IPIdentityCache.RLock()
+	ipcache.IPIdentityCache.DumpToListenerLocked(resyncListener{l: l})
+	ipcache.IPIdentityCache.RUnlock()
+
+	if l.gcReportOnly() {
+		err = l.logGarbageCollectReport()
+	} else {
+		err = l.garbageCollect(l.gcCtx)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to garbage collect ipcache BPF map: %s", err)
+	}
+
+	after, err := l.dumpKeys()
+	if err != nil {
+		return err
+	}
+
+	added, removed := 0, 0
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			added++
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed++
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"added":   added,
+		"removed": removed,
+	}).Info("Forced resync of ipcache BPF map completed")
+
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/ipcache"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// retryInterval is the interval in which failed operations on the
+	// BPF map are checked for being due for another attempt
+	retryInterval = time.Second
+
+	// retryBackoffMin is the backoff after the first failed attempt of an
+	// operation, it is doubled on every further failed attempt
+	retryBackoffMin = time.Second
+
+	// retryBackoffMax is the maximum backoff between two attempts of an
+	// operation
+	retryBackoffMax = time.Minute
+)
+
+// failedOperation is an upsert into or a delete from the BPF map which
+// failed and is waiting to be retried
+type failedOperation struct {
+	// value is the value to upsert, or nil for a delete
+	value *ipcacheMap.RemoteEndpointInfo
+
+	attempts    int
+	nextAttempt time.Time
+}
+
+// retryBackoff returns the backoff after the given number of failed attempts
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffMin
+	for i := 1; i < attempts && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > retryBackoffMax {
+		backoff = retryBackoffMax
+	}
+	return backoff
+}
+
+// retryQueue holds the failed operations on the BPF map, at most one per key.
+// A failed operation is superseded by any later operation for the same key.
+type retryQueue struct {
+	mutex   lock.Mutex
+	pending map[ipcacheMap.Key]*failedOperation
+
+	// startOnce guards starting the controller retrying the operations
+	startOnce sync.Once
+}
+
+// setDepth updates the queue depth metric, q.mutex must be held
+func (q *retryQueue) setDepth() {
+	metrics.IPCacheRetryQueueDepth.Set(float64(len(q.pending)))
+}
+
+// forget drops any failed operation for key
+func (q *retryQueue) forget(key ipcacheMap.Key) {
+	q.mutex.Lock()
+	if _, ok := q.pending[key]; ok {
+		delete(q.pending, key)
+		q.setDepth()
+	}
+	q.mutex.Unlock()
+}
+
+// retryLater queues the failed upsert of value for key, or the failed delete
+// of key if value is nil, to be retried with exponential backoff.
+func (l *BPFListener) retryLater(key ipcacheMap.Key, value *ipcacheMap.RemoteEndpointInfo) {
+	q := &l.retries
+
+	q.mutex.Lock()
+	q.pending[key] = &failedOperation{
+		value:       value,
+		attempts:    1,
+		nextAttempt: time.Now().Add(retryBackoff(1)),
+	}
+	q.setDepth()
+	q.mutex.Unlock()
+
+	q.startOnce.Do(func() {
+		controller.NewManager().UpdateController(l.controllerName("ipcache-bpf-retry"),
+			controller.ControllerParams{
+				DoFunc: func() error {
+					l.retryFailedOperations(time.Now())
+					return nil
+				},
+				RunInterval: retryInterval,
+			},
+		)
+	})
+}
+
+// retryFailedOperations retries all failed operations which are due at time
+// 'now'.
+func (l *BPFListener) retryFailedOperations(now time.Time) {
+	l.retryDueOperations(now)
+	l.checkSynced()
+}
+
+// retryDueOperations retries the operations due at time 'now'. The ipcache is
+// locked for reading so that no operation is retried after it has been
+// superseded by a concurrent change of the ipcache.
+func (l *BPFListener) retryDueOperations(now time.Time) {
+	ipcache.IPIdentityCache.RLock()
+	defer ipcache.IPIdentityCache.RUnlock()
+
+	q := &l.retries
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for key, op := range q.pending {
+		if now.Before(op.nextAttempt) {
+			continue
+		}
+
+		k := key
+		var err error
+		if op.value != nil {
+			err = l.bpfMap.Update(&k, op.value)
+			countMapOperation(metricOpUpsert, err)
+			if err == nil {
+				l.shadow.set(k, *op.value)
+			}
+		} else {
+			err = l.bpfMap.Delete(&k)
+			countMapOperation(metricOpDelete, err)
+		}
+
+		if err == nil {
+			delete(q.pending, key)
+			continue
+		}
+
+		op.attempts++
+		op.nextAttempt = now.Add(retryBackoff(op.attempts))
+		log.WithError(err).WithFields(logrus.Fields{
+			logfields.BPFMapKey: key.String(),
+			"attempts":          op.attempts,
+		}).Debug("Retry of bpf map operation failed")
+	}
+	q.setDepth()
+}
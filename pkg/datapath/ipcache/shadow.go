@@ -0,0 +1,61 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"github.com/cilium/cilium/pkg/lock"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+)
+
+// shadowMap mirrors the values last written into the BPF map by the listener,
+// so that upserts which would not change an entry can be skipped. An entry is
+// only present while its value in the BPF map is known; it is dropped whenever
+// the outcome of an operation on the key is uncertain, which at worst causes a
+// redundant write.
+type shadowMap struct {
+	mutex   lock.Mutex
+	entries map[ipcacheMap.Key]ipcacheMap.RemoteEndpointInfo
+}
+
+// get returns the value last written for key, if it is known
+func (s *shadowMap) get(key ipcacheMap.Key) (ipcacheMap.RemoteEndpointInfo, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.entries[key]
+	return value, ok
+}
+
+// set records value as written for key
+func (s *shadowMap) set(key ipcacheMap.Key, value ipcacheMap.RemoteEndpointInfo) {
+	s.mutex.Lock()
+	s.entries[key] = value
+	s.mutex.Unlock()
+}
+
+// forget drops the value recorded for key, e.g. once the key has been deleted
+// or an upsert of it failed
+func (s *shadowMap) forget(key ipcacheMap.Key) {
+	s.mutex.Lock()
+	delete(s.entries, key)
+	s.mutex.Unlock()
+}
+
+// reset drops all recorded values, e.g. once the BPF map has been replaced
+func (s *shadowMap) reset() {
+	s.mutex.Lock()
+	s.entries = map[ipcacheMap.Key]ipcacheMap.RemoteEndpointInfo{}
+	s.mutex.Unlock()
+}
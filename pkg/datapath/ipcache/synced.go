@@ -0,0 +1,114 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"sync"
+
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// syncState tracks whether the BPF map has converged with the in-memory
+// IPCache after startup
+type syncState struct {
+	mutex       lock.Mutex
+	gcCompleted bool
+
+	// synced is closed once the map is in sync
+	synced    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSyncState() syncState {
+	return syncState{synced: make(chan struct{})}
+}
+
+// Synced returns a channel which is closed once the BPF map is in sync with
+// the in-memory IPCache for the first time after startup, that is once the
+// first garbage collection has completed and no updates of the map are
+// pending anymore, e.g. waiting for an identity to be allocated, for the node
+// IP to be known, for a failed operation to be retried or for coalesced
+// changes to be flushed. It can be used by readiness checks to wait for the
+// datapath to converge.
+func (l *BPFListener) Synced() <-chan struct{} {
+	return l.sync.synced
+}
+
+// IsSynced returns true if the BPF map has been in sync with the in-memory
+// IPCache, see Synced().
+func (l *BPFListener) IsSynced() bool {
+	select {
+	case <-l.sync.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// hasPendingUpdates returns true if updates of the BPF map are deferred
+func (l *BPFListener) hasPendingUpdates() bool {
+	if v := l.identityVerifier; v != nil {
+		v.mutex.Lock()
+		pending := len(v.pending)
+		v.mutex.Unlock()
+		if pending > 0 {
+			return true
+		}
+	}
+
+	if l.unknownNodeIPMode == UnknownNodeIPDefer {
+		l.unresolved.mutex.Lock()
+		pending := len(l.unresolved.entries)
+		l.unresolved.mutex.Unlock()
+		if pending > 0 {
+			return true
+		}
+	}
+
+	if l.coalescer != nil && l.coalescer.len() > 0 {
+		return true
+	}
+
+	l.retries.mutex.Lock()
+	pending := len(l.retries.pending)
+	l.retries.mutex.Unlock()
+
+	return pending > 0
+}
+
+// garbageCollectCompleted marks the completion of a garbage collection run
+func (l *BPFListener) garbageCollectCompleted() {
+	l.sync.mutex.Lock()
+	l.sync.gcCompleted = true
+	l.sync.mutex.Unlock()
+
+	l.checkSynced()
+}
+
+// checkSynced signals Synced() if garbage collection has completed and no
+// updates are pending. It must be called whenever pending updates have been
+// applied.
+func (l *BPFListener) checkSynced() {
+	l.sync.mutex.Lock()
+	gcCompleted := l.sync.gcCompleted
+	l.sync.mutex.Unlock()
+
+	if gcCompleted && !l.hasPendingUpdates() {
+		l.sync.closeOnce.Do(func() {
+			log.Info("BPF ipcache is in sync with the in-memory ipcache")
+			close(l.sync.synced)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+	"github.com/cilium/cilium/pkg/monitor"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Notifier sends notifications to the node monitor, e.g. the daemon
+type Notifier interface {
+	SendNotification(typ monitor.AgentNotification, text string) error
+}
+
+// WithNotifier sets the notifier which is sent a monitor notification
+// whenever the tunnel endpoint of a prefix changes, and returns the listener.
+// It must be called before the listener is registered with the IPCache.
+func (l *BPFListener) WithNotifier(n Notifier) *BPFListener {
+	l.notifier = n
+	return l
+}
+
+// tunnelEndpointChanged reports that the tunnel endpoint programmed for
+// 'cidr' has changed from the one in 'previous' to the one in 'value', e.g.
+// because the endpoint has moved to a different node. A nil tunnel endpoint
+// means that traffic to the prefix is not encapsulated.
+func (l *BPFListener) tunnelEndpointChanged(cidr net.IPNet, previous, value ipcacheMap.RemoteEndpointInfo, scopedLog *logrus.Entry) {
+	oldTunnelEndpoint, newTunnelEndpoint := previous.GetTunnelEndpoint(), value.GetTunnelEndpoint()
+
+	scopedLog.WithFields(logrus.Fields{
+		"oldIdentity":       previous.SecurityIdentity,
+		"oldTunnelEndpoint": oldTunnelEndpoint,
+		"newTunnelEndpoint": newTunnelEndpoint,
+	}).Info("Tunnel endpoint of prefix changed")
+
+	if l.notifier == nil {
+		return
+	}
+
+	repr, err := monitor.TunnelEndpointChangeRepr(cidr, previous.SecurityIdentity, value.SecurityIdentity,
+		oldTunnelEndpoint, newTunnelEndpoint)
+	if err != nil {
+		scopedLog.WithError(err).Warning("Unable to encode tunnel endpoint change notification")
+		return
+	}
+	if err := l.notifier.SendNotification(monitor.AgentNotifyTunnelEndpointChanged, repr); err != nil {
+		scopedLog.WithError(err).Debug("Unable to send tunnel endpoint change notification")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipcache
+
+import (
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/controller"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	ipcacheMap "github.com/cilium/cilium/pkg/maps/ipcache"
+	"github.com/cilium/cilium/pkg/metrics"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// identityVerificationInterval is the interval in which deferred
+	// upserts are checked for their identity to be allocated.
+	identityVerificationInterval = time.Second
+)
+
+// deferredUpsert is an upsert into the BPF map which is waiting for its
+// identity to become known.
+type deferredUpsert struct {
+	cidr       net.IPNet
+	hostIP     net.IP
+	id         identity.NumericIdentity
+	encryptKey uint8
+	deadline   time.Time
+}
+
+// identityVerifier defers upserts into the BPF map until the identity of the
+// entry has been allocated, so that the datapath never refers to an
+// unallocated identity. Upserts are deferred for at most maxWait, after which
+// they are applied regardless.
+type identityVerifier struct {
+	mutex   lock.Mutex
+	pending map[ipcacheMap.Key]deferredUpsert
+	maxWait time.Duration
+
+	// isKnown returns true if the identity has been allocated
+	isKnown func(identity.NumericIdentity) bool
+}
+
+func identityIsAllocated(id identity.NumericIdentity) bool {
+	return identity.LookupIdentityByID(id) != nil
+}
+
+// WithIdentityVerification enables the verification that the identity of
+// each upserted entry is known to the identity allocator before the entry is
+// written into the BPF map. Upserts of entries with an unknown identity are
+// deferred for up to 'maxWait'. It must be called before the listener is
+// registered with the IPCache.
+func (l *BPFListener) WithIdentityVerification(maxWait time.Duration) *BPFListener {
+	l.identityVerifier = &identityVerifier{
+		pending: map[ipcacheMap.Key]deferredUpsert{},
+		maxWait: maxWait,
+		isKnown: identityIsAllocated,
+	}
+
+	controller.NewManager().UpdateController(l.controllerName("ipcache-bpf-identity-verification"),
+		controller.ControllerParams{
+			DoFunc: func() error {
+				l.applyDeferredUpserts(time.Now())
+				return nil
+			},
+			RunInterval: identityVerificationInterval,
+		},
+	)
+
+	return l
+}
+
+// deferUpsert queues the upsert until the identity is known.
+func (v *identityVerifier) deferUpsert(key ipcacheMap.Key, cidr net.IPNet, hostIP net.IP,
+	id identity.NumericIdentity, encryptKey uint8) {
+	v.mutex.Lock()
+	v.pending[key] = deferredUpsert{
+		cidr:       cidr,
+		hostIP:     hostIP,
+		id:         id,
+		encryptKey: encryptKey,
+		deadline:   time.Now().Add(v.maxWait),
+	}
+	v.mutex.Unlock()
+
+	metrics.IPCacheDeferredUpdates.Inc()
+}
+
+// cancel removes any deferred upsert for the key.
+func (v *identityVerifier) cancel(key ipcacheMap.Key) {
+	v.mutex.Lock()
+	delete(v.pending, key)
+	v.mutex.Unlock()
+}
+
+// applyDeferredUpserts writes all deferred upserts whose identity has become
+// known, or which have been waiting beyond their deadline, into the BPF map.
+func (l *BPFListener) applyDeferredUpserts(now time.Time) {
+	l.applyReadyUpserts(now)
+	l.checkSynced()
+}
+
+func (l *BPFListener) applyReadyUpserts(now time.Time) {
+	v := l.identityVerifier
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for key, upsert := range v.pending {
+		scopedLog := log.WithFields(logrus.Fields{
+			logfields.IPAddr:   upsert.cidr,
+			logfields.Identity: upsert.id,
+		})
+
+		switch {
+		case v.isKnown(upsert.id):
+			scopedLog.Debug("Identity has been allocated, applying deferred update of bpf map")
+		case now.After(upsert.deadline):
+			scopedLog.Warning("Identity is still not allocated, applying deferred update of bpf map regardless")
+		default:
+			continue
+		}
+
+		delete(v.pending, key)
+		l.upsert(key, upsert.cidr, upsert.hostIP, upsert.id, upsert.encryptKey, scopedLog)
+	}
+}
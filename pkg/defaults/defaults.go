@@ -15,6 +15,8 @@
 package defaults
 
 import (
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -59,6 +61,11 @@ const (
 	// This is the 1.2 protocol version.
 	MonitorSockPath1_2 = RuntimePath + "/monitor1_2.sock"
 
+	// MonitorSockPathHandshake is the path to the UNIX domain socket used
+	// to distribute BPF and agent events to listeners which negotiate the
+	// protocol version and features in a handshake.
+	MonitorSockPathHandshake = RuntimePath + "/monitor_handshake.sock"
+
 	// PidFilePath is the path to the pid file for the agent.
 	PidFilePath = RuntimePath + "/cilium.pid"
 
@@ -73,6 +80,14 @@ const (
 	// from previous state automatically
 	EnableHostIPRestore = true
 
+	// IPCacheGCInterval is the default interval in which the BPF ipcache
+	// map is garbage collected
+	IPCacheGCInterval = 5 * time.Minute
+
+	// IPCacheGCDeleteBatchSize is the default maximum number of stale
+	// entries deleted from the BPF ipcache map at once
+	IPCacheGCDeleteBatchSize = 256
+
 	// DefaultMapRoot is the default path where BPFFS should be mounted
 	DefaultMapRoot = "/sys/fs/bpf"
 
@@ -52,6 +52,13 @@ var (
 		TrafficDirection: policymap.Ingress.Uint8(),
 	}
 
+	// remoteNodeKey represents an ingress L3 allow from the other nodes
+	// of the cluster.
+	remoteNodeKey = policymap.PolicyKey{
+		Identity:         identityPkg.ReservedIdentityRemoteNode.Uint32(),
+		TrafficDirection: policymap.Ingress.Uint8(),
+	}
+
 	// worldKey represents an ingress L3 allow from the world.
 	worldKey = policymap.PolicyKey{
 		Identity:         identityPkg.ReservedIdentityWorld.Uint32(),
@@ -282,7 +289,10 @@ func (e *Endpoint) computeDesiredPolicyMapState(repo *policy.Repository) {
 // determineAllowLocalhost determines whether endpoint should be allowed to
 // communicate with the localhost. It inserts the PolicyKey corresponding to
 // the localhost in the desiredPolicyKeys if the endpoint is allowed to
-// communicate with the localhost.
+// communicate with the localhost. If the localhost is always allowed and
+// other nodes carry the remote-node identity, the PolicyKey corresponding to
+// the other nodes is inserted as well, as they used to be allowed as part of
+// the localhost.
 func (e *Endpoint) determineAllowLocalhost(desiredPolicyKeys PolicyMapState) {
 
 	if desiredPolicyKeys == nil {
@@ -292,6 +302,10 @@ func (e *Endpoint) determineAllowLocalhost(desiredPolicyKeys PolicyMapState) {
 	if option.Config.AlwaysAllowLocalhost() || (e.DesiredL4Policy != nil && e.DesiredL4Policy.HasRedirect()) {
 		desiredPolicyKeys[localHostKey] = PolicyMapStateEntry{}
 	}
+
+	if option.Config.AlwaysAllowLocalhost() && option.Config.EnableRemoteNodeIdentity {
+		desiredPolicyKeys[remoteNodeKey] = PolicyMapStateEntry{}
+	}
 }
 
 // determineAllowFromWorld determines whether world should be allowed to
@@ -55,22 +55,34 @@ const (
 	// ReservedIdentityInit is the identity given to endpoints that have not
 	// received any labels yet.
 	ReservedIdentityInit
+
+	// ReservedIdentityRemoteNode represents all nodes of the cluster other
+	// than the local node
+	ReservedIdentityRemoteNode
+
+	// ReservedIdentityKubeAPIServer represents the kube-apiserver if it is
+	// external to the cluster
+	ReservedIdentityKubeAPIServer
 )
 
 var (
 	reservedIdentities = map[string]NumericIdentity{
-		labels.IDNameHost:    ReservedIdentityHost,
-		labels.IDNameWorld:   ReservedIdentityWorld,
-		labels.IDNameHealth:  ReservedIdentityHealth,
-		labels.IDNameCluster: ReservedIdentityCluster,
-		labels.IDNameInit:    ReservedIdentityInit,
+		labels.IDNameHost:          ReservedIdentityHost,
+		labels.IDNameWorld:         ReservedIdentityWorld,
+		labels.IDNameHealth:        ReservedIdentityHealth,
+		labels.IDNameCluster:       ReservedIdentityCluster,
+		labels.IDNameInit:          ReservedIdentityInit,
+		labels.IDNameRemoteNode:    ReservedIdentityRemoteNode,
+		labels.IDNameKubeAPIServer: ReservedIdentityKubeAPIServer,
 	}
 	reservedIdentityNames = map[NumericIdentity]string{
-		ReservedIdentityHost:    labels.IDNameHost,
-		ReservedIdentityWorld:   labels.IDNameWorld,
-		ReservedIdentityHealth:  labels.IDNameHealth,
-		ReservedIdentityCluster: labels.IDNameCluster,
-		ReservedIdentityInit:    labels.IDNameInit,
+		ReservedIdentityHost:          labels.IDNameHost,
+		ReservedIdentityWorld:         labels.IDNameWorld,
+		ReservedIdentityHealth:        labels.IDNameHealth,
+		ReservedIdentityCluster:       labels.IDNameCluster,
+		ReservedIdentityInit:          labels.IDNameInit,
+		ReservedIdentityRemoteNode:    labels.IDNameRemoteNode,
+		ReservedIdentityKubeAPIServer: labels.IDNameKubeAPIServer,
 	}
 
 	// ErrNotUserIdentity is an error returned for an identity that is not user
@@ -57,6 +57,10 @@ type Identity struct {
 
 	// Source is the source of the identity in the cache
 	Source Source
+
+	// EncryptKey is the index of the key used to encrypt traffic to the
+	// IP, 0 if the traffic is not encrypted
+	EncryptKey uint8
 }
 
 // IPCache is a collection of mappings:
@@ -236,7 +240,7 @@ func (ipc *IPCache) Upsert(ip string, hostIP net.IP, newIdentity Identity) bool
 		}
 
 		// Skip update if IP is already mapped to the given identity
-		// and the host IP hasn't changed.
+		// and encryption key, and the host IP hasn't changed.
 		if cachedIdentity == newIdentity && bytes.Compare(oldHostIP, hostIP) == 0 {
 			return true
 		}
@@ -276,13 +280,14 @@ func (ipc *IPCache) Upsert(ip string, hostIP net.IP, newIdentity Identity) bool
 			cidrStr := cidr.String()
 			if cidrIdentity, cidrFound := ipc.ipToIdentityCache[cidrStr]; cidrFound {
 				oldHostIP = ipc.ipToHostIPCache[cidrStr]
-				if cidrIdentity.ID != newIdentity.ID || bytes.Compare(oldHostIP, hostIP) != 0 {
+				if cidrIdentity.ID != newIdentity.ID || cidrIdentity.EncryptKey != newIdentity.EncryptKey ||
+					bytes.Compare(oldHostIP, hostIP) != 0 {
 					scopedLog.Debug("New endpoint IP started shadowing existing CIDR to identity mapping")
 					oldIdentity = &cidrIdentity.ID
 				} else {
 					// The endpoint IP and the CIDR are associated with the
-					// same identity and host IP. Nothing changes for the
-					// listeners.
+					// same identity, encryption key and host IP. Nothing
+					// changes for the listeners.
 					callbackListeners = false
 				}
 			}
@@ -316,7 +321,8 @@ func (ipc *IPCache) Upsert(ip string, hostIP net.IP, newIdentity Identity) bool
 
 	if callbackListeners {
 		for _, listener := range ipc.listeners {
-			listener.OnIPIdentityCacheChange(Upsert, *cidr, oldHostIP, hostIP, oldIdentity, newIdentity.ID)
+			listener.OnIPIdentityCacheChange(Upsert, *cidr, oldHostIP, hostIP, oldIdentity, newIdentity.ID,
+				newIdentity.EncryptKey)
 		}
 	}
 
@@ -333,7 +339,7 @@ func (ipc *IPCache) DumpToListenerLocked(listener IPIdentityMappingListener) {
 			endpointIP := net.ParseIP(ip)
 			cidr = endpointIPToCIDR(endpointIP)
 		}
-		listener.OnIPIdentityCacheChange(Upsert, *cidr, nil, hostIP, nil, identity.ID)
+		listener.OnIPIdentityCacheChange(Upsert, *cidr, nil, hostIP, nil, identity.ID, identity.EncryptKey)
 	}
 }
 
@@ -392,14 +398,16 @@ func (ipc *IPCache) deleteLocked(ip string) {
 		cidrStr := cidr.String()
 		if cidrIdentity, cidrFound := ipc.ipToIdentityCache[cidrStr]; cidrFound {
 			newHostIP = ipc.ipToHostIPCache[cidrStr]
-			if cidrIdentity.ID != cachedIdentity.ID || bytes.Compare(oldHostIP, newHostIP) != 0 {
+			if cidrIdentity.ID != cachedIdentity.ID || cidrIdentity.EncryptKey != cachedIdentity.EncryptKey ||
+				bytes.Compare(oldHostIP, newHostIP) != 0 {
 				scopedLog.Debug("Removal of endpoint IP revives shadowed CIDR to identity mapping")
 				cacheModification = Upsert
 				oldIdentity = &cachedIdentity.ID
 				newIdentity = cidrIdentity
 			} else {
 				// The endpoint IP and the CIDR were associated with the same
-				// identity and host IP. Nothing changes for the listeners.
+				// identity, encryption key and host IP. Nothing changes for
+				// the listeners.
 				callbackListeners = false
 			}
 		}
@@ -420,7 +428,7 @@ func (ipc *IPCache) deleteLocked(ip string) {
 	if callbackListeners {
 		for _, listener := range ipc.listeners {
 			listener.OnIPIdentityCacheChange(cacheModification, *cidr, oldHostIP, newHostIP,
-				oldIdentity, newIdentity.ID)
+				oldIdentity, newIdentity.ID, newIdentity.EncryptKey)
 		}
 	}
 }
@@ -352,8 +352,9 @@ restart:
 					continue
 				}
 				IPIdentityCache.Upsert(ipIDPair.PrefixString(), ipIDPair.HostIP, Identity{
-					ID:     ipIDPair.ID,
-					Source: FromKVStore,
+					ID:         ipIDPair.ID,
+					Source:     FromKVStore,
+					EncryptKey: ipIDPair.Key,
 				})
 
 			case kvstore.EventTypeDelete:
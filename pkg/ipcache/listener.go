@@ -39,8 +39,10 @@ type IPIdentityMappingListener interface {
 	// oldID is not nil; otherwise it is nil.
 	// hostIP is the IP address of the location of the cidr.
 	// hostIP is optional and may only be non-nil for an Upsert modification.
+	// encryptKey is the index of the key used to encrypt traffic to the
+	// cidr, 0 if the traffic is not encrypted.
 	OnIPIdentityCacheChange(modType CacheModification, cidr net.IPNet, oldHostIP, newHostIP net.IP,
-		oldID *identity.NumericIdentity, newID identity.NumericIdentity)
+		oldID *identity.NumericIdentity, newID identity.NumericIdentity, encryptKey uint8)
 
 	// OnIPIdentityCacheGC will be called to sync other components which are
 	// reliant upon the IPIdentityCache with the IPIdentityCache.
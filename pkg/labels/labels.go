@@ -41,6 +41,14 @@ const (
 	// inside the cluster
 	IDNameCluster = "cluster"
 
+	// IDNameRemoteNode is the label used to identify all nodes of the
+	// cluster other than the local node
+	IDNameRemoteNode = "remote-node"
+
+	// IDNameKubeAPIServer is the label used to identify the kube-apiserver
+	// if it is external to the cluster
+	IDNameKubeAPIServer = "kube-apiserver"
+
 	// IDNameHealth is the label used for the local cilium-health endpoint
 	IDNameHealth = "health"
 
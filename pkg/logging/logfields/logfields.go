@@ -174,6 +174,9 @@ const (
 	// XDPDevice is the device name
 	XDPDevice = "xdpDevice"
 
+	// Entity is a policy entity, e.g. "world" or "host"
+	Entity = "entity"
+
 	// EndpointLabelSelector is a selector for Endpoints by label
 	EndpointLabelSelector = "EndpointLabelSelector"
 
@@ -15,6 +15,7 @@
 package ipcache
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"sync"
@@ -89,6 +90,23 @@ func (k Key) String() string {
 	return fmt.Sprintf("<unknown>")
 }
 
+// IPNet returns the prefix represented by the key.
+func (k Key) IPNet() net.IPNet {
+	prefixLen := int(k.Prefixlen - getStaticPrefixBits())
+	switch k.Family {
+	case bpf.EndpointKeyIPv4:
+		return net.IPNet{
+			IP:   net.IP(append([]byte{}, k.IP[:net.IPv4len]...)),
+			Mask: net.CIDRMask(prefixLen, net.IPv4len*8),
+		}
+	default:
+		return net.IPNet{
+			IP:   net.IP(append([]byte{}, k.IP[:]...)),
+			Mask: net.CIDRMask(prefixLen, net.IPv6len*8),
+		}
+	}
+}
+
 // getPrefixLen determines the length that should be set inside the Key so that
 // the lookup prefix is correct in the BPF map key. The specified 'prefixBits'
 // indicates the number of bits in the IP that must match to match the entry in
@@ -124,9 +142,28 @@ func NewKey(ip net.IP, mask net.IPMask) Key {
 
 // RemoteEndpointInfo implements the bpf.MapValue interface. It contains the
 // security identity of a remote endpoint.
+//
+// Must be in sync with struct remote_endpoint_info in <bpf/lib/common.h>
 type RemoteEndpointInfo struct {
 	SecurityIdentity uint32
 	TunnelEndpoint   [4]byte
+	// Key is the index of the key used to encrypt traffic to the
+	// endpoint, 0 if the traffic is not encrypted
+	Key uint8
+	Pad [3]uint8
+}
+
+// SetTunnelEndpoint sets the tunnel endpoint of the remote endpoint to ip.
+// IPv4-mapped IPv6 addresses are treated as IPv4 addresses. The datapath only
+// supports encapsulation to IPv4 tunnel endpoints, an error is returned for
+// any other address and the tunnel endpoint is left unchanged.
+func (v *RemoteEndpointInfo) SetTunnelEndpoint(ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return fmt.Errorf("tunnel endpoint %s is not an IPv4 address", ip)
+	}
+	copy(v.TunnelEndpoint[:], ip4)
+	return nil
 }
 
 func (v *RemoteEndpointInfo) String() string {
@@ -136,6 +173,39 @@ func (v *RemoteEndpointInfo) String() string {
 // GetValuePtr returns the unsafe pointer to the BPF value.
 func (v *RemoteEndpointInfo) GetValuePtr() unsafe.Pointer { return unsafe.Pointer(v) }
 
+// GetTunnelEndpoint returns the tunnel endpoint of the remote endpoint, or
+// nil if traffic to the remote endpoint is not encapsulated.
+func (v *RemoteEndpointInfo) GetTunnelEndpoint() net.IP {
+	ip := net.IP(append([]byte{}, v.TunnelEndpoint[:]...))
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// Entry is a decoded entry of the ipcache map
+type Entry struct {
+	Key   Key
+	Value RemoteEndpointInfo
+}
+
+// Prefix returns the prefix of the entry
+func (e *Entry) Prefix() net.IPNet {
+	return e.Key.IPNet()
+}
+
+// Less returns true if the entry sorts before 'other', ordering entries by
+// address family, address and prefix length.
+func (e *Entry) Less(other *Entry) bool {
+	if e.Key.Family != other.Key.Family {
+		return e.Key.Family < other.Key.Family
+	}
+	if c := bytes.Compare(e.Key.IP[:], other.Key.IP[:]); c != 0 {
+		return c < 0
+	}
+	return e.Key.Prefixlen < other.Key.Prefixlen
+}
+
 // Map represents an IPCache BPF map.
 type Map struct {
 	bpf.Map
@@ -228,6 +298,12 @@ func (m *Map) supportsDelete() bool {
 	return m.deleteSupport
 }
 
+// SupportsDelete determines whether the kernel supports the delete operation
+// on the map.
+func (m *Map) SupportsDelete() bool {
+	return m.supportsDelete()
+}
+
 // SupportsDelete determines whether the underlying kernel map type supports
 // the delete operation.
 func SupportsDelete() bool {
@@ -17,6 +17,7 @@ package proxymap
 import (
 	"fmt"
 	"math"
+	"syscall"
 
 	"github.com/cilium/cilium/pkg/bpf"
 )
@@ -46,6 +47,20 @@ func Delete(key ProxyMapKey) error {
 	return fmt.Errorf("unknown proxymap key type: %T", key)
 }
 
+// DeleteWithErrno removes a proxymap map entry and returns the errno of the
+// failed deletion along with the error, e.g. ENOENT if the entry does not
+// exist
+func DeleteWithErrno(key ProxyMapKey) (error, syscall.Errno) {
+	switch keyValue := key.(type) {
+	case Proxy4Key:
+		return Proxy4Map.DeleteWithErrno(&keyValue)
+	case Proxy6Key:
+		return Proxy6Map.DeleteWithErrno(&keyValue)
+	}
+
+	return fmt.Errorf("unknown proxymap key type: %T", key), 0
+}
+
 // Lookup looks up an entry in the proxymap
 func Lookup(key ProxyMapKey) (ProxyMapValue, error) {
 	switch keyValue := key.(type) {
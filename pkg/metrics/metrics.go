@@ -51,6 +51,11 @@ const (
 var (
 	registry = prometheus.NewPedanticRegistry()
 
+	// nodeMonitorRegistry holds the node monitor metrics, which are served
+	// by the node monitor process rather than the agent, see
+	// EnableNodeMonitor()
+	nodeMonitorRegistry = prometheus.NewPedanticRegistry()
+
 	// Namespace is used to scope metrics from cilium. It is prepended to metric
 	// names and separated with a '_'
 	Namespace = "cilium"
@@ -59,6 +64,10 @@ var (
 	// the datapath. It is prepended to metric names and separated with a '_'.
 	Datapath = "datapath"
 
+	// NodeMonitor is the subsystem to scope metrics related to the node
+	// monitor. It is prepended to metric names and separated with a '_'.
+	NodeMonitor = "node_monitor"
+
 	// Labels
 
 	// LabelValueOutcomeSuccess is used as a successful outcome of an operation
@@ -107,6 +116,46 @@ var (
 	// LabelBuildQueueName is the name of the build queue
 	LabelBuildQueueName = "name"
 
+	// LabelRedirect is the ID of a proxy redirect
+	LabelRedirect = "redirect"
+
+	// LabelDirection is the direction of traffic, ingress or egress
+	LabelDirection = "direction"
+
+	// LabelValueDirectionIngress marks ingress traffic
+	LabelValueDirectionIngress = "ingress"
+
+	// LabelValueDirectionEgress marks egress traffic
+	LabelValueDirectionEgress = "egress"
+
+	// LabelCompression is the compression algorithm used for a stream
+	LabelCompression = "compression"
+
+	// LabelOperation is the type of an operation
+	LabelOperation = "operation"
+
+	// LabelDropReason is the reason for which a message was dropped
+	LabelDropReason = "reason"
+
+	// LabelListener is the identifier of a node monitor listener
+	LabelListener = "listener"
+
+	// LabelValueDropReasonQueueFull marks messages dropped because the
+	// queue of a listener was full
+	LabelValueDropReasonQueueFull = "queue_full"
+
+	// LabelValueDropReasonPaused marks messages dropped because the queue
+	// of a paused listener was full
+	LabelValueDropReasonPaused = "paused"
+
+	// LabelValueDropReasonRateLimited marks messages dropped because they
+	// exceeded the rate limit of a node monitor listener
+	LabelValueDropReasonRateLimited = "rate_limited"
+
+	// LabelValueDropReasonOversize marks messages dropped because they
+	// exceeded the maximum message size of a node monitor listener
+	LabelValueDropReasonOversize = "oversize"
+
 	// LabelAction is the label used to defined what kind of action was performed in a metric
 	LabelAction = "action"
 
@@ -251,6 +300,30 @@ var (
 		Help:      "Number of redirects installed for endpoints, labeled by protocol",
 	}, []string{LabelProtocolL7})
 
+	// ProxyRedirectRules is the number of L7 rules installed by each
+	// redirect
+	ProxyRedirectRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "proxy_redirect_rules",
+		Help:      "Number of L7 rules installed by a redirect, labeled by redirect and protocol",
+	}, []string{LabelRedirect, LabelProtocolL7})
+
+	// ProxyRedirectUpdateDuration is the time taken to push the rules of a
+	// redirect to its proxy
+	ProxyRedirectUpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "proxy_redirect_update_duration_seconds",
+		Help:      "Duration of rule updates of redirects, labeled by protocol and direction",
+	}, []string{LabelProtocolL7, LabelDirection})
+
+	// ProxyRedirectUpdateFailures is the number of failed rule updates of
+	// redirects
+	ProxyRedirectUpdateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "proxy_redirect_update_failures_total",
+		Help:      "Number of failed rule updates of redirects, labeled by protocol and direction",
+	}, []string{LabelProtocolL7, LabelDirection})
+
 	// ProxyParseErrors is a count of failed parse errors on proxy
 	ProxyParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: Namespace,
@@ -346,6 +419,91 @@ var (
 			"labeled by datapath family and completion status",
 	}, []string{LabelDatapathFamily, LabelProtocol, LabelStatus})
 
+	// IPCacheDeferredUpdates is the number of updates of the BPF ipcache
+	// which were deferred because their identity was not allocated yet.
+	IPCacheDeferredUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Datapath,
+		Name:      "ipcache_deferred_updates_total",
+		Help:      "Number of ipcache updates deferred until their identity was allocated",
+	})
+
+	// IPCacheMapOperations is the number of operations on the BPF ipcache
+	// map, labeled by operation type and outcome
+	IPCacheMapOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Datapath,
+		Name:      "ipcache_map_operations_total",
+		Help:      "Number of operations on the BPF ipcache map, labeled by operation type and outcome",
+	}, []string{LabelOperation, LabelStatus})
+
+	// IPCacheSkippedUpdates is the number of upserts into the BPF ipcache
+	// map which were skipped because the entry already had the same value
+	IPCacheSkippedUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Datapath,
+		Name:      "ipcache_skipped_updates_total",
+		Help:      "Number of ipcache map upserts skipped because the entry was already programmed with the same value",
+	})
+
+	// IPCacheRetryQueueDepth is the number of failed operations on the BPF
+	// ipcache map waiting to be retried
+	IPCacheRetryQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: Datapath,
+		Name:      "ipcache_retry_queue_depth",
+		Help:      "Number of failed ipcache map operations waiting to be retried",
+	})
+
+	// IPCacheIdentityChurnAlerts is the number of times the identity of a
+	// prefix in the ipcache changed more often than the configured
+	// threshold.
+	IPCacheIdentityChurnAlerts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: Datapath,
+		Name:      "ipcache_identity_churn_alerts_total",
+		Help:      "Number of times the identity of an ipcache prefix changed more often than the churn threshold",
+	})
+
+	// Node monitor
+
+	// NodeMonitorListeners is the number of connected node monitor
+	// listeners, labeled by the compression algorithm in use
+	NodeMonitorListeners = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: NodeMonitor,
+		Name:      "listeners",
+		Help:      "Number of connected node monitor listeners, labeled by compression algorithm",
+	}, []string{LabelCompression})
+
+	// NodeMonitorDroppedMessages is the number of messages dropped by node
+	// monitor listeners, labeled by the reason of the drop
+	NodeMonitorDroppedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: NodeMonitor,
+		Name:      "dropped_messages_total",
+		Help:      "Number of messages dropped by node monitor listeners, labeled by reason",
+	}, []string{LabelDropReason})
+
+	// NodeMonitorListenerQueueLength is the number of messages in the
+	// queue of a node monitor listener, labeled by listener
+	NodeMonitorListenerQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Subsystem: NodeMonitor,
+		Name:      "listener_queue_length",
+		Help:      "Number of messages in the queue of a node monitor listener, labeled by listener",
+	}, []string{LabelListener})
+
+	// NodeMonitorListenerDroppedMessages is the number of messages dropped
+	// because the queue of a node monitor listener was full, labeled by
+	// listener
+	NodeMonitorListenerDroppedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Subsystem: NodeMonitor,
+		Name:      "listener_dropped_messages_total",
+		Help:      "Number of messages dropped because the queue of a node monitor listener was full, labeled by listener",
+	}, []string{LabelListener})
+
 	// Services
 
 	// ServicesCount number of services
@@ -411,6 +569,9 @@ func init() {
 	MustRegister(EventTSAPI)
 
 	MustRegister(ProxyRedirects)
+	MustRegister(ProxyRedirectRules)
+	MustRegister(ProxyRedirectUpdateDuration)
+	MustRegister(ProxyRedirectUpdateFailures)
 	MustRegister(ProxyParseErrors)
 	MustRegister(ProxyForwarded)
 	MustRegister(ProxyDenied)
@@ -426,6 +587,16 @@ func init() {
 	MustRegister(ConntrackGCKeyFallbacks)
 	MustRegister(ConntrackGCSize)
 	MustRegister(ConntrackGCDuration)
+	MustRegister(IPCacheDeferredUpdates)
+	MustRegister(IPCacheIdentityChurnAlerts)
+	MustRegister(IPCacheMapOperations)
+	MustRegister(IPCacheRetryQueueDepth)
+	MustRegister(IPCacheSkippedUpdates)
+
+	nodeMonitorRegistry.MustRegister(NodeMonitorListeners)
+	nodeMonitorRegistry.MustRegister(NodeMonitorDroppedMessages)
+	nodeMonitorRegistry.MustRegister(NodeMonitorListenerQueueLength)
+	nodeMonitorRegistry.MustRegister(NodeMonitorListenerDroppedMessages)
 
 	MustRegister(ServicesCount)
 
@@ -457,6 +628,19 @@ func Enable(addr string) error {
 	return nil
 }
 
+// EnableNodeMonitor begins serving the node monitor metrics on the address
+// passed in. It is used by cilium-node-monitor, which runs as a process of its
+// own and therefore cannot expose its metrics through Enable().
+func EnableNodeMonitor(addr string) error {
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(nodeMonitorRegistry, promhttp.HandlerOpts{}))
+		log.WithError(http.ListenAndServe(addr, mux)).Warnf("Cannot start node monitor metrics server on %s", addr)
+	}()
+
+	return nil
+}
+
 // GetCounterValue returns the current value
 // stored for the counter
 func GetCounterValue(m prometheus.Counter) float64 {
@@ -468,6 +652,17 @@ func GetCounterValue(m prometheus.Counter) float64 {
 	return 0
 }
 
+// GetGaugeValue returns the current value
+// stored for the gauge
+func GetGaugeValue(m prometheus.Gauge) float64 {
+	var pm dto.Metric
+	err := m.Write(&pm)
+	if err == nil {
+		return *pm.Gauge.Value
+	}
+	return 0
+}
+
 // DumpMetrics gets the current Cilium metrics and dumps all into a
 // models.Metrics structure.If metrics cannot be retrieved, returns an error
 func DumpMetrics() ([]*models.Metric, error) {
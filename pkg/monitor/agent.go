@@ -17,6 +17,7 @@ package monitor
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/cilium/cilium/pkg/monitor/notifications"
@@ -40,6 +41,7 @@ const (
 	AgentNotifyEndpointRegenerateFail
 	AgentNotifyPolicyUpdated
 	AgentNotifyPolicyDeleted
+	AgentNotifyTunnelEndpointChanged
 )
 
 var notifyTable = map[AgentNotification]string{
@@ -50,6 +52,7 @@ var notifyTable = map[AgentNotification]string{
 	AgentNotifyEndpointRegenerateFail:    "Failed endpoint regeneration",
 	AgentNotifyPolicyUpdated:             "Policy updated",
 	AgentNotifyPolicyDeleted:             "Policy deleted",
+	AgentNotifyTunnelEndpointChanged:     "Tunnel endpoint changed",
 }
 
 func resolveAgentType(t AgentNotification) string {
@@ -147,3 +150,31 @@ func TimeRepr(t time.Time) (string, error) {
 	repr, err := json.Marshal(notification)
 	return string(repr), err
 }
+
+// TunnelEndpointNotification structures tunnel endpoint change notification
+type TunnelEndpointNotification struct {
+	CIDR              string `json:"cidr"`
+	OldIdentity       uint32 `json:"old_identity"`
+	NewIdentity       uint32 `json:"new_identity"`
+	OldTunnelEndpoint string `json:"old_tunnel_endpoint,omitempty"`
+	NewTunnelEndpoint string `json:"new_tunnel_endpoint,omitempty"`
+}
+
+// TunnelEndpointChangeRepr returns string representation of monitor
+// notification. A nil tunnel endpoint means that traffic to the CIDR is not
+// encapsulated.
+func TunnelEndpointChangeRepr(cidr net.IPNet, oldID, newID uint32, oldTunnelEndpoint, newTunnelEndpoint net.IP) (string, error) {
+	notification := TunnelEndpointNotification{
+		CIDR:        cidr.String(),
+		OldIdentity: oldID,
+		NewIdentity: newID,
+	}
+	if oldTunnelEndpoint != nil {
+		notification.OldTunnelEndpoint = oldTunnelEndpoint.String()
+	}
+	if newTunnelEndpoint != nil {
+		notification.NewTunnelEndpoint = newTunnelEndpoint.String()
+	}
+	repr, err := json.Marshal(notification)
+	return string(repr), err
+}
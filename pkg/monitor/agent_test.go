@@ -17,6 +17,7 @@ package monitor
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"sort"
 	"testing"
 	"time"
@@ -160,3 +161,16 @@ func (s *MonitorSuite) TestTimeRepr(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(repr, Equals, fmt.Sprintf(`{"time":"%s"}`, t.String()))
 }
+
+func (s *MonitorSuite) TestTunnelEndpointChangeRepr(c *C) {
+	_, cidr, err := net.ParseCIDR("10.0.0.1/32")
+	c.Assert(err, IsNil)
+
+	repr, err := TunnelEndpointChangeRepr(*cidr, 100, 100, net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2"))
+	c.Assert(err, IsNil)
+	c.Assert(repr, Equals, `{"cidr":"10.0.0.1/32","old_identity":100,"new_identity":100,"old_tunnel_endpoint":"192.168.0.1","new_tunnel_endpoint":"192.168.0.2"}`)
+
+	repr, err = TunnelEndpointChangeRepr(*cidr, 100, 200, net.ParseIP("192.168.0.1"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(repr, Equals, `{"cidr":"10.0.0.1/32","old_identity":100,"new_identity":200,"old_tunnel_endpoint":"192.168.0.1"}`)
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/cilium/cilium/api/v1/models"
 	"github.com/cilium/cilium/common"
@@ -128,6 +129,30 @@ const (
 	// LogSystemLoadConfigName is the name of the option to enable system
 	// load loggging
 	LogSystemLoadConfigName = "log-system-load"
+
+	// IPCacheGCIntervalName is the name of the IPCacheGCInterval option
+	IPCacheGCIntervalName = "ipcache-gc-interval"
+
+	// IPCacheGCDryRunName is the name of the IPCacheGCDryRun option
+	IPCacheGCDryRunName = "ipcache-gc-dry-run"
+
+	// IPCacheGCSourcesName is the name of the IPCacheGCSources option
+	IPCacheGCSourcesName = "ipcache-gc-sources"
+
+	// IPCacheGCDeleteBatchSizeName is the name of the
+	// IPCacheGCDeleteBatchSize option
+	IPCacheGCDeleteBatchSizeName = "ipcache-gc-delete-batch-size"
+
+	// ProxyDrainTimeoutName is the name of the ProxyDrainTimeout option
+	ProxyDrainTimeoutName = "proxy-drain-timeout"
+
+	// EnableKubeAPIServerIdentityName is the name of the
+	// EnableKubeAPIServerIdentity option
+	EnableKubeAPIServerIdentityName = "enable-kube-apiserver-identity"
+
+	// EnableRemoteNodeIdentityName is the name of the
+	// EnableRemoteNodeIdentity option
+	EnableRemoteNodeIdentityName = "enable-remote-node-identity"
 )
 
 // Available option for daemonConfig.Tunnel
@@ -246,6 +271,37 @@ type daemonConfig struct {
 	// CTMapEntriesGlobalAny is the maximum number of conntrack entries
 	// allowed in each non-TCP CT table for IPv4/IPv6.
 	CTMapEntriesGlobalAny int
+
+	// IPCacheGCInterval is the interval in which the BPF ipcache map is
+	// garbage collected
+	IPCacheGCInterval time.Duration
+
+	// IPCacheGCDryRun makes garbage collection of the BPF ipcache map only
+	// log the entries it would remove instead of removing them
+	IPCacheGCDryRun bool
+
+	// IPCacheGCSources are the sources of the ipcache entries which are
+	// removed from the BPF ipcache map by garbage collection
+	IPCacheGCSources []string
+
+	// ProxyDrainTimeout, if not zero, is the time the connections of a
+	// proxy redirect being removed are given to finish before the redirect
+	// is closed
+	ProxyDrainTimeout time.Duration
+
+	// EnableKubeAPIServerIdentity associates the IPs of a kube-apiserver
+	// external to the cluster with the reserved kube-apiserver identity
+	// instead of the world identity
+	EnableKubeAPIServerIdentity bool
+
+	// EnableRemoteNodeIdentity associates the IPs of the other nodes of
+	// the cluster with the reserved remote-node identity instead of the
+	// host identity
+	EnableRemoteNodeIdentity bool
+
+	// IPCacheGCDeleteBatchSize is the maximum number of stale entries
+	// deleted from the BPF ipcache map at once
+	IPCacheGCDeleteBatchSize int
 }
 
 var (
@@ -255,6 +311,7 @@ var (
 		IPv6ClusterAllocCIDR:     defaults.IPv6ClusterAllocCIDR,
 		IPv6ClusterAllocCIDRBase: defaults.IPv6ClusterAllocCIDRBase,
 		EnableHostIPRestore:      defaults.EnableHostIPRestore,
+		IPCacheGCInterval:        defaults.IPCacheGCInterval,
 	}
 )
 
@@ -362,5 +419,24 @@ func (c *daemonConfig) Validate() error {
 			c.CTMapEntriesGlobalTCP, c.CTMapEntriesGlobalAny, ctTableMax)
 	}
 
+	c.IPCacheGCInterval = viper.GetDuration(IPCacheGCIntervalName)
+	if c.IPCacheGCInterval <= 0 {
+		return fmt.Errorf("%s '%s' must be positive", IPCacheGCIntervalName, c.IPCacheGCInterval)
+	}
+	c.IPCacheGCDryRun = viper.GetBool(IPCacheGCDryRunName)
+	c.IPCacheGCSources = viper.GetStringSlice(IPCacheGCSourcesName)
+	c.IPCacheGCDeleteBatchSize = viper.GetInt(IPCacheGCDeleteBatchSizeName)
+	if c.IPCacheGCDeleteBatchSize <= 0 {
+		return fmt.Errorf("%s '%d' must be positive", IPCacheGCDeleteBatchSizeName, c.IPCacheGCDeleteBatchSize)
+	}
+
+	c.ProxyDrainTimeout = viper.GetDuration(ProxyDrainTimeoutName)
+	if c.ProxyDrainTimeout < 0 {
+		return fmt.Errorf("%s '%s' must not be negative", ProxyDrainTimeoutName, c.ProxyDrainTimeout)
+	}
+
+	c.EnableKubeAPIServerIdentity = viper.GetBool(EnableKubeAPIServerIdentityName)
+	c.EnableRemoteNodeIdentity = viper.GetBool(EnableRemoteNodeIdentityName)
+
 	return nil
 }
@@ -137,7 +137,7 @@ type EgressRule struct {
 // GetDestinationEndpointSelectors returns a slice of endpoints selectors
 // covering all L3 destination selectors of the egress rule
 func (e *EgressRule) GetDestinationEndpointSelectors() EndpointSelectorSlice {
-	res := append(e.ToEndpoints, e.ToEntities.GetAsEndpointSelectors()...)
+	res := append(e.ToEndpoints, e.ToEntities.getAsEndpointSelectorsWarn()...)
 	res = append(res, e.ToCIDR.GetAsEndpointSelectors()...)
 	return append(res, e.ToCIDRSet.GetAsEndpointSelectors()...)
 }
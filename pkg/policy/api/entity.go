@@ -15,7 +15,19 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	k8sConst "github.com/cilium/cilium/pkg/k8s/apis/cilium.io"
 	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Entity specifies the class of receiver/sender endpoints that do not have
@@ -32,49 +44,349 @@ const (
 	EntityWorld Entity = "world"
 
 	// EntityCluster is an entity that represents traffic within the
-	// endpoint's cluster, to endpoints not managed by cilium
+	// endpoint's cluster, to endpoints not managed by cilium and to all
+	// nodes of the cluster other than the local node, see EntityRemoteNode
 	EntityCluster Entity = "cluster"
 
-	// EntityHost is an entity that represents traffic within endpoint host
+	// EntityHost is an entity that represents traffic within endpoint host.
+	// It only selects the local node, other nodes of the cluster are
+	// selected by EntityRemoteNode.
 	EntityHost Entity = "host"
 
+	// EntityRemoteNode is an entity that represents traffic to or from any
+	// node of the cluster other than the local node. It is a subset of
+	// EntityCluster.
+	EntityRemoteNode Entity = "remote-node"
+
+	// EntityKubeAPIServer is an entity that represents the kube-apiserver.
+	// If the kube-apiserver is external to the cluster and the agent runs
+	// with --enable-kube-apiserver-identity, the agent associates its IPs
+	// with the reserved kube-apiserver identity. A kube-apiserver running
+	// within the cluster keeps the identity of the node or pod it runs on
+	// and is not selected by this entity.
+	EntityKubeAPIServer Entity = "kube-apiserver"
+
 	// EntityInit is an entity that represents an initializing endpoint
 	EntityInit Entity = "init"
 )
 
+// EntityNamespacePrefix is the prefix of pseudo-entities selecting all
+// endpoints in a namespace, e.g. "namespace:kube-system". Namespace entities
+// are resolved on use, the namespace does not need to exist when the rule is
+// imported. See NewNamespaceEntity().
+const EntityNamespacePrefix = "namespace:"
+
+// NewNamespaceEntity returns the pseudo-entity selecting all endpoints in
+// the namespace
+func NewNamespaceEntity(namespace string) Entity {
+	return Entity(EntityNamespacePrefix + namespace)
+}
+
+// namespace returns the namespace selected by a namespace entity, and whether
+// the entity is a namespace entity. The namespace is not validated.
+func (e Entity) namespace() (string, bool) {
+	if !strings.HasPrefix(string(e), EntityNamespacePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(string(e), EntityNamespacePrefix), true
+}
+
+// validateNamespace returns an error if namespace is not a valid name of a
+// kubernetes namespace
+func validateNamespace(namespace string) error {
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// namespaceMutex protects namespaceSelectors
+var namespaceMutex lock.Mutex
+
+// namespaceSelectorsMaxEntries is the maximum number of namespaces whose
+// selectors are cached. The cache is flushed when it is full, as namespaces
+// come from user input.
+const namespaceSelectorsMaxEntries = 1024
+
+// namespaceSelectors caches the selectors of namespace entities by namespace,
+// so that matching a namespace entity does not build its selector every time
+var namespaceSelectors = map[string]EndpointSelectorSlice{}
+
+// lookupNamespaceEntity returns the selectors of the namespace entity for
+// namespace, selecting the endpoints carrying the namespace label of the
+// pod. Returns false if the namespace is invalid.
+func lookupNamespaceEntity(namespace string) (EndpointSelectorSlice, bool) {
+	namespaceMutex.Lock()
+	defer namespaceMutex.Unlock()
+
+	if selectors, ok := namespaceSelectors[namespace]; ok {
+		return selectors, true
+	}
+	if validateNamespace(namespace) != nil {
+		return nil, false
+	}
+
+	selectors := EndpointSelectorSlice{NewESFromLabels(&labels.Label{
+		Key:    k8sConst.PodNamespaceLabel,
+		Value:  namespace,
+		Source: labels.LabelSourceK8s,
+	})}
+	if len(namespaceSelectors) >= namespaceSelectorsMaxEntries {
+		namespaceSelectors = map[string]EndpointSelectorSlice{}
+	}
+	namespaceSelectors[namespace] = selectors
+	return selectors, true
+}
+
+// endpointSelectorCluster selects endpoints within the cluster not managed
+// by cilium
+var endpointSelectorCluster = NewESFromLabels(&labels.Label{
+	Key:    labels.IDNameCluster,
+	Value:  "",
+	Source: labels.LabelSourceReserved,
+})
+
+// endpointSelectorRemoteNode selects all nodes of the cluster other than the
+// local node
+var endpointSelectorRemoteNode = NewESFromLabels(&labels.Label{
+	Key:    labels.IDNameRemoteNode,
+	Value:  "",
+	Source: labels.LabelSourceReserved,
+})
+
+// entityMutex protects EntitySelectorMapping
+var entityMutex lock.RWMutex
+
 // EntitySelectorMapping maps special entity names that come in policies to
-// selectors
-var EntitySelectorMapping = map[Entity]EndpointSelector{
-	EntityAll: WildcardEndpointSelector,
-	EntityWorld: NewESFromLabels(&labels.Label{
+// selectors. An entity selects an endpoint if any of its selectors does. It
+// must only be accessed with entityMutex held, entities are added with
+// RegisterEntity().
+var EntitySelectorMapping = map[Entity]EndpointSelectorSlice{
+	EntityAll: {WildcardEndpointSelector},
+	EntityWorld: {NewESFromLabels(&labels.Label{
 		Key:    labels.IDNameWorld,
 		Value:  "",
 		Source: labels.LabelSourceReserved,
-	}),
-	EntityCluster: NewESFromLabels(&labels.Label{
-		Key:    labels.IDNameCluster,
-		Value:  "",
-		Source: labels.LabelSourceReserved,
-	}),
-	EntityHost: NewESFromLabels(&labels.Label{
+	})},
+	EntityCluster: {endpointSelectorCluster, endpointSelectorRemoteNode},
+	EntityHost: {NewESFromLabels(&labels.Label{
 		Key:    labels.IDNameHost,
 		Value:  "",
 		Source: labels.LabelSourceReserved,
-	}),
-	EntityInit: NewESFromLabels(&labels.Label{
+	})},
+	EntityRemoteNode: {endpointSelectorRemoteNode},
+	EntityInit: {NewESFromLabels(&labels.Label{
 		Key:    labels.IDNameInit,
 		Value:  "",
 		Source: labels.LabelSourceReserved,
-	}),
+	})},
+	EntityKubeAPIServer: {NewESFromLabels(&labels.Label{
+		Key:    labels.IDNameKubeAPIServer,
+		Value:  "",
+		Source: labels.LabelSourceReserved,
+	})},
+}
+
+// builtinEntities are the entities defined by this package, which cannot be
+// registered by RegisterEntity()
+var builtinEntities = func() map[Entity]struct{} {
+	builtin := make(map[Entity]struct{}, len(EntitySelectorMapping))
+	for e := range EntitySelectorMapping {
+		builtin[e] = struct{}{}
+	}
+	return builtin
+}()
+
+// lookupEntity returns the selectors of the entity, and whether the entity
+// is known. Namespace entities with a valid namespace are always known.
+func lookupEntity(e Entity) (EndpointSelectorSlice, bool) {
+	entityMutex.RLock()
+	defer entityMutex.RUnlock()
+	return lookupEntityLocked(e)
+}
+
+// lookupEntityLocked is lookupEntity for callers holding entityMutex for
+// reading
+func lookupEntityLocked(e Entity) (EndpointSelectorSlice, bool) {
+	if namespace, ok := e.namespace(); ok {
+		return lookupNamespaceEntity(namespace)
+	}
+
+	selectors, ok := EntitySelectorMapping[e]
+	return selectors, ok
+}
+
+// RegisterEntity makes the custom entity 'name' available in policies,
+// selecting all endpoints selected by any of 'selectors'. It allows programs
+// embedding cilium to define their own entities. An error is returned if the
+// name is empty, collides with an entity defined by this package or has
+// already been registered, or if no selector is given. Names starting with
+// EntityNamespacePrefix are reserved for namespace entities.
+func RegisterEntity(name Entity, selectors EndpointSelectorSlice) error {
+	if name == "" {
+		return fmt.Errorf("entity name must not be empty")
+	}
+	if _, ok := name.namespace(); ok {
+		return fmt.Errorf("entity %q uses the reserved prefix %q", name, EntityNamespacePrefix)
+	}
+	if len(selectors) == 0 {
+		return fmt.Errorf("entity %q must have at least one selector", name)
+	}
+	if _, ok := builtinEntities[name]; ok {
+		return fmt.Errorf("entity %q is a built-in entity", name)
+	}
+
+	entityMutex.Lock()
+	if _, ok := EntitySelectorMapping[name]; ok {
+		entityMutex.Unlock()
+		return fmt.Errorf("entity %q is already registered", name)
+	}
+	EntitySelectorMapping[name] = append(EndpointSelectorSlice{}, selectors...)
+	entityMutex.Unlock()
+
+	InvalidateEntityCache()
+	return nil
+}
+
+// entityCIDRs are the CIDRs used to classify IPs into entities, see
+// Entity.MatchesIP(). They must only be accessed with entityMutex held.
+var entityCIDRs struct {
+	// cluster are the CIDRs of the cluster, e.g. the pod and node CIDRs
+	cluster []*net.IPNet
+
+	// host are the CIDRs of the addresses of the local node
+	host []*net.IPNet
+}
+
+// SetClusterCIDRs sets the CIDRs of the local cluster, e.g. the pod and node
+// CIDRs, which Entity.MatchesIP() uses to tell EntityCluster from
+// EntityWorld. It must be called whenever the CIDRs of the cluster change.
+func SetClusterCIDRs(cidrs []*net.IPNet) {
+	entityMutex.Lock()
+	entityCIDRs.cluster = append([]*net.IPNet{}, cidrs...)
+	entityMutex.Unlock()
+}
+
+// SetHostCIDRs sets the CIDRs of the addresses of the local node, which
+// Entity.MatchesIP() uses to classify IPs into EntityHost. It must be called
+// whenever the addresses of the local node change.
+func SetHostCIDRs(cidrs []*net.IPNet) {
+	entityMutex.Lock()
+	entityCIDRs.host = append([]*net.IPNet{}, cidrs...)
+	entityMutex.Unlock()
+}
+
+// containsIP returns true if any of the CIDRs contains the IP
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesIP returns true if the IP belongs to the entity according to the
+// CIDRs set by SetClusterCIDRs() and SetHostCIDRs(), e.g. to classify a bare
+// IP without an identity in the datapath or the policy tracer. Addresses of
+// the local node belong to EntityHost. Other addresses within the cluster CIDRs
+// belong to EntityCluster, all remaining addresses to EntityWorld. Every IP
+// belongs to EntityAll, other entities never match a nil IP. Entities which
+// cannot be derived from an IP, e.g. EntityRemoteNode or namespace entities,
+// and unknown entities never match.
+func (e Entity) MatchesIP(ip net.IP) bool {
+	if e == EntityAll {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+
+	entityMutex.RLock()
+	defer entityMutex.RUnlock()
+
+	isHost := containsIP(entityCIDRs.host, ip)
+	switch e {
+	case EntityHost:
+		return isHost
+	case EntityCluster:
+		return !isHost && containsIP(entityCIDRs.cluster, ip)
+	case EntityWorld:
+		return !isHost && !containsIP(entityCIDRs.cluster, ip)
+	default:
+		return false
+	}
 }
 
 // EntitySlice is a slice of entities
 type EntitySlice []Entity
 
+// sorted returns a copy of the slice sorted by name
+func (s EntitySlice) sorted() EntitySlice {
+	result := append(EntitySlice{}, s...)
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// MarshalJSON returns the JSON representation of the slice with the entities
+// in canonical, sorted order, so that the representation does not depend on
+// the order in which the entities were specified.
+func (s EntitySlice) MarshalJSON() ([]byte, error) {
+	if s == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal([]Entity(s.sorted()))
+}
+
+// String returns the entities of the slice in sorted order, separated by
+// commas, for use in log messages.
+func (s EntitySlice) String() string {
+	entities := make([]string, 0, len(s))
+	for _, e := range s.sorted() {
+		entities = append(entities, string(e))
+	}
+	return strings.Join(entities, ",")
+}
+
+// IsValid returns true if the entity is known to EntitySelectorMapping, or is
+// a namespace entity with a valid namespace.
+func (e Entity) IsValid() bool {
+	_, ok := lookupEntity(e)
+	return ok
+}
+
+// validate returns an error describing why the entity is not valid, see
+// IsValid()
+func (e Entity) validate() error {
+	if namespace, ok := e.namespace(); ok {
+		if err := validateNamespace(namespace); err != nil {
+			return fmt.Errorf("invalid entity %s: %s", e, err)
+		}
+		return nil
+	}
+	if !e.IsValid() {
+		return fmt.Errorf("unsupported entity: %s, valid entities are %v", e, EntityValues())
+	}
+	return nil
+}
+
+// EntityValues returns all valid entities, sorted by name. The entities are
+// derived from EntitySelectorMapping, see Entity.IsValid().
+func EntityValues() []Entity {
+	entityMutex.RLock()
+	values := make([]Entity, 0, len(EntitySelectorMapping))
+	for e := range EntitySelectorMapping {
+		values = append(values, e)
+	}
+	entityMutex.RUnlock()
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
 // Matches returns true if the entity matches the labels
 func (e Entity) Matches(ctx labels.LabelArray) bool {
-	if selector, ok := EntitySelectorMapping[e]; ok {
-		return selector.Matches(ctx)
+	if selectors, ok := lookupEntity(e); ok {
+		return selectors.Matches(ctx)
 	}
 
 	return false
@@ -91,15 +403,361 @@ func (s EntitySlice) Matches(ctx labels.LabelArray) bool {
 	return false
 }
 
+// entityPriorities orders the built-in entities from the most to the least
+// specific, a subset preceding the entities including it, e.g. EntityHost
+// preceding EntityAll. Entities missing from the list, i.e. namespace
+// entities and entities added with RegisterEntity(), rank after the entities
+// selecting reserved identities of the cluster and before the entities
+// selecting the whole cluster or beyond.
+var entityPriorities = map[Entity]int{
+	EntityHost:          0,
+	EntityKubeAPIServer: 1,
+	EntityInit:          1,
+	EntityRemoteNode:    1,
+	EntityCluster:       3,
+	EntityWorld:         4,
+	EntityAll:           5,
+}
+
+// customEntityPriority is the priority of entities missing from
+// entityPriorities
+const customEntityPriority = 2
+
+// priority returns the priority of the entity, lower values taking
+// precedence
+func (e Entity) priority() int {
+	if priority, ok := entityPriorities[e]; ok {
+		return priority
+	}
+	return customEntityPriority
+}
+
+// precedes returns true if the entity takes precedence over 'other'.
+// Entities of the same priority are ordered by name so that the result does
+// not depend on the order of the entities in a slice.
+func (e Entity) precedes(other Entity) bool {
+	if p, o := e.priority(), other.priority(); p != o {
+		return p < o
+	}
+	return e < other
+}
+
+// MatchWithPriority returns the entity of the slice matching the labels
+// which takes precedence over all other matching entities, and whether any
+// entity matches. More specific entities take precedence over the entities
+// including them, e.g. EntityHost over EntityAll, so that overlapping
+// entities resolve deterministically in policy resolution.
+func (s EntitySlice) MatchWithPriority(ctx labels.LabelArray) (Entity, bool) {
+	var match Entity
+	found := false
+	for _, entity := range s {
+		if (!found || entity.precedes(match)) && entity.Matches(ctx) {
+			match, found = entity, true
+		}
+	}
+
+	return match, found
+}
+
+// EntitiesForLabels returns all entities selecting the labels, sorted by
+// name, e.g. to present the entities an identity belongs to in policy
+// traces. Entities selecting all endpoints, such as EntityAll, match any
+// labels and are omitted. An empty slice is returned if no entity selects
+// the labels. The result is consistent with Entity.Matches(), so the labels
+// of the local host are only reported as EntityHost, as EntityCluster only
+// selects the other nodes of the cluster.
+func EntitiesForLabels(ctx labels.LabelArray) EntitySlice {
+	entityMutex.RLock()
+	result := EntitySlice{}
+	for e, selectors := range EntitySelectorMapping {
+		if !selectors.SelectsAllEndpoints() && selectors.Matches(ctx) {
+			result = append(result, e)
+		}
+	}
+	entityMutex.RUnlock()
+
+	return result.sorted()
+}
+
 // GetAsEndpointSelectors returns the provided entity slice as a slice of
-// endpoint selectors
-func (s EntitySlice) GetAsEndpointSelectors() EndpointSelectorSlice {
+// endpoint selectors, along with the entities of the slice which are not
+// known to EntitySelectorMapping. Unknown entities do not resolve to any
+// selector, callers must decide whether to reject the rule or warn about
+// them, e.g. when a rule referencing an entity introduced by a newer version
+// is loaded. Selectors shared by several entities of the slice, e.g. the
+// remote-node selector of EntityCluster and EntityRemoteNode, are only
+// returned once.
+func (s EntitySlice) GetAsEndpointSelectors() (EndpointSelectorSlice, EntitySlice) {
 	slice := EndpointSelectorSlice{}
+	var unknown EntitySlice
 	for _, e := range s {
-		if selector, ok := EntitySelectorMapping[e]; ok {
-			slice = append(slice, selector)
+		if selectors, ok := lookupEntity(e); ok {
+			slice = append(slice, selectors...)
+		} else {
+			unknown = append(unknown, e)
+		}
+	}
+	slice = dedupSelectors(slice)
+
+	return slice, unknown
+}
+
+// dedupSelectors returns the selectors without duplicates, keeping the first
+// occurrence of each selector. Selectors are considered duplicates if they
+// select the same set of labels.
+func dedupSelectors(selectors EndpointSelectorSlice) EndpointSelectorSlice {
+	if len(selectors) < 2 {
+		return selectors
+	}
+
+	result := make(EndpointSelectorSlice, 0, len(selectors))
+	seen := make(map[string]struct{}, len(selectors))
+	for _, selector := range selectors {
+		key := selector.LabelSelectorString()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, selector)
+	}
+	return result
+}
+
+// exclusionRequirement returns the requirement that an endpoint does not carry
+// the label 'key' with 'value'
+func exclusionRequirement(key, value string) metav1.LabelSelectorRequirement {
+	if value == "" {
+		return metav1.LabelSelectorRequirement{
+			Key:      key,
+			Operator: metav1.LabelSelectorOpDoesNotExist,
+		}
+	}
+	return metav1.LabelSelectorRequirement{
+		Key:      key,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   []string{value},
+	}
+}
+
+// withRequirements returns a copy of the selector which additionally requires
+// 'reqs'
+func withRequirements(selector EndpointSelector, reqs []metav1.LabelSelectorRequirement) EndpointSelector {
+	matchLabels := make(map[string]string, len(selector.MatchLabels))
+	for k, v := range selector.MatchLabels {
+		matchLabels[k] = v
+	}
+	matchExpressions := make([]metav1.LabelSelectorRequirement, 0, len(selector.MatchExpressions)+len(reqs))
+	matchExpressions = append(matchExpressions, selector.MatchExpressions...)
+	matchExpressions = append(matchExpressions, reqs...)
+
+	return NewESFromMatchRequirements(matchLabels, matchExpressions)
+}
+
+// GetAsEndpointSelectorsExcept returns the endpoint selectors of the entities
+// in the slice, restricted to endpoints not selected by any entity in
+// 'exclude', e.g. to allow "all" except "world". Excluded entities resolving
+// to a single label are subtracted from every selector of the slice, other
+// excluded selectors are only removed where they are selected literally by
+// the slice. Unknown entities are skipped and duplicate selectors are
+// removed, as by GetAsEndpointSelectors.
+func (s EntitySlice) GetAsEndpointSelectorsExcept(exclude EntitySlice) EndpointSelectorSlice {
+	selectors := s.getAsEndpointSelectorsWarn()
+
+	var reqs []metav1.LabelSelectorRequirement
+	excluded := map[string]struct{}{}
+	for _, selector := range exclude.getAsEndpointSelectorsWarn() {
+		if selector.IsWildcard() {
+			return EndpointSelectorSlice{}
+		}
+		excluded[selector.LabelSelectorString()] = struct{}{}
+		if len(selector.MatchLabels) == 1 && len(selector.MatchExpressions) == 0 {
+			for key, value := range selector.MatchLabels {
+				reqs = append(reqs, exclusionRequirement(key, value))
+			}
+		}
+	}
+
+	result := make(EndpointSelectorSlice, 0, len(selectors))
+	for _, selector := range selectors {
+		if _, ok := excluded[selector.LabelSelectorString()]; ok {
+			continue
+		}
+		if len(reqs) > 0 {
+			selector = withRequirements(selector, reqs)
+		}
+		result = append(result, selector)
+	}
+
+	return result
+}
+
+// ResolveEntities resolves a batch of entity slices into endpoint selectors,
+// e.g. for all rules of a policy import. Each distinct entity slice in the
+// batch is resolved only once and the entities are locked only once for the
+// whole batch, identical entity slices share the resulting selectors. Unknown
+// entities are skipped and duplicate selectors are removed, as by
+// GetAsEndpointSelectors. The returned slices have no spare capacity so that
+// appending to one does not modify another, but their elements must not be
+// modified in place.
+func ResolveEntities(slices []EntitySlice) []EndpointSelectorSlice {
+	result := make([]EndpointSelectorSlice, len(slices))
+	resolved := map[string]EndpointSelectorSlice{}
+
+	entityMutex.RLock()
+	defer entityMutex.RUnlock()
+
+	for i, s := range slices {
+		// The quoted entities cannot collide with another slice, even if
+		// entities contain the separator
+		key := fmt.Sprintf("%q", []Entity(s))
+		if selectors, ok := resolved[key]; ok {
+			result[i] = selectors
+			continue
 		}
+
+		selectors := make(EndpointSelectorSlice, 0, len(s))
+		for _, e := range s {
+			if entitySelectors, ok := lookupEntityLocked(e); ok {
+				selectors = append(selectors, entitySelectors...)
+			}
+		}
+		selectors = dedupSelectors(selectors)
+		selectors = selectors[:len(selectors):len(selectors)]
+
+		resolved[key] = selectors
+		result[i] = selectors
 	}
 
+	return result
+}
+
+// getAsEndpointSelectorsWarn is GetAsEndpointSelectors but logs a warning
+// for every unknown entity instead of returning them
+func (s EntitySlice) getAsEndpointSelectorsWarn() EndpointSelectorSlice {
+	slice, unknown := s.GetAsEndpointSelectors()
+	for _, e := range unknown {
+		log.WithField(logfields.Entity, e).Warning("Ignoring unknown entity in policy rule")
+	}
 	return slice
 }
+
+// covers returns true if every endpoint selected by entity 'other' is also
+// selected by entity 'e'. This is the case if 'e' selects all endpoints, or if
+// every selector of 'other' is also a selector of 'e', e.g. EntityCluster
+// covers EntityRemoteNode.
+func (e Entity) covers(other Entity) bool {
+	if e == other {
+		return true
+	}
+
+	selectors, ok := lookupEntity(e)
+	if !ok {
+		return false
+	}
+	if selectors.SelectsAllEndpoints() {
+		return true
+	}
+
+	otherSelectors, ok := lookupEntity(other)
+	if !ok || len(otherSelectors) == 0 {
+		return false
+	}
+
+	covered := make(map[string]struct{}, len(selectors))
+	for _, sel := range selectors {
+		covered[sel.String()] = struct{}{}
+	}
+	for _, sel := range otherSelectors {
+		if _, ok := covered[sel.String()]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Conflicts returns true if any entity in the slice overlaps with any entity
+// in 'other', for example when one rule allows "world" while another denies
+// "all". The returned string explains the first overlap found and is
+// intended to be presented to users by policy linters.
+func (s EntitySlice) Conflicts(other EntitySlice) (bool, string) {
+	for _, a := range s {
+		for _, b := range other {
+			switch {
+			case a == b:
+				return true, fmt.Sprintf("entity %q is selected by both rules", a)
+			case a.covers(b):
+				return true, fmt.Sprintf("entity %q includes entity %q", a, b)
+			case b.covers(a):
+				return true, fmt.Sprintf("entity %q includes entity %q", b, a)
+			}
+		}
+	}
+
+	return false, ""
+}
+
+// EntityExplanation describes what an entity resolves to, for audits of
+// entity based rules
+type EntityExplanation struct {
+	// Entity is the explained entity
+	Entity Entity `json:"entity"`
+
+	// Known is false if the entity is not known to EntitySelectorMapping,
+	// in which case it does not select anything
+	Known bool `json:"known"`
+
+	// Wildcard is true if the entity selects all endpoints
+	Wildcard bool `json:"wildcard,omitempty"`
+
+	// ReservedLabels are the reserved labels required by any of the
+	// selectors of the entity. An endpoint is selected if it carries the
+	// reserved labels of at least one of the selectors.
+	ReservedLabels labels.LabelArray `json:"reserved-labels,omitempty"`
+
+	// Selectors are the label selectors the entity resolves to, including
+	// any requirement which is not expressed in ReservedLabels
+	Selectors []string `json:"selectors,omitempty"`
+}
+
+// reservedLabels returns the reserved labels required by any of the
+// selectors, sorted by key
+func reservedLabels(selectors EndpointSelectorSlice) labels.LabelArray {
+	var lbls labels.LabelArray
+	seen := map[string]struct{}{}
+	for _, selector := range selectors {
+		for key, value := range selector.MatchLabels {
+			if _, ok := seen[key]; ok || !strings.HasPrefix(key, labels.LabelSourceReservedKeyPrefix) {
+				continue
+			}
+			seen[key] = struct{}{}
+			lbls = append(lbls, &labels.Label{
+				Source: labels.LabelSourceReserved,
+				Key:    strings.TrimPrefix(key, labels.LabelSourceReservedKeyPrefix),
+				Value:  value,
+			})
+		}
+	}
+	sort.Slice(lbls, func(i, j int) bool { return lbls[i].Key < lbls[j].Key })
+	return lbls
+}
+
+// Explain returns a description of each entity in the slice, in order,
+// derived from EntitySelectorMapping. It is intended to present users with a
+// flattened view of the selectors an entity based rule resolves to.
+func (s EntitySlice) Explain() []EntityExplanation {
+	result := make([]EntityExplanation, 0, len(s))
+	for _, e := range s {
+		explanation := EntityExplanation{Entity: e}
+		if selectors, ok := lookupEntity(e); ok {
+			explanation.Known = true
+			explanation.Wildcard = selectors.SelectsAllEndpoints()
+			explanation.ReservedLabels = reservedLabels(selectors)
+			for _, selector := range selectors {
+				explanation.Selectors = append(explanation.Selectors, selector.LabelSelectorString())
+			}
+		}
+		result = append(result, explanation)
+	}
+
+	return result
+}
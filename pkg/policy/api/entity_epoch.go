@@ -0,0 +1,39 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"sync/atomic"
+)
+
+// entityEpoch is incremented whenever the selectors that entities resolve to
+// change. It must be accessed atomically.
+var entityEpoch uint64
+
+// EntityEpoch returns the current epoch of the entity to selector mapping.
+// The epoch changes whenever the selectors which any entity resolves to may
+// have changed. Caches of policy results derived from entities must include
+// the epoch in their key so that stale results are not used.
+func EntityEpoch() uint64 {
+	return atomic.LoadUint64(&entityEpoch)
+}
+
+// InvalidateEntityCache must be called after EntitySelectorMapping, or any
+// configuration that the selectors of entities depend on, has been modified.
+// It bumps the entity epoch so that all matchers compiled before become
+// stale, see EntityMatcher.IsStale().
+func InvalidateEntityCache() {
+	atomic.AddUint64(&entityEpoch, 1)
+}
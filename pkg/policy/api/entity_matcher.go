@@ -0,0 +1,205 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"strings"
+
+	"github.com/cilium/cilium/pkg/labels"
+
+	k8sLbls "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// labelRequirement is a k8s label requirement flattened for matching against
+// a LabelArray without parsing the key of the requirement, or building the
+// extended key of each label, on every match.
+type labelRequirement struct {
+	// key is the extended key of the requirement, e.g. "reserved.host"
+	key string
+
+	// anySource is true if the requirement matches labels of any source
+	// with key anyKey
+	anySource bool
+	anyKey    string
+
+	operator selection.Operator
+	values   []string
+
+	// req is the original requirement, used for operators which are not
+	// flattened
+	req k8sLbls.Requirement
+}
+
+func newLabelRequirement(req k8sLbls.Requirement) labelRequirement {
+	r := labelRequirement{
+		key:      req.Key(),
+		operator: req.Operator(),
+		values:   req.Values().List(),
+		req:      req,
+	}
+	keyLabel := labels.ParseLabel(labels.GetCiliumKeyFrom(r.key))
+	if keyLabel.IsAnySource() {
+		r.anySource = true
+		r.anyKey = keyLabel.Key
+	}
+	return r
+}
+
+// hasExtendedKey returns true if the extended key of l, source and key
+// separated by a dot, equals key. It is equivalent to comparing against
+// l.GetExtendedKey() without building the extended key.
+func hasExtendedKey(l *labels.Label, key string) bool {
+	return len(l.Source)+1+len(l.Key) == len(key) &&
+		strings.HasPrefix(key, l.Source) &&
+		key[len(l.Source):len(l.Source)+1] == labels.PathDelimiter &&
+		strings.HasSuffix(key, l.Key)
+}
+
+// lookup returns the value of the label in ctx matching the key of the
+// requirement, following the semantics of LabelArray.Has() and Get()
+func (r *labelRequirement) lookup(ctx labels.LabelArray) (string, bool) {
+	for _, l := range ctx {
+		if r.anySource {
+			if l.Key == r.anyKey {
+				return l.Value, true
+			}
+		} else if hasExtendedKey(l, r.key) {
+			return l.Value, true
+		}
+	}
+	return "", false
+}
+
+func (r *labelRequirement) hasValue(value string) bool {
+	for _, v := range r.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if ctx fulfills the requirement, with the same result
+// as k8sLbls.Requirement.Matches()
+func (r *labelRequirement) matches(ctx labels.LabelArray) bool {
+	switch r.operator {
+	case selection.In, selection.Equals, selection.DoubleEquals:
+		value, ok := r.lookup(ctx)
+		return ok && r.hasValue(value)
+	case selection.NotIn, selection.NotEquals:
+		value, ok := r.lookup(ctx)
+		return !ok || !r.hasValue(value)
+	case selection.Exists:
+		_, ok := r.lookup(ctx)
+		return ok
+	case selection.DoesNotExist:
+		_, ok := r.lookup(ctx)
+		return !ok
+	default:
+		return r.req.Matches(ctx)
+	}
+}
+
+// EntityMatcher matches labels against a set of entities which has been
+// compiled once, see EntitySlice.Compile(). It avoids resolving the entities
+// and converting their selectors on every match, for use in hot paths such
+// as policy recomputation.
+type EntityMatcher struct {
+	// matchAll is true if any of the entities selects all endpoints
+	matchAll bool
+
+	// requirements are the requirements of each selector of the entities,
+	// the labels match if they fulfill all requirements of any selector
+	requirements [][]labelRequirement
+
+	// epoch is the entity epoch the matcher was compiled in
+	epoch uint64
+}
+
+// Compile resolves the entities of the slice into an EntityMatcher. Unknown
+// entities are skipped, as by GetAsEndpointSelectors. The matcher reflects
+// the selectors of the entities at the time of compilation, it must be
+// compiled again once it is stale, see EntityMatcher.IsStale().
+func (s EntitySlice) Compile() *EntityMatcher {
+	epoch := EntityEpoch()
+	selectors, _ := s.GetAsEndpointSelectors()
+
+	m := &EntityMatcher{
+		requirements: make([][]labelRequirement, 0, len(selectors)),
+		epoch:        epoch,
+	}
+	for _, selector := range selectors {
+		_, selectsAll := selector.MatchLabels[labels.LabelSourceReservedKeyPrefix+labels.IDNameAll]
+		if selector.IsWildcard() || selectsAll {
+			m.matchAll = true
+			m.requirements = nil
+			break
+		}
+
+		requirements := selector.requirements
+		if requirements == nil {
+			requirements = labelSelectorToRequirements(selector.LabelSelector)
+		}
+		// Selectors which fail validation never match
+		if requirements != nil {
+			flattened := make([]labelRequirement, 0, len(*requirements))
+			for _, req := range *requirements {
+				flattened = append(flattened, newLabelRequirement(req))
+			}
+			m.requirements = append(m.requirements, flattened)
+		}
+	}
+
+	return m
+}
+
+// Compile resolves the entity into an EntityMatcher, see
+// EntitySlice.Compile().
+func (e Entity) Compile() *EntityMatcher {
+	return EntitySlice{e}.Compile()
+}
+
+// Matches returns true if the labels are selected by any of the compiled
+// entities. The result is identical to EntitySlice.Matches() as long as the
+// matcher is not stale.
+func (m *EntityMatcher) Matches(ctx labels.LabelArray) bool {
+	if m.matchAll {
+		return true
+	}
+
+	for _, requirements := range m.requirements {
+		if matchesRequirements(requirements, ctx) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesRequirements(requirements []labelRequirement, ctx labels.LabelArray) bool {
+	for i := range requirements {
+		if !requirements[i].matches(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsStale returns true if the selectors of any entity may have changed since
+// the matcher was compiled
+func (m *EntityMatcher) IsStale() bool {
+	return m.epoch != EntityEpoch()
+}
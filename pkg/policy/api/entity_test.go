@@ -15,6 +15,12 @@
 package api
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
 	"github.com/cilium/cilium/pkg/labels"
 
 	. "gopkg.in/check.v1"
@@ -32,13 +38,24 @@ func (s *PolicyAPITestSuite) TestEntityMatches(c *C) {
 	c.Assert(EntityAll.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
 	c.Assert(EntityAll.Matches(labels.ParseLabelArray("id=foo")), Equals, true)
 
-	// EntityCluster doesn't select host, as EndpointSelector can't express OR relationships.
+	// EntityCluster doesn't select the local host, but all other nodes.
 	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
 	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("reserved:cluster")), Equals, true)
+	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("reserved:remote-node")), Equals, true)
 	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("reserved:world")), Equals, false)
 	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("id=foo")), Equals, false)
 	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("id=foo", "id=bar")), Equals, false)
 
+	c.Assert(EntityRemoteNode.Matches(labels.ParseLabelArray("reserved:remote-node")), Equals, true)
+	c.Assert(EntityRemoteNode.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+	c.Assert(EntityRemoteNode.Matches(labels.ParseLabelArray("reserved:cluster")), Equals, false)
+	c.Assert(EntityHost.Matches(labels.ParseLabelArray("reserved:remote-node")), Equals, false)
+
+	c.Assert(EntityKubeAPIServer.Matches(labels.ParseLabelArray("reserved:kube-apiserver")), Equals, true)
+	c.Assert(EntityKubeAPIServer.Matches(labels.ParseLabelArray("reserved:world")), Equals, false)
+	c.Assert(EntityKubeAPIServer.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+	c.Assert(EntityWorld.Matches(labels.ParseLabelArray("reserved:kube-apiserver")), Equals, false)
+
 	c.Assert(EntityWorld.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
 	c.Assert(EntityWorld.Matches(labels.ParseLabelArray("reserved:cluster")), Equals, false)
 	c.Assert(EntityWorld.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
@@ -46,6 +63,23 @@ func (s *PolicyAPITestSuite) TestEntityMatches(c *C) {
 	c.Assert(EntityWorld.Matches(labels.ParseLabelArray("id=foo", "id=bar")), Equals, false)
 }
 
+func (s *PolicyAPITestSuite) TestEntitySliceUnknown(c *C) {
+	const entityUnknown Entity = "unknown-entity"
+
+	slice := EntitySlice{EntityHost, entityUnknown, EntityWorld}
+	selectors, unknown := slice.GetAsEndpointSelectors()
+	c.Assert(selectors, HasLen, 2)
+	c.Assert(unknown, DeepEquals, EntitySlice{entityUnknown})
+
+	selectors, unknown = EntitySlice{EntityHost}.GetAsEndpointSelectors()
+	c.Assert(selectors, HasLen, 1)
+	c.Assert(unknown, HasLen, 0)
+
+	// Rules skip unknown entities
+	rule := IngressRule{FromEntities: slice}
+	c.Assert(rule.GetSourceEndpointSelectors(), HasLen, 2)
+}
+
 func (s *PolicyAPITestSuite) TestEntitySliceMatches(c *C) {
 	slice := EntitySlice{EntityHost, EntityWorld}
 	c.Assert(slice.Matches(labels.ParseLabelArray("reserved:host")), Equals, true)
@@ -53,8 +87,480 @@ func (s *PolicyAPITestSuite) TestEntitySliceMatches(c *C) {
 	c.Assert(slice.Matches(labels.ParseLabelArray("id=foo")), Equals, false)
 
 	// result must be identical if matched via endpoint selector
-	selector := slice.GetAsEndpointSelectors()
+	selector, _ := slice.GetAsEndpointSelectors()
 	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:host")), Equals, true)
 	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
 	c.Assert(selector.Matches(labels.ParseLabelArray("id=foo")), Equals, false)
 }
+
+func (s *PolicyAPITestSuite) TestEntitySliceConflicts(c *C) {
+	conflict, reason := EntitySlice{EntityWorld}.Conflicts(EntitySlice{EntityAll})
+	c.Assert(conflict, Equals, true)
+	c.Assert(reason, Equals, `entity "all" includes entity "world"`)
+
+	conflict, reason = EntitySlice{EntityAll}.Conflicts(EntitySlice{EntityHost})
+	c.Assert(conflict, Equals, true)
+	c.Assert(reason, Equals, `entity "all" includes entity "host"`)
+
+	conflict, reason = EntitySlice{EntityHost, EntityWorld}.Conflicts(EntitySlice{EntityWorld})
+	c.Assert(conflict, Equals, true)
+	c.Assert(reason, Equals, `entity "world" is selected by both rules`)
+
+	conflict, reason = EntitySlice{EntityHost}.Conflicts(EntitySlice{EntityWorld, EntityCluster})
+	c.Assert(conflict, Equals, false)
+	c.Assert(reason, Equals, "")
+
+	conflict, reason = EntitySlice{EntityRemoteNode}.Conflicts(EntitySlice{EntityCluster})
+	c.Assert(conflict, Equals, true)
+	c.Assert(reason, Equals, `entity "cluster" includes entity "remote-node"`)
+
+	conflict, reason = EntitySlice{EntityCluster}.Conflicts(EntitySlice{EntityHost, EntityRemoteNode})
+	c.Assert(conflict, Equals, true)
+	c.Assert(reason, Equals, `entity "cluster" includes entity "remote-node"`)
+
+	conflict, reason = EntitySlice{EntityRemoteNode}.Conflicts(EntitySlice{EntityHost, Entity("unknown")})
+	c.Assert(conflict, Equals, false)
+	c.Assert(reason, Equals, "")
+}
+
+func (s *PolicyAPITestSuite) TestEntityMatcherStale(c *C) {
+	const entityTest Entity = "test-entity"
+	defer unregisterEntity(entityTest)
+
+	c.Assert(RegisterEntity(entityTest, EndpointSelectorSlice{ReservedEndpointSelectors[labels.IDNameWorld]}), IsNil)
+	slice := EntitySlice{entityTest}
+	selector, _ := slice.GetAsEndpointSelectors()
+	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
+	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+
+	epoch := EntityEpoch()
+	matcher := slice.Compile()
+	c.Assert(matcher.IsStale(), Equals, false)
+	c.Assert(matcher.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
+
+	// Changing the entities bumps the epoch, the matcher is stale and the
+	// new selectors are resolved
+	unregisterEntity(entityTest)
+	c.Assert(RegisterEntity(entityTest, EndpointSelectorSlice{ReservedEndpointSelectors[labels.IDNameHost]}), IsNil)
+	c.Assert(EntityEpoch(), Not(Equals), epoch)
+	c.Assert(matcher.IsStale(), Equals, true)
+	selector, _ = slice.GetAsEndpointSelectors()
+	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:world")), Equals, false)
+	c.Assert(selector.Matches(labels.ParseLabelArray("reserved:host")), Equals, true)
+	c.Assert(slice.Compile().Matches(labels.ParseLabelArray("reserved:host")), Equals, true)
+}
+
+func (s *PolicyAPITestSuite) TestResolveEntities(c *C) {
+	slices := []EntitySlice{
+		{EntityHost, EntityWorld},
+		{EntityCluster},
+		{EntityHost, EntityWorld},
+		{},
+		{EntityWorld, "unknown-entity"},
+		{NewNamespaceEntity("kube-system"), EntityHost},
+		{"host,world"},
+	}
+
+	result := ResolveEntities(slices)
+	c.Assert(result, HasLen, len(slices))
+	for i, slice := range slices {
+		expected, _ := slice.GetAsEndpointSelectors()
+		c.Assert(result[i], DeepEquals, expected)
+	}
+
+	// Appending to a result must not affect results sharing the selectors
+	result[0] = append(result[0], WildcardEndpointSelector)
+	c.Assert(result[2], HasLen, 2)
+
+	// Namespace entities are resolved like by GetAsEndpointSelectors
+	c.Assert(result[5], HasLen, 2)
+	c.Assert(result[5].Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=kube-system")), Equals, true)
+}
+
+// benchmarkEntitySlices returns the entity slices of 1000 rules with
+// overlapping entities
+func benchmarkEntitySlices() []EntitySlice {
+	entities := []EntitySlice{
+		{EntityWorld},
+		{EntityCluster},
+		{EntityHost, EntityWorld},
+		{EntityAll},
+		{EntityHost, EntityCluster, EntityWorld},
+	}
+
+	slices := make([]EntitySlice, 1000)
+	for i := range slices {
+		slices[i] = entities[i%len(entities)]
+	}
+	return slices
+}
+
+func BenchmarkGetAsEndpointSelectors1000(b *testing.B) {
+	slices := benchmarkEntitySlices()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, slice := range slices {
+			slice.GetAsEndpointSelectors()
+		}
+	}
+}
+
+func BenchmarkResolveEntities1000(b *testing.B) {
+	slices := benchmarkEntitySlices()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ResolveEntities(slices)
+	}
+}
+
+func (s *PolicyAPITestSuite) TestEntitySliceExplain(c *C) {
+	explained := EntitySlice{EntityAll, EntityHost, "unknown-entity"}.Explain()
+	c.Assert(explained, HasLen, 3)
+
+	c.Assert(explained[0].Entity, Equals, EntityAll)
+	c.Assert(explained[0].Known, Equals, true)
+	c.Assert(explained[0].Wildcard, Equals, true)
+	c.Assert(explained[0].ReservedLabels, HasLen, 0)
+
+	c.Assert(explained[1], DeepEquals, EntityExplanation{
+		Entity:         EntityHost,
+		Known:          true,
+		ReservedLabels: labels.LabelArray{labels.NewLabel(labels.IDNameHost, "", labels.LabelSourceReserved)},
+		Selectors:      []string{"reserved.host="},
+	})
+
+	c.Assert(explained[2], DeepEquals, EntityExplanation{Entity: "unknown-entity"})
+
+	// Every entity of EntitySelectorMapping is explained
+	for e := range EntitySelectorMapping {
+		explained := EntitySlice{e}.Explain()
+		c.Assert(explained[0].Known, Equals, true)
+		c.Assert(explained[0].Wildcard || len(explained[0].ReservedLabels) > 0, Equals, true)
+	}
+}
+
+func (s *PolicyAPITestSuite) TestEntityValues(c *C) {
+	values := EntityValues()
+	c.Assert(values, HasLen, len(EntitySelectorMapping))
+	for i, e := range values {
+		c.Assert(e.IsValid(), Equals, true)
+		if i > 0 {
+			c.Assert(values[i-1] < e, Equals, true)
+		}
+	}
+	c.Assert(EntityWorld.IsValid(), Equals, true)
+	c.Assert(Entity("wrld").IsValid(), Equals, false)
+
+	rule := Rule{
+		EndpointSelector: WildcardEndpointSelector,
+		Ingress:          []IngressRule{{FromEntities: EntitySlice{"wrld"}}},
+	}
+	err := rule.Sanitize()
+	c.Assert(err, Not(IsNil))
+	c.Assert(strings.HasPrefix(err.Error(), "unsupported entity: wrld"), Equals, true)
+}
+
+func (s *PolicyAPITestSuite) TestEntitiesForLabels(c *C) {
+	c.Assert(EntitiesForLabels(labels.ParseLabelArray("reserved:world")), DeepEquals,
+		EntitySlice{EntityWorld})
+	// The local host is not part of EntityCluster, only remote nodes are
+	c.Assert(EntitiesForLabels(labels.ParseLabelArray("reserved:host")), DeepEquals,
+		EntitySlice{EntityHost})
+	c.Assert(EntityCluster.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+	c.Assert(EntitiesForLabels(labels.ParseLabelArray("reserved:remote-node")), DeepEquals,
+		EntitySlice{EntityCluster, EntityRemoteNode})
+	c.Assert(EntitiesForLabels(labels.ParseLabelArray("reserved:init")), DeepEquals,
+		EntitySlice{EntityInit})
+	c.Assert(EntitiesForLabels(labels.ParseLabelArray("id=foo")), DeepEquals, EntitySlice{})
+}
+
+func (s *PolicyAPITestSuite) TestMatchWithPriority(c *C) {
+	hostLabels := labels.ParseLabelArray("reserved:host")
+
+	entity, ok := EntitySlice{EntityAll, EntityHost, EntityWorld}.MatchWithPriority(hostLabels)
+	c.Assert(ok, Equals, true)
+	c.Assert(entity, Equals, EntityHost)
+	entity, ok = EntitySlice{EntityAll, EntityHost}.MatchWithPriority(hostLabels)
+	c.Assert(ok, Equals, true)
+	c.Assert(entity, Equals, EntityHost)
+
+	remoteNodeLabels := labels.ParseLabelArray("reserved:remote-node")
+	entity, ok = EntitySlice{EntityCluster, EntityRemoteNode}.MatchWithPriority(remoteNodeLabels)
+	c.Assert(ok, Equals, true)
+	c.Assert(entity, Equals, EntityRemoteNode)
+	entity, ok = EntitySlice{EntityRemoteNode, EntityCluster}.MatchWithPriority(remoteNodeLabels)
+	c.Assert(ok, Equals, true)
+	c.Assert(entity, Equals, EntityRemoteNode)
+
+	namespaceLabels := labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=foo")
+	entity, ok = EntitySlice{EntityAll, NewNamespaceEntity("foo")}.MatchWithPriority(namespaceLabels)
+	c.Assert(ok, Equals, true)
+	c.Assert(entity, Equals, NewNamespaceEntity("foo"))
+
+	_, ok = EntitySlice{EntityHost, EntityWorld}.MatchWithPriority(remoteNodeLabels)
+	c.Assert(ok, Equals, false)
+	_, ok = EntitySlice{}.MatchWithPriority(hostLabels)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *PolicyAPITestSuite) TestEntityMatchesIP(c *C) {
+	defer SetClusterCIDRs(nil)
+	defer SetHostCIDRs(nil)
+
+	_, clusterCIDR, err := net.ParseCIDR("10.0.0.0/8")
+	c.Assert(err, IsNil)
+	_, hostCIDR, err := net.ParseCIDR("10.1.0.1/32")
+	c.Assert(err, IsNil)
+	_, hostCIDRv6, err := net.ParseCIDR("f00d::1/128")
+	c.Assert(err, IsNil)
+	SetClusterCIDRs([]*net.IPNet{clusterCIDR})
+	SetHostCIDRs([]*net.IPNet{hostCIDR, hostCIDRv6})
+
+	for _, tt := range []struct {
+		ip       string
+		entities EntitySlice
+	}{
+		{"10.1.0.1", EntitySlice{EntityAll, EntityHost}},
+		{"f00d::1", EntitySlice{EntityAll, EntityHost}},
+		{"10.2.0.1", EntitySlice{EntityAll, EntityCluster}},
+		{"192.168.0.1", EntitySlice{EntityAll, EntityWorld}},
+	} {
+		ip := net.ParseIP(tt.ip)
+		for _, e := range []Entity{EntityAll, EntityHost, EntityCluster, EntityWorld,
+			EntityRemoteNode, NewNamespaceEntity("foo"), Entity("unknown")} {
+			matches := false
+			for _, expected := range tt.entities {
+				matches = matches || e == expected
+			}
+			c.Assert(e.MatchesIP(ip), Equals, matches, Commentf("%s %s", tt.ip, e))
+		}
+	}
+
+	c.Assert(EntityAll.MatchesIP(nil), Equals, true)
+	c.Assert(EntityWorld.MatchesIP(nil), Equals, false)
+}
+
+func (s *PolicyAPITestSuite) TestGetAsEndpointSelectorsExcept(c *C) {
+	hostLabels := labels.ParseLabelArray("reserved:host")
+	worldLabels := labels.ParseLabelArray("reserved:world")
+	endpointLabels := labels.ParseLabelArray("k8s:id=a")
+
+	selectors := EntitySlice{EntityAll}.GetAsEndpointSelectorsExcept(EntitySlice{EntityWorld})
+	c.Assert(selectors, HasLen, 1)
+	c.Assert(selectors.Matches(hostLabels), Equals, true)
+	c.Assert(selectors.Matches(endpointLabels), Equals, true)
+	c.Assert(selectors.Matches(worldLabels), Equals, false)
+
+	// Excluded selectors are removed, remaining selectors are restricted
+	selectors = EntitySlice{EntityCluster}.GetAsEndpointSelectorsExcept(EntitySlice{EntityRemoteNode})
+	c.Assert(selectors, HasLen, 1)
+	c.Assert(selectors.Matches(labels.ParseLabelArray("reserved:cluster")), Equals, true)
+	c.Assert(selectors.Matches(labels.ParseLabelArray("reserved:remote-node")), Equals, false)
+	c.Assert(selectors.Matches(labels.ParseLabelArray("reserved:cluster", "reserved:remote-node")), Equals, false)
+
+	// Duplicates are removed
+	selectors = EntitySlice{EntityHost, EntityWorld, EntityHost}.GetAsEndpointSelectorsExcept(nil)
+	c.Assert(selectors, HasLen, 2)
+	c.Assert(selectors.Matches(hostLabels), Equals, true)
+	c.Assert(selectors.Matches(worldLabels), Equals, true)
+
+	// Excluding everything selects nothing
+	selectors = EntitySlice{EntityHost, EntityWorld}.GetAsEndpointSelectorsExcept(EntitySlice{EntityAll})
+	c.Assert(selectors, HasLen, 0)
+}
+
+func (s *PolicyAPITestSuite) TestGetAsEndpointSelectorsDedup(c *C) {
+	slice := EntitySlice{EntityCluster, EntityRemoteNode, EntityHost, EntityHost}
+	selectors, unknown := slice.GetAsEndpointSelectors()
+	c.Assert(unknown, HasLen, 0)
+	c.Assert(selectors, HasLen, 3)
+
+	seen := map[string]struct{}{}
+	for _, selector := range selectors {
+		key := selector.LabelSelectorString()
+		_, duplicate := seen[key]
+		c.Assert(duplicate, Equals, false, Commentf("duplicate selector %s", key))
+		seen[key] = struct{}{}
+	}
+	c.Assert(selectors.Matches(labels.ParseLabelArray("reserved:remote-node")), Equals, true)
+	c.Assert(selectors.Matches(labels.ParseLabelArray("reserved:host")), Equals, true)
+
+	c.Assert(ResolveEntities([]EntitySlice{slice})[0], DeepEquals, selectors)
+}
+
+func (s *PolicyAPITestSuite) TestEntitySliceMarshalJSON(c *C) {
+	slice := EntitySlice{EntityWorld, EntityHost, EntityCluster}
+	b, err := json.Marshal(slice)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, `["cluster","host","world"]`)
+	c.Assert(slice, DeepEquals, EntitySlice{EntityWorld, EntityHost, EntityCluster})
+	c.Assert(slice.String(), Equals, "cluster,host,world")
+
+	b2, err := json.Marshal(EntitySlice{EntityCluster, EntityWorld, EntityHost})
+	c.Assert(err, IsNil)
+	c.Assert(b2, DeepEquals, b)
+
+	var unmarshaled EntitySlice
+	c.Assert(json.Unmarshal(b, &unmarshaled), IsNil)
+	c.Assert(unmarshaled, DeepEquals, EntitySlice{EntityCluster, EntityHost, EntityWorld})
+
+	b, err = json.Marshal(IngressRule{})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(b), "fromEntities"), Equals, false)
+}
+
+// unregisterEntity removes an entity added by RegisterEntity()
+func unregisterEntity(e Entity) {
+	entityMutex.Lock()
+	delete(EntitySelectorMapping, e)
+	entityMutex.Unlock()
+
+	InvalidateEntityCache()
+}
+
+func (s *PolicyAPITestSuite) TestRegisterEntity(c *C) {
+	const entityProxy Entity = "service-mesh-proxy"
+	defer unregisterEntity(entityProxy)
+
+	proxyLabels := labels.ParseLabelArray("k8s:app=proxy")
+	proxySelector := NewESFromLabels(labels.ParseSelectLabel("k8s:app=proxy"))
+
+	c.Assert(entityProxy.IsValid(), Equals, false)
+	c.Assert(entityProxy.Matches(proxyLabels), Equals, false)
+
+	c.Assert(RegisterEntity(entityProxy, EndpointSelectorSlice{proxySelector}), IsNil)
+	c.Assert(entityProxy.IsValid(), Equals, true)
+	c.Assert(entityProxy.Matches(proxyLabels), Equals, true)
+	c.Assert(entityProxy.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+	selectors, unknown := EntitySlice{entityProxy}.GetAsEndpointSelectors()
+	c.Assert(unknown, HasLen, 0)
+	c.Assert(selectors.Matches(proxyLabels), Equals, true)
+
+	c.Assert(RegisterEntity(entityProxy, EndpointSelectorSlice{proxySelector}), Not(IsNil))
+	c.Assert(RegisterEntity(EntityHost, EndpointSelectorSlice{proxySelector}), Not(IsNil))
+	c.Assert(RegisterEntity("", EndpointSelectorSlice{proxySelector}), Not(IsNil))
+	c.Assert(RegisterEntity("empty", nil), Not(IsNil))
+
+	// Registration may race with policy evaluation
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			entity := Entity(fmt.Sprintf("concurrent-%d", i))
+			c.Check(RegisterEntity(entity, EndpointSelectorSlice{proxySelector}), IsNil)
+			defer unregisterEntity(entity)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		EntitySlice{entityProxy, EntityHost}.GetAsEndpointSelectors()
+		entityProxy.Matches(proxyLabels)
+	}
+	<-done
+}
+
+func (s *PolicyAPITestSuite) TestEntityMatcher(c *C) {
+	lblsSets := []labels.LabelArray{
+		labels.ParseLabelArray("reserved:host"),
+		labels.ParseLabelArray("reserved:world"),
+		labels.ParseLabelArray("reserved:cluster"),
+		labels.ParseLabelArray("reserved:remote-node"),
+		labels.ParseLabelArray("reserved:kube-apiserver"),
+		labels.ParseLabelArray("k8s:id=a"),
+	}
+	slices := []EntitySlice{
+		{EntityAll},
+		{EntityHost, EntityWorld},
+		{EntityCluster},
+		{EntityKubeAPIServer, EntityRemoteNode},
+		{"unknown-entity"},
+		{},
+	}
+	for _, slice := range slices {
+		m := slice.Compile()
+		c.Assert(m.IsStale(), Equals, false)
+		for _, lbls := range lblsSets {
+			c.Assert(m.Matches(lbls), Equals, slice.Matches(lbls), Commentf("%s matching %s", slice, lbls))
+		}
+	}
+
+	m := EntityWorld.Compile()
+	c.Assert(m.Matches(labels.ParseLabelArray("reserved:world")), Equals, true)
+	InvalidateEntityCache()
+	c.Assert(m.IsStale(), Equals, true)
+}
+
+// benchmarkLabels is a label set of a typical kubernetes pod
+var benchmarkLabels = labels.ParseLabelArray(
+	"k8s:app=frontend",
+	"k8s:version=v1.2.3",
+	"k8s:tier=web",
+	"k8s:io.kubernetes.pod.namespace=production",
+	"k8s:io.cilium.k8s.policy.cluster=default",
+	"k8s:io.cilium.k8s.policy.serviceaccount=frontend",
+	"k8s:pod-template-hash=5d8f9c7b6",
+	"container:io.kubernetes.container.name=frontend",
+)
+
+var benchmarkEntities = EntitySlice{EntityHost, EntityRemoteNode, EntityCluster, EntityWorld}
+
+func BenchmarkEntitySliceMatches(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchmarkEntities.Matches(benchmarkLabels)
+	}
+}
+
+func BenchmarkEntityMatcherMatches(b *testing.B) {
+	m := benchmarkEntities.Compile()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Matches(benchmarkLabels)
+	}
+}
+
+func (s *PolicyAPITestSuite) TestNamespaceEntity(c *C) {
+	kubeSystem := NewNamespaceEntity("kube-system")
+	c.Assert(kubeSystem, Equals, Entity("namespace:kube-system"))
+	c.Assert(kubeSystem.IsValid(), Equals, true)
+	c.Assert(kubeSystem.validate(), IsNil)
+
+	c.Assert(kubeSystem.Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=kube-system", "k8s:app=dns")), Equals, true)
+	c.Assert(kubeSystem.Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=default")), Equals, false)
+	c.Assert(kubeSystem.Matches(labels.ParseLabelArray("reserved:host")), Equals, false)
+
+	selectors, unknown := EntitySlice{kubeSystem, EntityHost}.GetAsEndpointSelectors()
+	c.Assert(unknown, HasLen, 0)
+	c.Assert(selectors, HasLen, 2)
+	c.Assert(selectors.Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=kube-system")), Equals, true)
+	c.Assert(EntitySlice{kubeSystem}.Compile().Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=kube-system")), Equals, true)
+
+	// Malformed namespaces are rejected
+	for _, e := range []Entity{"namespace:", "namespace:Kube_System", NewNamespaceEntity(strings.Repeat("a", 64))} {
+		c.Assert(e.IsValid(), Equals, false)
+		err := e.validate()
+		c.Assert(err, Not(IsNil))
+		c.Assert(strings.Contains(err.Error(), "invalid namespace"), Equals, true)
+		_, unknown := EntitySlice{e}.GetAsEndpointSelectors()
+		c.Assert(unknown, DeepEquals, EntitySlice{e})
+	}
+
+	egress := EgressRule{ToEntities: EntitySlice{"namespace:-invalid"}}
+	err := egress.sanitize()
+	c.Assert(err, Not(IsNil))
+	c.Assert(strings.Contains(err.Error(), "invalid namespace"), Equals, true)
+
+	c.Assert(RegisterEntity("namespace:custom", EndpointSelectorSlice{WildcardEndpointSelector}), Not(IsNil))
+
+	// The cache of namespace selectors is bounded
+	for i := 0; i < 2*namespaceSelectorsMaxEntries; i++ {
+		_, ok := lookupNamespaceEntity(fmt.Sprintf("ns-%d", i))
+		c.Assert(ok, Equals, true)
+	}
+	namespaceMutex.Lock()
+	c.Assert(len(namespaceSelectors) <= namespaceSelectorsMaxEntries, Equals, true)
+	namespaceMutex.Unlock()
+	c.Assert(kubeSystem.Matches(labels.ParseLabelArray("k8s:io.kubernetes.pod.namespace=kube-system")), Equals, true)
+}
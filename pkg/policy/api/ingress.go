@@ -109,7 +109,7 @@ type IngressRule struct {
 // GetSourceEndpointSelectors returns a slice of endpoints selectors covering
 // all L3 source selectors of the ingress rule
 func (i *IngressRule) GetSourceEndpointSelectors() EndpointSelectorSlice {
-	res := append(i.FromEndpoints, i.FromEntities.GetAsEndpointSelectors()...)
+	res := append(i.FromEndpoints, i.FromEntities.getAsEndpointSelectorsWarn()...)
 	res = append(res, i.FromCIDR.GetAsEndpointSelectors()...)
 	return append(res, i.FromCIDRSet.GetAsEndpointSelectors()...)
 }
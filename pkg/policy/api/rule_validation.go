@@ -114,9 +114,8 @@ func (i *IngressRule) sanitize() error {
 	}
 
 	for _, fromEntity := range i.FromEntities {
-		_, ok := EntitySelectorMapping[fromEntity]
-		if !ok {
-			return fmt.Errorf("unsupported entity: %s", fromEntity)
+		if err := fromEntity.validate(); err != nil {
+			return err
 		}
 	}
 
@@ -182,9 +181,8 @@ func (e *EgressRule) sanitize() error {
 	}
 
 	for _, toEntity := range e.ToEntities {
-		_, ok := EntitySelectorMapping[toEntity]
-		if !ok {
-			return fmt.Errorf("unsupported entity: %s", toEntity)
+		if err := toEntity.validate(); err != nil {
+			return err
 		}
 	}
 
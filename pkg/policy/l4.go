@@ -31,6 +31,18 @@ import (
 // L7DataMap contains a map of L7 rules per endpoint where key is a hash of EndpointSelector
 type L7DataMap map[api.EndpointSelector]api.L7Rules
 
+// DeepCopy returns a deep copy of the map, including its selectors and rules
+func (l7 L7DataMap) DeepCopy() L7DataMap {
+	if l7 == nil {
+		return nil
+	}
+	out := make(L7DataMap, len(l7))
+	for selector, rules := range l7 {
+		out[*selector.DeepCopy()] = *rules.DeepCopy()
+	}
+	return out
+}
+
 func (l7 L7DataMap) MarshalJSON() ([]byte, error) {
 	if len(l7) == 0 {
 		return []byte("[]"), nil
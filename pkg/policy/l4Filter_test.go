@@ -1342,6 +1342,18 @@ func (ds *PolicyTestSuite) TestAllowingLocalhostShadowsL7(c *C) {
 	c.Assert(state.selectedRules, Equals, 1)
 	c.Assert(state.matchedRules, Equals, 0)
 
+	// Other nodes are allowed along with the host if they carry the
+	// remote-node identity.
+	option.Config.EnableRemoteNodeIdentity = true
+	defer func() { option.Config.EnableRemoteNodeIdentity = false }()
+	expected.Ingress["80/TCP"].L7RulesPerEp[api.ReservedEndpointSelectors[labels.IDNameRemoteNode]] = api.L7Rules{}
+
+	state = traceState{}
+	res, err = rule.resolveL4IngressPolicy(&ctxToA, &state, NewL4Policy(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(res, Not(IsNil))
+	c.Assert(*res, checker.DeepEquals, *expected)
+
 	// Endpoints not selected by the rule should not match the rule.
 	buffer = new(bytes.Buffer)
 	ctxToC := SearchContext{To: labelsC, Trace: TRACE_VERBOSE}
@@ -1146,7 +1146,7 @@ func (ds *PolicyTestSuite) TestWildcardL3RulesIngressFromEntities(c *C) {
 	c.Assert(len(*policy), Equals, 2)
 	c.Assert(len((*policy)["80/TCP"].Endpoints), Equals, 2)
 	selWorld := (*policy)["80/TCP"].Endpoints[1]
-	c.Assert(selWorld, Equals, api.EntitySelectorMapping[api.EntityWorld])
+	c.Assert(selWorld, Equals, api.EntitySelectorMapping[api.EntityWorld][0])
 
 	expectedPolicy := L4PolicyMap{
 		"9092/TCP": {
@@ -1268,7 +1268,7 @@ func (ds *PolicyTestSuite) TestWildcardL3RulesEgressToEntities(c *C) {
 	c.Assert(len(*policy), Equals, 2)
 	c.Assert(len((*policy)["80/TCP"].Endpoints), Equals, 2)
 	selWorld := (*policy)["80/TCP"].Endpoints[1]
-	c.Assert(selWorld, Equals, api.EntitySelectorMapping[api.EntityWorld])
+	c.Assert(selWorld, Equals, api.EntitySelectorMapping[api.EntityWorld][0])
 
 	expectedPolicy := L4PolicyMap{
 		"9092/TCP": {
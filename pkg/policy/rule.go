@@ -162,10 +162,14 @@ func mergeL4Ingress(ctx *SearchContext, rule api.IngressRule, ruleLabels labels.
 	// we find any L7 rules matching host/world then we need to turn any L7
 	// restrictions on these endpoints into L7 allow-all so that the
 	// traffic is always allowed, but is also always redirected through the
-	// proxy
+	// proxy. Other nodes are allowed along with the host if they carry the
+	// remote-node identity, as they used to carry the host identity.
 	endpointsWithL3Override := []api.EndpointSelector{}
 	if option.Config.AlwaysAllowLocalhost() {
 		endpointsWithL3Override = append(endpointsWithL3Override, api.ReservedEndpointSelectors[labels.IDNameHost])
+		if option.Config.EnableRemoteNodeIdentity {
+			endpointsWithL3Override = append(endpointsWithL3Override, api.ReservedEndpointSelectors[labels.IDNameRemoteNode])
+		}
 		if option.Config.HostAllowsWorld {
 			endpointsWithL3Override = append(endpointsWithL3Override, api.ReservedEndpointSelectors[labels.IDNameWorld])
 		}
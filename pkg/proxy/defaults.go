@@ -27,4 +27,25 @@ const (
 	// connections of a proxied connection after one side has initiated the
 	// closing and the other side is not being closed.
 	proxyConnectionCloseTimeout = 10 * time.Second
+
+	// proxyMapKeyCacheSize is the maximum number of proxymap keys cached
+	// per redirect for connections which have not been closed yet
+	proxyMapKeyCacheSize = 1024
+
+	// defaultRedirectIdleTimeout is the duration after which connections
+	// flowing through a redirect without any activity are closed
+	defaultRedirectIdleTimeout = time.Hour
+
+	// idleReapIntervalMin is the minimum interval in which the connections
+	// of a redirect are checked for the idle timeout
+	idleReapIntervalMin = time.Second
+
+	// defaultUpdateRulesAttempts is the number of attempts made by
+	// Redirect.UpdateRulesAndWait() if the caller does not specify a bound
+	defaultUpdateRulesAttempts = 3
+
+	// defaultUpdateRulesAckTimeout is the maximum duration to wait for the
+	// proxy to acknowledge the rules pushed by an attempt of
+	// Redirect.UpdateRulesAndWait() if the caller does not specify one
+	defaultUpdateRulesAckTimeout = 10 * time.Second
 )
@@ -17,9 +17,11 @@ package proxy
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/cilium/cilium/pkg/completion"
 	"github.com/cilium/cilium/pkg/envoy"
+	"github.com/cilium/cilium/pkg/policy"
 
 	"github.com/spf13/viper"
 )
@@ -35,6 +37,21 @@ type envoyRedirect struct {
 
 var envoyOnce sync.Once
 
+// newEnvoyRedirect is the redirect factory of all parser types implemented
+// by Envoy
+func newEnvoyRedirect(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+	return createEnvoyRedirect(r, p.stateDir, p.XDSServer, wg)
+}
+
+func init() {
+	if err := RegisterRedirectFactory(policy.ParserTypeHTTP, newEnvoyRedirect); err != nil {
+		log.WithError(err).Fatal("Unable to register Envoy redirect factory")
+	}
+	// Envoy implements the generic L7 protocols which are parsed by
+	// proxylib parsers
+	setGenericRedirectFactory(newEnvoyRedirect)
+}
+
 // createEnvoyRedirect creates a redirect with corresponding proxy
 // configuration. This will launch a proxy instance.
 func createEnvoyRedirect(r *Redirect, stateDir string, xdsServer *envoy.XDSServer, wg *completion.WaitGroup) (RedirectImplementation, error) {
@@ -64,11 +81,21 @@ func createEnvoyRedirect(r *Redirect, stateDir string, xdsServer *envoy.XDSServe
 	return nil, fmt.Errorf("%s: Envoy proxy process failed to start, cannot add redirect", r.id)
 }
 
-// UpdateRules replaces old l7 rules of a redirect with new ones.
+// UpdateRules replaces old l7 rules of a redirect with new ones. The rules are
+// delivered to Envoy with the network policy of the endpoint, an error is
+// returned if the Envoy process is not running.
 func (r *envoyRedirect) UpdateRules(wg *completion.WaitGroup) error {
+	if envoyProxy == nil {
+		return fmt.Errorf("%s: Envoy proxy process is not running, cannot update rules", r.listenerName)
+	}
 	return nil
 }
 
+// Drain is not supported by Envoy redirects, the listener is removed
+// immediately when the redirect is closed.
+func (r *envoyRedirect) Drain(timeout time.Duration, wg *completion.WaitGroup) {
+}
+
 // Close the redirect.
 func (r *envoyRedirect) Close(wg *completion.WaitGroup) {
 	if envoyProxy != nil {
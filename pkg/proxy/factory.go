@@ -0,0 +1,93 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/policy"
+)
+
+// RedirectFactory creates the implementation of the redirect r in the proxy
+// p. The proxy port of r has been allocated and the rules of r have been set
+// when the factory is called. The redirect structure passed in is safe to
+// access for reading and writing.
+type RedirectFactory func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error)
+
+var (
+	// redirectFactoriesMutex protects redirectFactories and
+	// genericRedirectFactory
+	redirectFactoriesMutex lock.RWMutex
+
+	// redirectFactories maps each L7 parser type to the factory creating
+	// the implementations of its redirects
+	redirectFactories = map[policy.L7ParserType]RedirectFactory{}
+
+	// genericRedirectFactory, if not nil, creates the implementations of
+	// redirects of parser types without a registered factory, i.e. the
+	// generic L7 protocols selected with the l7proto field of a rule
+	genericRedirectFactory RedirectFactory
+)
+
+// RegisterRedirectFactory makes factory create the implementations of all
+// redirects of the L7 parser type parserType. It allows parser integrations
+// to plug into the proxy without modifying it. An error is returned if the
+// parser type is empty or if a factory has already been registered for it.
+func RegisterRedirectFactory(parserType policy.L7ParserType, factory RedirectFactory) error {
+	if parserType == policy.ParserTypeNone {
+		return fmt.Errorf("parser type must not be empty")
+	}
+	if factory == nil {
+		return fmt.Errorf("redirect factory of parser type %q must not be nil", parserType)
+	}
+
+	redirectFactoriesMutex.Lock()
+	defer redirectFactoriesMutex.Unlock()
+
+	if _, ok := redirectFactories[parserType]; ok {
+		return fmt.Errorf("redirect factory of parser type %q is already registered", parserType)
+	}
+	redirectFactories[parserType] = factory
+	return nil
+}
+
+// setGenericRedirectFactory sets the factory used for all parser types
+// without a registered factory
+func setGenericRedirectFactory(factory RedirectFactory) {
+	redirectFactoriesMutex.Lock()
+	genericRedirectFactory = factory
+	redirectFactoriesMutex.Unlock()
+}
+
+// lookupRedirectFactory returns the factory creating the implementations of
+// redirects of the given parser type
+func lookupRedirectFactory(parserType policy.L7ParserType) (RedirectFactory, error) {
+	if parserType == policy.ParserTypeNone {
+		return nil, fmt.Errorf("no L7 parser type given")
+	}
+
+	redirectFactoriesMutex.RLock()
+	defer redirectFactoriesMutex.RUnlock()
+
+	if factory, ok := redirectFactories[parserType]; ok {
+		return factory, nil
+	}
+	if genericRedirectFactory != nil {
+		return genericRedirectFactory, nil
+	}
+	return nil, fmt.Errorf("no redirect factory registered for parser type %q", parserType)
+}
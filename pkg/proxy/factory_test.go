@@ -0,0 +1,165 @@
+// Copyright 2016-2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/policy"
+	"github.com/cilium/cilium/pkg/proxy/logger"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *proxyTestSuite) TestRegisterRedirectFactory(c *C) {
+	const parserType = policy.L7ParserType("test-register")
+
+	impl := &fakeRedirectImplementation{}
+	factory := func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		return impl, nil
+	}
+	c.Assert(RegisterRedirectFactory(parserType, factory), IsNil)
+	defer func() {
+		redirectFactoriesMutex.Lock()
+		delete(redirectFactories, parserType)
+		redirectFactoriesMutex.Unlock()
+	}()
+
+	c.Assert(RegisterRedirectFactory(parserType, factory), Not(IsNil))
+	c.Assert(RegisterRedirectFactory(policy.ParserTypeNone, factory), Not(IsNil))
+	c.Assert(RegisterRedirectFactory("test-nil", nil), Not(IsNil))
+
+	// The built-in parser types are registered
+	_, err := lookupRedirectFactory(policy.ParserTypeHTTP)
+	c.Assert(err, IsNil)
+	_, err = lookupRedirectFactory(policy.ParserTypeKafka)
+	c.Assert(err, IsNil)
+	_, err = lookupRedirectFactory(policy.ParserTypeNone)
+	c.Assert(err, Not(IsNil))
+
+	found, err := lookupRedirectFactory(parserType)
+	c.Assert(err, IsNil)
+	created, err := found(nil, nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(created, Equals, impl)
+
+	// Parser types without a factory fall back to the generic factory,
+	// if any
+	_, err = lookupRedirectFactory("test-unknown")
+	c.Assert(err, IsNil)
+
+	redirectFactoriesMutex.RLock()
+	generic := genericRedirectFactory
+	redirectFactoriesMutex.RUnlock()
+	setGenericRedirectFactory(nil)
+	defer setGenericRedirectFactory(generic)
+
+	_, err = lookupRedirectFactory("test-unknown")
+	c.Assert(err, ErrorMatches, `no redirect factory registered for parser type "test-unknown"`)
+}
+
+func (s *proxyTestSuite) TestCreateRedirectWithFactory(c *C) {
+	const parserType = policy.L7ParserType("test-create")
+
+	impl := &fakeRedirectImplementation{}
+	var created *Redirect
+	err := RegisterRedirectFactory(parserType, func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		created = r
+		return impl, nil
+	})
+	c.Assert(err, IsNil)
+	defer func() {
+		redirectFactoriesMutex.Lock()
+		delete(redirectFactories, parserType)
+		redirectFactoriesMutex.Unlock()
+	}()
+
+	p := &Proxy{
+		rangeMin:       20000,
+		rangeMax:       30000,
+		allocatedPorts: map[uint16]struct{}{},
+		redirects:      map[string]*Redirect{},
+	}
+	l4 := &policy.L4Filter{L7Parser: parserType}
+
+	r, err := p.CreateOrUpdateRedirect(l4, "factory", localEndpointMock, nil)
+	c.Assert(err, IsNil)
+	c.Assert(r, Equals, created)
+	c.Assert(r.implementation, Equals, impl)
+	c.Assert(r.ParserType(), Equals, parserType)
+	_, ok := p.allocatedPorts[r.GetProxyPort()]
+	c.Assert(ok, Equals, true)
+
+	// Rule updates of the existing redirect are pushed to the proxy and
+	// failures are returned once all attempts have failed
+	updated, err := p.CreateOrUpdateRedirect(l4, "factory", localEndpointMock, nil)
+	c.Assert(err, IsNil)
+	c.Assert(updated, Equals, r)
+	impl.failUpdates = defaultUpdateRulesAttempts
+	_, err = p.CreateOrUpdateRedirect(l4, "factory", localEndpointMock, nil)
+	c.Assert(err, Not(IsNil))
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update", "update-failed", "update-failed", "update-failed"})
+
+	// The acknowledgements of the proxy are added to the wait group of
+	// the caller
+	impl.unackedUpdates = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	wg := completion.NewWaitGroup(ctx)
+	updated, err = p.CreateOrUpdateRedirect(l4, "factory", localEndpointMock, wg)
+	c.Assert(err, IsNil)
+	c.Assert(updated, Equals, r)
+	c.Assert(wg.Wait(), Not(IsNil))
+
+	// A redirect which has been closed concurrently is recreated
+	r.Close(nil)
+	recreated, err := p.CreateOrUpdateRedirect(l4, "factory", localEndpointMock, nil)
+	c.Assert(err, IsNil)
+	c.Assert(recreated, Not(Equals), r)
+	c.Assert(recreated, Equals, created)
+	c.Assert(p.redirects["factory"], Equals, recreated)
+
+	// A redirect which fails to be created is closed, including its
+	// access log sink
+	const failingType = policy.L7ParserType("test-create-failure")
+	err = RegisterRedirectFactory(failingType, func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		created = r
+		return nil, fmt.Errorf("creation failed")
+	})
+	c.Assert(err, IsNil)
+	defer func() {
+		redirectFactoriesMutex.Lock()
+		delete(redirectFactories, failingType)
+		redirectFactoriesMutex.Unlock()
+	}()
+	sink := &fakeSink{}
+	p.SetAccessLogSinkFunc(func(id string, l4 *policy.L4Filter) logger.Sink { return sink })
+	_, err = p.CreateOrUpdateRedirect(&policy.L4Filter{L7Parser: failingType}, "failing", localEndpointMock, nil)
+	c.Assert(err, ErrorMatches, "creation failed")
+	c.Assert(sink.closed, Equals, true)
+	c.Assert(created.reaperStopped, Equals, true)
+	p.SetAccessLogSinkFunc(nil)
+
+	setGenericRedirectFactory(nil)
+	defer setGenericRedirectFactory(newEnvoyRedirect)
+
+	l4 = &policy.L4Filter{L7Parser: "test-unknown"}
+	_, err = p.CreateOrUpdateRedirect(l4, "unknown", localEndpointMock, nil)
+	c.Assert(err, ErrorMatches, `no redirect factory registered for parser type "test-unknown"`)
+	c.Assert(p.redirects, HasLen, 1)
+}
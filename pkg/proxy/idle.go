@@ -0,0 +1,174 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetIdleTimeout overrides the idle timeout of the redirect. Connections
+// flowing through the redirect without any activity for longer than timeout
+// are closed and their proxymap entry is removed. A timeout of zero disables
+// the idle timeout. Has no effect once the redirect has been closed.
+func (r *Redirect) SetIdleTimeout(timeout time.Duration) {
+	r.idleMutex.Lock()
+	defer r.idleMutex.Unlock()
+
+	r.idleTimeout = timeout
+	r.startIdleReaper()
+}
+
+// IdleTimeout returns the idle timeout of the redirect, see SetIdleTimeout()
+func (r *Redirect) IdleTimeout() time.Duration {
+	r.idleMutex.Lock()
+	defer r.idleMutex.Unlock()
+	return r.idleTimeout
+}
+
+// idleReapInterval returns the interval in which connections are checked
+// for the given idle timeout
+func idleReapInterval(timeout time.Duration) time.Duration {
+	interval := timeout / 2
+	if interval < idleReapIntervalMin {
+		interval = idleReapIntervalMin
+	}
+	return interval
+}
+
+// startIdleReaper starts the goroutine which closes idle connections if an
+// idle timeout is configured, connections are tracked and the goroutine is
+// not running yet. Proxies which do not track connections, e.g. Envoy, never
+// run the goroutine. Redirect.idleMutex must be held.
+func (r *Redirect) startIdleReaper() {
+	if r.idleTimeout == 0 || len(r.idleConns) == 0 || r.reaperStop != nil || r.reaperStopped {
+		return
+	}
+
+	r.reaperStop = make(chan struct{})
+	r.reaperDone = make(chan struct{})
+	go r.runIdleReaper(r.reaperStop, r.reaperDone)
+}
+
+// stopIdleReaper stops the goroutine which closes idle connections and waits
+// for it to exit. The reaper is never started again afterwards.
+func (r *Redirect) stopIdleReaper() {
+	r.idleMutex.Lock()
+	if r.reaperStopped {
+		r.idleMutex.Unlock()
+		return
+	}
+	r.reaperStopped = true
+	stop, done := r.reaperStop, r.reaperDone
+	r.idleMutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (r *Redirect) runIdleReaper(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		timeout := r.IdleTimeout()
+		interval := idleReapIntervalMin
+		if timeout != 0 {
+			interval = idleReapInterval(timeout)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		if timeout != 0 {
+			r.reapIdleConnections(time.Now().Add(-timeout))
+		}
+	}
+}
+
+// reapIdleConnections closes all tracked connections which have not been
+// active since deadline and removes their proxymap entries
+func (r *Redirect) reapIdleConnections(deadline time.Time) {
+	var idle []net.Conn
+
+	r.idleMutex.Lock()
+	for c, lastActive := range r.idleConns {
+		if lastActive.Before(deadline) {
+			idle = append(idle, c)
+			delete(r.idleConns, c)
+		}
+	}
+	r.idleMutex.Unlock()
+
+	for _, c := range idle {
+		scopedLog := log.WithFields(logrus.Fields{
+			fieldProxyRedirectID: r.id,
+			logfields.IPAddr:     c.RemoteAddr(),
+		})
+
+		switch err := r.removeProxyMapEntryOnClose(c); {
+		case err == ErrProxyMapEntryNotFound:
+			scopedLog.WithError(err).Debug("Proxymap entry already removed before closing idle connection")
+		case err != nil:
+			scopedLog.WithError(err).Warning("Unable to remove proxymap entry of idle connection")
+		}
+
+		if err := c.Close(); err != nil {
+			scopedLog.WithError(err).Debug("Unable to close idle connection")
+		}
+
+		scopedLog.Debug("Closed idle connection")
+	}
+}
+
+// trackConnection starts tracking the activity of a connection accepted by
+// the proxy of the redirect so that it can be closed once it is idle
+func (r *Redirect) trackConnection(c net.Conn) {
+	r.idleMutex.Lock()
+	r.idleConns[c] = time.Now()
+	r.startIdleReaper()
+	r.idleMutex.Unlock()
+}
+
+// connectionActive records activity on a tracked connection
+func (r *Redirect) connectionActive(c net.Conn) {
+	r.idleMutex.Lock()
+	if _, ok := r.idleConns[c]; ok {
+		r.idleConns[c] = time.Now()
+	}
+	r.idleMutex.Unlock()
+}
+
+// untrackConnection stops tracking a connection. Returns false if the
+// connection is no longer tracked because it has been closed as idle, in
+// which case its proxymap entry has already been removed.
+func (r *Redirect) untrackConnection(c net.Conn) bool {
+	r.idleMutex.Lock()
+	defer r.idleMutex.Unlock()
+
+	if _, ok := r.idleConns[c]; !ok {
+		return false
+	}
+	delete(r.idleConns, c)
+	return true
+}
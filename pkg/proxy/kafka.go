@@ -55,6 +55,15 @@ type kafkaConfiguration struct {
 	lookupNewDest destLookupFunc
 }
 
+func init() {
+	err := RegisterRedirectFactory(policy.ParserTypeKafka, func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		return createKafkaRedirect(r, kafkaConfiguration{}, DefaultEndpointInfoRegistry)
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Unable to register Kafka redirect factory")
+	}
+}
+
 // createKafkaRedirect creates a redirect to the kafka proxy. The redirect structure passed
 // in is safe to access for reading and writing.
 func createKafkaRedirect(r *Redirect, conf kafkaConfiguration, endpointInfoRegistry logger.EndpointInfoRegistry) (RedirectImplementation, error) {
@@ -96,6 +105,8 @@ func createKafkaRedirect(r *Redirect, conf kafkaConfiguration, endpointInfoRegis
 			case <-socket.closing:
 				// Don't report errors while the socket is being closed
 				return
+			case <-socket.draining:
+				return
 			default:
 			}
 
@@ -155,6 +166,7 @@ func (k *kafkaRedirect) canAccess(req *kafka.RequestMessage, srcIdentity identit
 type kafkaLogRecord struct {
 	*logger.LogRecord
 	localEndpoint logger.EndpointUpdater
+	sink          logger.Sink
 	topics        []string
 }
 
@@ -175,6 +187,7 @@ func (k *kafkaRedirect) newLogRecordFromRequest(req *kafka.RequestMessage) kafka
 				CorrelationID: int32(req.GetCorrelationID()),
 			})),
 		localEndpoint: k.redirect.localEndpoint,
+		sink:          k.redirect.accessLogSink,
 		topics:        req.GetTopics(),
 	}
 }
@@ -184,6 +197,7 @@ func (k *kafkaRedirect) newLogRecordFromResponse(res *kafka.ResponseMessage, req
 		LogRecord: logger.NewLogRecord(k.endpointInfoRegistry, k.redirect.localEndpoint,
 			accesslog.TypeResponse, k.redirect.ingress, logger.LogTags.Kafka(&accesslog.LogRecordKafka{})),
 		localEndpoint: k.redirect.localEndpoint,
+		sink:          k.redirect.accessLogSink,
 	}
 
 	if res != nil {
@@ -207,7 +221,7 @@ func (l *kafkaLogRecord) log(verdict accesslog.FlowVerdict, code int, info strin
 	// Log multiple entries for multiple Kafka topics in a single request.
 	for _, t := range l.topics {
 		l.Kafka.Topic.Topic = t
-		l.Log()
+		l.LogTo(l.sink)
 	}
 
 	// Update stats for the endpoint.
@@ -323,7 +337,7 @@ func (k *kafkaRedirect) handleRequests(done <-chan struct{}, pair *connectionPai
 
 	// retrieve identity of source together with original destination IP
 	// and destination port
-	srcIdentity, dstIPPort, err := k.conf.lookupNewDest(remoteAddr.String(), k.redirect.ProxyPort)
+	srcIdentity, dstIPPort, err := k.conf.lookupNewDest(remoteAddr.String(), k.redirect.GetProxyPort())
 	if err != nil {
 		scopedLog.WithField("source",
 			remoteAddr.String()).WithError(err).Error("Unable to lookup original destination")
@@ -353,6 +367,7 @@ func (k *kafkaRedirect) handleRequests(done <-chan struct{}, pair *connectionPai
 			return
 		}
 
+		k.redirect.connectionActive(pair.Rx.conn)
 		handler(pair, req, correlationCache, remoteAddr, srcIdentity, dstIPPort)
 	}
 }
@@ -408,17 +423,27 @@ func (k *kafkaRedirect) handleRequestConnection(pair *connectionPair) {
 		"to":   pair.Tx,
 	}), "Proxying request Kafka connection")
 
+	k.redirect.connectionOpened()
+	k.redirect.trackConnection(pair.Rx.conn)
+	if _, err := k.redirect.cacheProxyMapKey(pair.Rx.conn); err != nil {
+		log.WithError(err).Debug("Unable to cache proxymap key of connection")
+	}
+
 	k.handleRequests(k.socket.closing, pair, pair.Rx, k.handleRequest)
 
 	// The proxymap contains an entry with metadata for the receive side of the
-	// connection, remove it after the connection has been closed.
-	if pair.Rx != nil {
+	// connection, remove it after the connection has been closed unless the
+	// connection has been closed for being idle and the entry is gone already.
+	if pair.Rx != nil && k.redirect.untrackConnection(pair.Rx.conn) {
 		// We are running in our own go routine here so we can just
 		// block this go routine until after the connection is
 		// guaranteed to have been closed
 		time.Sleep(proxyConnectionCloseTimeout + time.Second)
 
-		if err := k.redirect.removeProxyMapEntryOnClose(pair.Rx.conn); err != nil {
+		switch err := k.redirect.removeProxyMapEntryOnClose(pair.Rx.conn); {
+		case err == ErrProxyMapEntryNotFound:
+			log.WithError(err).Debug("Proxymap entry already removed after closing connection")
+		case err != nil:
 			log.WithError(err).Warning("Unable to remove proxymap entry after closing connection")
 		}
 	}
@@ -437,16 +462,38 @@ func (k *kafkaRedirect) handleResponseConnection(pair *connectionPair, correlati
 		}, remoteAddr, remoteIdentity, origDstAddr)
 }
 
-// UpdateRules replaces old l7 rules of a redirect with new ones.
+// UpdateRules replaces old l7 rules of a redirect with new ones. The rules are
+// read from the redirect for every request, an error is returned if the
+// socket of the redirect has been closed and the rules can no longer apply.
 func (k *kafkaRedirect) UpdateRules(wg *completion.WaitGroup) error {
+	select {
+	case <-k.socket.closing:
+		return fmt.Errorf("%s: Kafka proxy socket has been closed, cannot update rules", k.redirect.id)
+	default:
+	}
 	return nil
 }
 
+// Drain stops accepting new Kafka connections and waits for up to timeout
+// for the existing connections to be closed.
+func (k *kafkaRedirect) Drain(timeout time.Duration, wg *completion.WaitGroup) {
+	if !k.socket.Drain(timeout) {
+		log.WithField(fieldID, k.redirect.id).
+			Debug("Timeout while draining Kafka connections, closing remaining connections")
+	}
+}
+
 // Close the redirect.
 func (k *kafkaRedirect) Close(wg *completion.WaitGroup) {
 	k.socket.Close()
 }
 
+// tracksConnections returns true as the Kafka proxy accounts all connections
+// it handles with the redirect.
+func (k *kafkaRedirect) tracksConnections() bool {
+	return true
+}
+
 func init() {
 	if err := proto.ConfigureParser(proto.ParserConfig{
 		SimplifiedMessageSetParsing: false,
@@ -187,7 +187,7 @@ func (k *proxyTestSuite) TestKafkaRedirect(c *C) {
 	kafkaRule2 := api.PortRuleKafka{APIKey: "produce", APIVersion: "0", Topic: "allowedTopic"}
 	c.Assert(kafkaRule2.Sanitize(), IsNil)
 
-	r := newRedirect(localEndpointMock, "foo")
+	r := newRedirect(localEndpointMock, "foo", nil, 0)
 	r.ProxyPort = uint16(proxyPort)
 	r.ingress = true
 
@@ -0,0 +1,109 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"container/list"
+
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/maps/proxymap"
+)
+
+// proxyMapKeyCache is a bounded LRU cache of proxymap keys indexed by the
+// remote address of a proxied connection. It avoids re-parsing the remote
+// address of a connection when its proxymap entry is removed on close.
+type proxyMapKeyCache struct {
+	mutex lock.Mutex
+
+	// size is the maximum number of keys kept in the cache
+	size int
+
+	// lru holds *proxyMapKeyCacheEntry, most recently used first
+	lru *list.List
+
+	// entries indexes the elements of lru by remote address
+	entries map[string]*list.Element
+}
+
+type proxyMapKeyCacheEntry struct {
+	remoteAddr string
+	key        proxymap.ProxyMapKey
+}
+
+func newProxyMapKeyCache(size int) *proxyMapKeyCache {
+	return &proxyMapKeyCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// lookup returns the cached key for the remote address
+func (c *proxyMapKeyCache) lookup(remoteAddr string) (proxymap.ProxyMapKey, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[remoteAddr]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*proxyMapKeyCacheEntry).key, true
+}
+
+// insert adds or replaces the key for the remote address, evicting the
+// least recently used key if the cache is full
+func (c *proxyMapKeyCache) insert(remoteAddr string, key proxymap.ProxyMapKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[remoteAddr]; ok {
+		elem.Value.(*proxyMapKeyCacheEntry).key = key
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		if oldest := c.lru.Back(); oldest != nil {
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*proxyMapKeyCacheEntry).remoteAddr)
+		}
+	}
+
+	c.entries[remoteAddr] = c.lru.PushFront(&proxyMapKeyCacheEntry{
+		remoteAddr: remoteAddr,
+		key:        key,
+	})
+}
+
+// remove deletes the key for the remote address from the cache
+func (c *proxyMapKeyCache) remove(remoteAddr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[remoteAddr]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, remoteAddr)
+	}
+}
+
+// len returns the number of keys in the cache
+func (c *proxyMapKeyCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
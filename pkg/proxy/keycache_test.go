@@ -0,0 +1,56 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"github.com/cilium/cilium/pkg/maps/proxymap"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *proxyTestSuite) TestProxyMapKeyCache(c *C) {
+	cache := newProxyMapKeyCache(2)
+
+	key1, err := createProxyMapKey("10.0.0.1:1000", 4000)
+	c.Assert(err, IsNil)
+	key2, err := createProxyMapKey("10.0.0.2:1000", 4000)
+	c.Assert(err, IsNil)
+	key3, err := createProxyMapKey("[f00d::1]:1000", 4000)
+	c.Assert(err, IsNil)
+
+	cache.insert("10.0.0.1:1000", key1)
+	cache.insert("10.0.0.2:1000", key2)
+	c.Assert(cache.len(), Equals, 2)
+
+	// Touch key1 so that key2 becomes the least recently used entry
+	key, ok := cache.lookup("10.0.0.1:1000")
+	c.Assert(ok, Equals, true)
+	c.Assert(key, Equals, key1)
+
+	cache.insert("[f00d::1]:1000", key3)
+	c.Assert(cache.len(), Equals, 2)
+
+	_, ok = cache.lookup("10.0.0.2:1000")
+	c.Assert(ok, Equals, false)
+	key, ok = cache.lookup("[f00d::1]:1000")
+	c.Assert(ok, Equals, true)
+	c.Assert(key.(proxymap.Proxy6Key), Equals, key3.(proxymap.Proxy6Key))
+
+	cache.remove("10.0.0.1:1000")
+	cache.remove("10.0.0.1:1000")
+	c.Assert(cache.len(), Equals, 1)
+	_, ok = cache.lookup("10.0.0.1:1000")
+	c.Assert(ok, Equals, false)
+}
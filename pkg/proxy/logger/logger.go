@@ -336,6 +336,17 @@ func (lr *LogRecord) getRawLogMessage() []byte {
 
 // Log logs a record to the logfile and flushes the buffer
 func (lr *LogRecord) Log() {
+	lr.LogTo(nil)
+}
+
+// LogTo logs a record like Log, but writes it to 'sink' instead of the shared
+// access log file if sink is not nil. The notifier is called before the record
+// is written to the sink, as it is for the shared access log. If the sink
+// fails, e.g. because it has been closed, the record is written to the shared
+// access log instead so that it is not lost. The failure is logged for every
+// record, unless sink is a TrackedSink, in which case it is only logged for
+// the first record failing after a successful write.
+func (lr *LogRecord) LogTo(sink Sink) {
 	flowdebug.Log(lr.getLogFields(), "Logging flow record")
 
 	// Lock while writing access log so we serialize writes as we may have
@@ -349,6 +360,23 @@ func (lr *LogRecord) Log() {
 		notifier.NewProxyLogRecord(lr)
 	}
 
+	if sink != nil {
+		err := sink.Write(lr)
+		tracked, _ := sink.(*TrackedSink)
+		if err == nil {
+			if tracked != nil {
+				tracked.failing = false
+			}
+			return
+		}
+		if tracked == nil || !tracked.failing {
+			log.WithError(err).Warning("Error writing to access log sink, writing to shared access log")
+		}
+		if tracked != nil {
+			tracked.failing = true
+		}
+	}
+
 	if logger == nil {
 		flowdebug.Log(log.WithField(FieldFilePath, logPath),
 			"Skipping writing to access log (logger nil)")
@@ -0,0 +1,109 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"errors"
+
+	"github.com/cilium/cilium/pkg/lock"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// ErrSinkClosed is returned when writing to a sink which has been closed
+var ErrSinkClosed = errors.New("access log sink is closed")
+
+// Sink is a destination for access log records which replaces the shared
+// access log file, e.g. for the records of an individual redirect.
+type Sink interface {
+	// Write writes the record to the sink
+	Write(lr *LogRecord) error
+
+	// Close flushes and closes the sink. Writes after Close must fail
+	// with ErrSinkClosed.
+	Close() error
+}
+
+// TrackedSink is a Sink which remembers whether the last record written to
+// it by LogRecord.LogTo() failed, so that a sink which keeps failing, e.g.
+// after it has been closed, is only reported once. A successful write clears
+// the failure, so that a sink failing again after it recovered is reported
+// again. Each owner of a sink, e.g. a redirect, wraps it in its own
+// TrackedSink.
+type TrackedSink struct {
+	Sink
+
+	// failing is true if the last write to Sink failed. It is protected
+	// by logMutex.
+	failing bool
+}
+
+// NewTrackedSink returns a TrackedSink wrapping sink
+func NewTrackedSink(sink Sink) *TrackedSink {
+	return &TrackedSink{Sink: sink}
+}
+
+// Failing returns true if the last record written to the sink by
+// LogRecord.LogTo() failed to be written
+func (s *TrackedSink) Failing() bool {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	return s.failing
+}
+
+// fileSink is a Sink writing to a dedicated, rotated log file
+type fileSink struct {
+	mutex  lock.Mutex
+	logger *lumberjack.Logger
+	closed bool
+}
+
+// NewFileSink returns a Sink which writes records to the file at path. The
+// file is rotated with the same settings as the shared access log.
+func NewFileSink(path string) Sink {
+	return &fileSink{
+		logger: &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    100, // megabytes
+			MaxBackups: 3,
+			MaxAge:     28, //days
+			Compress:   true,
+		},
+	}
+}
+
+func (s *fileSink) Write(lr *LogRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	_, err := s.logger.Write(lr.getRawLogMessage())
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	return s.logger.Close()
+}
@@ -15,6 +15,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"sync"
@@ -80,6 +81,45 @@ type Proxy struct {
 	// the redirect identifier. Redirects may be implemented by different
 	// proxies.
 	redirects map[string]*Redirect
+
+	// accessLogSinkFunc, if not nil, returns the access log sink of a new
+	// redirect, see SetAccessLogSinkFunc()
+	accessLogSinkFunc AccessLogSinkFunc
+
+	// drainTimeout, if not zero, is the time redirects are drained for
+	// before being closed on removal, see SetRedirectDrainTimeout()
+	drainTimeout time.Duration
+}
+
+// SetRedirectDrainTimeout enables the graceful removal of redirects if
+// timeout is not zero: a redirect being removed, e.g. during a policy update,
+// stops accepting new connections and existing connections are given up to
+// timeout to finish before the redirect is closed. Draining happens in the
+// background, the removal itself does not block. Redirects whose proxy does
+// not support draining are closed right after the removal.
+func (p *Proxy) SetRedirectDrainTimeout(timeout time.Duration) {
+	p.mutex.Lock()
+	p.drainTimeout = timeout
+	p.mutex.Unlock()
+}
+
+// AccessLogSinkFunc returns the sink for the access log records of a new
+// redirect with the given ID and L4 filter, or nil to use the shared access
+// log.
+type AccessLogSinkFunc func(id string, l4 *policy.L4Filter) logger.Sink
+
+// SetAccessLogSinkFunc sets the function which selects the access log sink of
+// new redirects, e.g. to log the records of redirects for sensitive services
+// to a dedicated destination. It only applies to redirects created after the
+// call. The notifier set with logger.SetNotifier() is called for all records
+// regardless of the sink, before the record is written to the sink.
+//
+// Records of Envoy redirects are received via the access log server and are
+// always written to the shared access log.
+func (p *Proxy) SetAccessLogSinkFunc(fn AccessLogSinkFunc) {
+	p.mutex.Lock()
+	p.accessLogSinkFunc = fn
+	p.mutex.Unlock()
 }
 
 // StartProxySupport starts the servers to support L7 proxies: xDS GRPC server
@@ -149,7 +189,10 @@ var gcOnce sync.Once
 // CreateOrUpdateRedirect creates or updates a L4 redirect with corresponding
 // proxy configuration. This will allocate a proxy port as required and launch
 // a proxy instance. If the redirect is already in place, only the rules will be
-// updated.
+// updated. Failed updates are retried as in Redirect.UpdateRulesAndWait(),
+// bounded by the context of wg, while the acknowledgements of the proxy are
+// added to wg for the caller to wait for. If the redirect is closed during
+// the update, it is created anew.
 func (p *Proxy) CreateOrUpdateRedirect(l4 *policy.L4Filter, id string, localEndpoint logger.EndpointUpdater,
 	wg *completion.WaitGroup) (*Redirect, error) {
 	gcOnce.Do(func() {
@@ -164,43 +207,62 @@ func (p *Proxy) CreateOrUpdateRedirect(l4 *policy.L4Filter, id string, localEndp
 		}()
 	})
 
+	scopedLog := log.WithField(fieldProxyRedirectID, id)
+
+	p.mutex.RLock()
+	r, ok := p.redirects[id]
+	p.mutex.RUnlock()
+
+	// parserType is immutable, no need to hold the redirect mutex. The
+	// proxy mutex is not held while retrying the update so that other
+	// redirects can be changed in the meantime.
+	if ok && r.parserType == l4.L7Parser {
+		ctx := context.Background()
+		if wg != nil {
+			ctx = wg.Context()
+		}
+		err := r.updateRulesWithRetry(ctx, l4, 0, func(generation uint64) error {
+			return r.pushRulesOfGeneration(generation, wg)
+		})
+		switch err {
+		case nil:
+			scopedLog.WithField(logfields.Object, logfields.Repr(r)).
+				Debug("updated existing ", l4.L7Parser, " proxy instance")
+			return r, nil
+		case errRedirectClosed:
+			// The redirect has been removed concurrently, e.g. by a
+			// cleanup of the endpoint, create a new one below
+			scopedLog.Debug("Existing ", l4.L7Parser, " proxy instance has been closed, recreating it")
+		default:
+			scopedLog.WithError(err).Error("Unable to update ", l4.L7Parser, " proxy")
+			return nil, err
+		}
+	}
+
 	p.mutex.Lock()
 	defer func() {
 		p.UpdateRedirectMetrics()
 		p.mutex.Unlock()
 	}()
 
-	scopedLog := log.WithField(fieldProxyRedirectID, id)
-
 	if r, ok := p.redirects[id]; ok {
-		r.mutex.Lock()
-		defer r.mutex.Unlock()
-
-		if r.parserType != l4.L7Parser {
-			if err := p.removeRedirect(id, r, wg); err != nil {
-				return nil, fmt.Errorf("unable to remove old redirect: %s", err)
-			}
-
-			goto create
-		}
-
-		r.updateRules(l4)
-		err := r.implementation.UpdateRules(wg)
-		if err != nil {
-			scopedLog.WithError(err).Error("Unable to update ", l4.L7Parser, " proxy")
-			return nil, err
+		if err := p.removeRedirect(id, r, wg); err != nil {
+			return nil, fmt.Errorf("unable to remove old redirect: %s", err)
 		}
+	}
 
-		r.lastUpdated = time.Now()
-
-		scopedLog.WithField(logfields.Object, logfields.Repr(r)).
-			Debug("updated existing ", l4.L7Parser, " proxy instance")
+	factory, err := lookupRedirectFactory(l4.L7Parser)
+	if err != nil {
+		scopedLog.WithError(err).Error("Unable to create ", l4.L7Parser, " proxy")
+		return nil, err
+	}
 
-		return r, nil
+	var sink logger.Sink
+	if p.accessLogSinkFunc != nil {
+		sink = p.accessLogSinkFunc(id, l4)
 	}
 
-create:
-	redir := newRedirect(localEndpoint, id)
+	redir := newRedirect(localEndpoint, id, sink, defaultRedirectIdleTimeout)
 	redir.endpointID = localEndpoint.GetID()
 	redir.ingress = l4.Ingress
 	redir.parserType = l4.L7Parser
@@ -210,20 +272,13 @@ retryCreatePort:
 	for nRetry := 0; ; nRetry++ {
 		to, err := p.allocatePort()
 		if err != nil {
+			redir.Close(nil)
 			return nil, err
 		}
 
 		redir.ProxyPort = to
 
-		switch l4.L7Parser {
-		case policy.ParserTypeKafka:
-			redir.implementation, err = createKafkaRedirect(redir, kafkaConfiguration{}, DefaultEndpointInfoRegistry)
-
-		case policy.ParserTypeHTTP:
-			redir.implementation, err = createEnvoyRedirect(redir, p.stateDir, p.XDSServer, wg)
-		default:
-			redir.implementation, err = createEnvoyRedirect(redir, p.stateDir, p.XDSServer, wg)
-		}
+		redir.implementation, err = factory(p, redir, wg)
 
 		switch {
 		case err == nil:
@@ -238,6 +293,7 @@ retryCreatePort:
 		// an error occurred, and we have no more retries
 		case nRetry >= redirectCreationAttempts:
 			scopedLog.WithError(err).Error("Unable to create ", l4.L7Parser, " proxy")
+			redir.Close(nil)
 			return nil, err
 
 		// an error occurred and we can retry
@@ -265,30 +321,134 @@ func (p *Proxy) RemoveRedirect(id string, wg *completion.WaitGroup) error {
 	return p.removeRedirect(id, r, wg)
 }
 
-// removeRedirect removes an existing redirect. p.mutex must be held
+// removeRedirect removes an existing redirect. p.mutex must be held. If a
+// drain timeout is set, the redirect is drained and closed in the background
+// so that other redirects can be created, updated and removed in the
+// meantime. The closing of a drained redirect is not tracked by wg.
 func (p *Proxy) removeRedirect(id string, r *Redirect, wg *completion.WaitGroup) error {
 	log.WithField(fieldProxyRedirectID, id).
 		Debug("removing proxy redirect")
-	r.implementation.Close(wg)
 
 	delete(p.redirects, id)
+	proxyPort := r.GetProxyPort()
+
+	drainTimeout := p.drainTimeout
+	if drainTimeout == 0 {
+		r.Close(wg)
+	}
 
-	// delay the release and reuse of the port number so it is guaranteed
-	// to be safe to listen on the port again
 	go func() {
-		time.Sleep(portReuseDelay)
+		if drainTimeout != 0 {
+			r.Drain(drainTimeout, nil)
+			r.Close(nil)
+		}
 
-		// The cleanup of the proxymap is delayed a bit to ensure that
-		// the datapath has implemented the redirect change and we
-		// cleanup the map before we release the port and allow reuse
-		proxymap.CleanupOnRedirectClose(r.ProxyPort)
+		p.releasePort(id, proxyPort)
+	}()
 
-		p.mutex.Lock()
-		delete(p.allocatedPorts, r.ProxyPort)
-		p.mutex.Unlock()
+	return nil
+}
 
-		log.WithField(fieldProxyRedirectID, id).Debugf("Delayed release of proxy port %d", r.ProxyPort)
-	}()
+// releasePort releases the proxy port of the redirect with the given ID. The
+// release and reuse of the port number is delayed so it is guaranteed to be
+// safe to listen on the port again, releasePort must therefore be called in
+// its own goroutine and without holding p.mutex.
+func (p *Proxy) releasePort(id string, proxyPort uint16) {
+	time.Sleep(portReuseDelay)
+
+	// The cleanup of the proxymap is delayed a bit to ensure that
+	// the datapath has implemented the redirect change and we
+	// cleanup the map before we release the port and allow reuse
+	proxymap.CleanupOnRedirectClose(proxyPort)
+
+	p.mutex.Lock()
+	delete(p.allocatedPorts, proxyPort)
+	p.mutex.Unlock()
+
+	log.WithField(fieldProxyRedirectID, id).Debugf("Delayed release of proxy port %d", proxyPort)
+}
+
+// SetRedirectProxyPort changes the port of the proxy the redirect with the
+// given ID redirects to, e.g. after the proxy has restarted on another port.
+// The new port is allocated, the proxy implementation of the redirect is
+// re-created on it through the redirect factory of its parser type and the
+// rules are pushed to it, then the old implementation is closed and the old
+// port is released as on removal of the redirect. The new port is programmed
+// into the datapath the next time the endpoint of the redirect is
+// regenerated.
+//
+// As connections in flight are bound to the old port and are cut when the
+// old implementation is closed, the change is rejected unless force is true
+// while connections are flowing through the redirect, or if the proxy
+// implementation does not account its connections so that they cannot be
+// ruled out.
+func (p *Proxy) SetRedirectProxyPort(id string, port uint16, force bool, wg *completion.WaitGroup) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	r, ok := p.redirects[id]
+	if !ok {
+		return fmt.Errorf("unable to find redirect %s", id)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("redirect %s has been closed", id)
+	}
+
+	oldPort := r.ProxyPort
+	if port == oldPort {
+		return nil
+	}
+
+	if _, ok := p.allocatedPorts[port]; ok {
+		return fmt.Errorf("unable to change proxy port of redirect %s from %d to %d: port is already allocated",
+			id, oldPort, port)
+	}
+
+	if !force {
+		if tracker, ok := r.implementation.(connectionTracker); !ok || !tracker.tracksConnections() {
+			return fmt.Errorf("unable to change proxy port of redirect %s from %d to %d: connections of the %s proxy are not accounted",
+				id, oldPort, port, r.parserType)
+		}
+		if n := r.NumConnections(); n > 0 {
+			return fmt.Errorf("unable to change proxy port of redirect %s from %d to %d: %d connections in flight",
+				id, oldPort, port, n)
+		}
+	}
+
+	factory, err := lookupRedirectFactory(r.parserType)
+	if err != nil {
+		return err
+	}
+
+	oldImplementation := r.implementation
+	r.ProxyPort = port
+	implementation, err := factory(p, r, wg)
+	if err != nil {
+		r.ProxyPort = oldPort
+		return fmt.Errorf("unable to create %s proxy on port %d: %s", r.parserType, port, err)
+	}
+
+	r.implementation = implementation
+	if err := r.pushRules(wg); err != nil {
+		implementation.Close(wg)
+		r.implementation = oldImplementation
+		r.ProxyPort = oldPort
+		return err
+	}
+
+	p.allocatedPorts[port] = struct{}{}
+	oldImplementation.Close(wg)
+	go p.releasePort(id, oldPort)
+
+	log.WithFields(logrus.Fields{
+		fieldProxyRedirectID: id,
+		"oldPort":            oldPort,
+		logfields.Port:       port,
+	}).Info("Changed proxy port of redirect")
 
 	return nil
 }
@@ -15,70 +15,647 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/cilium/cilium/pkg/completion"
 	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/maps/proxymap"
+	"github.com/cilium/cilium/pkg/metrics"
 	"github.com/cilium/cilium/pkg/policy"
 	"github.com/cilium/cilium/pkg/proxy/logger"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// updateRetryIntervalMin is the interval after which a failed rule
+	// update of a redirect is retried for the first time, it is doubled on
+	// every further failed attempt
+	updateRetryIntervalMin = 100 * time.Millisecond
+
+	// updateRetryIntervalMax is the maximum interval between two attempts
+	// of a rule update
+	updateRetryIntervalMax = 5 * time.Second
 )
 
 // RedirectImplementation is the generic proxy redirect interface that each
 // proxy redirect type must implement
+//
+// UpdateRules is not passed the rules in any particular order. All L7 rules
+// are allow rules, a request is allowed if it matches any rule, so the order
+// in which implementations evaluate the rules does not affect enforcement.
+// Should deny rules be introduced, rules must be handed to implementations
+// with deny rules first.
+//
+// Drain stops accepting new connections and lets existing connections finish
+// for up to timeout before the redirect is closed. Implementations which do
+// not support draining return immediately and are closed right away.
 type RedirectImplementation interface {
 	UpdateRules(wg *completion.WaitGroup) error
+	Drain(timeout time.Duration, wg *completion.WaitGroup)
 	Close(wg *completion.WaitGroup)
 }
 
+// connectionTracker is implemented by redirect implementations which account
+// all connections flowing through the redirect, see Redirect.NumConnections().
+// The connections of other implementations are unknown.
+type connectionTracker interface {
+	tracksConnections() bool
+}
+
 type Redirect struct {
+	// numConnections is the number of connections flowing through the
+	// redirect, it must only be accessed atomically. It is the first field
+	// to guarantee 64-bit alignment.
+	numConnections int64
+
 	// The following fields are only written to during initialization, it
 	// is safe to read these fields without locking the mutex
 
-	// ProxyPort is the port the redirects redirects to where the proxy is
-	// listening on
-	ProxyPort      uint16
-	endpointID     uint64
-	id             string
-	ingress        bool
-	localEndpoint  logger.EndpointUpdater
-	parserType     policy.L7ParserType
-	created        time.Time
-	implementation RedirectImplementation
+	endpointID    uint64
+	id            string
+	ingress       bool
+	localEndpoint logger.EndpointUpdater
+	parserType    policy.L7ParserType
+	created       time.Time
+
+	// accessLogSink, if not nil, receives the access log records of the
+	// redirect instead of the shared access log. It is a
+	// logger.TrackedSink so that a failing sink is only reported once per
+	// failure. It is closed when the redirect is closed.
+	accessLogSink logger.Sink
+
+	// keyCache caches the proxymap keys of connections flowing through
+	// the redirect so they don't need to be recomputed on close
+	keyCache *proxyMapKeyCache
+
+	// The following fields implement the idle timeout of connections
+	// flowing through the redirect, see SetIdleTimeout(). idleMutex must
+	// be held to read and write these fields.
+	idleMutex lock.Mutex
+
+	// idleTimeout, if not zero, is the duration after which connections
+	// without any activity are closed
+	idleTimeout time.Duration
+
+	// idleConns maps the connections flowing through the redirect to the
+	// time of their last activity
+	idleConns map[net.Conn]time.Time
+
+	// reaperStop and reaperDone stop the goroutine closing idle
+	// connections and signal its exit. reaperStopped is true once the
+	// goroutine has been stopped by Close().
+	reaperStop    chan struct{}
+	reaperDone    chan struct{}
+	reaperStopped bool
 
 	// The following fields are updated while the redirect is alive, the
 	// mutex must be held to read and write these fields
 	mutex       lock.RWMutex
 	lastUpdated time.Time
 	rules       policy.L7DataMap
+
+	// implementation is the proxy implementation of the redirect. It is
+	// replaced when the proxy port changes, see
+	// Proxy.SetRedirectProxyPort().
+	implementation RedirectImplementation
+
+	// rulesUpdatedHook, if not nil, is called whenever the rules of the
+	// redirect are replaced, see OnRulesUpdated()
+	rulesUpdatedHook RulesUpdatedFunc
+
+	// ProxyPort is the port the redirects redirects to where the proxy is
+	// listening on. It is set on creation and only changes if the proxy
+	// restarts on another port, see Proxy.SetRedirectProxyPort(). Once the
+	// redirect has been created, it must be read with GetProxyPort().
+	ProxyPort uint16
+
+	// generation is incremented every time the rules of the redirect are
+	// replaced and when the redirect is closed
+	generation uint64
+
+	// closed is true after the redirect has been closed, rules are no
+	// longer accepted after this point
+	closed bool
 }
 
-func newRedirect(localEndpoint logger.EndpointUpdater, id string) *Redirect {
-	return &Redirect{
+// newRedirect returns a new redirect. If accessLogSink is not nil, the access
+// log records of the redirect are written to it instead of the shared access
+// log. Connections idle for longer than idleTimeout are closed, a timeout of
+// zero disables the idle timeout, see SetIdleTimeout(). The goroutine closing
+// idle connections is only started once the proxy tracks a connection.
+func newRedirect(localEndpoint logger.EndpointUpdater, id string, accessLogSink logger.Sink, idleTimeout time.Duration) *Redirect {
+	r := &Redirect{
 		localEndpoint: localEndpoint,
 		id:            id,
 		created:       time.Now(),
 		lastUpdated:   time.Now(),
+		keyCache:      newProxyMapKeyCache(proxyMapKeyCacheSize),
+		idleTimeout:   idleTimeout,
+		idleConns:     map[net.Conn]time.Time{},
+	}
+	if accessLogSink != nil {
+		r.accessLogSink = logger.NewTrackedSink(accessLogSink)
 	}
+	return r
+}
+
+// ParserType returns the L7 parser type of the redirect. The parser type is
+// set when the redirect is created and never changes, it is safe to call
+// without holding the mutex of the redirect.
+func (r *Redirect) ParserType() policy.L7ParserType {
+	return r.parserType
+}
+
+// IsIngress returns true if the redirect redirects ingress traffic, false if
+// it redirects egress traffic. The direction is set when the redirect is
+// created and never changes, it is safe to call without holding the mutex of
+// the redirect.
+func (r *Redirect) IsIngress() bool {
+	return r.ingress
+}
+
+// Created returns the time the redirect was created. It never changes, it is
+// safe to call without holding the mutex of the redirect.
+func (r *Redirect) Created() time.Time {
+	return r.created
+}
+
+// EndpointID returns the ID of the endpoint the redirect belongs to. It is
+// set when the redirect is created and never changes, it is safe to call
+// without holding the mutex of the redirect.
+func (r *Redirect) EndpointID() uint64 {
+	return r.endpointID
+}
+
+// ID returns the ID of the redirect, as used by the proxy to identify the
+// redirect. It is set when the redirect is created and never changes, it is
+// safe to call without holding the mutex of the redirect.
+func (r *Redirect) ID() string {
+	return r.id
+}
+
+// LastUpdated returns the time the rules of the redirect have last been
+// pushed to the proxy successfully. It does not advance if an update fails,
+// so it tells how stale the rules enforced by the proxy may be.
+func (r *Redirect) LastUpdated() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lastUpdated
+}
+
+// Rules returns a snapshot of the L7 rules currently installed on the
+// redirect, e.g. for introspection. The returned map is a deep copy which the
+// caller may modify, it does not reflect subsequent updates of the rules.
+func (r *Redirect) Rules() policy.L7DataMap {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.rules.DeepCopy()
+}
+
+// GetProxyPort returns the port of the proxy the redirect redirects to
+func (r *Redirect) GetProxyPort() uint16 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.ProxyPort
 }
 
-// updateRules updates the rules of the redirect, Redirect.mutex must be held
+// RulesUpdatedFunc is called with copies of the old and the new rules of a
+// redirect whenever its rules are replaced
+type RulesUpdatedFunc func(old, new policy.L7DataMap)
+
+// OnRulesUpdated registers hook to be called whenever the rules of the
+// redirect are replaced, e.g. to audit the rules enforced by the proxy. The
+// hook is called after the mutex of the redirect has been released and is
+// passed copies of the rules, which it may modify. A nil hook removes the
+// hook registered before.
+func (r *Redirect) OnRulesUpdated(hook RulesUpdatedFunc) {
+	r.mutex.Lock()
+	r.rulesUpdatedHook = hook
+	r.mutex.Unlock()
+}
+
+// updateRules updates the rules of the redirect, Redirect.mutex must be held.
+// It is only used while the redirect is created, before any hook can have
+// been registered.
 func (r *Redirect) updateRules(l4 *policy.L4Filter) {
+	r.swapRules(l4.L7RulesPerEp)
+}
+
+// swapRules replaces the rules of the redirect with a copy of rules,
+// Redirect.mutex must be held. It returns a function notifying the rules
+// update hook of the change, which must be called after Redirect.mutex has
+// been released.
+func (r *Redirect) swapRules(rules policy.L7DataMap) (notify func()) {
+	notify = func() {}
+	if hook := r.rulesUpdatedHook; hook != nil {
+		oldRules, newRules := r.rules.DeepCopy(), rules.DeepCopy()
+		notify = func() { hook(oldRules, newRules) }
+	}
+
 	r.rules = policy.L7DataMap{}
-	for key, val := range l4.L7RulesPerEp {
+	numRules := 0
+	for key, val := range rules {
 		r.rules[key] = val
+		numRules += val.Len()
+	}
+	r.generation++
+
+	metrics.ProxyRedirectRules.WithLabelValues(r.id, string(r.parserType)).Set(float64(numRules))
+	log.WithFields(logrus.Fields{
+		fieldProxyRedirectID: r.id,
+		"count.selectors":    len(r.rules),
+		"count.rules":        numRules,
+	}).Debug("Updated rules of proxy redirect")
+
+	return notify
+}
+
+// validateRules returns an error if any rule in rules cannot be enforced by
+// a proxy of the given parser type. The rules are validated on copies, rules
+// is not modified.
+func validateRules(parserType policy.L7ParserType, rules policy.L7DataMap) error {
+	for selector, l7 := range rules {
+		var err error
+		switch parserType {
+		case policy.ParserTypeHTTP:
+			if len(l7.Kafka) > 0 || len(l7.L7) > 0 {
+				err = fmt.Errorf("non-HTTP rules not allowed")
+			}
+			for i := 0; err == nil && i < len(l7.HTTP); i++ {
+				rule := l7.HTTP[i]
+				err = rule.Sanitize()
+			}
+
+		case policy.ParserTypeKafka:
+			if len(l7.HTTP) > 0 || len(l7.L7) > 0 {
+				err = fmt.Errorf("non-Kafka rules not allowed")
+			}
+			for i := 0; err == nil && i < len(l7.Kafka); i++ {
+				rule := l7.Kafka[i]
+				err = rule.Sanitize()
+			}
+
+		default:
+			if len(l7.HTTP) > 0 || len(l7.Kafka) > 0 {
+				err = fmt.Errorf("HTTP and Kafka rules not allowed")
+			} else if l7.L7Proto != "" && l7.L7Proto != string(parserType) {
+				err = fmt.Errorf("rules for L7 protocol %q not allowed", l7.L7Proto)
+			}
+			for i := 0; err == nil && i < len(l7.L7); i++ {
+				rule := l7.L7[i]
+				err = rule.Sanitize()
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid %s rule for selector %s: %s",
+				parserType, selector.LabelSelectorString(), err)
+		}
+	}
+
+	return nil
+}
+
+// direction returns the direction of the redirect as metric label value
+func (r *Redirect) direction() string {
+	if r.ingress {
+		return metrics.LabelValueDirectionIngress
+	}
+	return metrics.LabelValueDirectionEgress
+}
+
+// pushRules pushes the rules of the redirect to the proxy implementation and
+// accounts the duration and outcome of the update. lastUpdated is only
+// advanced if the update succeeds. Redirect.mutex must be held.
+func (r *Redirect) pushRules(wg *completion.WaitGroup) error {
+	start := time.Now()
+	err := r.implementation.UpdateRules(wg)
+	metrics.ProxyRedirectUpdateDuration.WithLabelValues(string(r.parserType), r.direction()).
+		Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.ProxyRedirectUpdateFailures.WithLabelValues(string(r.parserType), r.direction()).Inc()
+		return err
+	}
+
+	r.lastUpdated = time.Now()
+	return nil
+}
+
+// replaceRules swaps the rules of the redirect with rules and pushes them to
+// the proxy implementation. If validate is true, the entire set of rules is
+// validated first and the rules of the redirect are left untouched if any
+// rule is invalid. If pushing the rules fails, the previous rules are
+// restored and the error is returned.
+func (r *Redirect) replaceRules(rules policy.L7DataMap, wg *completion.WaitGroup, validate bool) error {
+	r.mutex.Lock()
+	notify, err := r.replaceRulesLocked(rules, wg, validate)
+	r.mutex.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+	return err
+}
+
+// replaceRulesLocked implements replaceRules(), Redirect.mutex must be held.
+// If the rules have been replaced, the returned function notifying the rules
+// update hook must be called after Redirect.mutex has been released.
+func (r *Redirect) replaceRulesLocked(rules policy.L7DataMap, wg *completion.WaitGroup, validate bool) (func(), error) {
+	if r.closed {
+		return nil, fmt.Errorf("redirect %s has been closed", r.id)
 	}
+
+	if validate {
+		if err := validateRules(r.parserType, rules); err != nil {
+			return nil, err
+		}
+	}
+
+	oldRules := r.rules
+	notify := r.swapRules(rules)
+	if err := r.pushRules(wg); err != nil {
+		// The proxy did not apply the rules, restore the previous
+		// rules so the redirect never reports rules it does not enforce
+		r.swapRules(oldRules)
+		return nil, err
+	}
+
+	return notify, nil
+}
+
+// UpdateRules replaces the rules of the redirect with the rules of the L4
+// filter and pushes them to the proxy implementation. The redirect mutex is
+// held for the entire duration so that a concurrent Close() waits for the
+// update to complete. Returns an error if the redirect has been closed or if
+// the proxy implementation fails to apply the rules, in which case the
+// redirect keeps its previous rules.
+func (r *Redirect) UpdateRules(l4 *policy.L4Filter, wg *completion.WaitGroup) error {
+	return r.replaceRules(l4.L7RulesPerEp, wg, false)
+}
+
+// SetRules atomically replaces all rules of the redirect with rules and
+// pushes them to the proxy implementation. Unlike UpdateRules, the entire
+// set of rules is validated against the parser type of the redirect first.
+// If any rule is invalid, an error is returned and the redirect keeps its
+// current rules, so it never enforces a partially applied set of rules.
+func (r *Redirect) SetRules(rules policy.L7DataMap, wg *completion.WaitGroup) error {
+	return r.replaceRules(rules, wg, true)
+}
+
+// errRedirectClosed is returned when the rules of a redirect are updated
+// after the redirect has been closed
+var errRedirectClosed = errors.New("redirect has been closed")
+
+// UpdateRulesAndWait replaces the rules of the redirect with the rules of the
+// L4 filter, pushes them to the proxy implementation and waits for the proxy
+// to acknowledge them within ackTimeout. Failed or unacknowledged updates are
+// retried with exponential backoff for up to attempts attempts in total, so
+// that a transient failure of the proxy does not leave stale rules installed.
+// The defaults apply if attempts or ackTimeout is not positive. Unlike
+// UpdateRules, the final error is returned to the caller, e.g. to fail the
+// regeneration of the endpoint, and the previous rules are restored unless
+// they have been superseded in the meantime. Returns nil if the rules are
+// superseded by newer rules while retrying and errRedirectClosed if the
+// redirect is closed before the rules have been acknowledged.
+func (r *Redirect) UpdateRulesAndWait(ctx context.Context, l4 *policy.L4Filter, attempts int, ackTimeout time.Duration) error {
+	if ackTimeout <= 0 {
+		ackTimeout = defaultUpdateRulesAckTimeout
+	}
+
+	return r.updateRulesWithRetry(ctx, l4, attempts, func(generation uint64) error {
+		return r.pushRulesAndWait(ctx, generation, ackTimeout)
+	})
+}
+
+// updateRulesWithRetry replaces the rules of the redirect with the rules of
+// the L4 filter and calls push with the generation of the new rules until it
+// succeeds, see UpdateRulesAndWait(). Retrying stops early if push returns
+// errRedirectClosed.
+func (r *Redirect) updateRulesWithRetry(ctx context.Context, l4 *policy.L4Filter, attempts int, push func(generation uint64) error) error {
+	if attempts <= 0 {
+		attempts = defaultUpdateRulesAttempts
+	}
+
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return errRedirectClosed
+	}
+	oldRules := r.rules
+	notify := r.swapRules(l4.L7RulesPerEp)
+	generation := r.generation
+	r.mutex.Unlock()
+	notify()
+
+	var (
+		err     error
+		attempt int
+	)
+	backoff := updateRetryIntervalMin
+retry:
+	for attempt = 1; ; attempt++ {
+		if err = push(generation); err == nil || err == errRedirectClosed {
+			return err
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+
+		log.WithError(err).WithField(fieldProxyRedirectID, r.id).
+			Debug("Unable to update rules of proxy redirect, will retry")
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break retry
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > updateRetryIntervalMax {
+			backoff = updateRetryIntervalMax
+		}
+	}
+
+	r.mutex.Lock()
+	if !r.closed && r.generation == generation {
+		r.swapRules(oldRules)
+	}
+	r.mutex.Unlock()
+
+	return fmt.Errorf("unable to update rules of redirect %s after %d attempts: %s", r.id, attempt, err)
+}
+
+// pushRulesOfGeneration pushes the rules of the given generation to the
+// proxy implementation, adding the completions of the proxy to wg. Returns
+// nil without pushing if the rules have been superseded and
+// errRedirectClosed if the redirect has been closed.
+func (r *Redirect) pushRulesOfGeneration(generation uint64, wg *completion.WaitGroup) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch {
+	case r.closed:
+		return errRedirectClosed
+	case r.generation != generation:
+		return nil
+	}
+	return r.pushRules(wg)
+}
+
+// pushRulesAndWait pushes the rules of the given generation to the proxy
+// implementation and waits for up to ackTimeout for the proxy to acknowledge
+// them, see pushRulesOfGeneration(). The mutex of the redirect is not held
+// while waiting.
+func (r *Redirect) pushRulesAndWait(ctx context.Context, generation uint64, ackTimeout time.Duration) error {
+	ackCtx, cancel := context.WithTimeout(ctx, ackTimeout)
+	defer cancel()
+	wg := completion.NewWaitGroup(ackCtx)
+
+	if err := r.pushRulesOfGeneration(generation, wg); err != nil {
+		return err
+	}
+
+	if err := wg.Wait(); err != nil {
+		return fmt.Errorf("proxy did not acknowledge the rules: %s", err)
+	}
+
+	return nil
 }
 
+// Drain stops the proxy implementation of the redirect from accepting new
+// connections and waits for up to timeout for existing connections to
+// finish. The mutex of the redirect is not held while draining so that the
+// rules can still be updated for the remaining connections. The redirect
+// must be closed with Close() afterwards. Closed redirects are ignored.
+func (r *Redirect) Drain(timeout time.Duration, wg *completion.WaitGroup) {
+	r.mutex.RLock()
+	closed, implementation := r.closed, r.implementation
+	r.mutex.RUnlock()
+
+	if closed {
+		return
+	}
+
+	implementation.Drain(timeout, wg)
+}
+
+// Close tears down the proxy implementation of the redirect. If an update of
+// the rules is in progress, Close waits for it to complete first. The rules
+// of the redirect are released so that connections which are still being
+// handled by the proxy no longer match any rule, and the access log sink of
+// the redirect is closed. The goroutine closing idle connections is stopped
+// before the redirect is locked as it requires the lock to remove proxymap
+// entries.
+func (r *Redirect) Close(wg *completion.WaitGroup) {
+	r.stopIdleReaper()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.closed = true
+	r.rules = policy.L7DataMap{}
+	r.generation++
+	metrics.ProxyRedirectRules.DeleteLabelValues(r.id, string(r.parserType))
+	// The implementation is nil if the redirect failed to be created
+	if r.implementation != nil {
+		r.implementation.Close(wg)
+	}
+
+	// Records of connections still being handled by the proxy are written
+	// to the shared access log after the sink has been closed.
+	if r.accessLogSink != nil {
+		if err := r.accessLogSink.Close(); err != nil {
+			log.WithError(err).WithField(fieldProxyRedirectID, r.id).
+				Warning("Unable to close access log sink of redirect")
+		}
+	}
+}
+
+// cacheProxyMapKey computes the proxymap key of the connection and stores it
+// in the key cache of the redirect. It is called when a connection is
+// accepted so the key is readily available when the connection is closed.
+func (r *Redirect) cacheProxyMapKey(c net.Conn) (proxymap.ProxyMapKey, error) {
+	addr := c.RemoteAddr()
+	if addr == nil {
+		return nil, fmt.Errorf("RemoteAddr() returned nil")
+	}
+
+	remoteAddr := addr.String()
+	if key, ok := r.keyCache.lookup(remoteAddr); ok {
+		return key, nil
+	}
+
+	key, err := getProxyMapKey(c, r.GetProxyPort())
+	if err != nil {
+		return nil, err
+	}
+
+	r.keyCache.insert(remoteAddr, key)
+	return key, nil
+}
+
+// connectionOpened accounts a connection accepted by the proxy of the
+// redirect
+func (r *Redirect) connectionOpened() {
+	atomic.AddInt64(&r.numConnections, 1)
+}
+
+// connectionClosed accounts a connection closed by the proxy of the redirect.
+// The count never drops below zero, even if a connection is accounted as
+// closed more than once.
+func (r *Redirect) connectionClosed() {
+	for {
+		n := atomic.LoadInt64(&r.numConnections)
+		if n <= 0 || atomic.CompareAndSwapInt64(&r.numConnections, n, n-1) {
+			return
+		}
+	}
+}
+
+// NumConnections returns the number of connections currently flowing through
+// the redirect, e.g. to determine whether the redirect is idle. Connections
+// are accounted until their proxymap entry has been removed after they have
+// been closed.
+func (r *Redirect) NumConnections() int {
+	return int(atomic.LoadInt64(&r.numConnections))
+}
+
+// ErrProxyMapEntryNotFound is returned by removeProxyMapEntryOnClose if the
+// proxymap entry of the connection no longer exists, e.g. because the
+// connection has already been closed or the entry has been garbage collected
+var ErrProxyMapEntryNotFound = errors.New("proxymap entry not found")
+
+// deleteProxyMapEntry removes a proxymap entry, it is replaced in unit tests
+// which cannot access the BPF maps
+var deleteProxyMapEntry = proxymap.DeleteWithErrno
+
 // removeProxyMapEntryOnClose is called after the proxy has closed a connection
-// and will remove the proxymap entry for that connection
+// and will remove the proxymap entry for that connection. If the entry does
+// not exist, ErrProxyMapEntryNotFound is returned.
 func (r *Redirect) removeProxyMapEntryOnClose(c net.Conn) error {
-	key, err := getProxyMapKey(c, r.ProxyPort)
+	r.connectionClosed()
+
+	key, err := r.cacheProxyMapKey(c)
 	if err != nil {
 		return fmt.Errorf("unable to extract proxymap key: %s", err)
 	}
 
-	return proxymap.Delete(key)
+	// The remote address may be reused by a new connection once this one
+	// is closed, release the cached key along with the proxymap entry.
+	r.keyCache.remove(c.RemoteAddr().String())
+
+	err, errno := deleteProxyMapEntry(key)
+	if errno == unix.ENOENT {
+		return ErrProxyMapEntryNotFound
+	}
+	return err
 }
@@ -0,0 +1,566 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cilium/cilium/pkg/completion"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/metrics"
+	"github.com/cilium/cilium/pkg/policy"
+	"github.com/cilium/cilium/pkg/policy/api"
+	"github.com/cilium/cilium/pkg/proxy/accesslog"
+	"github.com/cilium/cilium/pkg/proxy/logger"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeRedirectImplementation records the calls made by a Redirect. If
+// updateStarted is not nil, UpdateRules signals it and blocks until
+// updateRelease is closed. If drainRelease is not nil, Drain blocks until it
+// is closed. The first failUpdates calls of UpdateRules fail,
+// the first unackedUpdates successful calls are never acknowledged.
+type fakeRedirectImplementation struct {
+	mutex          lock.Mutex
+	calls          []string
+	updateStarted  chan struct{}
+	updateRelease  chan struct{}
+	failUpdates    int
+	unackedUpdates int
+	drainRelease   chan struct{}
+}
+
+func (f *fakeRedirectImplementation) record(call string) {
+	f.mutex.Lock()
+	f.calls = append(f.calls, call)
+	f.mutex.Unlock()
+}
+
+func (f *fakeRedirectImplementation) getCalls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeRedirectImplementation) UpdateRules(wg *completion.WaitGroup) error {
+	if f.updateStarted != nil {
+		close(f.updateStarted)
+		<-f.updateRelease
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failUpdates > 0 {
+		f.failUpdates--
+		f.calls = append(f.calls, "update-failed")
+		return fmt.Errorf("update failed")
+	}
+	if f.unackedUpdates > 0 && wg != nil {
+		f.unackedUpdates--
+		wg.AddCompletion()
+		f.calls = append(f.calls, "update-unacked")
+		return nil
+	}
+	f.calls = append(f.calls, "update")
+	return nil
+}
+
+func (f *fakeRedirectImplementation) Drain(timeout time.Duration, wg *completion.WaitGroup) {
+	f.record("drain")
+	if f.drainRelease != nil {
+		<-f.drainRelease
+	}
+}
+
+func (f *fakeRedirectImplementation) Close(wg *completion.WaitGroup) {
+	f.record("close")
+}
+
+func newTestL4Filter() *policy.L4Filter {
+	return &policy.L4Filter{
+		L7Parser: policy.ParserTypeHTTP,
+		L7RulesPerEp: policy.L7DataMap{
+			api.WildcardEndpointSelector: api.L7Rules{
+				HTTP: []api.PortRuleHTTP{{Path: "/foo", Method: "GET"}},
+			},
+		},
+	}
+}
+
+func (s *proxyTestSuite) TestRedirectCloseWaitsForUpdate(c *C) {
+	impl := &fakeRedirectImplementation{
+		updateStarted: make(chan struct{}),
+		updateRelease: make(chan struct{}),
+	}
+	r := newRedirect(localEndpointMock, "slow-update", nil, 0)
+	r.parserType = policy.ParserTypeHTTP
+	r.implementation = impl
+
+	updateDone := make(chan error)
+	go func() {
+		updateDone <- r.UpdateRules(newTestL4Filter(), nil)
+	}()
+	<-impl.updateStarted
+
+	closeDone := make(chan struct{})
+	go func() {
+		r.Close(nil)
+		close(closeDone)
+	}()
+
+	select {
+	case <-closeDone:
+		c.Fatalf("Close() returned while UpdateRules() was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(impl.updateRelease)
+	c.Assert(<-updateDone, IsNil)
+	<-closeDone
+
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update", "close"})
+
+	r.mutex.RLock()
+	c.Assert(r.rules, HasLen, 0)
+	c.Assert(r.generation, Equals, uint64(2))
+	r.mutex.RUnlock()
+
+	// Updates after Close must not install any rules
+	c.Assert(r.UpdateRules(newTestL4Filter(), nil), Not(IsNil))
+	r.mutex.RLock()
+	c.Assert(r.rules, HasLen, 0)
+	r.mutex.RUnlock()
+
+	// Closing twice is a no-op
+	r.Close(nil)
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update", "close"})
+}
+
+func (s *proxyTestSuite) TestRemoveRedirectDrain(c *C) {
+	p := &Proxy{
+		allocatedPorts: map[uint16]struct{}{},
+		redirects:      map[string]*Redirect{},
+	}
+
+	newFakeRedirect := func(id string) *fakeRedirectImplementation {
+		impl := &fakeRedirectImplementation{}
+		r := newRedirect(localEndpointMock, id, nil, 0)
+		r.implementation = impl
+		p.redirects[id] = r
+		return impl
+	}
+
+	// Redirects are closed immediately by default
+	impl := newFakeRedirect("immediate")
+	c.Assert(p.RemoveRedirect("immediate", nil), IsNil)
+	c.Assert(impl.getCalls(), DeepEquals, []string{"close"})
+
+	// Draining redirects are closed in the background without holding
+	// the proxy lock
+	p.SetRedirectDrainTimeout(time.Second)
+	impl = newFakeRedirect("graceful")
+	impl.drainRelease = make(chan struct{})
+	c.Assert(p.RemoveRedirect("graceful", nil), IsNil)
+	p.mutex.Lock()
+	c.Assert(p.redirects, HasLen, 0)
+	p.mutex.Unlock()
+
+	close(impl.drainRelease)
+	for i := 0; len(impl.getCalls()) < 2 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(impl.getCalls(), DeepEquals, []string{"drain", "close"})
+}
+
+func (s *proxyTestSuite) TestRedirectNumConnections(c *C) {
+	r := newRedirect(localEndpointMock, "connections", nil, 0)
+	c.Assert(r.NumConnections(), Equals, 0)
+
+	r.connectionOpened()
+	r.connectionOpened()
+	c.Assert(r.NumConnections(), Equals, 2)
+
+	r.connectionClosed()
+	r.connectionClosed()
+	c.Assert(r.NumConnections(), Equals, 0)
+
+	// Closing a connection twice must not make the count negative
+	r.connectionClosed()
+	c.Assert(r.NumConnections(), Equals, 0)
+}
+
+func (s *proxyTestSuite) TestRedirectIdleTimeout(c *C) {
+	r := newRedirect(localEndpointMock, "idle", nil, time.Hour)
+	r.implementation = &fakeRedirectImplementation{}
+	c.Assert(r.IdleTimeout(), Equals, time.Hour)
+
+	r.SetIdleTimeout(time.Minute)
+	c.Assert(r.IdleTimeout(), Equals, time.Minute)
+
+	idle, peer := net.Pipe()
+	defer peer.Close()
+	active, activePeer := net.Pipe()
+	defer active.Close()
+	defer activePeer.Close()
+
+	// The reaper is only started once a connection is tracked
+	c.Assert(r.reaperStop, IsNil)
+	r.connectionOpened()
+	r.trackConnection(idle)
+	c.Assert(r.reaperStop, Not(IsNil))
+	r.connectionOpened()
+	r.trackConnection(active)
+
+	time.Sleep(10 * time.Millisecond)
+	deadline := time.Now()
+	r.connectionActive(active)
+	r.reapIdleConnections(deadline)
+
+	// The idle connection has been closed and is no longer tracked
+	_, err := idle.Write([]byte{0})
+	c.Assert(err, Equals, io.ErrClosedPipe)
+	c.Assert(r.untrackConnection(idle), Equals, false)
+	c.Assert(r.NumConnections(), Equals, 1)
+
+	c.Assert(r.untrackConnection(active), Equals, true)
+
+	// Closing the redirect stops the reaper
+	done := r.reaperDone
+	r.Close(nil)
+	select {
+	case <-done:
+	default:
+		c.Fatal("idle connection reaper still running after close")
+	}
+
+	r.SetIdleTimeout(time.Minute)
+	c.Assert(r.reaperDone, Equals, done)
+}
+
+// trackingRedirectImplementation is a fakeRedirectImplementation which
+// accounts its connections
+type trackingRedirectImplementation struct {
+	*fakeRedirectImplementation
+}
+
+func (t trackingRedirectImplementation) tracksConnections() bool {
+	return true
+}
+
+func (s *proxyTestSuite) TestSetRedirectProxyPort(c *C) {
+	const parserType = policy.L7ParserType("test-port-change")
+
+	var impls []*fakeRedirectImplementation
+	tracking := true
+	err := RegisterRedirectFactory(parserType, func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		impl := &fakeRedirectImplementation{}
+		impls = append(impls, impl)
+		if tracking {
+			return trackingRedirectImplementation{impl}, nil
+		}
+		return impl, nil
+	})
+	c.Assert(err, IsNil)
+	defer func() {
+		redirectFactoriesMutex.Lock()
+		delete(redirectFactories, parserType)
+		redirectFactoriesMutex.Unlock()
+	}()
+
+	p := &Proxy{
+		rangeMin:       20000,
+		rangeMax:       30000,
+		allocatedPorts: map[uint16]struct{}{},
+		redirects:      map[string]*Redirect{},
+	}
+	r, err := p.CreateOrUpdateRedirect(&policy.L4Filter{L7Parser: parserType}, "port-change", localEndpointMock, nil)
+	c.Assert(err, IsNil)
+	oldPort := r.GetProxyPort()
+	c.Assert(p.allocatedPorts, DeepEquals, map[uint16]struct{}{oldPort: {}})
+
+	// The proxy is re-created on the new port, which is allocated, the old
+	// port remains allocated until its delayed release
+	c.Assert(p.SetRedirectProxyPort("port-change", 10001, false, nil), IsNil)
+	c.Assert(r.GetProxyPort(), Equals, uint16(10001))
+	c.Assert(p.allocatedPorts, DeepEquals, map[uint16]struct{}{oldPort: {}, 10001: {}})
+	c.Assert(impls, HasLen, 2)
+	c.Assert(impls[0].getCalls(), DeepEquals, []string{"close"})
+	c.Assert(impls[1].getCalls(), DeepEquals, []string{"update"})
+
+	// Allocated ports are rejected
+	c.Assert(p.SetRedirectProxyPort("port-change", oldPort, true, nil), Not(IsNil))
+	c.Assert(r.GetProxyPort(), Equals, uint16(10001))
+
+	// Connections in flight are bound to the current port
+	r.connectionOpened()
+	c.Assert(p.SetRedirectProxyPort("port-change", 10002, false, nil), Not(IsNil))
+	c.Assert(r.GetProxyPort(), Equals, uint16(10001))
+	c.Assert(p.allocatedPorts, DeepEquals, map[uint16]struct{}{oldPort: {}, 10001: {}})
+	r.connectionClosed()
+
+	// Connections of implementations which do not account them cannot
+	// be ruled out
+	tracking = false
+	c.Assert(p.SetRedirectProxyPort("port-change", 10002, true, nil), IsNil)
+	c.Assert(p.SetRedirectProxyPort("port-change", 10003, false, nil), Not(IsNil))
+	c.Assert(r.GetProxyPort(), Equals, uint16(10002))
+	c.Assert(impls, HasLen, 3)
+	c.Assert(impls[1].getCalls(), DeepEquals, []string{"update", "close"})
+
+	// A failing rule update keeps the redirect on the current port
+	tracking = true
+	failing := &fakeRedirectImplementation{failUpdates: 1}
+	c.Assert(RegisterRedirectFactory("test-port-change-failing", func(p *Proxy, r *Redirect, wg *completion.WaitGroup) (RedirectImplementation, error) {
+		return failing, nil
+	}), IsNil)
+	defer func() {
+		redirectFactoriesMutex.Lock()
+		delete(redirectFactories, "test-port-change-failing")
+		redirectFactoriesMutex.Unlock()
+	}()
+	r.parserType = "test-port-change-failing"
+	c.Assert(p.SetRedirectProxyPort("port-change", 10003, true, nil), Not(IsNil))
+	r.parserType = parserType
+	c.Assert(r.GetProxyPort(), Equals, uint16(10002))
+	c.Assert(failing.getCalls(), DeepEquals, []string{"update-failed", "close"})
+	c.Assert(impls[2].getCalls(), DeepEquals, []string{"update"})
+
+	// Removing the redirect closes the implementation on the current port
+	c.Assert(p.RemoveRedirect("port-change", nil), IsNil)
+	c.Assert(impls[2].getCalls(), DeepEquals, []string{"update", "close"})
+	c.Assert(p.SetRedirectProxyPort("port-change", 10003, true, nil), Not(IsNil))
+}
+
+func (s *proxyTestSuite) TestRedirectRules(c *C) {
+	r := newRedirect(localEndpointMock, "rules", nil, 0)
+	r.implementation = &fakeRedirectImplementation{}
+	c.Assert(r.UpdateRules(newTestL4Filter(), nil), IsNil)
+
+	rules := r.Rules()
+	c.Assert(rules, HasLen, 1)
+	for selector, l7 := range rules {
+		c.Assert(selector.IsWildcard(), Equals, true)
+		c.Assert(l7.HTTP, DeepEquals, []api.PortRuleHTTP{{Path: "/foo", Method: "GET"}})
+
+		// Modifying the snapshot must not affect the installed rules
+		l7.HTTP[0].Path = "/bar"
+		selector.LabelSelector.MatchLabels["foo"] = "bar"
+	}
+
+	for selector, l7 := range r.Rules() {
+		c.Assert(selector.IsWildcard(), Equals, true)
+		c.Assert(l7.HTTP[0].Path, Equals, "/foo")
+	}
+}
+
+func (s *proxyTestSuite) TestRedirectAccessors(c *C) {
+	r := newRedirect(localEndpointMock, "accessors", nil, 0)
+	r.endpointID = 42
+	c.Assert(r.ID(), Equals, "accessors")
+	c.Assert(r.EndpointID(), Equals, uint64(42))
+}
+
+func (s *proxyTestSuite) TestRedirectOnRulesUpdated(c *C) {
+	r := newRedirect(localEndpointMock, "rules-hook", nil, 0)
+	r.implementation = &fakeRedirectImplementation{}
+
+	var oldRules, newRules []policy.L7DataMap
+	r.OnRulesUpdated(func(old, new policy.L7DataMap) {
+		// The mutex of the redirect is released while the hook is called
+		c.Assert(r.Rules(), HasLen, len(new))
+		oldRules = append(oldRules, old)
+		newRules = append(newRules, new)
+		for selector := range new {
+			delete(new, selector)
+		}
+	})
+
+	// The rules of the redirect are not affected by the hook modifying them
+	c.Assert(r.UpdateRules(newTestL4Filter(), nil), IsNil)
+	c.Assert(r.Rules(), HasLen, 1)
+	c.Assert(r.SetRules(policy.L7DataMap{}, nil), IsNil)
+	c.Assert(oldRules, HasLen, 2)
+	c.Assert(oldRules[0], HasLen, 0)
+	c.Assert(newRules[0], HasLen, 0)
+	c.Assert(oldRules[1], HasLen, 1)
+	c.Assert(newRules[1], HasLen, 0)
+
+	// Rules are not replaced if they are rejected
+	c.Assert(r.SetRules(policy.L7DataMap{
+		api.WildcardEndpointSelector: api.L7Rules{Kafka: []api.PortRuleKafka{{Topic: "foo"}}},
+	}, nil), Not(IsNil))
+	c.Assert(oldRules, HasLen, 2)
+
+	r.OnRulesUpdated(nil)
+	c.Assert(r.UpdateRules(newTestL4Filter(), nil), IsNil)
+	c.Assert(oldRules, HasLen, 2)
+	c.Assert(r.Rules(), HasLen, 1)
+}
+
+func (s *proxyTestSuite) TestRedirectUpdateFailure(c *C) {
+	impl := &fakeRedirectImplementation{}
+	r := newRedirect(localEndpointMock, "update-failure", nil, 0)
+	r.implementation = impl
+	l4 := newTestL4Filter()
+	c.Assert(r.UpdateRules(l4, nil), IsNil)
+	lastUpdated := r.LastUpdated()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, wg := range []*completion.WaitGroup{nil, completion.NewWaitGroup(ctx)} {
+		// The failure is returned and the previous rules are restored
+		impl.failUpdates = 1
+		rules := policy.L7DataMap{
+			api.WildcardEndpointSelector: api.L7Rules{
+				HTTP: []api.PortRuleHTTP{{Path: "/bar"}},
+			},
+		}
+		c.Assert(r.UpdateRules(&policy.L4Filter{L7RulesPerEp: rules}, wg), Not(IsNil))
+		r.mutex.RLock()
+		c.Assert(r.rules, DeepEquals, l4.L7RulesPerEp)
+		r.mutex.RUnlock()
+		c.Assert(r.LastUpdated(), Equals, lastUpdated)
+	}
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update", "update-failed", "update-failed"})
+}
+
+func (s *proxyTestSuite) TestRedirectUpdateRulesAndWait(c *C) {
+	impl := &fakeRedirectImplementation{failUpdates: 1, unackedUpdates: 1}
+	r := newRedirect(localEndpointMock, "update-and-wait", nil, 0)
+	r.implementation = impl
+
+	// Failed and unacknowledged updates are retried
+	l4 := newTestL4Filter()
+	c.Assert(r.UpdateRulesAndWait(context.Background(), l4, 3, 50*time.Millisecond), IsNil)
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update-failed", "update-unacked", "update"})
+
+	// The final error is returned once all attempts have failed and the
+	// previous rules are restored
+	impl.failUpdates = 1
+	impl.unackedUpdates = 1
+	c.Assert(r.UpdateRulesAndWait(context.Background(), &policy.L4Filter{}, 2, 50*time.Millisecond), Not(IsNil))
+	c.Assert(impl.getCalls()[3:], DeepEquals, []string{"update-failed", "update-unacked"})
+	r.mutex.RLock()
+	c.Assert(r.rules, DeepEquals, l4.L7RulesPerEp)
+	r.mutex.RUnlock()
+
+	// Closed redirects are rejected
+	r.Close(nil)
+	c.Assert(r.UpdateRulesAndWait(context.Background(), newTestL4Filter(), 1, 0), Equals, errRedirectClosed)
+}
+
+func (s *proxyTestSuite) TestRedirectRulesMetric(c *C) {
+	r := newRedirect(localEndpointMock, "rules-metric", nil, 0)
+	r.parserType = policy.ParserTypeHTTP
+	r.implementation = &fakeRedirectImplementation{}
+
+	c.Assert(r.UpdateRules(newTestL4Filter(), nil), IsNil)
+	c.Assert(metrics.GetGaugeValue(metrics.ProxyRedirectRules.WithLabelValues(r.id, string(r.parserType))), Equals, float64(1))
+
+	r.Close(nil)
+}
+
+// fakeSink is an access log sink recording the records written to it
+type fakeSink struct {
+	records []*logger.LogRecord
+	closed  bool
+}
+
+func (s *fakeSink) Write(lr *logger.LogRecord) error {
+	if s.closed {
+		return logger.ErrSinkClosed
+	}
+	s.records = append(s.records, lr)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *proxyTestSuite) TestRedirectAccessLogSink(c *C) {
+	sink := &fakeSink{}
+	r := newRedirect(localEndpointMock, "sink", sink, 0)
+	r.implementation = &fakeRedirectImplementation{}
+
+	record := logger.NewLogRecord(DefaultEndpointInfoRegistry, localEndpointMock,
+		accesslog.TypeRequest, false)
+	record.LogTo(r.accessLogSink)
+	c.Assert(sink.records, HasLen, 1)
+
+	// A failing sink is tracked until a record is written successfully
+	tracked := r.accessLogSink.(*logger.TrackedSink)
+	sink.closed = true
+	record.LogTo(r.accessLogSink)
+	c.Assert(tracked.Failing(), Equals, true)
+	sink.closed = false
+	record.LogTo(r.accessLogSink)
+	c.Assert(tracked.Failing(), Equals, false)
+	c.Assert(sink.records, HasLen, 2)
+
+	// The sink is closed along with the redirect, later records are
+	// written to the shared access log
+	r.Close(nil)
+	c.Assert(sink.closed, Equals, true)
+	record.LogTo(r.accessLogSink)
+	c.Assert(sink.records, HasLen, 2)
+	c.Assert(tracked.Failing(), Equals, true)
+
+	// Redirects without a sink log to the shared access log
+	c.Assert(newRedirect(localEndpointMock, "no-sink", nil, 0).accessLogSink, IsNil)
+}
+
+func (s *proxyTestSuite) TestRedirectSetRules(c *C) {
+	impl := &fakeRedirectImplementation{}
+	r := newRedirect(localEndpointMock, "set-rules", nil, 0)
+	r.parserType = policy.ParserTypeHTTP
+	r.implementation = impl
+
+	valid := newTestL4Filter().L7RulesPerEp
+	c.Assert(r.SetRules(valid, nil), IsNil)
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update"})
+
+	invalid := []policy.L7DataMap{
+		{
+			api.WildcardEndpointSelector: api.L7Rules{
+				HTTP: []api.PortRuleHTTP{{Path: "/foo"}, {Path: "[bad"}},
+			},
+		},
+		{
+			api.WildcardEndpointSelector: api.L7Rules{
+				Kafka: []api.PortRuleKafka{{Topic: "foo"}},
+			},
+		},
+	}
+	for _, rules := range invalid {
+		c.Assert(r.SetRules(rules, nil), Not(IsNil))
+
+		// The previous rules are kept and not pushed again
+		r.mutex.RLock()
+		c.Assert(r.rules, DeepEquals, valid)
+		c.Assert(r.generation, Equals, uint64(1))
+		r.mutex.RUnlock()
+		c.Assert(impl.getCalls(), DeepEquals, []string{"update"})
+	}
+
+	// UpdateRules does not validate the rules
+	c.Assert(r.UpdateRules(&policy.L4Filter{L7RulesPerEp: invalid[1]}, nil), IsNil)
+	c.Assert(impl.getCalls(), DeepEquals, []string{"update", "update"})
+}
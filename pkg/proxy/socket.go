@@ -27,6 +27,7 @@ import (
 	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/maps/proxymap"
+	"github.com/cilium/cilium/pkg/u8proto"
 
 	"github.com/sirupsen/logrus"
 )
@@ -35,24 +36,34 @@ const (
 	fieldConn     = "conn"
 	fieldSize     = "size"
 	fieldConnPair = "connPair"
+
+	// socketDrainInterval is the interval in which a draining socket
+	// checks whether all connections have been closed
+	socketDrainInterval = 100 * time.Millisecond
 )
 
 type proxySocket struct {
 	// listener is the TCP listener.
 	listener net.Listener
 
-	// locker protects closing the closing channel and accessing pairs.
+	// locker protects closing the closing and draining channels and
+	// accessing pairs.
 	locker lock.Mutex
 
 	closing chan struct{}
 
+	// draining is closed once the socket stops accepting new connections
+	// while the existing connections are drained, see Drain()
+	draining chan struct{}
+
 	// pairs is the set of active connection pairs.
 	pairs []*connectionPair
 }
 
 func listenSocket(address string, mark int) (*proxySocket, error) {
 	socket := &proxySocket{
-		closing: make(chan struct{}),
+		closing:  make(chan struct{}),
+		draining: make(chan struct{}),
 	}
 
 	addr, err := net.ResolveTCPAddr("tcp", address)
@@ -203,6 +214,37 @@ func (s *proxySocket) Close() {
 	}
 }
 
+// Drain stops accepting new connections and waits until all connection pairs
+// for which cascading close was requested in Accept have been closed, or
+// until timeout expires. Returns false if connection pairs remain open after
+// the timeout. The socket must be closed with Close() afterwards, which also
+// closes any remaining connection pairs.
+func (s *proxySocket) Drain(timeout time.Duration) bool {
+	s.locker.Lock()
+	select {
+	case <-s.draining:
+	default:
+		close(s.draining)
+		s.listener.Close()
+	}
+	s.locker.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		s.locker.Lock()
+		remaining := len(s.pairs)
+		s.locker.Unlock()
+
+		if remaining == 0 {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(socketDrainInterval)
+	}
+}
+
 type socketQueue chan []byte
 
 type proxyConnection struct {
@@ -471,15 +513,26 @@ func setSocketMark(c net.Conn, mark int) {
 	}
 }
 
+// getProxyMapKey returns the proxymap key of a connection accepted by the
+// proxy listening on proxyPort. The key is derived from the IP and port of
+// the remote address, IPv4 and IPv4-mapped IPv6 addresses result in a key of
+// the IPv4 proxymap, all other addresses in a key of the IPv6 proxymap.
 func getProxyMapKey(c net.Conn, proxyPort uint16) (proxymap.ProxyMapKey, error) {
-	addr := c.RemoteAddr()
-	if addr == nil {
+	switch addr := c.RemoteAddr().(type) {
+	case nil:
 		return nil, fmt.Errorf("RemoteAddr() returned nil")
+	case *net.TCPAddr:
+		return newProxyMapKey(addr.IP, addr.Port, proxyPort, u8proto.TCP)
+	case *net.UDPAddr:
+		return newProxyMapKey(addr.IP, addr.Port, proxyPort, u8proto.UDP)
+	default:
+		return createProxyMapKey(addr.String(), proxyPort)
 	}
-
-	return createProxyMapKey(addr.String(), proxyPort)
 }
 
+// createProxyMapKey returns the proxymap key of a TCP connection from the
+// remote address addr in host:port notation to the proxy listening on
+// proxyPort
 func createProxyMapKey(addr string, proxyPort uint16) (proxymap.ProxyMapKey, error) {
 	ip, port, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -496,23 +549,36 @@ func createProxyMapKey(addr string, proxyPort uint16) (proxymap.ProxyMapKey, err
 		return nil, fmt.Errorf("unable to parse port string: %s", err)
 	}
 
-	if pIP.To4() != nil {
+	return newProxyMapKey(pIP, int(sport), proxyPort, u8proto.TCP)
+}
+
+func newProxyMapKey(ip net.IP, sport int, proxyPort uint16, proto u8proto.U8proto) (proxymap.ProxyMapKey, error) {
+	if sport < 0 || sport > 0xffff {
+		return nil, fmt.Errorf("invalid source port %d", sport)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
 		key := proxymap.Proxy4Key{
 			SPort:   uint16(sport),
 			DPort:   proxyPort,
-			Nexthdr: 6,
+			Nexthdr: uint8(proto),
 		}
 
-		copy(key.SAddr[:], pIP.To4())
+		copy(key.SAddr[:], ip4)
 		return key, nil
 	}
 
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return nil, fmt.Errorf("invalid IP %s", ip)
+	}
+
 	key := proxymap.Proxy6Key{
 		SPort:   uint16(sport),
 		DPort:   proxyPort,
-		Nexthdr: 6,
+		Nexthdr: uint8(proto),
 	}
 
-	copy(key.SAddr[:], pIP.To16())
+	copy(key.SAddr[:], ip6)
 	return key, nil
 }
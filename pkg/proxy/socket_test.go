@@ -0,0 +1,117 @@
+// Copyright 2018 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/cilium/cilium/pkg/maps/proxymap"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+// remoteAddrConn is a net.Conn with a fixed remote address
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func newRemoteAddrConn(addr net.Addr) *remoteAddrConn {
+	c, _ := net.Pipe()
+	return &remoteAddrConn{Conn: c, remoteAddr: addr}
+}
+
+func (s *proxyTestSuite) TestGetProxyMapKey(c *C) {
+	key, err := getProxyMapKey(newRemoteAddrConn(&net.TCPAddr{
+		IP:   net.ParseIP("10.0.0.1"),
+		Port: 1000,
+	}), 4000)
+	c.Assert(err, IsNil)
+	key4 := proxymap.Proxy4Key{SPort: 1000, DPort: 4000, Nexthdr: 6}
+	copy(key4.SAddr[:], net.ParseIP("10.0.0.1").To4())
+	c.Assert(key, Equals, key4)
+
+	// IPv4-mapped IPv6 addresses of dual stack sockets use the IPv4 proxymap
+	key, err = getProxyMapKey(newRemoteAddrConn(&net.TCPAddr{
+		IP:   net.ParseIP("::ffff:10.0.0.1"),
+		Port: 1000,
+	}), 4000)
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, key4)
+
+	key, err = getProxyMapKey(newRemoteAddrConn(&net.TCPAddr{
+		IP:   net.ParseIP("fe80::1"),
+		Port: 1000,
+		Zone: "eth0",
+	}), 4000)
+	c.Assert(err, IsNil)
+	key6 := proxymap.Proxy6Key{SPort: 1000, DPort: 4000, Nexthdr: 6}
+	copy(key6.SAddr[:], net.ParseIP("fe80::1"))
+	c.Assert(key, Equals, key6)
+
+	key, err = getProxyMapKey(newRemoteAddrConn(&net.UDPAddr{
+		IP:   net.ParseIP("f00d::1"),
+		Port: 53,
+	}), 4000)
+	c.Assert(err, IsNil)
+	key6 = proxymap.Proxy6Key{SPort: 53, DPort: 4000, Nexthdr: 17}
+	copy(key6.SAddr[:], net.ParseIP("f00d::1"))
+	c.Assert(key, Equals, key6)
+
+	_, err = getProxyMapKey(newRemoteAddrConn(&net.TCPAddr{Port: 1000}), 4000)
+	c.Assert(err, Not(IsNil))
+	_, err = getProxyMapKey(newRemoteAddrConn(nil), 4000)
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *proxyTestSuite) TestRemoveProxyMapEntryOnCloseIPv6(c *C) {
+	var deleted []proxymap.ProxyMapKey
+	entries := map[proxymap.ProxyMapKey]struct{}{}
+	oldDelete := deleteProxyMapEntry
+	deleteProxyMapEntry = func(key proxymap.ProxyMapKey) (error, syscall.Errno) {
+		deleted = append(deleted, key)
+		if _, ok := entries[key]; !ok {
+			return unix.ENOENT, unix.ENOENT
+		}
+		delete(entries, key)
+		return nil, 0
+	}
+	defer func() { deleteProxyMapEntry = oldDelete }()
+
+	r := newRedirect(localEndpointMock, "ipv6", nil, 0)
+	r.ProxyPort = 4000
+
+	key := proxymap.Proxy6Key{SPort: 1000, DPort: 4000, Nexthdr: 6}
+	copy(key.SAddr[:], net.ParseIP("f00d::1"))
+	entries[key] = struct{}{}
+
+	conn := newRemoteAddrConn(&net.TCPAddr{IP: net.ParseIP("f00d::1"), Port: 1000})
+	r.connectionOpened()
+	_, err := r.cacheProxyMapKey(conn)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.removeProxyMapEntryOnClose(conn), IsNil)
+	c.Assert(deleted, DeepEquals, []proxymap.ProxyMapKey{key})
+	c.Assert(entries, HasLen, 0)
+	c.Assert(r.NumConnections(), Equals, 0)
+
+	// Removing the entry a second time reports it as missing
+	err = r.removeProxyMapEntryOnClose(conn)
+	c.Assert(err, Equals, ErrProxyMapEntryNotFound)
+}